@@ -0,0 +1,19 @@
+#![no_main]
+
+use std::net::SocketAddr;
+
+use dock::protocol;
+use libfuzzer_sys::fuzz_target;
+
+fuzz_target!(|arg: &str| {
+    if let Some(SocketAddr::V4(addr)) = protocol::parse_port(arg) {
+        let formatted = protocol::format_pasv(addr);
+        assert_eq!(protocol::parse_port(&formatted), Some(SocketAddr::V4(addr)));
+    }
+
+    if let Some(addr) = protocol::parse_eprt(arg) {
+        let family = if addr.is_ipv4() { 1 } else { 2 };
+        let formatted = format!("|{family}|{}|{}|", addr.ip(), addr.port());
+        assert_eq!(protocol::parse_eprt(&formatted), Some(addr));
+    }
+});
@@ -0,0 +1,20 @@
+#![no_main]
+
+use dock::protocol::{self, LineBuffer, MAX_LINE_LENGTH};
+use libfuzzer_sys::fuzz_target;
+
+fuzz_target!(|data: &[u8]| {
+    let mut lines = LineBuffer::default();
+    // Feed the input in uneven chunks, as it would arrive from the network.
+    for chunk in data.chunks(7) {
+        lines.push(chunk);
+        while let Ok(Some(line)) = lines.next_line() {
+            assert!(!line.contains('\n'));
+            assert!(line.len() <= MAX_LINE_LENGTH * 3);
+            if let Some((verb, _)) = protocol::parse_command(&line) {
+                assert!(!verb.is_empty());
+                assert!(!verb.contains(' '));
+            }
+        }
+    }
+});
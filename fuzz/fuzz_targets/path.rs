@@ -0,0 +1,17 @@
+#![no_main]
+
+use dock::protocol;
+use libfuzzer_sys::fuzz_target;
+
+fuzz_target!(|input: (&str, &str)| {
+    let (current_dir, path) = input;
+    let cleaned = protocol::clean_path(path);
+    assert!(cleaned.starts_with('/'));
+    assert!(!cleaned.contains("//"));
+    assert!(!cleaned.split('/').any(|segment| segment == ".." || segment == "."));
+    assert_eq!(protocol::clean_path(&cleaned), cleaned);
+
+    let joined = protocol::join_path(&protocol::clean_path(current_dir), path);
+    assert!(joined.starts_with('/'));
+    assert_eq!(protocol::clean_path(&joined), joined);
+});
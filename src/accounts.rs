@@ -0,0 +1,262 @@
+//! Users in CSV and JSON files, for `dock user import` and `dock user export`.
+//!
+//! JSON files hold an array of users in the same form as the config. CSV
+//! files start with a header naming the columns, in any order: `name`,
+//! `password`, `permissions`, `root`, `quota`, `file_quota`, `group`,
+//! `enabled` and `expires_at`. Only `name` and `password` are required. Transfer quotas and limits can only
+//! be moved with JSON.
+
+use std::collections::HashMap;
+
+use anyhow::{Result, anyhow, bail};
+
+use crate::{
+    config::{Config, Permissions, User},
+    datetime::DateTime,
+    limits::Limits,
+};
+
+const CSV_COLUMNS: [&str; 9] = [
+    "name",
+    "password",
+    "permissions",
+    "root",
+    "quota",
+    "file_quota",
+    "group",
+    "enabled",
+    "expires_at",
+];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, clap::ValueEnum)]
+pub enum Format {
+    Csv,
+    Json,
+}
+
+impl Format {
+    /// Guesses the format from the extension of the file name.
+    pub fn from_file_name(name: &str) -> Option<Self> {
+        let (_, extension) = name.rsplit_once('.')?;
+        match extension.to_ascii_lowercase().as_str() {
+            "csv" => Some(Format::Csv),
+            "json" => Some(Format::Json),
+            _ => None,
+        }
+    }
+}
+
+/// Parses users and checks that they are valid for the config.
+pub fn parse(content: &str, format: Format, config: &Config) -> Result<Vec<User>> {
+    let users = match format {
+        Format::Csv => parse_csv(content)?,
+        Format::Json => {
+            serde_json::from_str(content).map_err(|e| anyhow!("bad users format: {e}"))?
+        }
+    };
+
+    let mut seen = HashMap::new();
+    for (index, user) in users.iter().enumerate() {
+        if user.name.is_empty() {
+            bail!("user {} has no name", index + 1);
+        }
+        if let Some(first) = seen.insert(user.name.as_str(), index) {
+            bail!(
+                "user {} is listed twice, as {} and {}",
+                user.name,
+                first + 1,
+                index + 1
+            );
+        }
+        if let Some(group) = &user.group
+            && !config.groups.contains_key(group)
+        {
+            bail!("user {} is in unknown group {group}", user.name);
+        }
+    }
+    Ok(users)
+}
+
+/// Formats users in the given format.
+pub fn format(users: &[User], format: Format) -> Result<String> {
+    match format {
+        Format::Csv => Ok(format_csv(users)),
+        Format::Json => Ok(serde_json::to_string_pretty(users)? + "\n"),
+    }
+}
+
+fn parse_csv(content: &str) -> Result<Vec<User>> {
+    let mut lines = content
+        .lines()
+        .enumerate()
+        .filter(|(_, line)| !line.trim().is_empty());
+    let Some((_, header)) = lines.next() else {
+        return Ok(Vec::new());
+    };
+    let header: Vec<String> = split_record(header)?
+        .into_iter()
+        .map(|column| column.trim().to_ascii_lowercase())
+        .collect();
+    for column in &header {
+        if !CSV_COLUMNS.contains(&column.as_str()) {
+            bail!("unknown column {column}");
+        }
+    }
+    for required in ["name", "password"] {
+        if !header.iter().any(|c| c == required) {
+            bail!("column {required} is missing");
+        }
+    }
+
+    let mut users = Vec::new();
+    for (index, line) in lines {
+        let fields = split_record(line).map_err(|e| anyhow!("line {}: {e}", index + 1))?;
+        if fields.len() != header.len() {
+            bail!(
+                "line {}: expected {} fields, found {}",
+                index + 1,
+                header.len(),
+                fields.len()
+            );
+        }
+        let record: HashMap<&str, &str> = header
+            .iter()
+            .map(String::as_str)
+            .zip(fields.iter().map(String::as_str))
+            .collect();
+        users.push(user_from_record(&record).map_err(|e| anyhow!("line {}: {e}", index + 1))?);
+    }
+    Ok(users)
+}
+
+fn user_from_record(record: &HashMap<&str, &str>) -> Result<User> {
+    let field = |name: &str| record.get(name).copied().filter(|v| !v.is_empty());
+
+    let permissions = match field("permissions").map(str::to_ascii_lowercase).as_deref() {
+        None | Some("read") => Permissions::Read,
+        Some("write") => Permissions::Write,
+        Some("all") => Permissions::All,
+        Some(other) => bail!("unknown permissions {other}"),
+    };
+    let quota = field("quota")
+        .map(|q| q.parse::<u64>())
+        .transpose()
+        .map_err(|_| anyhow!("quota is not a number of bytes"))?;
+    let file_quota = field("file_quota")
+        .map(|q| q.parse::<u64>())
+        .transpose()
+        .map_err(|_| anyhow!("file_quota is not a number of files"))?;
+    let enabled = match field("enabled").map(str::to_ascii_lowercase).as_deref() {
+        None | Some("true" | "yes" | "1") => true,
+        Some("false" | "no" | "0") => false,
+        Some(other) => bail!("enabled should be true or false, not {other}"),
+    };
+    let expires_at = field("expires_at")
+        .map(|e| {
+            DateTime::parse_readable(e)
+                .ok_or_else(|| anyhow!("expires_at should be YYYY-MM-DD or YYYY-MM-DD HH:MM:SS"))
+        })
+        .transpose()?;
+
+    Ok(User {
+        name: field("name").unwrap_or_default().to_string(),
+        password: record
+            .get("password")
+            .copied()
+            .unwrap_or_default()
+            .to_string(),
+        permissions,
+        countries: None,
+        hostnames: None,
+        client_certificates: Vec::new(),
+        root: field("root").map(String::from),
+        quota,
+        file_quota,
+        transfer_quota: None,
+        enabled,
+        expires_at,
+        group: field("group").map(String::from),
+        limits: Limits::default(),
+    })
+}
+
+/// Splits a CSV line into fields. Fields may be quoted, with `""` standing
+/// for a quote, but can not span lines. Unquoted fields are trimmed.
+fn split_record(line: &str) -> Result<Vec<String>> {
+    let mut fields = Vec::new();
+    let mut field = String::new();
+    let mut chars = line.chars().peekable();
+    let mut in_quotes = false;
+    let mut was_quoted = false;
+    while let Some(c) = chars.next() {
+        match c {
+            '"' if in_quotes && chars.peek() == Some(&'"') => {
+                chars.next();
+                field.push('"');
+            }
+            '"' if in_quotes => in_quotes = false,
+            '"' if !was_quoted && field.trim().is_empty() => {
+                field.clear();
+                in_quotes = true;
+                was_quoted = true;
+            }
+            ',' if !in_quotes => {
+                fields.push(finish_field(std::mem::take(&mut field), was_quoted));
+                was_quoted = false;
+            }
+            c if was_quoted && !in_quotes => {
+                if !c.is_whitespace() {
+                    bail!("unexpected text after a quoted field");
+                }
+            }
+            c => field.push(c),
+        }
+    }
+    if in_quotes {
+        bail!("unclosed quote");
+    }
+    fields.push(finish_field(field, was_quoted));
+    Ok(fields)
+}
+
+fn finish_field(field: String, quoted: bool) -> String {
+    if quoted {
+        field
+    } else {
+        field.trim().to_string()
+    }
+}
+
+fn format_csv(users: &[User]) -> String {
+    let mut content = CSV_COLUMNS.join(",") + "\n";
+    for user in users {
+        let permissions = match user.permissions {
+            Permissions::Read => "read",
+            Permissions::Write => "write",
+            Permissions::All => "all",
+        };
+        let fields = [
+            user.name.clone(),
+            user.password.clone(),
+            permissions.to_string(),
+            user.root.clone().unwrap_or_default(),
+            user.quota.map(|q| q.to_string()).unwrap_or_default(),
+            user.file_quota.map(|q| q.to_string()).unwrap_or_default(),
+            user.group.clone().unwrap_or_default(),
+            user.enabled.to_string(),
+            user.expires_at.map(|e| e.to_readable()).unwrap_or_default(),
+        ];
+        let fields: Vec<String> = fields.iter().map(|f| quote(f)).collect();
+        content.push_str(&fields.join(","));
+        content.push('\n');
+    }
+    content
+}
+
+fn quote(field: &str) -> String {
+    if field.contains([',', '"', '\n', '\r']) || field.trim() != field {
+        format!("\"{}\"", field.replace('"', "\"\""))
+    } else {
+        field.to_string()
+    }
+}
@@ -0,0 +1,681 @@
+//! Certificates from an ACME CA like Let's Encrypt (RFC 8555).
+//!
+//! The account key, certificate and key are kept in the cache directory. A
+//! certificate is ordered when there is none or it expires within
+//! `RENEW_BEFORE`, and the domain is validated with the HTTP-01 challenge.
+
+use std::{
+    collections::HashMap,
+    fs,
+    io::Write,
+    path::{Path, PathBuf},
+    sync::Arc,
+    time::Duration,
+};
+
+use anyhow::{Result, anyhow, bail};
+use base64::{
+    Engine,
+    engine::general_purpose::{STANDARD, URL_SAFE_NO_PAD},
+};
+use reqwest::{Response, header};
+use ring::{
+    digest,
+    rand::SystemRandom,
+    signature::{
+        ECDSA_P256_SHA256_ASN1_SIGNING, ECDSA_P256_SHA256_FIXED_SIGNING, EcdsaKeyPair, KeyPair,
+    },
+};
+use serde::{Deserialize, de::DeserializeOwned};
+use serde_json::json;
+use tokio::{
+    io::{AsyncReadExt, AsyncWriteExt},
+    net::TcpListener,
+    task::JoinHandle,
+    time,
+};
+use tracing::{info, warn};
+
+use crate::{datetime::unix_now, state::SharedState, x509};
+
+const LETS_ENCRYPT_DIRECTORY: &str = "https://acme-v02.api.letsencrypt.org/directory";
+/// Certificates are renewed when they expire sooner than this.
+const RENEW_BEFORE: Duration = Duration::from_secs(30 * 86400);
+/// How often the certificate is checked for renewal.
+const CHECK_INTERVAL: Duration = Duration::from_secs(12 * 3600);
+/// Wait after a failed order before trying again.
+const RETRY_DELAY: Duration = Duration::from_secs(3600);
+/// How long the CA gets to validate the domain and issue the certificate.
+const POLL_ATTEMPTS: u32 = 30;
+const POLL_INTERVAL: Duration = Duration::from_secs(2);
+const HTTP_TIMEOUT: Duration = Duration::from_secs(30);
+const CHALLENGE_PATH: &str = "/.well-known/acme-challenge/";
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct AcmeConfig {
+    /// Host name the certificate is issued for. It has to resolve to this
+    /// server.
+    pub domain: String,
+    /// Contact address for notices of the CA, like expiring certificates.
+    pub email: String,
+    /// Directory the account key, certificate and key are kept in.
+    pub cache_dir: String,
+    /// Directory URL of the CA.
+    #[serde(default = "default_directory")]
+    pub directory: String,
+    /// Address HTTP-01 challenges are answered on. It is bound at startup,
+    /// before privileges are dropped, but only answered while an order is
+    /// validated. The CA connects to port 80 of the domain.
+    #[serde(default = "default_http_address")]
+    pub http_address: String,
+}
+
+fn default_directory() -> String {
+    String::from(LETS_ENCRYPT_DIRECTORY)
+}
+
+fn default_http_address() -> String {
+    String::from("0.0.0.0:80")
+}
+
+impl AcmeConfig {
+    /// Files the certificate chain and its key are written to.
+    pub fn certificate_files(&self) -> (PathBuf, PathBuf) {
+        let dir = Path::new(&self.cache_dir);
+        (
+            dir.join(format!("{}.crt", self.domain)),
+            dir.join(format!("{}.key", self.domain)),
+        )
+    }
+
+    fn account_key_file(&self) -> PathBuf {
+        Path::new(&self.cache_dir).join("account.key")
+    }
+}
+
+/// Orders a certificate whenever the current one is missing or about to
+/// expire, and loads it once issued. Challenges are answered on `listener`.
+/// Runs until the server stops.
+pub async fn keep_renewed(config: AcmeConfig, listener: Arc<TcpListener>, state: Arc<SharedState>) {
+    loop {
+        let delay = if needs_renewal(&config) {
+            info!(domain=%config.domain, "Ordering TLS certificate.");
+            match order_certificate(&config, &listener).await {
+                Ok(()) => {
+                    info!(domain=%config.domain, "Obtained TLS certificate.");
+                    if let Some(tls) = &state.tls
+                        && let Err(e) = tls.reload()
+                    {
+                        warn!(reason=%e, "Failed to load the new TLS certificate.");
+                    }
+                    CHECK_INTERVAL
+                }
+                Err(e) => {
+                    warn!(domain=%config.domain, reason=%e, "Failed to obtain TLS certificate.");
+                    RETRY_DELAY
+                }
+            }
+        } else {
+            CHECK_INTERVAL
+        };
+        time::sleep(delay).await;
+    }
+}
+
+/// Checks if there is no certificate yet or it expires soon.
+fn needs_renewal(config: &AcmeConfig) -> bool {
+    let (cert_file, _) = config.certificate_files();
+    let expires = fs::read_to_string(cert_file)
+        .ok()
+        .and_then(|pem| pem_blocks(&pem, "CERTIFICATE").into_iter().next())
+        .and_then(|der| x509::not_after(&der));
+    expires.is_none_or(|expires| expires < unix_now() as i64 + RENEW_BEFORE.as_secs() as i64)
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct Directory {
+    new_nonce: String,
+    new_account: String,
+    new_order: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct Order {
+    status: String,
+    #[serde(default)]
+    authorizations: Vec<String>,
+    finalize: String,
+    #[serde(default)]
+    certificate: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Authorization {
+    status: String,
+    #[serde(default)]
+    challenges: Vec<Challenge>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Challenge {
+    #[serde(rename = "type")]
+    kind: String,
+    url: String,
+    #[serde(default)]
+    token: String,
+}
+
+/// Error document of the CA.
+#[derive(Debug, Deserialize)]
+struct Problem {
+    #[serde(rename = "type", default)]
+    kind: String,
+    #[serde(default)]
+    detail: String,
+}
+
+/// Account at the CA and the nonce for its next request.
+struct Account {
+    http: reqwest::Client,
+    directory: Directory,
+    key: EcdsaKeyPair,
+    rng: SystemRandom,
+    /// URL of the account, known once it is registered.
+    id: Option<String>,
+    nonce: Option<String>,
+}
+
+impl Account {
+    /// Loads or creates the account key and registers it with the CA.
+    async fn register(config: &AcmeConfig) -> Result<Self> {
+        let http = reqwest::Client::builder().timeout(HTTP_TIMEOUT).build()?;
+        let directory: Directory = http
+            .get(&config.directory)
+            .send()
+            .await?
+            .error_for_status()?
+            .json()
+            .await
+            .map_err(|e| anyhow!("bad ACME directory: {e}"))?;
+
+        let rng = SystemRandom::new();
+        let pkcs8 = load_or_generate_key(&config.account_key_file(), &rng)?;
+        let key = EcdsaKeyPair::from_pkcs8(&ECDSA_P256_SHA256_FIXED_SIGNING, &pkcs8, &rng)
+            .map_err(|_| anyhow!("bad ACME account key"))?;
+
+        let mut account = Account {
+            http,
+            directory,
+            key,
+            rng,
+            id: None,
+            nonce: None,
+        };
+        let payload = json!({
+            "termsOfServiceAgreed": true,
+            "contact": [format!("mailto:{}", config.email)],
+        });
+        let url = account.directory.new_account.clone();
+        let response = account.post(&url, Some(payload)).await?;
+        account.id = Some(location(&response)?);
+        Ok(account)
+    }
+
+    fn jwk(&self) -> serde_json::Value {
+        let public = self.key.public_key().as_ref();
+        // Uncompressed point: 0x04, then both coordinates.
+        json!({
+            "crv": "P-256",
+            "kty": "EC",
+            "x": URL_SAFE_NO_PAD.encode(&public[1..33]),
+            "y": URL_SAFE_NO_PAD.encode(&public[33..65]),
+        })
+    }
+
+    /// Key authorization for a challenge token: the token and the
+    /// thumbprint of the account key (RFC 7638).
+    fn key_authorization(&self, token: &str) -> String {
+        // The members are already in the order the thumbprint requires.
+        let jwk = self.jwk().to_string();
+        let thumbprint = digest::digest(&digest::SHA256, jwk.as_bytes());
+        format!("{token}.{}", URL_SAFE_NO_PAD.encode(thumbprint))
+    }
+
+    async fn nonce(&mut self) -> Result<String> {
+        if let Some(nonce) = self.nonce.take() {
+            return Ok(nonce);
+        }
+        let response = self.http.head(&self.directory.new_nonce).send().await?;
+        replay_nonce(&response).ok_or_else(|| anyhow!("ACME server sent no nonce"))
+    }
+
+    /// Sends a signed request. Without a payload, it is a POST-as-GET.
+    async fn post(&mut self, url: &str, payload: Option<serde_json::Value>) -> Result<Response> {
+        // A nonce can be rejected once, e.g. when it has expired.
+        let mut retried = false;
+        loop {
+            let mut protected = json!({
+                "alg": "ES256",
+                "nonce": self.nonce().await?,
+                "url": url,
+            });
+            match &self.id {
+                Some(id) => protected["kid"] = json!(id),
+                None => protected["jwk"] = self.jwk(),
+            }
+            let protected = URL_SAFE_NO_PAD.encode(protected.to_string());
+            let payload = payload
+                .as_ref()
+                .map(|p| URL_SAFE_NO_PAD.encode(p.to_string()))
+                .unwrap_or_default();
+            let signature = self
+                .key
+                .sign(&self.rng, format!("{protected}.{payload}").as_bytes())
+                .map_err(|_| anyhow!("failed to sign ACME request"))?;
+            let body = json!({
+                "protected": protected,
+                "payload": payload,
+                "signature": URL_SAFE_NO_PAD.encode(signature),
+            });
+
+            let response = self
+                .http
+                .post(url)
+                .header(header::CONTENT_TYPE, "application/jose+json")
+                .body(body.to_string())
+                .send()
+                .await?;
+            self.nonce = replay_nonce(&response);
+            if response.status().is_success() {
+                return Ok(response);
+            }
+            let status = response.status();
+            let problem: Problem = response.json().await.unwrap_or(Problem {
+                kind: String::new(),
+                detail: String::new(),
+            });
+            if problem.kind.ends_with(":badNonce") && !retried {
+                retried = true;
+                continue;
+            }
+            bail!("ACME request failed with {status}: {}", problem.detail);
+        }
+    }
+
+    async fn fetch<T: DeserializeOwned>(&mut self, url: &str) -> Result<T> {
+        let response = self.post(url, None).await?;
+        response
+            .json()
+            .await
+            .map_err(|e| anyhow!("bad ACME response: {e}"))
+    }
+
+    /// Polls the order until it is no longer pending or processing.
+    async fn wait_for_order(&mut self, url: &str) -> Result<Order> {
+        for _ in 0..POLL_ATTEMPTS {
+            let order: Order = self.fetch(url).await?;
+            if order.status != "pending" && order.status != "processing" {
+                return Ok(order);
+            }
+            time::sleep(POLL_INTERVAL).await;
+        }
+        bail!("ACME order was not ready in time")
+    }
+
+    /// Polls the authorization until it is validated.
+    async fn wait_for_authorization(&mut self, url: &str) -> Result<()> {
+        for _ in 0..POLL_ATTEMPTS {
+            let authorization: Authorization = self.fetch(url).await?;
+            match authorization.status.as_str() {
+                "valid" => return Ok(()),
+                "pending" => time::sleep(POLL_INTERVAL).await,
+                status => bail!("domain validation failed, authorization is {status}"),
+            }
+        }
+        bail!("domain was not validated in time")
+    }
+}
+
+/// Runs an order for the domain and writes the certificate and its key to
+/// the cache directory.
+async fn order_certificate(config: &AcmeConfig, listener: &Arc<TcpListener>) -> Result<()> {
+    fs::create_dir_all(&config.cache_dir)
+        .map_err(|e| anyhow!("failed to create {}: {e}", config.cache_dir))?;
+    let mut account = Account::register(config).await?;
+
+    let payload = json!({
+        "identifiers": [{"type": "dns", "value": config.domain}],
+    });
+    let url = account.directory.new_order.clone();
+    let response = account.post(&url, Some(payload)).await?;
+    let order_url = location(&response)?;
+    let order: Order = response.json().await?;
+
+    let mut tokens = HashMap::new();
+    let mut pending = Vec::new();
+    for url in &order.authorizations {
+        let authorization: Authorization = account.fetch(url).await?;
+        if authorization.status == "valid" {
+            continue;
+        }
+        let challenge = authorization
+            .challenges
+            .into_iter()
+            .find(|c| c.kind == "http-01")
+            .ok_or_else(|| anyhow!("ACME server offers no HTTP-01 challenge"))?;
+        tokens.insert(
+            challenge.token.clone(),
+            account.key_authorization(&challenge.token),
+        );
+        pending.push((url.clone(), challenge.url));
+    }
+
+    if !pending.is_empty() {
+        let responder = ChallengeResponder::start(Arc::clone(listener), tokens);
+        for (authorization, challenge) in &pending {
+            account.post(challenge, Some(json!({}))).await?;
+            account.wait_for_authorization(authorization).await?;
+        }
+        drop(responder);
+    }
+
+    let rng = SystemRandom::new();
+    let pkcs8 = EcdsaKeyPair::generate_pkcs8(&ECDSA_P256_SHA256_ASN1_SIGNING, &rng)
+        .map_err(|_| anyhow!("failed to generate certificate key"))?;
+    let key = EcdsaKeyPair::from_pkcs8(&ECDSA_P256_SHA256_ASN1_SIGNING, pkcs8.as_ref(), &rng)
+        .map_err(|_| anyhow!("failed to generate certificate key"))?;
+    let csr = certificate_request(&config.domain, &key, &rng)?;
+    account
+        .post(
+            &order.finalize,
+            Some(json!({"csr": URL_SAFE_NO_PAD.encode(csr)})),
+        )
+        .await?;
+    let order = account.wait_for_order(&order_url).await?;
+    let Some(certificate_url) = order.certificate.filter(|_| order.status == "valid") else {
+        bail!("ACME order is {}", order.status);
+    };
+    let chain = account.post(&certificate_url, None).await?.text().await?;
+    if pem_blocks(&chain, "CERTIFICATE").is_empty() {
+        bail!("ACME server sent no certificate");
+    }
+
+    let (cert_file, key_file) = config.certificate_files();
+    write_file(
+        &key_file,
+        pem_encode("PRIVATE KEY", pkcs8.as_ref()).as_bytes(),
+    )?;
+    write_file(&cert_file, chain.as_bytes())
+}
+
+/// Answers HTTP-01 challenges until dropped.
+struct ChallengeResponder(JoinHandle<()>);
+
+impl ChallengeResponder {
+    fn start(listener: Arc<TcpListener>, tokens: HashMap<String, String>) -> Self {
+        let tokens = Arc::new(tokens);
+        ChallengeResponder(tokio::spawn(async move {
+            loop {
+                let Ok((mut stream, _)) = listener.accept().await else {
+                    continue;
+                };
+                let tokens = Arc::clone(&tokens);
+                tokio::spawn(async move {
+                    let mut request = Vec::new();
+                    let mut buf = [0u8; 1024];
+                    // Only the request line matters.
+                    while !request.windows(2).any(|w| w == b"\r\n") && request.len() < 8192 {
+                        match time::timeout(HTTP_TIMEOUT, stream.read(&mut buf)).await {
+                            Ok(Ok(n)) if n > 0 => request.extend_from_slice(&buf[..n]),
+                            _ => return,
+                        }
+                    }
+                    let request = String::from_utf8_lossy(&request);
+                    let answer = request
+                        .split_whitespace()
+                        .nth(1)
+                        .and_then(|path| path.strip_prefix(CHALLENGE_PATH))
+                        .and_then(|token| tokens.get(token));
+                    let response = match answer {
+                        Some(answer) => format!(
+                            "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{answer}",
+                            answer.len()
+                        ),
+                        None => String::from(
+                            "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+                        ),
+                    };
+                    let _ = stream.write_all(response.as_bytes()).await;
+                    let _ = stream.shutdown().await;
+                });
+            }
+        }))
+    }
+}
+
+impl Drop for ChallengeResponder {
+    fn drop(&mut self) {
+        self.0.abort();
+    }
+}
+
+fn location(response: &Response) -> Result<String> {
+    response
+        .headers()
+        .get(header::LOCATION)
+        .and_then(|l| l.to_str().ok())
+        .map(String::from)
+        .ok_or_else(|| anyhow!("ACME server sent no location"))
+}
+
+fn replay_nonce(response: &Response) -> Option<String> {
+    response
+        .headers()
+        .get("Replay-Nonce")
+        .and_then(|n| n.to_str().ok())
+        .map(String::from)
+}
+
+/// Reads a PKCS#8 key from a PEM file, or generates one and writes it there.
+fn load_or_generate_key(path: &Path, rng: &SystemRandom) -> Result<Vec<u8>> {
+    if let Ok(pem) = fs::read_to_string(path) {
+        return pem_blocks(&pem, "PRIVATE KEY")
+            .into_iter()
+            .next()
+            .ok_or_else(|| anyhow!("no private key found in {}", path.display()));
+    }
+    let pkcs8 = EcdsaKeyPair::generate_pkcs8(&ECDSA_P256_SHA256_FIXED_SIGNING, rng)
+        .map_err(|_| anyhow!("failed to generate ACME account key"))?;
+    write_file(path, pem_encode("PRIVATE KEY", pkcs8.as_ref()).as_bytes())?;
+    Ok(pkcs8.as_ref().to_vec())
+}
+
+/// Writes the file through a temporary file, so it is never seen half
+/// written. Keys are only readable by the owner, from the moment the file
+/// is created.
+fn write_file(path: &Path, content: &[u8]) -> Result<()> {
+    let temp_path = path.with_extension("tmp");
+    // A leftover temporary file would keep its permissions.
+    let _ = fs::remove_file(&temp_path);
+    let mut options = fs::OpenOptions::new();
+    options.write(true).create_new(true);
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::OpenOptionsExt;
+        options.mode(0o600);
+    }
+    options
+        .open(&temp_path)
+        .and_then(|mut file| file.write_all(content))
+        .and_then(|_| fs::rename(&temp_path, path))
+        .map_err(|e| anyhow!("failed to write {}: {e}", path.display()))
+}
+
+fn pem_encode(label: &str, der: &[u8]) -> String {
+    let encoded = STANDARD.encode(der);
+    let mut pem = format!("-----BEGIN {label}-----\n");
+    for line in encoded.as_bytes().chunks(64) {
+        pem.push_str(&String::from_utf8_lossy(line));
+        pem.push('\n');
+    }
+    pem.push_str(&format!("-----END {label}-----\n"));
+    pem
+}
+
+/// Decodes every PEM block with the label.
+fn pem_blocks(pem: &str, label: &str) -> Vec<Vec<u8>> {
+    let begin = format!("-----BEGIN {label}-----");
+    let end = format!("-----END {label}-----");
+    pem.split(begin.as_str())
+        .skip(1)
+        .filter_map(|block| block.split_once(end.as_str()))
+        .filter_map(|(body, _)| {
+            let body: String = body.split_whitespace().collect();
+            STANDARD.decode(body).ok()
+        })
+        .collect()
+}
+
+/// Encodes a DER element.
+fn der(tag: u8, content: &[u8]) -> Vec<u8> {
+    let mut element = vec![tag];
+    let len = content.len();
+    if len < 0x80 {
+        element.push(len as u8);
+    } else {
+        let bytes: Vec<u8> = len
+            .to_be_bytes()
+            .into_iter()
+            .skip_while(|&b| b == 0)
+            .collect();
+        element.push(0x80 | bytes.len() as u8);
+        element.extend(bytes);
+    }
+    element.extend_from_slice(content);
+    element
+}
+
+const SEQUENCE: u8 = 0x30;
+const SET: u8 = 0x31;
+const OID_COMMON_NAME: &[u8] = &[0x06, 0x03, 0x55, 0x04, 0x03];
+const OID_EC_PUBLIC_KEY: &[u8] = &[0x06, 0x07, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x02, 0x01];
+const OID_P256: &[u8] = &[0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07];
+const OID_ECDSA_SHA256: &[u8] = &[0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x04, 0x03, 0x02];
+const OID_EXTENSION_REQUEST: &[u8] = &[
+    0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x09, 0x0e,
+];
+const OID_SUBJECT_ALT_NAME: &[u8] = &[0x06, 0x03, 0x55, 0x1d, 0x11];
+
+/// Builds a PKCS#10 request for the domain, signed with the key.
+fn certificate_request(domain: &str, key: &EcdsaKeyPair, rng: &SystemRandom) -> Result<Vec<u8>> {
+    let name = der(
+        SEQUENCE,
+        &der(
+            SET,
+            &der(
+                SEQUENCE,
+                &[OID_COMMON_NAME, &der(0x0c, domain.as_bytes())].concat(),
+            ),
+        ),
+    );
+    let mut public_key = vec![0];
+    public_key.extend_from_slice(key.public_key().as_ref());
+    let key_info = der(
+        SEQUENCE,
+        &[
+            der(SEQUENCE, &[OID_EC_PUBLIC_KEY, OID_P256].concat()),
+            der(0x03, &public_key),
+        ]
+        .concat(),
+    );
+    let alt_names = der(SEQUENCE, &der(0x82, domain.as_bytes()));
+    let extensions = der(
+        SEQUENCE,
+        &der(
+            SEQUENCE,
+            &[OID_SUBJECT_ALT_NAME, &der(0x04, &alt_names)].concat(),
+        ),
+    );
+    let attributes = der(
+        0xa0,
+        &der(
+            SEQUENCE,
+            &[OID_EXTENSION_REQUEST, &der(SET, &extensions)].concat(),
+        ),
+    );
+    let info = der(
+        SEQUENCE,
+        &[&der(0x02, &[0])[..], &name, &key_info, &attributes].concat(),
+    );
+
+    let signature = key
+        .sign(rng, &info)
+        .map_err(|_| anyhow!("failed to sign certificate request"))?;
+    let mut signature_bits = vec![0];
+    signature_bits.extend_from_slice(signature.as_ref());
+    Ok(der(
+        SEQUENCE,
+        &[
+            info,
+            der(SEQUENCE, OID_ECDSA_SHA256),
+            der(0x03, &signature_bits),
+        ]
+        .concat(),
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use tokio::net::TcpStream;
+
+    use super::*;
+
+    #[test]
+    fn keys_are_written_private() {
+        let dir = std::env::temp_dir().join(format!("dock-acme-{}", cuid2::cuid()));
+        fs::create_dir_all(&dir).unwrap();
+        let path = dir.join("example.com.key");
+        // A readable leftover must not be reused.
+        fs::write(path.with_extension("tmp"), b"old").unwrap();
+
+        write_file(&path, b"key").unwrap();
+        assert_eq!(fs::read(&path).unwrap(), b"key");
+        assert!(!path.with_extension("tmp").exists());
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            assert_eq!(
+                fs::metadata(&path).unwrap().permissions().mode() & 0o777,
+                0o600
+            );
+        }
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    async fn get(address: std::net::SocketAddr, path: &str) -> String {
+        let mut stream = TcpStream::connect(address).await.unwrap();
+        stream
+            .write_all(format!("GET {path} HTTP/1.1\r\nHost: example.com\r\n\r\n").as_bytes())
+            .await
+            .unwrap();
+        let mut response = String::new();
+        stream.read_to_string(&mut response).await.unwrap();
+        response
+    }
+
+    #[tokio::test]
+    async fn challenges_are_answered_on_the_given_listener() {
+        let listener = Arc::new(TcpListener::bind("127.0.0.1:0").await.unwrap());
+        let address = listener.local_addr().unwrap();
+        let tokens = HashMap::from([(String::from("token"), String::from("token.thumbprint"))]);
+        let responder = ChallengeResponder::start(Arc::clone(&listener), tokens);
+
+        let response = get(address, "/.well-known/acme-challenge/token").await;
+        assert!(response.starts_with("HTTP/1.1 200 OK"));
+        assert!(response.ends_with("\r\n\r\ntoken.thumbprint"));
+        let response = get(address, "/.well-known/acme-challenge/other").await;
+        assert!(response.starts_with("HTTP/1.1 404 Not Found"));
+        drop(responder);
+    }
+}
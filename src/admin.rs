@@ -0,0 +1,395 @@
+//! Admin API.
+//!
+//! A small HTTP/1.1 server that answers with JSON. Every request except
+//! `GET /health` has to carry `Authorization: Bearer <token>` when a token is
+//! configured. Without a token, the API only listens on loopback addresses.
+
+use std::{
+    sync::{Arc, atomic::Ordering},
+    time::Duration,
+};
+
+use anyhow::{Result, anyhow};
+use serde::Deserialize;
+use serde_json::{Value, json};
+use tokio::{
+    io::{AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufReader},
+    net::{TcpListener, TcpStream},
+};
+use tracing::{info, warn};
+
+use crate::{
+    config::{AdminConfig, User},
+    maintenance::DEFAULT_GRACE_PERIOD,
+    password,
+    state::SharedState,
+    transfer_log::{self, Query},
+    users::{UserStoreError, UserUpdate},
+};
+
+/// Requests with a larger body are rejected.
+const MAX_BODY_SIZE: usize = 1024 * 1024;
+/// Default number of entries returned by list endpoints.
+const DEFAULT_LIST_LIMIT: usize = 50;
+
+/// Parsed HTTP request.
+#[derive(Debug)]
+pub struct Request {
+    pub method: String,
+    pub path: String,
+    pub body: Vec<u8>,
+}
+
+impl Request {
+    /// Returns a value of the query string parameter.
+    pub fn query(&self, name: &str) -> Option<&str> {
+        let (_, query) = self.path.split_once('?')?;
+        query
+            .split('&')
+            .filter_map(|pair| pair.split_once('='))
+            .find(|(key, _)| *key == name)
+            .map(|(_, value)| value)
+    }
+
+    fn limit(&self) -> usize {
+        self.query("limit")
+            .and_then(|l| l.parse().ok())
+            .unwrap_or(DEFAULT_LIST_LIMIT)
+    }
+}
+
+/// Body of a request that creates a user.
+#[derive(Debug, Deserialize)]
+struct NewUser {
+    /// Required when tenants are configured.
+    #[serde(default)]
+    tenant: Option<String>,
+    #[serde(flatten)]
+    user: User,
+}
+
+#[derive(Debug, Deserialize, Default)]
+#[serde(deny_unknown_fields)]
+struct MaintenanceRequest {
+    /// Seconds open sessions may keep running.
+    #[serde(default)]
+    grace_secs: Option<u64>,
+}
+
+/// JSON response with a status code.
+#[derive(Debug)]
+pub struct Response {
+    pub status: u16,
+    pub body: Value,
+}
+
+impl Response {
+    pub fn ok(body: Value) -> Self {
+        Response { status: 200, body }
+    }
+
+    pub fn error(status: u16, message: &str) -> Self {
+        Response {
+            status,
+            body: json!({ "error": message }),
+        }
+    }
+}
+
+/// Accepts admin connections until the process exits.
+pub async fn serve(config: AdminConfig, state: Arc<SharedState>) -> Result<()> {
+    let listener = TcpListener::bind(&config.address)
+        .await
+        .map_err(|_| anyhow!("failed to bind admin API to given address"))?;
+    // A host name may have resolved to an outside address.
+    if config.token.is_none() && !listener.local_addr()?.ip().is_loopback() {
+        return Err(anyhow!(
+            "admin API without a token can only listen on a loopback address"
+        ));
+    }
+    info!("Admin API is listening on {}", config.address);
+
+    let config = Arc::new(config);
+    loop {
+        let (stream, addr) = listener
+            .accept()
+            .await
+            .map_err(|_| anyhow!("cannot accept admin connection"))?;
+        let config = Arc::clone(&config);
+        let state = Arc::clone(&state);
+
+        tokio::spawn(async move {
+            if let Err(e) = handle_connection(stream, &config, &state).await {
+                warn!(ip=%addr, reason=%e, "Admin request failed.");
+            }
+        });
+    }
+}
+
+async fn handle_connection(
+    stream: TcpStream,
+    config: &AdminConfig,
+    state: &SharedState,
+) -> Result<()> {
+    let mut reader = BufReader::new(stream);
+
+    let mut request_line = String::new();
+    reader.read_line(&mut request_line).await?;
+    let mut parts = request_line.split_whitespace();
+    let (Some(method), Some(path)) = (parts.next(), parts.next()) else {
+        return write_response(reader.get_mut(), Response::error(400, "bad request")).await;
+    };
+    let (method, path) = (method.to_string(), path.to_string());
+
+    let mut content_length = 0usize;
+    let mut authorization = String::new();
+    loop {
+        let mut line = String::new();
+        if reader.read_line(&mut line).await? == 0 {
+            break;
+        }
+        let line = line.trim_end();
+        if line.is_empty() {
+            break;
+        }
+        if let Some((name, value)) = line.split_once(':') {
+            match name.trim().to_ascii_lowercase().as_str() {
+                "content-length" => content_length = value.trim().parse().unwrap_or(0),
+                "authorization" => authorization = value.trim().to_string(),
+                _ => {}
+            }
+        }
+    }
+
+    // Load balancers probe health without credentials.
+    let is_health_probe = method == "GET" && path.split('?').next() == Some("/health");
+    if let Some(token) = &config.token
+        && !is_health_probe
+        && !authorization
+            .strip_prefix("Bearer ")
+            .is_some_and(|given| password::constant_time_eq(given, token))
+    {
+        return write_response(reader.get_mut(), Response::error(401, "unauthorized")).await;
+    }
+
+    if content_length > MAX_BODY_SIZE {
+        return write_response(reader.get_mut(), Response::error(413, "body is too large")).await;
+    }
+    let mut body = vec![0u8; content_length];
+    reader.read_exact(&mut body).await?;
+
+    let request = Request { method, path, body };
+    let response = route(&request, state).await;
+    write_response(reader.get_mut(), response).await
+}
+
+async fn route(request: &Request, state: &SharedState) -> Response {
+    let path = request.path.split('?').next().unwrap_or_default();
+    let segments: Vec<&str> = path.trim_matches('/').split('/').collect();
+
+    match (request.method.as_str(), segments.as_slice()) {
+        ("GET", ["health"]) => {
+            let active_sessions = state.active_sessions.load(Ordering::Relaxed);
+            match state.maintenance.status() {
+                Some(maintenance) => Response {
+                    status: 503,
+                    body: json!({
+                        "status": "maintenance",
+                        "active_sessions": active_sessions,
+                        "maintenance": maintenance,
+                    }),
+                },
+                None => Response::ok(json!({
+                    "status": "ok",
+                    "active_sessions": active_sessions,
+                })),
+            }
+        }
+        ("GET", ["maintenance"]) => Response::ok(json!({
+            "enabled": state.maintenance.is_enabled(),
+            "status": state.maintenance.status(),
+        })),
+        ("POST", ["maintenance"]) => {
+            let options = if request.body.is_empty() {
+                MaintenanceRequest::default()
+            } else {
+                match serde_json::from_slice::<MaintenanceRequest>(&request.body) {
+                    Ok(o) => o,
+                    Err(e) => {
+                        return Response::error(400, &format!("bad maintenance format: {e}"));
+                    }
+                }
+            };
+            let grace = options
+                .grace_secs
+                .map_or(DEFAULT_GRACE_PERIOD, Duration::from_secs);
+            let status = state.maintenance.enable(grace);
+            info!(
+                grace_secs = status.grace_secs,
+                "Maintenance mode was enabled."
+            );
+            Response::ok(json!({"enabled": true, "status": status}))
+        }
+        ("DELETE", ["maintenance"]) => {
+            state.maintenance.disable();
+            info!("Maintenance mode was disabled.");
+            Response::ok(json!({"enabled": false, "status": null}))
+        }
+        ("GET", ["transfers"]) => Response::ok(json!(state.transfers.snapshot())),
+        ("DELETE", ["transfers", session_id]) => {
+            if state.transfers.abort(session_id) {
+                info!(session_id=%session_id, "Transfer was aborted through the admin API.");
+                Response::ok(json!({"aborted": true}))
+            } else {
+                Response::error(404, "transfer not found")
+            }
+        }
+        ("GET", ["quarantine"]) => Response::ok(json!(state.quarantine.list())),
+        ("POST", ["quarantine", id]) => match state.quarantine.approve(id).await {
+            Some(Ok(upload)) => {
+                info!(id=%upload.id, file=%upload.path, "Quarantined upload was approved through the admin API.");
+                Response::ok(json!({"approved": true}))
+            }
+            Some(Err(e)) => Response::error(500, &format!("failed to move upload: {e}")),
+            None => Response::error(404, "upload not found"),
+        },
+        ("DELETE", ["quarantine", id]) => match state.quarantine.reject(id).await {
+            Some(Ok(upload)) => {
+                info!(id=%upload.id, file=%upload.path, "Quarantined upload was rejected through the admin API.");
+                Response::ok(json!({"rejected": true}))
+            }
+            Some(Err(e)) => Response::error(500, &format!("failed to delete upload: {e}")),
+            None => Response::error(404, "upload not found"),
+        },
+        ("GET", ["transfers", "history"]) => {
+            let logs = state.all_transfer_logs();
+            if logs.is_empty() {
+                return Response::error(404, "transfer log is not enabled");
+            }
+            let mut query = Query {
+                user: request.query("user").map(String::from),
+                path: request.query("path").map(String::from),
+                limit: request.limit(),
+                ..Query::default()
+            };
+            for (name, time) in [("since", &mut query.since), ("until", &mut query.until)] {
+                if let Some(value) = request.query(name) {
+                    match transfer_log::parse_time(value) {
+                        Some(t) => *time = Some(t),
+                        None => {
+                            return Response::error(
+                                400,
+                                &format!("{name} should be a Unix timestamp or YYYY-MM-DD"),
+                            );
+                        }
+                    }
+                }
+            }
+            match transfer_log::query_all(&logs, &query) {
+                Ok(entries) => Response::ok(json!(entries)),
+                Err(e) => Response::error(500, &format!("failed to query transfer log: {e}")),
+            }
+        }
+        ("GET", ["stats"]) => Response::ok(json!(state.stats.snapshot())),
+        ("GET", ["stats", user]) => Response::ok(json!(state.stats.get(user))),
+        ("GET", ["sessions", "history"]) => {
+            Response::ok(json!(state.history.recent(request.limit())))
+        }
+        ("GET", ["sessions", "history", id]) => match state.history.get(id) {
+            Some(record) => Response::ok(json!(record)),
+            None => Response::error(404, "session not found"),
+        },
+        ("GET", ["users"]) => {
+            let users: serde_json::Map<String, Value> = state
+                .users
+                .snapshot()
+                .iter()
+                .map(|(key, user)| (key.clone(), user_json(user)))
+                .collect();
+            Response::ok(Value::Object(users))
+        }
+        ("GET", ["users", key @ ..]) => match state.users.get(&key.join("/")) {
+            Some(user) => Response::ok(user_json(&user)),
+            None => Response::error(404, "user not found"),
+        },
+        ("POST", ["users"]) => {
+            let new_user = match serde_json::from_slice::<NewUser>(&request.body) {
+                Ok(u) => u,
+                Err(e) => return Response::error(400, &format!("bad user format: {e}")),
+            };
+            match state
+                .users
+                .create(new_user.tenant.as_deref(), new_user.user.clone())
+            {
+                Ok(key) => {
+                    info!(user=%key, "User was created through the admin API.");
+                    Response {
+                        status: 201,
+                        body: user_json(&new_user.user),
+                    }
+                }
+                Err(e) => store_error(e),
+            }
+        }
+        ("PATCH", ["users", key @ ..]) => {
+            let update = match serde_json::from_slice::<UserUpdate>(&request.body) {
+                Ok(u) => u,
+                Err(e) => return Response::error(400, &format!("bad update format: {e}")),
+            };
+            let key = key.join("/");
+            match state.users.update(&key, update) {
+                Ok(user) => {
+                    info!(user=%key, "User was updated through the admin API.");
+                    Response::ok(user_json(&user))
+                }
+                Err(e) => store_error(e),
+            }
+        }
+        _ => Response::error(404, "not found"),
+    }
+}
+
+/// Serializes a user without the password.
+fn user_json(user: &User) -> Value {
+    let mut value = json!(user);
+    if let Some(fields) = value.as_object_mut() {
+        fields.remove("password");
+    }
+    value
+}
+
+fn store_error(error: UserStoreError) -> Response {
+    let status = match error {
+        UserStoreError::NotFound => 404,
+        UserStoreError::AlreadyExists => 409,
+        UserStoreError::UnknownTenant => 400,
+        UserStoreError::Persist(_) => 500,
+    };
+    Response::error(status, &error.to_string())
+}
+
+async fn write_response(stream: &mut TcpStream, response: Response) -> Result<()> {
+    let body = response.body.to_string();
+    let reason = match response.status {
+        200 => "OK",
+        201 => "Created",
+        400 => "Bad Request",
+        401 => "Unauthorized",
+        404 => "Not Found",
+        409 => "Conflict",
+        413 => "Payload Too Large",
+        500 => "Internal Server Error",
+        503 => "Service Unavailable",
+        _ => "Error",
+    };
+    let head = format!(
+        "HTTP/1.1 {} {}\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+        response.status,
+        reason,
+        body.len()
+    );
+    stream.write_all(head.as_bytes()).await?;
+    stream.write_all(body.as_bytes()).await?;
+    stream.shutdown().await?;
+    Ok(())
+}
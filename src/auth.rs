@@ -0,0 +1,251 @@
+//! Backends that check the password of a user at login.
+//!
+//! A backend is plugged in by implementing [`Authenticator`] and adding it
+//! to [`AuthBackend`]. Sessions ask the backends in the order of
+//! `auth_backends`, and the first one that knows the user decides.
+
+use std::{fmt, future::Future, net::IpAddr, pin::Pin};
+
+use serde::Deserialize;
+use thiserror::Error;
+
+use crate::{
+    config::{Config, User},
+    external_auth::{self, ExternalAuthConfig},
+    htpasswd::Htpasswd,
+    ldap::{self, LdapConfig},
+    pam::{self, PamConfig},
+    password,
+    state::SharedState,
+    user_db::UserDb,
+    users::{UserStore, account_key},
+};
+
+#[derive(Debug, Error)]
+pub enum AuthError {
+    /// The backend does not know the user, so the next one is asked.
+    #[error("unknown user")]
+    UnknownUser,
+    /// The backend knows the user, so no other backend is asked.
+    #[error("wrong password")]
+    WrongPassword,
+    /// The backend could not decide, e.g. because its server is down or
+    /// it can not tell unknown users from wrong passwords. The next one is
+    /// asked.
+    #[error("{0}")]
+    Failed(anyhow::Error),
+}
+
+impl From<anyhow::Error> for AuthError {
+    fn from(e: anyhow::Error) -> Self {
+        AuthError::Failed(e)
+    }
+}
+
+/// Future returned by an authenticator.
+pub type AuthFuture<'a> = Pin<Box<dyn Future<Output = Result<User, AuthError>> + Send + 'a>>;
+
+/// Checks the password of a user and returns the user it logs in as.
+pub trait Authenticator: Send + Sync {
+    fn authenticate<'a>(
+        &'a self,
+        username: &'a str,
+        password: &'a str,
+        ip: Option<IpAddr>,
+    ) -> AuthFuture<'a>;
+}
+
+#[derive(Debug, Deserialize, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "snake_case")]
+pub enum AuthBackend {
+    /// Users of the config and the users file.
+    Users,
+    Htpasswd,
+    UserDb,
+    Pam,
+    Ldap,
+    ExternalAuth,
+}
+
+impl fmt::Display for AuthBackend {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            AuthBackend::Users => "users",
+            AuthBackend::Htpasswd => "htpasswd",
+            AuthBackend::UserDb => "user_db",
+            AuthBackend::Pam => "pam",
+            AuthBackend::Ldap => "ldap",
+            AuthBackend::ExternalAuth => "external_auth",
+        })
+    }
+}
+
+impl AuthBackend {
+    /// Order backends are asked in when `auth_backends` is not set.
+    pub const DEFAULT_ORDER: [AuthBackend; 6] = [
+        AuthBackend::Users,
+        AuthBackend::Htpasswd,
+        AuthBackend::UserDb,
+        AuthBackend::Pam,
+        AuthBackend::Ldap,
+        AuthBackend::ExternalAuth,
+    ];
+
+    /// Checks if the config has the section of the backend.
+    pub fn is_configured(self, config: &Config) -> bool {
+        match self {
+            AuthBackend::Users => true,
+            AuthBackend::Htpasswd => config.htpasswd.is_some(),
+            AuthBackend::UserDb => config.user_db.is_some(),
+            AuthBackend::Pam => config.pam.is_some(),
+            AuthBackend::Ldap => config.ldap.is_some(),
+            AuthBackend::ExternalAuth => config.external_auth.is_some(),
+        }
+    }
+
+    /// Users of these backends are in the user store, and are looked up
+    /// there during the session so changes apply at once. Users of other
+    /// backends are only known once their password is checked.
+    pub fn is_stored(self) -> bool {
+        matches!(self, AuthBackend::Users | AuthBackend::Htpasswd)
+    }
+}
+
+impl<T: Authenticator + ?Sized> Authenticator for &T {
+    fn authenticate<'a>(
+        &'a self,
+        username: &'a str,
+        password: &'a str,
+        ip: Option<IpAddr>,
+    ) -> AuthFuture<'a> {
+        (**self).authenticate(username, password, ip)
+    }
+}
+
+/// Authenticators of the backends of the config, in the order they are
+/// asked.
+pub fn authenticators<'a>(
+    config: &'a Config,
+    state: &'a SharedState,
+) -> Vec<(AuthBackend, Box<dyn Authenticator + 'a>)> {
+    let tenant = config.tenant.as_deref();
+    config
+        .auth_backends()
+        .into_iter()
+        .filter_map(|backend| {
+            let authenticator: Box<dyn Authenticator + 'a> = match backend {
+                AuthBackend::Users => Box::new(StoredUsers {
+                    users: &state.users,
+                    tenant,
+                }),
+                AuthBackend::Htpasswd => {
+                    config.htpasswd.as_ref()?;
+                    Box::new(HtpasswdUsers {
+                        htpasswd: state.users.htpasswd(),
+                        tenant,
+                    })
+                }
+                AuthBackend::UserDb => Box::new(state.user_db(tenant)?),
+                AuthBackend::Pam => Box::new(config.pam.as_ref()?),
+                AuthBackend::Ldap => Box::new(config.ldap.as_ref()?),
+                AuthBackend::ExternalAuth => Box::new(config.external_auth.as_ref()?),
+            };
+            Some((backend, authenticator))
+        })
+        .collect()
+}
+
+/// Checks the password of a user a backend has found. Unknown users cost
+/// as much as known ones.
+async fn check_password(user: Option<User>, password: &str) -> Result<User, AuthError> {
+    let Some(user) = user else {
+        password::verify_dummy(password).await;
+        return Err(AuthError::UnknownUser);
+    };
+    if password::verify(&user.password, password).await {
+        Ok(user)
+    } else {
+        Err(AuthError::WrongPassword)
+    }
+}
+
+struct StoredUsers<'a> {
+    users: &'a UserStore,
+    tenant: Option<&'a str>,
+}
+
+impl Authenticator for StoredUsers<'_> {
+    fn authenticate<'a>(
+        &'a self,
+        username: &'a str,
+        password: &'a str,
+        _ip: Option<IpAddr>,
+    ) -> AuthFuture<'a> {
+        let key = account_key(self.tenant, username);
+        Box::pin(check_password(self.users.get_stored(&key), password))
+    }
+}
+
+struct HtpasswdUsers<'a> {
+    htpasswd: &'a [Htpasswd],
+    tenant: Option<&'a str>,
+}
+
+impl Authenticator for HtpasswdUsers<'_> {
+    fn authenticate<'a>(
+        &'a self,
+        username: &'a str,
+        password: &'a str,
+        _ip: Option<IpAddr>,
+    ) -> AuthFuture<'a> {
+        let key = account_key(self.tenant, username);
+        let user = self.htpasswd.iter().find_map(|h| h.get(&key));
+        Box::pin(check_password(user, password))
+    }
+}
+
+impl Authenticator for UserDb {
+    fn authenticate<'a>(
+        &'a self,
+        username: &'a str,
+        password: &'a str,
+        _ip: Option<IpAddr>,
+    ) -> AuthFuture<'a> {
+        Box::pin(async move { check_password(self.find(username).await?, password).await })
+    }
+}
+
+impl Authenticator for PamConfig {
+    fn authenticate<'a>(
+        &'a self,
+        username: &'a str,
+        password: &'a str,
+        ip: Option<IpAddr>,
+    ) -> AuthFuture<'a> {
+        Box::pin(async move { Ok(pam::authenticate(self, username, password, ip).await?) })
+    }
+}
+
+impl Authenticator for LdapConfig {
+    fn authenticate<'a>(
+        &'a self,
+        username: &'a str,
+        password: &'a str,
+        _ip: Option<IpAddr>,
+    ) -> AuthFuture<'a> {
+        Box::pin(async move { Ok(ldap::authenticate(self, username, password).await?) })
+    }
+}
+
+impl Authenticator for ExternalAuthConfig {
+    fn authenticate<'a>(
+        &'a self,
+        username: &'a str,
+        password: &'a str,
+        ip: Option<IpAddr>,
+    ) -> AuthFuture<'a> {
+        Box::pin(
+            async move { Ok(external_auth::authenticate(self, username, password, ip).await?) },
+        )
+    }
+}
@@ -0,0 +1,149 @@
+//! Checksums of stored files.
+
+use std::{
+    fs::File,
+    io::{self, Read, Seek, SeekFrom},
+    path::Path,
+};
+
+use md5::Md5;
+use sha2::{Digest, Sha256, Sha512};
+use tokio::task;
+
+/// Size of a single read while hashing.
+const BUFFER_SIZE: usize = 64 * 1024;
+
+/// Parses a SHA-256 checksum in hex. Returns it in lowercase.
+pub fn parse_sha256(text: &str) -> Option<String> {
+    (text.len() == 64 && text.chars().all(|c| c.is_ascii_hexdigit()))
+        .then(|| text.to_ascii_lowercase())
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum Algorithm {
+    Crc32,
+    Md5,
+    #[default]
+    Sha256,
+    Sha512,
+}
+
+impl Algorithm {
+    /// Algorithms offered to HASH, in the order FEAT lists them.
+    pub const ALL: [Algorithm; 4] = [
+        Algorithm::Sha256,
+        Algorithm::Sha512,
+        Algorithm::Md5,
+        Algorithm::Crc32,
+    ];
+
+    /// Name used by HASH and OPTS HASH.
+    pub fn name(self) -> &'static str {
+        match self {
+            Algorithm::Crc32 => "CRC32",
+            Algorithm::Md5 => "MD5",
+            Algorithm::Sha256 => "SHA-256",
+            Algorithm::Sha512 => "SHA-512",
+        }
+    }
+
+    /// Finds an algorithm by its name, ignoring case.
+    pub fn from_name(name: &str) -> Option<Self> {
+        Self::ALL
+            .into_iter()
+            .find(|a| a.name().eq_ignore_ascii_case(name))
+    }
+}
+
+/// FEAT line of HASH, with the selected algorithm marked by `*`.
+pub fn hash_feature(selected: Algorithm) -> String {
+    let names: Vec<String> = Algorithm::ALL
+        .iter()
+        .map(|&a| {
+            if a == selected {
+                format!("{}*", a.name())
+            } else {
+                a.name().to_string()
+            }
+        })
+        .collect();
+    format!("HASH {}", names.join(";"))
+}
+
+enum Hasher {
+    Crc32(crc32fast::Hasher),
+    Md5(Md5),
+    Sha256(Sha256),
+    Sha512(Sha512),
+}
+
+impl Hasher {
+    fn new(algorithm: Algorithm) -> Self {
+        match algorithm {
+            Algorithm::Crc32 => Hasher::Crc32(crc32fast::Hasher::new()),
+            Algorithm::Md5 => Hasher::Md5(Md5::new()),
+            Algorithm::Sha256 => Hasher::Sha256(Sha256::new()),
+            Algorithm::Sha512 => Hasher::Sha512(Sha512::new()),
+        }
+    }
+
+    fn update(&mut self, data: &[u8]) {
+        match self {
+            Hasher::Crc32(h) => h.update(data),
+            Hasher::Md5(h) => h.update(data),
+            Hasher::Sha256(h) => h.update(data),
+            Hasher::Sha512(h) => h.update(data),
+        }
+    }
+
+    /// Returns the digest in lowercase hex.
+    fn finish(self) -> String {
+        let digest = match self {
+            Hasher::Crc32(h) => return format!("{:08x}", h.finalize()),
+            Hasher::Md5(h) => h.finalize().to_vec(),
+            Hasher::Sha256(h) => h.finalize().to_vec(),
+            Hasher::Sha512(h) => h.finalize().to_vec(),
+        };
+        digest.iter().map(|b| format!("{b:02x}")).collect()
+    }
+}
+
+/// Returns the digest of the data in lowercase hex.
+pub fn digest(algorithm: Algorithm, data: &[u8]) -> String {
+    let mut hasher = Hasher::new(algorithm);
+    hasher.update(data);
+    hasher.finish()
+}
+
+/// Returns the digest of the bytes of the file from `start` up to `end`,
+/// or to the end of the file, in lowercase hex.
+pub async fn digest_file(
+    path: &Path,
+    algorithm: Algorithm,
+    start: u64,
+    end: Option<u64>,
+) -> io::Result<String> {
+    let path = path.to_path_buf();
+    task::spawn_blocking(move || {
+        let mut file = File::open(path)?;
+        file.seek(SeekFrom::Start(start))?;
+        let mut file = file.take(end.map_or(u64::MAX, |end| end.saturating_sub(start)));
+        let mut hasher = Hasher::new(algorithm);
+        let mut buffer = vec![0u8; BUFFER_SIZE];
+        loop {
+            let read = file.read(&mut buffer)?;
+            if read == 0 {
+                break;
+            }
+            hasher.update(&buffer[..read]);
+        }
+        Ok(hasher.finish())
+    })
+    .await
+    .map_err(io::Error::other)?
+}
+
+/// Returns the SHA-256 checksum of the file in lowercase hex.
+pub async fn sha256_file(path: &Path) -> io::Result<String> {
+    digest_file(path, Algorithm::Sha256, 0, None).await
+}
@@ -1,4 +1,6 @@
-use clap::Parser;
+use clap::{Parser, Subcommand};
+
+use crate::accounts::Format;
 
 #[derive(Parser)]
 #[command(
@@ -10,4 +12,137 @@ pub struct Cli {
     /// The path to the configuration file.
     #[arg(short, long)]
     pub config: Option<String>,
+
+    #[command(subcommand)]
+    pub command: Option<SubCommand>,
+}
+
+#[derive(Subcommand)]
+pub enum SubCommand {
+    /// Show per-user transfer statistics.
+    Stats {
+        /// Show statistics only for this user.
+        #[arg(short, long)]
+        user: Option<String>,
+    },
+    /// Check the configuration and the system for common problems.
+    Doctor,
+    /// Import or export users of the users file.
+    User {
+        #[command(subcommand)]
+        action: UserAction,
+    },
+    /// Hash a password for the users of the config. The password is read
+    /// from the terminal without echo, or as a line from the standard input.
+    HashPassword {
+        /// Hash with bcrypt instead of argon2id.
+        #[arg(long)]
+        bcrypt: bool,
+        /// Store the hash as the password of this user in the config file
+        /// instead of printing it.
+        #[arg(short, long)]
+        user: Option<String>,
+        /// Tenant of the user.
+        #[arg(short, long, requires = "user")]
+        tenant: Option<String>,
+    },
+    /// Search the transfer log.
+    Log {
+        #[command(subcommand)]
+        action: LogAction,
+    },
+    /// Replay a recorded session and report replies that differ.
+    Replay {
+        /// Recording made with `record_dir`.
+        file: String,
+        /// Server to replay against. By default a test server is started
+        /// with the files that were downloaded in the recording.
+        #[arg(short, long)]
+        address: Option<String>,
+        /// User to log in as instead of the recorded one.
+        #[arg(short, long)]
+        user: Option<String>,
+        /// Password to log in with. Recordings never contain passwords.
+        #[arg(short, long)]
+        password: Option<String>,
+        /// Keep the delays between commands as recorded.
+        #[arg(long)]
+        realtime: bool,
+    },
+    /// Manage Dock as a Windows service.
+    Service {
+        #[command(subcommand)]
+        action: ServiceAction,
+    },
+}
+
+#[derive(Subcommand, Clone, Copy)]
+pub enum ServiceAction {
+    /// Register Dock as a service that starts automatically.
+    Install,
+    /// Remove the registered service.
+    Uninstall,
+    /// Start the registered service.
+    Start,
+    /// Stop the running service.
+    Stop,
+    /// Run under the service control manager. Used by the service itself.
+    #[command(hide = true)]
+    Run,
+}
+
+#[derive(Subcommand)]
+pub enum UserAction {
+    /// Add users from a CSV or JSON file to the users file. A running server
+    /// picks them up after a restart.
+    Import {
+        file: String,
+        /// Guessed from the file extension by default.
+        #[arg(short, long)]
+        format: Option<Format>,
+        /// Tenant to add the users to.
+        #[arg(short, long)]
+        tenant: Option<String>,
+        /// Replace existing users with the same name instead of skipping them.
+        #[arg(long)]
+        replace: bool,
+    },
+    /// Write users of the config and the users file as CSV or JSON.
+    Export {
+        /// File to write to instead of the standard output.
+        #[arg(short, long)]
+        output: Option<String>,
+        /// Guessed from the output file extension, JSON by default.
+        #[arg(short, long)]
+        format: Option<Format>,
+        /// Tenant to export the users of.
+        #[arg(short, long)]
+        tenant: Option<String>,
+    },
+}
+
+#[derive(Subcommand)]
+pub enum LogAction {
+    /// Show transfers from the transfer log, newest first.
+    Query {
+        /// Only transfers of this user.
+        #[arg(short, long)]
+        user: Option<String>,
+        /// Only transfers of this file or of files in this directory.
+        #[arg(short, long)]
+        path: Option<String>,
+        /// Only transfers finished at or after this time, given as a Unix
+        /// timestamp, YYYY-MM-DD or "YYYY-MM-DD HH:MM:SS" in UTC.
+        #[arg(long)]
+        since: Option<String>,
+        /// Only transfers finished before this time.
+        #[arg(long)]
+        until: Option<String>,
+        /// Maximum number of transfers to show.
+        #[arg(short, long, default_value_t = 50)]
+        limit: usize,
+        /// Print JSON instead of a table.
+        #[arg(long)]
+        json: bool,
+    },
 }
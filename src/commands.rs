@@ -1,4 +1,4 @@
-#[derive(Debug)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
 pub enum Commands {
     User,
     Password,
@@ -9,38 +9,168 @@ pub enum Commands {
     Type,
     ChangeDirectoryUp,
     List,
+    NameList,
+    MachineList,
+    MachineListDir,
     Port,
+    ExtendedPort,
     Size,
+    ModificationTime,
     Retrive,
     Store,
+    Append,
+    StoreUnique,
+    Delete,
+    MakeDir,
+    RemoveDir,
+    RenameFrom,
+    RenameTo,
     Rest,
     Passive,
     Option,
     Quit,
+    Site,
+    Help,
+    Status,
+    Noop,
+    Abort,
+    Reinitialize,
+    Allocate,
+    Structure,
+    Crc32,
+    Md5,
+    Sha256,
+    Hash,
+    Available,
+    Client,
+    Language,
+    Host,
+    Combine,
+    Authenticate,
+    ProtectionBufferSize,
+    DataProtection,
     Unknown,
 }
 
+/// Every verb the server recognizes and the command it maps to.
+pub const COMMAND_TABLE: &[(&str, Commands)] = &[
+    ("USER", Commands::User),
+    ("PASS", Commands::Password),
+    ("PWD", Commands::WorkingDir),
+    ("XPWD", Commands::WorkingDir),
+    ("CWD", Commands::ChangeDir),
+    ("CDUP", Commands::ChangeDirectoryUp),
+    ("XCUP", Commands::ChangeDirectoryUp),
+    ("OPTS", Commands::Option),
+    ("LIST", Commands::List),
+    ("NLST", Commands::NameList),
+    ("MLSD", Commands::MachineListDir),
+    ("MLST", Commands::MachineList),
+    ("PORT", Commands::Port),
+    ("EPRT", Commands::ExtendedPort),
+    ("REST", Commands::Rest),
+    ("PASV", Commands::Passive),
+    ("RETR", Commands::Retrive),
+    ("STOR", Commands::Store),
+    ("APPE", Commands::Append),
+    ("STOU", Commands::StoreUnique),
+    ("DELE", Commands::Delete),
+    ("MKD", Commands::MakeDir),
+    ("XMKD", Commands::MakeDir),
+    ("RMD", Commands::RemoveDir),
+    ("XRMD", Commands::RemoveDir),
+    ("RNFR", Commands::RenameFrom),
+    ("RNTO", Commands::RenameTo),
+    ("SIZE", Commands::Size),
+    ("MDTM", Commands::ModificationTime),
+    ("SYST", Commands::System),
+    ("TYPE", Commands::Type),
+    ("FEAT", Commands::Features),
+    ("QUIT", Commands::Quit),
+    ("SITE", Commands::Site),
+    ("HELP", Commands::Help),
+    ("STAT", Commands::Status),
+    ("NOOP", Commands::Noop),
+    ("ABOR", Commands::Abort),
+    ("REIN", Commands::Reinitialize),
+    ("ALLO", Commands::Allocate),
+    ("STRU", Commands::Structure),
+    ("XCRC", Commands::Crc32),
+    ("XMD5", Commands::Md5),
+    ("XSHA256", Commands::Sha256),
+    ("HASH", Commands::Hash),
+    ("AVBL", Commands::Available),
+    ("CLNT", Commands::Client),
+    ("LANG", Commands::Language),
+    ("HOST", Commands::Host),
+    ("COMB", Commands::Combine),
+    ("AUTH", Commands::Authenticate),
+    ("PBSZ", Commands::ProtectionBufferSize),
+    ("PROT", Commands::DataProtection),
+];
+
 impl From<String> for Commands {
     fn from(val: String) -> Self {
-        match val.as_str() {
-            "USER" => Commands::User,
-            "PASS" => Commands::Password,
-            "PWD" | "XPWD" => Commands::WorkingDir,
-            "CWD" => Commands::ChangeDir,
-            "CDUP" => Commands::ChangeDirectoryUp,
-            "OPTS" => Commands::Option,
-            "LIST" | "NLST" | "MLST" | "MLSD" => Commands::List,
-            "PORT" => Commands::Port,
-            "REST" => Commands::Rest,
-            "PASV" => Commands::Passive,
-            "RETR" => Commands::Retrive,
-            "STOR" => Commands::Store,
-            "SIZE" => Commands::Size,
-            "SYST" => Commands::System,
-            "TYPE" => Commands::Type,
-            "FEAT" => Commands::Features,
-            "QUIT" => Commands::Quit,
-            _ => Commands::Unknown,
+        COMMAND_TABLE
+            .iter()
+            .find(|(verb, _)| *verb == val)
+            .map(|(_, command)| *command)
+            .unwrap_or(Commands::Unknown)
+    }
+}
+
+impl Commands {
+    /// Arguments the command takes, shown by `HELP <command>`.
+    pub fn syntax(self) -> &'static str {
+        match self {
+            Commands::User => "<username>",
+            Commands::Password => "<password>",
+            Commands::ChangeDir
+            | Commands::Size
+            | Commands::ModificationTime
+            | Commands::Retrive
+            | Commands::Store
+            | Commands::Append
+            | Commands::Delete
+            | Commands::MakeDir
+            | Commands::RemoveDir
+            | Commands::RenameFrom
+            | Commands::RenameTo
+            | Commands::Hash => "<path>",
+            Commands::List
+            | Commands::NameList
+            | Commands::MachineList
+            | Commands::MachineListDir
+            | Commands::Status
+            | Commands::Available => "[<path>]",
+            Commands::Crc32 | Commands::Md5 | Commands::Sha256 => "<path> [<start> [<end>]]",
+            Commands::Type => "A|I",
+            Commands::Structure => "F|R|P",
+            Commands::Port => "<h1,h2,h3,h4,p1,p2>",
+            Commands::ExtendedPort => "|<family>|<address>|<port>|",
+            Commands::Rest => "<offset>",
+            Commands::Allocate => "<size> [R <record size>]",
+            Commands::Option => "<option> [<value>]",
+            Commands::Site => "<command> [<arguments>]",
+            Commands::Help => "[<command>]",
+            Commands::Client => "<client name>",
+            Commands::Language => "[<language tag>]",
+            Commands::Host => "<host name>",
+            Commands::Combine => "<target> <segment> [<segment> ...]",
+            Commands::Authenticate => "TLS",
+            Commands::ProtectionBufferSize => "0",
+            Commands::DataProtection => "C|P",
+            Commands::WorkingDir
+            | Commands::Features
+            | Commands::System
+            | Commands::ChangeDirectoryUp
+            | Commands::StoreUnique
+            | Commands::Passive
+            | Commands::Quit
+            | Commands::Noop
+            | Commands::Abort
+            | Commands::Reinitialize
+            | Commands::Unknown => "",
         }
     }
 }
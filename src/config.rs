@@ -1,9 +1,45 @@
-use std::{collections::HashMap, fs};
+use std::{
+    collections::HashMap,
+    fs,
+    path::{Path, PathBuf},
+    sync::Arc,
+};
 
 use anyhow::{Result, anyhow};
-use serde::Deserialize;
+use serde::{Deserialize, Serialize};
 
-#[derive(Debug, Deserialize, Clone, PartialEq, Eq)]
+use crate::{
+    auth::AuthBackend,
+    charset::Charset,
+    datetime::{DateTime, unix_now},
+    disk::SpaceThreshold,
+    external_auth::ExternalAuthConfig,
+    gateway::GatewayConfig,
+    geoip::{CountryPolicy, GeoIpConfig},
+    handover::RestartConfig,
+    history::HistoryConfig,
+    htpasswd::HtpasswdConfig,
+    language::Catalog,
+    ldap::LdapConfig,
+    limits::{Limits, TransferQuota},
+    listing::{DirStyle, ListingLimits},
+    messages::{LoginMessage, Messages},
+    pam::PamConfig,
+    passive::PassiveConfig,
+    password::PasswordPolicy,
+    quarantine::QuarantineConfig,
+    quirks::ClientQuirks,
+    rdns::{HostnamePolicy, ReverseDnsConfig},
+    tarpit::TarpitConfig,
+    tls::TlsConfig,
+    transfer_log::TransferLogConfig,
+    uploads::ResumeConfig,
+    user_db::UserDbConfig,
+    users,
+    virtual_files::VirtualFile,
+};
+
+#[derive(Debug, Serialize, Deserialize, Clone, PartialEq, Eq)]
 pub enum Permissions {
     Write,
     Read,
@@ -12,18 +48,337 @@ pub enum Permissions {
 
 #[derive(Debug, Deserialize, Clone, Default)]
 pub struct Config {
+    #[serde(default)]
     pub address: String,
+    #[serde(default)]
     pub users: Vec<User>,
+    #[serde(default)]
     pub root: String,
+    /// Uploads are refused when free space on the volume drops below this value.
+    #[serde(default)]
+    pub min_free_space: Option<SpaceThreshold>,
+    /// User and group to switch to after the listener is bound.
+    #[serde(default)]
+    pub run_as: Option<RunAs>,
+    /// Confine the process to the root directory with chroot(2) on Unix.
+    #[serde(default)]
+    pub chroot: bool,
+    /// Create the root of a user at login when it does not exist yet, e.g.
+    /// a per-user or per-day directory from a template.
+    #[serde(default)]
+    pub create_user_roots: bool,
+    /// Let RMD remove directories that are not empty, with everything in
+    /// them.
+    #[serde(default)]
+    pub recursive_rmd: bool,
+    /// Reserve disk space for uploads announced with ALLO before they are
+    /// written, which keeps large files from being fragmented.
+    #[serde(default)]
+    pub preallocate_uploads: bool,
+    /// Restrict file system access and system calls on Linux. Only the
+    /// roots, the directories of the state files and the ones user roots
+    /// are expanded in are accessible, so users added at runtime need roots
+    /// below them. Login message files known at start, the resolver
+    /// configuration and CA certificates can be read. Programs can not be
+    /// run, which rules out `quarantine.hook`, `external_auth.command` and
+    /// PAM.
+    #[serde(default)]
+    pub sandbox: bool,
+    /// Port range and advertised address of passive data connections.
+    #[serde(default)]
+    pub passive: PassiveConfig,
+    /// Refuse USER and PASS until the control connection is encrypted, so
+    /// credentials are never sent in cleartext.
+    #[serde(default)]
+    pub require_tls: bool,
+    /// Certificate for AUTH TLS. The files are read before chroot and
+    /// privilege dropping.
+    #[serde(default)]
+    pub tls: Option<TlsConfig>,
+    /// File where per-user statistics are persisted. When chroot is enabled,
+    /// the path is resolved inside the root.
+    #[serde(default)]
+    pub stats_file: Option<String>,
+    #[serde(default)]
+    pub admin: Option<AdminConfig>,
+    #[serde(default)]
+    pub history: HistoryConfig,
+    /// Zero-downtime restarts on `SIGUSR2`.
+    #[serde(default)]
+    pub restart: RestartConfig,
+    /// Record every transfer in a database that can be queried.
+    #[serde(default)]
+    pub transfer_log: Option<TransferLogConfig>,
+    /// Delay replies to failed logins, growing with every failure from the same address.
+    #[serde(default)]
+    pub tarpit: Option<TarpitConfig>,
+    /// Allow or deny connections by country. The database is opened before
+    /// chroot and privilege dropping.
+    #[serde(default)]
+    pub geoip: Option<GeoIpConfig>,
+    /// Look up host names of clients and allow or deny connections by them.
+    /// With chroot, the resolver configuration has to exist inside the root.
+    #[serde(default)]
+    pub reverse_dns: Option<ReverseDnsConfig>,
+    /// Isolated sites served by this process. When set, top-level `address`,
+    /// `root` and `users` are ignored. Backends, the transfer log and the
+    /// statistics file of the top level are shared by the tenants that do not
+    /// set their own.
+    #[serde(default)]
+    pub tenants: Vec<TenantConfig>,
+    /// Name of the tenant this config was derived for.
+    #[serde(skip, default)]
+    pub tenant: Option<String>,
+    /// Host names clients select the tenant with in HOST.
+    #[serde(skip, default)]
+    pub host_names: Vec<String>,
+    /// Configs of every tenant served on the same address, which clients
+    /// choose between with HOST. Only set on the config of a listener.
     #[serde(skip, default)]
-    pub users_map: HashMap<String, User>,
+    pub virtual_hosts: Arc<Vec<Config>>,
+    /// Connections of the listener start with the TLS handshake. Only set
+    /// on the config of a listener.
+    #[serde(skip, default)]
+    pub implicit_tls: bool,
+    /// File where users changed through the admin API are persisted, readable
+    /// by the owner only. Users in it override the ones above. When chroot is
+    /// enabled, the path is resolved inside the root.
+    #[serde(default)]
+    pub users_file: Option<String>,
+    /// Users from an htpasswd file, in addition to the ones above.
+    #[serde(default)]
+    pub htpasswd: Option<HtpasswdConfig>,
+    /// Let system users log in through PAM. Requires a build with the `pam`
+    /// feature.
+    #[serde(default)]
+    pub pam: Option<PamConfig>,
+    /// Let users of an LDAP directory or Active Directory log in.
+    #[serde(default)]
+    pub ldap: Option<LdapConfig>,
+    /// Look users up in an SQLite database at login.
+    #[serde(default)]
+    pub user_db: Option<UserDbConfig>,
+    /// Let a webhook or a program decide on logins of unknown users.
+    #[serde(default)]
+    pub external_auth: Option<ExternalAuthConfig>,
+    /// Backends asked for the password at login, in this order, like
+    /// `["ldap", "users"]`. Defaults to every configured backend, starting
+    /// with the users of the config.
+    #[serde(default)]
+    pub auth_backends: Vec<AuthBackend>,
+    /// Let users change their password with SITE PSWD, following this
+    /// policy. Requires `users_file`.
+    #[serde(default)]
+    pub password_change: Option<PasswordPolicy>,
+    /// Hash plaintext and MD5 passwords with argon2id when their users log
+    /// in and write them back. Requires `users_file`.
+    #[serde(default)]
+    pub upgrade_password_hashes: bool,
+    /// Keep incomplete uploads so clients can resume them after reconnecting.
+    #[serde(default)]
+    pub upload_resume: Option<ResumeConfig>,
+    /// Hold uploads back until they are approved through the admin API or
+    /// by a hook.
+    #[serde(default)]
+    pub quarantine: Option<QuarantineConfig>,
+    /// Serve the files of another FTP server instead of the root.
+    #[serde(default)]
+    pub gateway: Option<GatewayConfig>,
+    #[serde(default)]
+    pub messages: Messages,
+    /// Name of the file whose contents are shown when entering a directory.
+    /// An empty name disables it.
+    #[serde(default = "default_message_file")]
+    pub message_file: String,
+    /// Copy file data with io_uring on Linux when the kernel allows it.
+    #[serde(default)]
+    pub io_uring: bool,
+    /// Open active mode data connections from the port below the control
+    /// port, e.g. 20 when serving on 21, as some firewalls expect. Ports below
+    /// 1024 need privileges, without them any port is used.
+    #[serde(default)]
+    pub active_source_port: bool,
+    #[serde(default)]
+    pub listing: ListingLimits,
+    /// Format of directory listings. Clients can switch it for their session
+    /// with SITE DIRSTYLE.
+    #[serde(default)]
+    pub dir_style: DirStyle,
+    /// Workarounds applied to clients by the identification they send with
+    /// CLNT.
+    #[serde(default)]
+    pub client_quirks: Vec<ClientQuirks>,
+    /// Reply languages clients can select with LANG, keyed by language tag
+    /// like `de`. Replies are in English unless translated.
+    #[serde(default)]
+    pub languages: HashMap<String, Catalog>,
+    /// Read-only files served from generated content.
+    #[serde(default)]
+    pub virtual_files: Vec<VirtualFile>,
+    /// Charset of paths sent by clients that have not enabled UTF-8. Replies
+    /// and listings are sent to them in it as well.
+    #[serde(default)]
+    pub client_encoding: Option<Charset>,
+    /// Limits of every session. Groups and users can override them.
+    #[serde(default)]
+    pub limits: Limits,
+    /// Limits of users in a group, keyed by group name.
+    #[serde(default)]
+    pub groups: HashMap<String, Limits>,
+    /// Directory where every session is recorded for `dock replay`. When
+    /// chroot is enabled, the path is resolved inside the root.
+    #[serde(default)]
+    pub record_dir: Option<String>,
 }
 
+/// A site with its own listener, root and users. Settings that are not
+/// listed here are inherited from the top-level config.
 #[derive(Debug, Deserialize, Clone)]
+pub struct TenantConfig {
+    pub name: String,
+    pub address: String,
+    pub root: String,
+    pub users: Vec<User>,
+    #[serde(default)]
+    pub min_free_space: Option<SpaceThreshold>,
+    /// Host names clients select the tenant with in HOST. Tenants with host
+    /// names may share an address.
+    #[serde(default)]
+    pub hosts: Vec<String>,
+    /// Replies of the tenant, like its greeting. Defaults to the ones of the
+    /// server.
+    #[serde(default)]
+    pub messages: Option<Messages>,
+    // Backends and files of the tenant, used instead of the ones of the
+    // server so that tenants do not share users, logs or statistics.
+    #[serde(default)]
+    pub htpasswd: Option<HtpasswdConfig>,
+    #[serde(default)]
+    pub ldap: Option<LdapConfig>,
+    #[serde(default)]
+    pub user_db: Option<UserDbConfig>,
+    #[serde(default)]
+    pub external_auth: Option<ExternalAuthConfig>,
+    #[serde(default)]
+    pub transfer_log: Option<TransferLogConfig>,
+    #[serde(default)]
+    pub stats_file: Option<String>,
+    #[serde(default)]
+    pub record_dir: Option<String>,
+}
+
+fn default_message_file() -> String {
+    String::from(".message")
+}
+
+fn default_enabled() -> bool {
+    true
+}
+
+#[derive(Debug, Serialize, Deserialize, Clone)]
 pub struct User {
     pub name: String,
     pub password: String,
     pub permissions: Permissions,
+    /// Countries the user may log in from. Requires `geoip` to be configured.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub countries: Option<CountryPolicy>,
+    /// Host names the user may log in from. Requires `reverse_dns` to be
+    /// configured.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub hostnames: Option<HostnamePolicy>,
+    /// Names in client certificates that log in as the user without a
+    /// password: a common name of the subject, or a DNS name or email
+    /// address of the alternative names. Requires `tls.client_auth`.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub client_certificates: Vec<String>,
+    /// Root directory of the user. Defaults to the root of the server. May
+    /// be a template like `/srv/ftp/%u`, see [`users::expand_root`].
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub root: Option<String>,
+    /// Maximum total size of files under the user's root, in bytes.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub quota: Option<u64>,
+    /// Maximum number of files under the user's root.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub file_quota: Option<u64>,
+    /// Bytes the user may transfer per day, week or month.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub transfer_quota: Option<TransferQuota>,
+    /// Disabled users can not log in.
+    #[serde(default = "default_enabled")]
+    pub enabled: bool,
+    /// The user can not log in from this time on, written in UTC as
+    /// `YYYY-MM-DD` or `YYYY-MM-DD HH:MM:SS`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub expires_at: Option<DateTime>,
+    /// Group whose limits apply to the user.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub group: Option<String>,
+    /// Limits that override the ones of the server and the group.
+    #[serde(default, skip_serializing_if = "Limits::is_empty")]
+    pub limits: Limits,
+}
+
+impl User {
+    /// Checks if user has access to read.
+    pub fn can_read(&self) -> bool {
+        self.permissions == Permissions::Read || self.permissions == Permissions::All
+    }
+
+    /// Checks if the account is disabled or expired.
+    pub fn is_locked(&self) -> bool {
+        !self.enabled
+            || self
+                .expires_at
+                .is_some_and(|expires| expires.to_unix() <= unix_now() as i64)
+    }
+
+    /// Checks if user has access to write.
+    pub fn can_write(&self) -> bool {
+        self.permissions == Permissions::Write || self.permissions == Permissions::All
+    }
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct RunAs {
+    pub user: String,
+    /// Defaults to the primary group of the user.
+    #[serde(default)]
+    pub group: Option<String>,
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct AdminConfig {
+    /// Address of the admin API. Should not be reachable from the outside.
+    pub address: String,
+    /// Bearer token required for every request. Only optional when the
+    /// address is a loopback address.
+    #[serde(default)]
+    pub token: Option<String>,
+}
+
+impl AdminConfig {
+    /// Checks that the API can not be reached without a token from outside
+    /// of this machine.
+    pub fn validate(&self) -> Result<()> {
+        if self.token.is_some() {
+            return Ok(());
+        }
+        let loopback = match self.address.parse::<std::net::SocketAddr>() {
+            Ok(address) => address.ip().is_loopback(),
+            Err(_) => self
+                .address
+                .rsplit_once(':')
+                .is_some_and(|(host, _)| host == "localhost"),
+        };
+        if !loopback {
+            return Err(anyhow!(
+                "admin.token is required unless admin.address is a loopback address"
+            ));
+        }
+        Ok(())
+    }
 }
 
 #[derive(Debug)]
@@ -33,57 +388,394 @@ pub enum ConfigError {
 }
 
 impl Config {
-    /// Checks if user exists.
-    pub fn check_user(&self, username: &str) -> bool {
-        if !self.users_map.is_empty() {
-            self.users_map.contains_key(username)
-        } else {
-            self.users.iter().any(|f| f.name == username)
+    /// Returns a config for every server instance: one per tenant, or the
+    /// config itself when no tenants are defined.
+    pub fn instances(&self) -> Vec<Config> {
+        if self.tenants.is_empty() {
+            return vec![self.clone()];
         }
+
+        self.tenants
+            .iter()
+            .map(|tenant| {
+                let mut config = self.clone();
+                config.tenants = Vec::new();
+                config.tenant = Some(tenant.name.clone());
+                config.address = tenant.address.clone();
+                config.root = tenant.root.clone();
+                config.users = tenant.users.clone();
+                if tenant.min_free_space.is_some() {
+                    config.min_free_space = tenant.min_free_space;
+                }
+                config.host_names = tenant.hosts.clone();
+                if let Some(messages) = &tenant.messages {
+                    config.messages = messages.clone();
+                }
+                config.htpasswd = tenant.htpasswd.clone().or(config.htpasswd);
+                config.ldap = tenant.ldap.clone().or(config.ldap);
+                config.user_db = tenant.user_db.clone().or(config.user_db);
+                config.external_auth = tenant.external_auth.clone().or(config.external_auth);
+                config.transfer_log = tenant.transfer_log.clone().or(config.transfer_log);
+                config.stats_file = tenant.stats_file.clone().or(config.stats_file);
+                config.record_dir = tenant.record_dir.clone().or(config.record_dir);
+                config
+            })
+            .collect()
     }
 
-    // Checks if user's password matches.
-    pub fn check_password(&self, username: &str, password: &str) -> bool {
-        if !self.users_map.is_empty() {
-            self.users_map
-                .get(username)
-                .map(|u| u.password == password)
-                .unwrap_or(false)
-        } else {
-            self.users
-                .iter()
-                .any(|f| f.name == username && f.password == password)
+    /// Backends asked for the password at login, in order.
+    pub fn auth_backends(&self) -> Vec<AuthBackend> {
+        if !self.auth_backends.is_empty() {
+            return self.auth_backends.clone();
         }
+        AuthBackend::DEFAULT_ORDER
+            .into_iter()
+            .filter(|backend| backend.is_configured(self))
+            .collect()
     }
 
-    /// Checks if user has access to write.
-    pub fn can_user_write(&self, username: &str) -> bool {
-        if let Some(user) = self.users_map.get(username) {
-            user.permissions == Permissions::Write || user.permissions == Permissions::All
-        } else {
-            false
+    /// Key that identifies the user across tenants, e.g. in statistics.
+    pub fn account_key(&self, username: &str) -> String {
+        users::account_key(self.tenant.as_deref(), username)
+    }
+
+    /// Limits of the user: the ones of the server overridden by the ones of
+    /// the group, which are overridden by the ones of the user.
+    pub fn limits_for(&self, user: &User) -> Limits {
+        let group = user.group.as_ref().and_then(|g| self.groups.get(g));
+        match group {
+            Some(group) => self.limits.overridden_by(group),
+            None => self.limits.clone(),
         }
+        .overridden_by(&user.limits)
     }
 
-    /// Checks if user has access to read.
-    pub fn can_user_read(&self, username: &str) -> bool {
-        if let Some(user) = self.users_map.get(username) {
-            user.permissions == Permissions::Read || user.permissions == Permissions::All
+    /// Returns where a path the server opens after chroot is seen from
+    /// outside of it, e.g. by commands of the CLI.
+    pub fn outside_chroot(&self, path: &Path) -> PathBuf {
+        if self.chroot {
+            Path::new(&self.root).join(path.strip_prefix("/").unwrap_or(path))
         } else {
-            false
+            path.to_path_buf()
+        }
+    }
+
+    /// Checks if restarts can be used. After chroot or in the sandbox, the
+    /// new process could neither find the executable nor be started.
+    pub fn supports_restarts(&self) -> bool {
+        !(cfg!(unix) && (self.chroot || self.sandbox))
+    }
+
+    /// Settings that run programs, which the sandbox forbids.
+    pub fn sandbox_conflicts(&self) -> Vec<&'static str> {
+        let mut conflicts = Vec::new();
+        if self.quarantine.as_ref().is_some_and(|q| q.hook.is_some()) {
+            conflicts.push("quarantine.hook");
+        }
+        if self.instances().iter().any(|instance| {
+            instance
+                .external_auth
+                .as_ref()
+                .is_some_and(|e| e.command.is_some())
+        }) {
+            conflicts.push("external_auth.command");
+        }
+        // Modules like pam_unix run helpers such as unix_chkpwd.
+        if self.pam.is_some() {
+            conflicts.push("pam");
         }
+        conflicts
+    }
+
+    /// Paths the sandbox leaves accessible besides the roots: directories
+    /// that are written to, and files that are only read.
+    pub fn sandbox_paths(&self) -> Result<(Vec<PathBuf>, Vec<PathBuf>)> {
+        let mut writable: Vec<PathBuf> = self
+            .state_files()
+            .iter()
+            .filter_map(|f| f.parent().map(Path::to_path_buf))
+            .collect();
+        writable.extend(self.quarantine.as_ref().map(|q| PathBuf::from(&q.dir)));
+        // Certificates are read again when they are renewed, ACME writes
+        // them and its account to the cache.
+        if let Some(tls) = &self.tls {
+            let (cert_file, key_file) = tls.certificate_files();
+            writable.extend(
+                [cert_file, key_file]
+                    .iter()
+                    .filter_map(|file| file.parent().map(Path::to_path_buf)),
+            );
+            writable.extend(tls.acme.as_ref().map(|a| PathBuf::from(&a.cache_dir)));
+        }
+        writable.extend(
+            self.gateway
+                .as_ref()
+                .and_then(|g| g.cache.as_ref())
+                .map(|c| PathBuf::from(&c.dir)),
+        );
+
+        // Roots of users are expanded at login, so the directories they are
+        // expanded in are allowed.
+        let users = users::UserStore::load(self)?.snapshot();
+        let mut root_templates: Vec<_> = users.values().filter_map(|u| u.root.clone()).collect();
+        for instance in self.instances() {
+            writable.extend(instance.record_dir.map(PathBuf::from));
+            writable.extend(
+                instance
+                    .htpasswd
+                    .as_ref()
+                    .and_then(|h| Path::new(&h.file).parent().map(Path::to_path_buf)),
+            );
+            writable.extend(
+                instance
+                    .user_db
+                    .as_ref()
+                    .and_then(|d| Path::new(&d.file).parent().map(Path::to_path_buf)),
+            );
+            root_templates.extend(
+                [
+                    instance.htpasswd.and_then(|h| h.root),
+                    instance.user_db.and_then(|d| d.root),
+                    instance.ldap.and_then(|l| l.root),
+                    instance.external_auth.and_then(|e| e.root),
+                ]
+                .into_iter()
+                .flatten(),
+            );
+        }
+        writable.extend(
+            root_templates
+                .iter()
+                .map(|template| users::root_base(template).to_path_buf()),
+        );
+
+        // Login messages are read at every login.
+        let read_only = std::iter::once(&self.limits)
+            .chain(self.groups.values())
+            .chain(users.values().map(|user| &user.limits))
+            .filter_map(|limits| match &limits.login_message {
+                Some(LoginMessage::File(file)) => Some(PathBuf::from(file)),
+                _ => None,
+            })
+            .collect();
+        Ok((writable, read_only))
+    }
+
+    /// Files outside of the root the server writes its state to, including
+    /// the ones of tenants.
+    pub fn state_files(&self) -> Vec<PathBuf> {
+        let mut files: Vec<PathBuf> = [
+            self.history.file.as_deref(),
+            self.users_file.as_deref(),
+            self.upload_resume.as_ref().and_then(|r| r.file.as_deref()),
+            self.quarantine.as_ref().and_then(|q| q.file.as_deref()),
+        ]
+        .into_iter()
+        .flatten()
+        .map(PathBuf::from)
+        .collect();
+        for instance in self.instances() {
+            files.extend(instance.stats_file.map(PathBuf::from));
+            files.extend(instance.transfer_log.map(|l| PathBuf::from(l.file)));
+        }
+        files.sort();
+        files.dedup();
+        files
     }
 }
 
 pub fn load_config(path: &str) -> Result<Config> {
     let content = fs::read_to_string(path).map_err(|_| anyhow!("a file system error occurred."))?;
-    let mut config =
+    let config =
         serde_json::from_str::<Config>(&content).map_err(|e| anyhow!("bad config format: {e}"))?;
-    config.users_map = config
+    if config.tenants.is_empty() && (config.address.is_empty() || config.root.is_empty()) {
+        return Err(anyhow!("bad config format: address and root are required"));
+    }
+    let users = config
         .users
         .iter()
-        .cloned()
-        .map(|u| (u.name.clone(), u))
-        .collect();
+        .chain(config.tenants.iter().flat_map(|t| &t.users));
+    for user in users {
+        if let Some(group) = &user.group
+            && !config.groups.contains_key(group)
+        {
+            return Err(anyhow!(
+                "bad config format: user {} is in unknown group {group}",
+                user.name
+            ));
+        }
+    }
+    if let Some(admin) = &config.admin {
+        admin
+            .validate()
+            .map_err(|e| anyhow!("bad config format: {e}"))?;
+    }
+    let instances = config.instances();
+    for instance in &instances {
+        if let Some(ldap) = &instance.ldap {
+            ldap.validate()
+                .map_err(|e| anyhow!("bad config format: {e}"))?;
+        }
+        if let Some(external_auth) = &instance.external_auth {
+            external_auth
+                .validate()
+                .map_err(|e| anyhow!("bad config format: {e}"))?;
+        }
+    }
+    // Backends may be configured by some tenants only.
+    for backend in &config.auth_backends {
+        if !instances.iter().any(|i| backend.is_configured(i)) {
+            return Err(anyhow!(
+                "bad config format: auth_backends lists {backend}, which is not configured"
+            ));
+        }
+    }
+    for instance in &instances {
+        let backend_groups = [
+            (
+                "htpasswd",
+                instance.htpasswd.as_ref().and_then(|h| h.group.as_ref()),
+            ),
+            ("pam", instance.pam.as_ref().and_then(|p| p.group.as_ref())),
+            (
+                "ldap",
+                instance.ldap.as_ref().and_then(|l| l.group.as_ref()),
+            ),
+            (
+                "user_db",
+                instance.user_db.as_ref().and_then(|d| d.group.as_ref()),
+            ),
+            (
+                "external_auth",
+                instance
+                    .external_auth
+                    .as_ref()
+                    .and_then(|e| e.group.as_ref()),
+            ),
+        ];
+        for (backend, group) in backend_groups {
+            if let Some(group) = group
+                && !config.groups.contains_key(group)
+            {
+                return Err(anyhow!(
+                    "bad config format: {backend} users are in unknown group {group}"
+                ));
+            }
+        }
+    }
     Ok(config)
 }
+
+#[cfg(test)]
+mod tests {
+    use serde_json::json;
+
+    use super::*;
+
+    #[test]
+    fn sandbox_conflicts_with_programs() {
+        let config: Config = serde_json::from_value(json!({
+            "sandbox": true,
+            "quarantine": {"dir": "/srv/quarantine"},
+        }))
+        .unwrap();
+        assert!(config.sandbox_conflicts().is_empty());
+
+        let config: Config = serde_json::from_value(json!({
+            "sandbox": true,
+            "quarantine": {"dir": "/srv/quarantine", "hook": "/usr/bin/scan"},
+            "pam": {"permissions": "Read"},
+        }))
+        .unwrap();
+        assert_eq!(config.sandbox_conflicts(), ["quarantine.hook", "pam"]);
+    }
+
+    #[test]
+    fn confinement_rules_out_restarts() {
+        let config: Config = serde_json::from_value(json!({})).unwrap();
+        assert!(config.restart.enabled);
+        assert!(config.supports_restarts());
+        for confinement in ["chroot", "sandbox"] {
+            let config: Config = serde_json::from_value(json!({confinement: true})).unwrap();
+            assert_eq!(config.supports_restarts(), !cfg!(unix));
+        }
+    }
+
+    #[test]
+    fn tenants_override_backends_and_files() {
+        let config: Config = serde_json::from_value(json!({
+            "stats_file": "/var/lib/dock/stats.json",
+            "transfer_log": {"file": "/var/lib/dock/transfers.db"},
+            "ldap": {"url": "ldap://shared", "permissions": "Read"},
+            "tenants": [
+                {"name": "a", "address": "", "root": "", "users": []},
+                {
+                    "name": "b", "address": "", "root": "", "users": [],
+                    "stats_file": "/srv/b/stats.json",
+                    "transfer_log": {"file": "/srv/b/transfers.db"},
+                    "record_dir": "/srv/b/recordings",
+                },
+            ],
+        }))
+        .unwrap();
+        let instances = config.instances();
+
+        assert_eq!(
+            instances[0].stats_file.as_deref(),
+            Some("/var/lib/dock/stats.json")
+        );
+        assert_eq!(
+            instances[1].stats_file.as_deref(),
+            Some("/srv/b/stats.json")
+        );
+        assert_eq!(instances[0].record_dir, None);
+        assert_eq!(
+            instances[1].record_dir.as_deref(),
+            Some("/srv/b/recordings")
+        );
+        assert!(instances.iter().all(|i| i.ldap.is_some()));
+        assert_eq!(
+            config.state_files(),
+            [
+                "/srv/b/stats.json",
+                "/srv/b/transfers.db",
+                "/var/lib/dock/stats.json",
+                "/var/lib/dock/transfers.db",
+            ]
+            .map(PathBuf::from)
+        );
+    }
+
+    #[test]
+    fn sandbox_allows_files_read_after_confinement() {
+        let config: Config = serde_json::from_value(json!({
+            "sandbox": true,
+            "stats_file": "/var/lib/dock/stats.json",
+            "tls": {
+                "acme": {"domain": "ftp.example.com", "email": "admin@example.com", "cache_dir": "/var/lib/dock/acme"},
+            },
+            "limits": {"login_message": {"file": "/etc/dock/motd"}},
+            "groups": {"staff": {"login_message": {"file": "/etc/dock/staff-motd"}}},
+            "tenants": [{
+                "name": "a", "address": "", "root": "", "users": [],
+                "record_dir": "/srv/a/recordings",
+                "ldap": {"url": "ldap://ldap", "permissions": "Read", "root": "/srv/a/home/%u"},
+            }],
+        }))
+        .unwrap();
+        let (writable, read_only) = config.sandbox_paths().unwrap();
+
+        for path in [
+            "/var/lib/dock",
+            "/var/lib/dock/acme",
+            "/srv/a/recordings",
+            "/srv/a/home",
+        ] {
+            assert!(writable.contains(&PathBuf::from(path)), "{path}");
+        }
+        assert_eq!(
+            read_only,
+            ["/etc/dock/motd", "/etc/dock/staff-motd"].map(PathBuf::from)
+        );
+    }
+}
@@ -0,0 +1,153 @@
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use serde::{Deserialize, Deserializer, Serialize, Serializer, de};
+
+/// Calendar date and time in UTC.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct DateTime {
+    pub year: i64,
+    pub month: u32,
+    pub day: u32,
+    pub hour: u32,
+    pub minute: u32,
+    pub second: u32,
+}
+
+impl DateTime {
+    /// Converts seconds since the Unix epoch into a calendar date.
+    pub fn from_unix(timestamp: i64) -> Self {
+        let days = timestamp.div_euclid(86400);
+        let seconds = timestamp.rem_euclid(86400) as u32;
+
+        // Days to civil date, see http://howardhinnant.github.io/date_algorithms.html
+        let z = days + 719468;
+        let era = z.div_euclid(146097);
+        let doe = z.rem_euclid(146097);
+        let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146096) / 365;
+        let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+        let mp = (5 * doy + 2) / 153;
+        let day = (doy - (153 * mp + 2) / 5 + 1) as u32;
+        let month = if mp < 10 { mp + 3 } else { mp - 9 } as u32;
+        let year = yoe + era * 400 + i64::from(month <= 2);
+
+        DateTime {
+            year,
+            month,
+            day,
+            hour: seconds / 3600,
+            minute: (seconds / 60) % 60,
+            second: seconds % 60,
+        }
+    }
+
+    /// Current time.
+    pub fn now() -> Self {
+        Self::from_unix(unix_now() as i64)
+    }
+
+    /// Converts the date back into seconds since the Unix epoch.
+    pub fn to_unix(&self) -> i64 {
+        let year = self.year - i64::from(self.month <= 2);
+        let era = year.div_euclid(400);
+        let yoe = year.rem_euclid(400);
+        let month = i64::from(self.month);
+        let doy = (153 * (if month > 2 { month - 3 } else { month + 9 }) + 2) / 5
+            + i64::from(self.day)
+            - 1;
+        let doe = yoe * 365 + yoe / 4 - yoe / 100 + doy;
+        let days = era * 146097 + doe - 719468;
+
+        days * 86400
+            + i64::from(self.hour) * 3600
+            + i64::from(self.minute) * 60
+            + i64::from(self.second)
+    }
+
+    /// Formats the date as `YYYYMMDDHHMMSS`, as used in FTP replies.
+    pub fn to_ftp(&self) -> String {
+        format!(
+            "{:04}{:02}{:02}{:02}{:02}{:02}",
+            self.year, self.month, self.day, self.hour, self.minute, self.second
+        )
+    }
+
+    /// Parses `YYYYMMDDHHMMSS` as used in FTP commands. Fractional seconds
+    /// after a dot are ignored.
+    pub fn parse_ftp(value: &str) -> Option<Self> {
+        let digits = value.split_once('.').map_or(value, |(digits, _)| digits);
+        if digits.len() != 14 || !digits.bytes().all(|b| b.is_ascii_digit()) {
+            return None;
+        }
+        let field = |start: usize, end: usize| digits[start..end].parse::<u32>().ok();
+        let date = DateTime {
+            year: i64::from(field(0, 4)?),
+            month: field(4, 6)?,
+            day: field(6, 8)?,
+            hour: field(8, 10)?,
+            minute: field(10, 12)?,
+            second: field(12, 14)?,
+        };
+        // Out of range fields do not survive the round trip.
+        let valid = (1..=12).contains(&date.month) && Self::from_unix(date.to_unix()) == date;
+        valid.then_some(date)
+    }
+
+    /// Parses `YYYY-MM-DD HH:MM:SS` or just `YYYY-MM-DD`, which is midnight.
+    pub fn parse_readable(value: &str) -> Option<Self> {
+        let (date, time) = value
+            .trim()
+            .split_once(' ')
+            .unwrap_or((value.trim(), "00:00:00"));
+        let mut date = date.splitn(3, '-');
+        let mut time = time.splitn(3, ':');
+        let field = |parts: &mut std::str::SplitN<'_, char>, width: usize| {
+            parts
+                .next()
+                .filter(|p| p.len() == width && p.bytes().all(|b| b.is_ascii_digit()))
+                .and_then(|p| p.parse::<u32>().ok())
+        };
+        let parsed = DateTime {
+            year: i64::from(field(&mut date, 4)?),
+            month: field(&mut date, 2)?,
+            day: field(&mut date, 2)?,
+            hour: field(&mut time, 2)?,
+            minute: field(&mut time, 2)?,
+            second: field(&mut time, 2)?,
+        };
+        let valid = (1..=12).contains(&parsed.month) && Self::from_unix(parsed.to_unix()) == parsed;
+        valid.then_some(parsed)
+    }
+
+    /// Formats the date as `YYYY-MM-DD HH:MM:SS`.
+    pub fn to_readable(&self) -> String {
+        format!(
+            "{:04}-{:02}-{:02} {:02}:{:02}:{:02}",
+            self.year, self.month, self.day, self.hour, self.minute, self.second
+        )
+    }
+}
+
+impl Serialize for DateTime {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.serialize_str(&self.to_readable())
+    }
+}
+
+impl<'de> Deserialize<'de> for DateTime {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        let value = String::deserialize(deserializer)?;
+        DateTime::parse_readable(&value).ok_or_else(|| {
+            de::Error::custom(format!(
+                "bad date {value}, expected YYYY-MM-DD or YYYY-MM-DD HH:MM:SS"
+            ))
+        })
+    }
+}
+
+/// Seconds since the Unix epoch.
+pub fn unix_now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
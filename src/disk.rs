@@ -0,0 +1,286 @@
+use std::{
+    collections::HashMap,
+    io,
+    path::{Path, PathBuf},
+    sync::Mutex,
+    time::{Duration, Instant},
+};
+
+use serde::Deserialize;
+
+/// How long the usage of a root is trusted before it is walked again, to
+/// notice changes made outside of the server.
+const USAGE_TTL: Duration = Duration::from_secs(300);
+
+/// Space information about the volume that holds a path.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct DiskSpace {
+    pub total: u64,
+    /// Space available to the server, without blocks reserved for root.
+    pub free: u64,
+    pub used: u64,
+}
+
+/// Minimum amount of free space that must be kept on the volume.
+///
+/// Can be written in config as a plain number of bytes (`1073741824`),
+/// a size with a suffix (`512M`, `10G`) or a percentage (`5%`).
+#[derive(Debug, Deserialize, Clone, Copy, PartialEq)]
+#[serde(try_from = "String")]
+pub enum SpaceThreshold {
+    Bytes(u64),
+    Percent(f64),
+}
+
+impl SpaceThreshold {
+    /// Checks if the volume still has enough free space left.
+    pub fn is_satisfied(&self, space: &DiskSpace) -> bool {
+        match self {
+            SpaceThreshold::Bytes(bytes) => space.free >= *bytes,
+            SpaceThreshold::Percent(percent) => {
+                if space.total == 0 {
+                    return true;
+                }
+                (space.free as f64 / space.total as f64) * 100.0 >= *percent
+            }
+        }
+    }
+}
+
+impl TryFrom<String> for SpaceThreshold {
+    type Error = String;
+
+    fn try_from(value: String) -> Result<Self, Self::Error> {
+        let value = value.trim();
+        if let Some(percent) = value.strip_suffix('%') {
+            let percent = percent
+                .trim()
+                .parse::<f64>()
+                .map_err(|_| format!("invalid percentage: {value}"))?;
+            if !(0.0..=100.0).contains(&percent) {
+                return Err(format!("percentage out of range: {value}"));
+            }
+            return Ok(SpaceThreshold::Percent(percent));
+        }
+
+        parse_size(value)
+            .map(SpaceThreshold::Bytes)
+            .ok_or_else(|| format!("invalid size: {value}"))
+    }
+}
+
+/// Parses a size like `1024`, `512K`, `10M`, `2G` or `1T` into bytes.
+pub fn parse_size(value: &str) -> Option<u64> {
+    let value = value.trim();
+    let upper = value.to_ascii_uppercase();
+    let trimmed = upper.trim_end_matches('B');
+    let (number, multiplier) = match trimmed.chars().last()? {
+        'K' => (&trimmed[..trimmed.len() - 1], 1u64 << 10),
+        'M' => (&trimmed[..trimmed.len() - 1], 1u64 << 20),
+        'G' => (&trimmed[..trimmed.len() - 1], 1u64 << 30),
+        'T' => (&trimmed[..trimmed.len() - 1], 1u64 << 40),
+        _ => (trimmed, 1),
+    };
+    number.trim().parse::<u64>().ok()?.checked_mul(multiplier)
+}
+
+/// Returns space information of the volume that holds the given path.
+#[cfg(unix)]
+#[allow(clippy::unnecessary_cast)] // `statvfs` field types differ between platforms.
+pub fn disk_space(path: &Path) -> io::Result<DiskSpace> {
+    use std::{ffi::CString, mem::MaybeUninit, os::unix::ffi::OsStrExt};
+
+    let c_path = CString::new(path.as_os_str().as_bytes())
+        .map_err(|_| io::Error::new(io::ErrorKind::InvalidInput, "path contains nul byte"))?;
+    let mut stat = MaybeUninit::<libc::statvfs>::uninit();
+
+    // SAFETY: `c_path` is a valid nul-terminated string and `stat` points to
+    // writable memory large enough for `statvfs`.
+    let result = unsafe { libc::statvfs(c_path.as_ptr(), stat.as_mut_ptr()) };
+    if result != 0 {
+        return Err(io::Error::last_os_error());
+    }
+
+    // SAFETY: `statvfs` returned successfully, so the struct is initialized.
+    let stat = unsafe { stat.assume_init() };
+    let block_size = stat.f_frsize as u64;
+    Ok(DiskSpace {
+        total: stat.f_blocks as u64 * block_size,
+        free: stat.f_bavail as u64 * block_size,
+        used: (stat.f_blocks as u64).saturating_sub(stat.f_bfree as u64) * block_size,
+    })
+}
+
+/// Returns space information of the volume that holds the given path.
+#[cfg(windows)]
+pub fn disk_space(path: &Path) -> io::Result<DiskSpace> {
+    use std::os::windows::ffi::OsStrExt;
+    use windows_sys::Win32::Storage::FileSystem::GetDiskFreeSpaceExW;
+
+    let wide: Vec<u16> = path.as_os_str().encode_wide().chain(Some(0)).collect();
+    let mut free_to_caller = 0u64;
+    let mut total = 0u64;
+    let mut total_free = 0u64;
+
+    // SAFETY: `wide` is a valid nul-terminated wide string and output
+    // pointers reference live stack variables.
+    let result = unsafe {
+        GetDiskFreeSpaceExW(
+            wide.as_ptr(),
+            &mut free_to_caller,
+            &mut total,
+            &mut total_free,
+        )
+    };
+    if result == 0 {
+        return Err(io::Error::last_os_error());
+    }
+
+    Ok(DiskSpace {
+        total,
+        free: free_to_caller,
+        used: total.saturating_sub(total_free),
+    })
+}
+
+/// Reserves `len` bytes of disk space for the file after `offset` without
+/// changing its size.
+#[cfg(target_os = "linux")]
+pub fn preallocate(file: &impl std::os::fd::AsRawFd, offset: u64, len: u64) -> io::Result<()> {
+    // SAFETY: the descriptor belongs to `file`, which is borrowed for the
+    // whole call.
+    let result = unsafe {
+        libc::fallocate(
+            file.as_raw_fd(),
+            libc::FALLOC_FL_KEEP_SIZE,
+            offset as libc::off_t,
+            len as libc::off_t,
+        )
+    };
+    if result != 0 {
+        return Err(io::Error::last_os_error());
+    }
+    Ok(())
+}
+
+/// Reserves `len` bytes of disk space for the file after `offset` without
+/// changing its size.
+#[cfg(not(target_os = "linux"))]
+pub fn preallocate<T>(_file: &T, _offset: u64, _len: u64) -> io::Result<()> {
+    Ok(())
+}
+
+/// Total size and number of files under a directory.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct DirectoryUsage {
+    pub bytes: u64,
+    pub files: u64,
+}
+
+/// Returns the size and the number of files under the directory.
+/// Unreadable entries are skipped and symlinks are not followed.
+pub async fn directory_usage(path: &Path) -> DirectoryUsage {
+    let path = path.to_path_buf();
+    tokio::task::spawn_blocking(move || {
+        let mut usage = DirectoryUsage::default();
+        let mut pending = vec![path];
+        while let Some(dir) = pending.pop() {
+            let Ok(entries) = std::fs::read_dir(&dir) else {
+                continue;
+            };
+            for entry in entries.flatten() {
+                match entry.metadata() {
+                    Ok(metadata) if metadata.is_dir() => pending.push(entry.path()),
+                    Ok(metadata) => {
+                        usage.bytes += metadata.len();
+                        usage.files += 1;
+                    }
+                    Err(_) => {}
+                }
+            }
+        }
+        usage
+    })
+    .await
+    .unwrap_or_default()
+}
+
+/// Usage of user roots, so quotas do not walk the whole tree on every
+/// upload. Uploads and deletions adjust the usage, other changes make the
+/// root be walked again on the next use.
+#[derive(Debug, Default)]
+pub struct UsageCache {
+    entries: Mutex<HashMap<PathBuf, (DirectoryUsage, Instant)>>,
+}
+
+impl UsageCache {
+    /// Returns the usage of the root, walking it if it is not cached.
+    pub async fn get(&self, root: &Path) -> DirectoryUsage {
+        if let Some((usage, walked)) = self.entries.lock().unwrap().get(root)
+            && walked.elapsed() < USAGE_TTL
+        {
+            return *usage;
+        }
+        let usage = directory_usage(root).await;
+        self.entries
+            .lock()
+            .unwrap()
+            .insert(root.to_path_buf(), (usage, Instant::now()));
+        usage
+    }
+
+    /// Applies a change of `bytes` and `files` at the path to the cached
+    /// usage of every root that holds it.
+    pub fn adjust(&self, path: &Path, bytes: i64, files: i64) {
+        for (root, (usage, _)) in self.entries.lock().unwrap().iter_mut() {
+            if path.starts_with(root) {
+                usage.bytes = usage.bytes.saturating_add_signed(bytes);
+                usage.files = usage.files.saturating_add_signed(files);
+            }
+        }
+    }
+
+    /// Drops the usage of every root that holds the path, after a change
+    /// that is not worth working out.
+    pub fn changed(&self, path: &Path) {
+        self.entries
+            .lock()
+            .unwrap()
+            .retain(|root, _| !path.starts_with(root));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn usage_is_cached_until_changed() {
+        let root = std::env::temp_dir().join(format!("dock-usage-{}", cuid2::cuid()));
+        std::fs::create_dir_all(root.join("dir")).unwrap();
+        std::fs::write(root.join("dir/file"), b"12345").unwrap();
+        let cache = UsageCache::default();
+
+        let usage = cache.get(&root).await;
+        assert_eq!((usage.bytes, usage.files), (5, 1));
+
+        // Files written behind the cache are not seen until told.
+        std::fs::write(root.join("other"), b"123").unwrap();
+        assert_eq!(cache.get(&root).await.bytes, 5);
+        cache.adjust(&root.join("other"), 3, 1);
+        let usage = cache.get(&root).await;
+        assert_eq!((usage.bytes, usage.files), (8, 2));
+
+        std::fs::remove_file(root.join("dir/file")).unwrap();
+        cache.changed(&std::env::temp_dir().join("dock-usage-elsewhere"));
+        assert_eq!(cache.get(&root).await.bytes, 8);
+        cache.changed(&root.join("dir/file"));
+        let usage = cache.get(&root).await;
+        assert_eq!((usage.bytes, usage.files), (3, 1));
+        // Usage never drops below zero.
+        cache.adjust(&root.join("other"), -10, -10);
+        assert_eq!(cache.get(&root).await.bytes, 0);
+
+        std::fs::remove_dir_all(&root).unwrap();
+    }
+}
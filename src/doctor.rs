@@ -0,0 +1,487 @@
+//! Self-test for common misconfigurations, run with `dock doctor`.
+
+use std::{
+    fmt, fs,
+    net::{IpAddr, SocketAddr, TcpListener, TcpStream, ToSocketAddrs},
+    path::Path,
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
+
+use crate::{
+    config::Config, datetime::DateTime, disk, gateway::GatewayConfig, htpasswd, ldap::LdapConfig,
+    password, user_db::UserDb, users,
+};
+
+/// Clocks before this are certainly wrong (2024-01-01).
+const EARLIEST_SANE_TIME: u64 = 1_704_067_200;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Status {
+    Ok,
+    Warning,
+    Failure,
+}
+
+impl fmt::Display for Status {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.pad(match self {
+            Status::Ok => "ok",
+            Status::Warning => "warn",
+            Status::Failure => "FAIL",
+        })
+    }
+}
+
+#[derive(Debug)]
+pub struct Check {
+    pub status: Status,
+    pub message: String,
+    /// What to do about a warning or failure.
+    pub fix: Option<String>,
+}
+
+impl Check {
+    fn ok(message: impl Into<String>) -> Self {
+        Check {
+            status: Status::Ok,
+            message: message.into(),
+            fix: None,
+        }
+    }
+
+    fn warning(message: impl Into<String>, fix: impl Into<String>) -> Self {
+        Check {
+            status: Status::Warning,
+            message: message.into(),
+            fix: Some(fix.into()),
+        }
+    }
+
+    fn failure(message: impl Into<String>, fix: impl Into<String>) -> Self {
+        Check {
+            status: Status::Failure,
+            message: message.into(),
+            fix: Some(fix.into()),
+        }
+    }
+}
+
+/// Runs every check against the config.
+pub fn run(config: &Config) -> Vec<Check> {
+    let mut checks = vec![check_clock()];
+    for instance in config.instances() {
+        let name = instance.tenant.as_deref().unwrap_or("server").to_string();
+        checks.push(check_address(&name, &instance.address));
+        if let Some(address) = instance
+            .tls
+            .as_ref()
+            .and_then(|t| t.implicit_address.as_ref())
+        {
+            checks.push(check_address(&name, address));
+        }
+        checks.push(check_passive_address(&name, &instance));
+        checks.extend(check_root(&name, Path::new(&instance.root), &instance));
+        for user in &instance.users {
+            if let Some(template) = &user.root {
+                let name = format!("user {}", user.name);
+                let root = match users::expand_root(template, &user.name, DateTime::now()) {
+                    Ok(root) => root,
+                    Err(e) => {
+                        checks.push(Check::failure(
+                            format!("{name}: {e}"),
+                            "rename the user or take %u out of its root",
+                        ));
+                        continue;
+                    }
+                };
+                if instance.create_user_roots && !Path::new(&root).exists() {
+                    checks.push(Check::ok(format!(
+                        "{name}: root {root} will be created at login"
+                    )));
+                } else {
+                    checks.extend(check_root(&name, Path::new(&root), &instance));
+                }
+            }
+        }
+        let plaintext: Vec<_> = instance
+            .users
+            .iter()
+            .filter(|user| password::Scheme::of(&user.password) == password::Scheme::Plaintext)
+            .map(|user| user.name.as_str())
+            .collect();
+        if !plaintext.is_empty() {
+            checks.push(Check::warning(
+                format!(
+                    "{name}: users {} have plaintext passwords",
+                    plaintext.join(", ")
+                ),
+                "replace them with argon2id or bcrypt hashes, plaintext passwords are deprecated",
+            ));
+        }
+    }
+    checks.push(check_passive_ports(config));
+    if config.sandbox {
+        let conflicts = config.sandbox_conflicts();
+        checks.push(if conflicts.is_empty() {
+            Check::ok("sandbox has no settings that run programs")
+        } else {
+            Check::failure(
+                format!(
+                    "sandbox can not be used with {}, they run programs",
+                    conflicts.join(", ")
+                ),
+                "turn off the sandbox or remove these settings",
+            )
+        });
+    }
+    for path in config.state_files() {
+        checks.push(check_state_file(&config.outside_chroot(&path)));
+    }
+    if let Some(quarantine) = &config.quarantine {
+        checks.push(check_writable_dir(
+            "quarantine directory",
+            &config.outside_chroot(Path::new(&quarantine.dir)),
+        ));
+    }
+    if let Some(tls) = &config.tls {
+        let (cert_file, _) = tls.certificate_files();
+        checks.push(match crate::tls::Tls::load(tls) {
+            Ok(_) if !cert_file.exists() => Check::ok(format!(
+                "TLS certificate {} will be obtained with ACME",
+                cert_file.display()
+            )),
+            Ok(_) => Check::ok(format!("TLS certificate {} loads", cert_file.display())),
+            Err(e) => Check::failure(
+                format!("TLS cannot be set up: {e}"),
+                "check the files and the settings of the tls section",
+            ),
+        });
+        if let Some(acme) = &tls.acme {
+            checks.push(check_writable_dir(
+                "ACME cache directory",
+                Path::new(&acme.cache_dir),
+            ));
+            checks.push(check_address("ACME challenges", &acme.http_address));
+        }
+    }
+    if let Some(pam) = &config.pam {
+        let rules = Path::new("/etc/pam.d").join(&pam.service);
+        checks.push(if !crate::pam::is_supported() {
+            Check::failure(
+                "PAM is configured, but Dock was built without it",
+                "build Dock with --features pam",
+            )
+        } else if rules.exists() {
+            Check::ok(format!("PAM service {} is set up", pam.service))
+        } else {
+            Check::warning(
+                format!("PAM service {} has no rules in /etc/pam.d", pam.service),
+                format!(
+                    "create {} or PAM uses the rules of the other service",
+                    rules.display()
+                ),
+            )
+        });
+    }
+    checks.extend(check_backends(config));
+    // Tenants that bring their own backends or recordings get them checked
+    // as well.
+    for (tenant, instance) in config.tenants.iter().zip(config.instances()) {
+        checks.extend(check_backends(&Config {
+            htpasswd: tenant.htpasswd.clone(),
+            ldap: tenant.ldap.clone(),
+            user_db: tenant.user_db.clone(),
+            external_auth: tenant.external_auth.clone(),
+            record_dir: tenant.record_dir.clone(),
+            ..instance
+        }));
+    }
+    if let Some(gateway) = &config.gateway {
+        checks.push(check_gateway(gateway));
+        if let Some(cache) = &gateway.cache {
+            checks.push(check_writable_dir(
+                "storage cache directory",
+                &config.outside_chroot(Path::new(&cache.dir)),
+            ));
+        }
+    }
+    if let Some(geoip) = &config.geoip {
+        checks.push(match crate::geoip::GeoIp::open(&geoip.database) {
+            Ok(_) => Check::ok(format!("GeoIP database {} opens", geoip.database)),
+            Err(e) => Check::failure(
+                format!("GeoIP database {} cannot be opened: {e}", geoip.database),
+                "point geoip.database to a MaxMind country database",
+            ),
+        });
+    }
+    checks
+}
+
+/// Checks the backends and the recording directory of the config.
+fn check_backends(config: &Config) -> Vec<Check> {
+    let mut checks = Vec::new();
+    if let Some(dir) = &config.record_dir {
+        checks.push(check_writable_dir(
+            "recording directory",
+            &config.outside_chroot(Path::new(dir)),
+        ));
+    }
+    if let Some(htpasswd) = &config.htpasswd {
+        let path = config.outside_chroot(Path::new(&htpasswd.file));
+        checks.push(
+            match fs::read_to_string(&path)
+                .map_err(|e| e.to_string())
+                .and_then(|content| htpasswd::parse(&content).map_err(|e| e.to_string()))
+            {
+                Ok(entries) => Check::ok(format!(
+                    "htpasswd file {} has {} users",
+                    path.display(),
+                    entries.len()
+                )),
+                Err(e) => Check::failure(
+                    format!("htpasswd file {} cannot be read: {e}", path.display()),
+                    "point htpasswd.file to a file written by htpasswd",
+                ),
+            },
+        );
+    }
+    if let Some(user_db) = &config.user_db {
+        let path = config.outside_chroot(Path::new(&user_db.file));
+        checks.push(match UserDb::open(user_db, &path) {
+            Ok(_) => Check::ok(format!("user database {} opens", path.display())),
+            Err(e) => Check::failure(
+                format!("user database cannot be used: {e}"),
+                "check user_db.file and user_db.query",
+            ),
+        });
+    }
+    if let Some(command) = config
+        .external_auth
+        .as_ref()
+        .and_then(|e| e.command.as_ref())
+    {
+        checks.push(if Path::new(command).is_file() {
+            Check::ok(format!("external auth program {command} exists"))
+        } else {
+            Check::failure(
+                format!("external auth program {command} does not exist"),
+                "point external_auth.command to an executable",
+            )
+        });
+    }
+    if let Some(ldap) = &config.ldap {
+        checks.push(check_ldap(ldap));
+    }
+    checks
+}
+
+/// Only checks that the server accepts connections, binding needs the
+/// password of a user.
+fn check_ldap(ldap: &LdapConfig) -> Check {
+    let Some(address) = ldap.address() else {
+        return Check::failure(
+            format!("LDAP server {} is not a valid URL", ldap.url),
+            "set ldap.url like ldaps://ldap.example.com",
+        );
+    };
+    let reachable = address.to_socket_addrs().is_ok_and(|mut addrs| {
+        addrs.any(|addr| TcpStream::connect_timeout(&addr, Duration::from_secs(5)).is_ok())
+    });
+    if reachable {
+        Check::ok(format!("LDAP server {address} accepts connections"))
+    } else {
+        Check::failure(
+            format!("LDAP server {address} cannot be reached"),
+            "check ldap.url and the firewall",
+        )
+    }
+}
+
+fn check_gateway(gateway: &GatewayConfig) -> Check {
+    let reachable = gateway.address.to_socket_addrs().is_ok_and(|mut addrs| {
+        addrs.any(|addr| TcpStream::connect_timeout(&addr, Duration::from_secs(5)).is_ok())
+    });
+    if reachable {
+        Check::ok(format!(
+            "upstream FTP server {} accepts connections",
+            gateway.address
+        ))
+    } else {
+        Check::failure(
+            format!("upstream FTP server {} cannot be reached", gateway.address),
+            "check gateway.address and the firewall",
+        )
+    }
+}
+
+fn check_clock() -> Check {
+    let now = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or(Duration::ZERO)
+        .as_secs();
+    let readable = DateTime::from_unix(now as i64).to_readable();
+    if now < EARLIEST_SANE_TIME {
+        Check::failure(
+            format!("system clock is at {readable} UTC, which is in the past"),
+            "synchronize the clock with NTP, timestamps in listings and MDTM depend on it",
+        )
+    } else {
+        Check::ok(format!("system clock is at {readable} UTC"))
+    }
+}
+
+fn check_address(name: &str, address: &str) -> Check {
+    let Ok(addr) = address.parse::<SocketAddr>() else {
+        return Check::failure(
+            format!("{name}: address {address} is not an IP address with a port"),
+            "write the address like 0.0.0.0:21",
+        );
+    };
+    match TcpListener::bind(addr) {
+        Ok(_) => Check::ok(format!("{name}: {address} can be bound")),
+        Err(e) if e.kind() == std::io::ErrorKind::AddrInUse => Check::warning(
+            format!("{name}: {address} is already in use"),
+            "this is expected if Dock is running, otherwise stop whatever listens there",
+        ),
+        Err(e) if e.kind() == std::io::ErrorKind::PermissionDenied => Check::failure(
+            format!("{name}: not allowed to bind {address}"),
+            "start as root and use run_as, or grant CAP_NET_BIND_SERVICE for ports below 1024",
+        ),
+        Err(e) => Check::failure(
+            format!("{name}: {address} cannot be bound: {e}"),
+            "use an address that belongs to this machine",
+        ),
+    }
+}
+
+/// Passive replies advertise the local address of the control connection,
+/// which clients behind other networks cannot reach if it is private.
+fn check_passive_address(name: &str, config: &Config) -> Check {
+    if let Some(ip) = config.passive.address {
+        return Check::ok(format!("{name}: passive replies advertise {ip}"));
+    }
+    let Ok(addr) = config.address.parse::<SocketAddr>() else {
+        return Check::ok(format!("{name}: passive address is not checked"));
+    };
+    let private = match addr.ip() {
+        IpAddr::V4(ip) => ip.is_private() || ip.is_loopback() || ip.is_link_local(),
+        IpAddr::V6(ip) => ip.is_loopback() || ip.is_unique_local() || ip.is_unicast_link_local(),
+    };
+    if addr.ip().is_unspecified() {
+        Check::warning(
+            format!(
+                "{name}: passive replies advertise whichever local address a client connected to"
+            ),
+            "behind NAT, set passive.address to the public address",
+        )
+    } else if private {
+        Check::warning(
+            format!(
+                "{name}: passive replies advertise {}, which is not reachable from the internet",
+                addr.ip()
+            ),
+            "set passive.address if clients connect from outside this network",
+        )
+    } else {
+        Check::ok(format!("{name}: passive replies advertise {}", addr.ip()))
+    }
+}
+
+/// Passive listeners use the configured range or ports picked by the system.
+fn check_passive_ports(config: &Config) -> Check {
+    if let Some(range) = config.passive.ports {
+        return Check::warning(
+            format!("passive mode uses ports {}-{}", range.first, range.last),
+            "allow incoming connections to this range in the firewall",
+        );
+    }
+    let range = fs::read_to_string("/proc/sys/net/ipv4/ip_local_port_range")
+        .ok()
+        .map(|r| r.split_whitespace().collect::<Vec<_>>().join("-"));
+    match range {
+        Some(range) => Check::warning(
+            format!("passive mode uses ephemeral ports {range}"),
+            "allow incoming connections to this range in the firewall",
+        ),
+        None => Check::warning(
+            "passive mode uses ephemeral ports picked by the system",
+            "allow incoming connections to the ephemeral port range in the firewall",
+        ),
+    }
+}
+
+fn check_root(name: &str, root: &Path, config: &Config) -> Vec<Check> {
+    let label = format!("{name}: root {}", root.display());
+    let metadata = match fs::metadata(root) {
+        Ok(m) if m.is_dir() => m,
+        Ok(_) => {
+            return vec![Check::failure(
+                format!("{label} is not a directory"),
+                "point root to a directory",
+            )];
+        }
+        Err(e) => {
+            return vec![Check::failure(
+                format!("{label} cannot be accessed: {e}"),
+                "create the directory or fix its permissions",
+            )];
+        }
+    };
+
+    let mut checks = vec![check_writable_dir(&label, root)];
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+
+        if metadata.permissions().mode() & 0o002 != 0 {
+            checks.push(Check::warning(
+                format!("{label} is writable by everyone"),
+                format!("chmod o-w {}", root.display()),
+            ));
+        }
+    }
+    #[cfg(not(unix))]
+    let _ = metadata;
+
+    if let Some(threshold) = config.min_free_space {
+        checks.push(match disk::disk_space(root) {
+            Ok(space) if threshold.is_satisfied(&space) => {
+                Check::ok(format!("{label} has {} bytes free", space.free))
+            }
+            Ok(space) => Check::failure(
+                format!(
+                    "{label} has only {} bytes free, uploads will be refused",
+                    space.free
+                ),
+                "free up space or lower min_free_space",
+            ),
+            Err(e) => Check::warning(
+                format!("free space of {label} is unknown: {e}"),
+                "uploads are not checked against min_free_space",
+            ),
+        });
+    }
+    checks
+}
+
+fn check_writable_dir(label: &str, dir: &Path) -> Check {
+    let probe = dir.join(format!(".dock-doctor-{}", std::process::id()));
+    match fs::write(&probe, b"") {
+        Ok(()) => {
+            let _ = fs::remove_file(&probe);
+            Check::ok(format!("{label} is writable"))
+        }
+        Err(e) => Check::failure(
+            format!("{label} is not writable: {e}"),
+            "give the user Dock runs as write access",
+        ),
+    }
+}
+
+fn check_state_file(path: &Path) -> Check {
+    let dir = match path.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir,
+        _ => Path::new("."),
+    };
+    check_writable_dir(&format!("directory of {}", path.display()), dir)
+}
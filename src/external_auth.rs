@@ -0,0 +1,175 @@
+//! Login decided by an external service, so any identity system can be
+//! plugged in.
+//!
+//! The credentials are sent as JSON, either in a POST request to a webhook or
+//! on the standard input of a program. The answer allows or denies the login
+//! and may set the root and permissions of the user.
+
+use std::{net::IpAddr, process::Stdio, time::Duration};
+
+use anyhow::{Result, anyhow, bail};
+use serde::{Deserialize, Serialize};
+use tokio::{io::AsyncWriteExt, process::Command, time};
+
+use crate::{
+    config::{Permissions, User},
+    limits::Limits,
+};
+
+fn default_timeout_secs() -> u64 {
+    10
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct ExternalAuthConfig {
+    /// Webhook the credentials are posted to. A 2xx reply with the answer as
+    /// JSON is expected, other replies deny the login.
+    #[serde(default)]
+    pub url: Option<String>,
+    /// Program that reads the credentials from its standard input and
+    /// writes the answer to its standard output. Exiting with anything but
+    /// 0 denies the login. Either this or `url` is required.
+    #[serde(default)]
+    pub command: Option<String>,
+    /// Permissions of users the answer has none for.
+    pub permissions: Permissions,
+    /// Root of users the answer has none for, see
+    /// [`crate::users::expand_root`]. Defaults to the root of the server.
+    #[serde(default)]
+    pub root: Option<String>,
+    /// Group whose limits apply to the users.
+    #[serde(default)]
+    pub group: Option<String>,
+    /// Time the webhook or program gets to answer.
+    #[serde(default = "default_timeout_secs")]
+    pub timeout_secs: u64,
+}
+
+impl ExternalAuthConfig {
+    /// Checks that there is exactly one way to ask.
+    pub fn validate(&self) -> Result<()> {
+        match (&self.url, &self.command) {
+            (Some(_), Some(_)) => bail!("external_auth needs either url or command, not both"),
+            (None, None) => bail!("external_auth needs url or command"),
+            _ => Ok(()),
+        }
+    }
+
+    fn timeout(&self) -> Duration {
+        Duration::from_secs(self.timeout_secs)
+    }
+}
+
+#[derive(Debug, Serialize)]
+struct Request<'a> {
+    user: &'a str,
+    password: &'a str,
+    ip: Option<IpAddr>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Answer {
+    allow: bool,
+    #[serde(default)]
+    root: Option<String>,
+    #[serde(default)]
+    permissions: Option<Permissions>,
+}
+
+/// Asks the webhook or program whether the user may log in.
+pub async fn authenticate(
+    config: &ExternalAuthConfig,
+    username: &str,
+    password: &str,
+    ip: Option<IpAddr>,
+) -> Result<User> {
+    let request = Request {
+        user: username,
+        password,
+        ip,
+    };
+    let answer = match (&config.url, &config.command) {
+        (Some(url), _) => ask_webhook(config, url, &request).await?,
+        (None, Some(command)) => ask_program(config, command, &request).await?,
+        (None, None) => bail!("external_auth needs url or command"),
+    };
+    if !answer.allow {
+        bail!("denied");
+    }
+
+    Ok(User {
+        name: username.to_string(),
+        // Never matches a password, the external service checks them.
+        password: String::new(),
+        permissions: answer
+            .permissions
+            .unwrap_or_else(|| config.permissions.clone()),
+        countries: None,
+        hostnames: None,
+        client_certificates: Vec::new(),
+        root: answer.root.or_else(|| config.root.clone()),
+        quota: None,
+        file_quota: None,
+        transfer_quota: None,
+        enabled: true,
+        expires_at: None,
+        group: config.group.clone(),
+        limits: Limits::default(),
+    })
+}
+
+async fn ask_webhook(
+    config: &ExternalAuthConfig,
+    url: &str,
+    request: &Request<'_>,
+) -> Result<Answer> {
+    let response = reqwest::Client::builder()
+        .timeout(config.timeout())
+        .build()?
+        .post(url)
+        .json(request)
+        .send()
+        .await
+        .map_err(|e| anyhow!("webhook failed: {e}"))?;
+    if !response.status().is_success() {
+        bail!("webhook replied {}", response.status());
+    }
+    response
+        .json()
+        .await
+        .map_err(|e| anyhow!("bad answer of webhook: {e}"))
+}
+
+async fn ask_program(
+    config: &ExternalAuthConfig,
+    command: &str,
+    request: &Request<'_>,
+) -> Result<Answer> {
+    let mut child = Command::new(command)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .kill_on_drop(true)
+        .spawn()
+        .map_err(|e| anyhow!("failed to run {command}: {e}"))?;
+    // The password is passed on the standard input, where other users can
+    // not see it like they could see arguments.
+    let mut input = serde_json::to_vec(request)?;
+    input.push(b'\n');
+    let mut stdin = child
+        .stdin
+        .take()
+        .ok_or_else(|| anyhow!("failed to write to {command}"))?;
+
+    let output = time::timeout(config.timeout(), async move {
+        stdin.write_all(&input).await?;
+        drop(stdin);
+        child.wait_with_output().await
+    })
+    .await
+    .map_err(|_| anyhow!("{command} timed out"))??;
+    if !output.status.success() {
+        bail!("{command} exited with {}", output.status);
+    }
+    serde_json::from_slice(&output.stdout).map_err(|e| anyhow!("bad answer of {command}: {e}"))
+}
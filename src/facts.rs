@@ -0,0 +1,211 @@
+//! Machine-readable facts for MLST and MLSD (RFC 3659).
+
+use std::{fs::Metadata, path::Path};
+
+use crate::datetime::DateTime;
+
+/// What the configured permissions allow the user to do.
+#[derive(Debug, Clone, Copy)]
+pub struct UserAccess {
+    pub read: bool,
+    pub write: bool,
+}
+
+/// Access the server process itself has to a path.
+#[derive(Debug, Clone, Copy, Default)]
+struct FileAccess {
+    read: bool,
+    write: bool,
+    execute: bool,
+}
+
+#[cfg(unix)]
+fn file_access(path: &Path) -> FileAccess {
+    use std::{ffi::CString, os::unix::ffi::OsStrExt};
+
+    let Ok(c_path) = CString::new(path.as_os_str().as_bytes()) else {
+        return FileAccess::default();
+    };
+    // SAFETY: `c_path` is a valid nul-terminated string.
+    let check = |mode| unsafe { libc::access(c_path.as_ptr(), mode) == 0 };
+    FileAccess {
+        read: check(libc::R_OK),
+        write: check(libc::W_OK),
+        execute: check(libc::X_OK),
+    }
+}
+
+#[cfg(not(unix))]
+fn file_access(path: &Path) -> FileAccess {
+    match std::fs::metadata(path) {
+        Ok(metadata) => FileAccess {
+            read: true,
+            write: !metadata.permissions().readonly(),
+            execute: true,
+        },
+        Err(_) => FileAccess::default(),
+    }
+}
+
+/// Computes the `perm` fact from the file mode and the user's permissions.
+pub fn perm_fact(path: &Path, metadata: &Metadata, user: UserAccess) -> String {
+    let own = file_access(path);
+    let parent_writable = path.parent().map(|p| file_access(p).write).unwrap_or(false);
+    let mut perm = String::new();
+
+    if metadata.is_dir() {
+        if user.write && own.write {
+            perm.push('c');
+        }
+        if user.write && parent_writable {
+            perm.push('d');
+        }
+        if own.execute {
+            perm.push('e');
+        }
+        if user.write && parent_writable {
+            perm.push('f');
+        }
+        if user.read && own.read {
+            perm.push('l');
+        }
+        if user.write && own.write {
+            perm.push('m');
+            perm.push('p');
+        }
+    } else {
+        if user.write && own.write {
+            perm.push('a');
+        }
+        if user.write && parent_writable {
+            perm.push('d');
+            perm.push('f');
+        }
+        if user.read && own.read {
+            perm.push('r');
+        }
+        if user.write && own.write {
+            perm.push('w');
+        }
+    }
+
+    perm
+}
+
+/// Facts sent by MLST and MLSD. The unique fact is only known on Unix.
+pub fn supported() -> Vec<&'static str> {
+    let mut facts = vec!["type", "size", "modify", "perm"];
+    if cfg!(unix) {
+        facts.push("unique");
+    }
+    facts
+}
+
+/// FEAT line of MLST, with the facts that are sent marked by `*`.
+pub fn feature(selected: &[&str]) -> String {
+    let facts: String = supported()
+        .iter()
+        .map(|f| {
+            if selected.contains(f) {
+                format!("{f}*;")
+            } else {
+                format!("{f};")
+            }
+        })
+        .collect();
+    format!("MLST {facts}")
+}
+
+/// Parses the facts requested with `OPTS MLST`, like `type;size;`. Facts
+/// that are not supported are left out, as RFC 3659 asks.
+pub fn parse_selection(value: &str) -> Vec<&'static str> {
+    let requested: Vec<&str> = value.split(';').map(str::trim).collect();
+    supported()
+        .into_iter()
+        .filter(|f| requested.iter().any(|r| r.eq_ignore_ascii_case(f)))
+        .collect()
+}
+
+/// Formats the selected facts followed by the name.
+fn format_selected(facts: &[(&str, String)], selected: &[&str], name: &str) -> String {
+    let facts: String = facts
+        .iter()
+        .filter(|(fact, _)| selected.contains(fact))
+        .map(|(fact, value)| format!("{fact}={value};"))
+        .collect();
+    format!("{facts} {name}")
+}
+
+/// Identifies the file on the server, so clients can tell hard links and
+/// symbolic links apart from copies.
+#[cfg(unix)]
+fn unique_fact(metadata: &Metadata) -> Option<String> {
+    use std::os::unix::fs::MetadataExt;
+
+    Some(format!("{:x}g{:x}", metadata.dev(), metadata.ino()))
+}
+
+#[cfg(not(unix))]
+fn unique_fact(_metadata: &Metadata) -> Option<String> {
+    None
+}
+
+fn format_with_type(
+    kind: &str,
+    path: &Path,
+    metadata: &Metadata,
+    user: UserAccess,
+    name: &str,
+    selected: &[&str],
+) -> String {
+    let modified = metadata
+        .modified()
+        .ok()
+        .and_then(|t| t.duration_since(std::time::UNIX_EPOCH).ok())
+        .map(|d| DateTime::from_unix(d.as_secs() as i64).to_ftp())
+        .unwrap_or_default();
+    let mut facts = vec![
+        ("type", kind.to_string()),
+        ("size", metadata.len().to_string()),
+        ("modify", modified),
+        ("perm", perm_fact(path, metadata, user)),
+    ];
+    if let Some(unique) = unique_fact(metadata) {
+        facts.push(("unique", unique));
+    }
+    format_selected(&facts, selected, name)
+}
+
+/// Formats the selected facts of a path followed by its name, as used in
+/// MLST and MLSD.
+pub fn format_facts(
+    path: &Path,
+    metadata: &Metadata,
+    user: UserAccess,
+    name: &str,
+    selected: &[&str],
+) -> String {
+    let kind = if metadata.is_dir() { "dir" } else { "file" };
+    format_with_type(kind, path, metadata, user, name, selected)
+}
+
+/// Formats facts of the directory listed by MLSD, which comes first.
+pub fn format_cdir_facts(
+    path: &Path,
+    metadata: &Metadata,
+    user: UserAccess,
+    selected: &[&str],
+) -> String {
+    format_with_type("cdir", path, metadata, user, ".", selected)
+}
+
+/// Formats facts of a virtual file, which can only be read.
+pub fn format_virtual_facts(size: u64, modified: u64, name: &str, selected: &[&str]) -> String {
+    let facts = [
+        ("type", String::from("file")),
+        ("size", size.to_string()),
+        ("modify", DateTime::from_unix(modified as i64).to_ftp()),
+        ("perm", String::from("r")),
+    ];
+    format_selected(&facts, selected, name)
+}
@@ -0,0 +1,359 @@
+//! Helpers for end-to-end tests and embedders.
+//!
+//! [`TestServer`] runs a server on an ephemeral port with a temporary root,
+//! and [`Client`] is a minimal scriptable FTP client to talk to it.
+//!
+//! A test starts a server with `TestServer::start`, connects with
+//! `TestServer::client`, logs in as [`TEST_USER`] and drives the session with
+//! `Client` methods or raw commands.
+
+use std::{
+    net::{Ipv4Addr, SocketAddr},
+    path::{Path, PathBuf},
+};
+
+use anyhow::{Result, anyhow, bail};
+use serde_json::json;
+use tokio::{
+    io::{AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufReader},
+    net::TcpStream,
+    sync::oneshot,
+    task::JoinHandle,
+};
+
+use crate::{config::Config, server::Server};
+
+/// Name of the user every test server has.
+pub const TEST_USER: &str = "user";
+/// Password of [`TEST_USER`].
+pub const TEST_PASSWORD: &str = "password";
+
+/// Reply to a command.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Reply {
+    pub code: u16,
+    /// Text of every line without the code.
+    pub lines: Vec<String>,
+}
+
+impl Reply {
+    /// Text of the last line.
+    pub fn message(&self) -> &str {
+        self.lines.last().map(String::as_str).unwrap_or_default()
+    }
+
+    pub fn is_success(&self) -> bool {
+        (200..400).contains(&self.code)
+    }
+}
+
+/// FTP client that uses passive mode for data connections.
+#[derive(Debug)]
+pub struct Client {
+    control: BufReader<TcpStream>,
+    /// Reply sent on connect.
+    pub greeting: Reply,
+}
+
+impl Client {
+    pub async fn connect(addr: SocketAddr) -> Result<Self> {
+        let stream = TcpStream::connect(addr).await?;
+        let mut control = BufReader::new(stream);
+        let greeting = read_reply(&mut control).await?;
+        Ok(Client { control, greeting })
+    }
+
+    /// Sends a raw command line and returns the reply.
+    pub async fn command(&mut self, line: &str) -> Result<Reply> {
+        self.send(line).await?;
+        self.reply().await
+    }
+
+    /// Reads the next reply, e.g. the one that follows a transfer.
+    pub async fn reply(&mut self) -> Result<Reply> {
+        read_reply(&mut self.control).await
+    }
+
+    pub async fn login(&mut self, username: &str, password: &str) -> Result<()> {
+        let reply = self.command(&format!("USER {username}")).await?;
+        if reply.code != 331 {
+            bail!("USER failed: {} {}", reply.code, reply.message());
+        }
+        expect(self.command(&format!("PASS {password}")).await?, 230)
+    }
+
+    /// Returns lines of the directory listing.
+    pub async fn list(&mut self, path: &str) -> Result<Vec<String>> {
+        self.listing("LIST", path).await
+    }
+
+    /// Returns the names in the directory.
+    pub async fn nlst(&mut self, path: &str) -> Result<Vec<String>> {
+        self.listing("NLST", path).await
+    }
+
+    /// Returns lines of the machine-readable listing.
+    pub async fn mlsd(&mut self, path: &str) -> Result<Vec<String>> {
+        self.listing("MLSD", path).await
+    }
+
+    async fn listing(&mut self, verb: &str, path: &str) -> Result<Vec<String>> {
+        let command = if path.is_empty() {
+            verb.to_string()
+        } else {
+            format!("{verb} {path}")
+        };
+        let data = self.download(&command).await?;
+        Ok(String::from_utf8_lossy(&data)
+            .lines()
+            .map(String::from)
+            .collect())
+    }
+
+    pub async fn retr(&mut self, path: &str) -> Result<Vec<u8>> {
+        self.download(&format!("RETR {path}")).await
+    }
+
+    pub async fn stor(&mut self, path: &str, content: &[u8]) -> Result<()> {
+        self.upload(&format!("STOR {path}"), content).await
+    }
+
+    pub async fn appe(&mut self, path: &str, content: &[u8]) -> Result<()> {
+        self.upload(&format!("APPE {path}"), content).await
+    }
+
+    pub async fn quit(mut self) -> Result<()> {
+        expect(self.command("QUIT").await?, 221)
+    }
+
+    async fn send(&mut self, line: &str) -> Result<()> {
+        let line = format!("{line}\r\n");
+        self.control.get_mut().write_all(line.as_bytes()).await?;
+        Ok(())
+    }
+
+    /// Runs a command that receives data from the client.
+    async fn upload(&mut self, command: &str, content: &[u8]) -> Result<()> {
+        let mut data = self.passive().await?;
+        expect(self.command(command).await?, 150)?;
+        data.write_all(content).await?;
+        data.shutdown().await?;
+        drop(data);
+        expect(self.reply().await?, 226)
+    }
+
+    /// Runs a command that sends data to the client and returns the data.
+    async fn download(&mut self, command: &str) -> Result<Vec<u8>> {
+        let mut data = self.passive().await?;
+        expect(self.command(command).await?, 150)?;
+        let mut content = Vec::new();
+        data.read_to_end(&mut content).await?;
+        expect(self.reply().await?, 226)?;
+        Ok(content)
+    }
+
+    /// Enters passive mode and opens the data connection, for tests that
+    /// drive a transfer themselves.
+    pub async fn passive(&mut self) -> Result<TcpStream> {
+        let reply = self.command("PASV").await?;
+        if reply.code != 227 {
+            bail!("PASV failed: {} {}", reply.code, reply.message());
+        }
+        let addr = parse_pasv(reply.message())
+            .ok_or_else(|| anyhow!("bad PASV reply: {}", reply.message()))?;
+        Ok(TcpStream::connect(addr).await?)
+    }
+}
+
+fn expect(reply: Reply, code: u16) -> Result<()> {
+    if reply.code != code {
+        bail!(
+            "expected {code}, got {} {}",
+            reply.code,
+            reply.lines.join("\n")
+        );
+    }
+    Ok(())
+}
+
+pub(crate) async fn read_reply(control: &mut BufReader<TcpStream>) -> Result<Reply> {
+    let mut lines = Vec::new();
+    let mut code = None;
+    loop {
+        let mut line = String::new();
+        if control.read_line(&mut line).await? == 0 {
+            bail!("connection closed");
+        }
+        let line = line.trim_end_matches(['\r', '\n']);
+        let parsed = line.get(..3).and_then(|c| c.parse::<u16>().ok());
+        match (code, parsed, line.as_bytes().get(3)) {
+            (None, Some(c), Some(b'-')) => {
+                code = Some(c);
+                lines.push(line[4..].to_string());
+            }
+            (None, Some(c), _) => {
+                lines.push(line.get(4..).unwrap_or_default().to_string());
+                return Ok(Reply { code: c, lines });
+            }
+            (Some(c), Some(p), Some(b' ')) if c == p => {
+                lines.push(line[4..].to_string());
+                return Ok(Reply { code: c, lines });
+            }
+            (Some(_), _, _) => lines.push(line.trim_start().to_string()),
+            (None, None, _) => bail!("bad reply: {line}"),
+        }
+    }
+}
+
+/// Parses `227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)`.
+pub(crate) fn parse_pasv(message: &str) -> Option<SocketAddr> {
+    let start = message.find('(')?;
+    let end = message[start..].find(')')? + start;
+    let numbers: Vec<u8> = message[start + 1..end]
+        .split(',')
+        .map(|n| n.trim().parse().ok())
+        .collect::<Option<_>>()?;
+    let [h1, h2, h3, h4, p1, p2] = numbers.as_slice() else {
+        return None;
+    };
+    let port = u16::from(*p1) * 256 + u16::from(*p2);
+    Some(SocketAddr::from((Ipv4Addr::new(*h1, *h2, *h3, *h4), port)))
+}
+
+/// Server running on an ephemeral port with a temporary root, which is
+/// removed when the server is dropped.
+#[derive(Debug)]
+pub struct TestServer {
+    addr: SocketAddr,
+    root: PathBuf,
+    shutdown: Option<oneshot::Sender<()>>,
+    task: Option<JoinHandle<Result<()>>>,
+}
+
+impl TestServer {
+    /// Starts a server with a single [`TEST_USER`] that has all permissions.
+    pub async fn start() -> Result<Self> {
+        let config = serde_json::from_value(json!({
+            "users": [{
+                "name": TEST_USER,
+                "password": TEST_PASSWORD,
+                "permissions": "All",
+            }],
+        }))?;
+        Self::with_config(config).await
+    }
+
+    /// Starts a server with the config. Address and root are replaced.
+    pub async fn with_config(mut config: Config) -> Result<Self> {
+        let root = std::env::temp_dir().join(format!("dock-test-{}", cuid2::cuid()));
+        std::fs::create_dir_all(&root)?;
+        let root = root.canonicalize()?;
+
+        config.address = String::from("127.0.0.1:0");
+        config.root = root.to_string_lossy().to_string();
+        config.tenants = Vec::new();
+
+        let mut server = Server::new(config);
+        server.prepare()?;
+        let addr = *server
+            .local_addrs()
+            .first()
+            .ok_or_else(|| anyhow!("server is not listening"))?;
+
+        let (shutdown, stopped) = oneshot::channel();
+        let task = tokio::spawn(async move {
+            server
+                .start_server_until(async {
+                    let _ = stopped.await;
+                })
+                .await
+        });
+
+        Ok(TestServer {
+            addr,
+            root,
+            shutdown: Some(shutdown),
+            task: Some(task),
+        })
+    }
+
+    pub fn addr(&self) -> SocketAddr {
+        self.addr
+    }
+
+    /// Root directory of the server.
+    pub fn root(&self) -> &Path {
+        &self.root
+    }
+
+    /// Connects a new client.
+    pub async fn client(&self) -> Result<Client> {
+        Client::connect(self.addr).await
+    }
+
+    /// Stops the server and waits for it to exit.
+    pub async fn stop(mut self) -> Result<()> {
+        if let Some(shutdown) = self.shutdown.take() {
+            let _ = shutdown.send(());
+        }
+        match self.task.take() {
+            Some(task) => task.await?,
+            None => Ok(()),
+        }
+    }
+}
+
+impl Drop for TestServer {
+    fn drop(&mut self) {
+        if let Some(task) = &self.task {
+            task.abort();
+        }
+        let _ = std::fs::remove_dir_all(&self.root);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn serves_files() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        assert_eq!(client.greeting.code, 220);
+        assert_eq!(client.command("CWD /").await.unwrap().code, 530);
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        client.stor("hello.txt", b"Hello, world!").await.unwrap();
+        assert_eq!(
+            std::fs::read(server.root().join("hello.txt")).unwrap(),
+            b"Hello, world!"
+        );
+        assert_eq!(client.retr("hello.txt").await.unwrap(), b"Hello, world!");
+        let listing = client.list("").await.unwrap();
+        assert_eq!(listing.len(), 1);
+        assert!(listing[0].ends_with(" hello.txt"));
+        let size = client.command("SIZE hello.txt").await.unwrap();
+        assert_eq!((size.code, size.message()), (213, "13"));
+        client.quit().await.unwrap();
+        server.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn rejects_wrong_password() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        assert!(client.login(TEST_USER, "wrong").await.is_err());
+        assert!(client.login("nobody", TEST_PASSWORD).await.is_err());
+    }
+
+    #[test]
+    fn parses_replies_to_pasv() {
+        assert_eq!(
+            parse_pasv("Entering Passive Mode (127,0,0,1,195,80)."),
+            Some(SocketAddr::from(([127, 0, 0, 1], 50000)))
+        );
+        assert_eq!(parse_pasv("Entering Passive Mode (127,0,0,1,195)."), None);
+        assert_eq!(parse_pasv("Entering Passive Mode"), None);
+    }
+}
@@ -0,0 +1,420 @@
+//! Storage backend that proxies to another FTP server, so dock can front a
+//! legacy internal server with TLS, its own logins and logging.
+//!
+//! Users log in to dock as usual. Their commands then run on the upstream
+//! server over a pool of control connections logged in with a service
+//! account, and data is copied through passive mode data connections.
+
+use std::{net::SocketAddr, time::Duration};
+
+use anyhow::{Result, anyhow, bail};
+use serde::Deserialize;
+use tokio::{
+    io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt, BufReader},
+    net::TcpStream,
+    sync::{Mutex, Semaphore},
+    time,
+};
+
+use crate::{
+    ftptest::{self, Reply},
+    protocol,
+    storage::{Reader, Storage, StorageFuture, Writer},
+    storage_cache::StorageCacheConfig,
+};
+
+/// Listings longer than this are refused.
+const MAX_LISTING_SIZE: u64 = 16 * 1024 * 1024;
+
+fn default_root() -> String {
+    String::from("/")
+}
+
+fn default_pool_size() -> usize {
+    4
+}
+
+fn default_timeout_secs() -> u64 {
+    30
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct GatewayConfig {
+    /// Upstream server like `ftp.internal:21`. Connections to it are not
+    /// encrypted, so it should be reachable over a trusted network only.
+    pub address: String,
+    /// Account every session uses on the upstream server.
+    pub username: String,
+    pub password: String,
+    /// Directory of the upstream server users see as their root.
+    #[serde(default = "default_root")]
+    pub root: String,
+    /// Upstream control connections kept open and used at most at once.
+    #[serde(default = "default_pool_size")]
+    pub pool_size: usize,
+    /// Time the upstream server gets to answer a command or send data.
+    #[serde(default = "default_timeout_secs")]
+    pub timeout_secs: u64,
+    /// Keeps hot files and uploads on the local disk.
+    #[serde(default)]
+    pub cache: Option<StorageCacheConfig>,
+}
+
+impl GatewayConfig {
+    fn timeout(&self) -> Duration {
+        Duration::from_secs(self.timeout_secs)
+    }
+}
+
+/// Logged in control connection to the upstream server.
+#[derive(Debug)]
+struct Upstream {
+    control: BufReader<TcpStream>,
+    timeout: Duration,
+}
+
+impl Upstream {
+    async fn connect(config: &GatewayConfig) -> Result<Self> {
+        let timeout = config.timeout();
+        let stream = time::timeout(timeout, TcpStream::connect(&config.address))
+            .await
+            .map_err(|_| anyhow!("connecting to {} timed out", config.address))?
+            .map_err(|e| anyhow!("failed to connect to {}: {e}", config.address))?;
+        let mut upstream = Upstream {
+            control: BufReader::new(stream),
+            timeout,
+        };
+        expect(upstream.reply().await?, &[220])?;
+        let reply = upstream
+            .command(&format!("USER {}", config.username))
+            .await?;
+        if reply.code == 331 {
+            let reply = upstream
+                .command(&format!("PASS {}", config.password))
+                .await?;
+            expect(reply, &[230, 202])?;
+        } else {
+            expect(reply, &[230])?;
+        }
+        expect(upstream.command("TYPE I").await?, &[200])?;
+        Ok(upstream)
+    }
+
+    async fn command(&mut self, line: &str) -> Result<Reply> {
+        let line = format!("{line}\r\n");
+        time::timeout(
+            self.timeout,
+            self.control.get_mut().write_all(line.as_bytes()),
+        )
+        .await
+        .map_err(|_| anyhow!("upstream server timed out"))??;
+        self.reply().await
+    }
+
+    async fn reply(&mut self) -> Result<Reply> {
+        time::timeout(self.timeout, ftptest::read_reply(&mut self.control))
+            .await
+            .map_err(|_| anyhow!("upstream server timed out"))?
+    }
+
+    /// Opens a passive mode data connection. The address in the reply is
+    /// ignored in favor of the one of the control connection, so a server
+    /// behind NAT works and a bad one can not send dock elsewhere.
+    async fn passive(&mut self) -> Result<TcpStream> {
+        let reply = self.command("PASV").await?;
+        if reply.code != 227 {
+            bail!("PASV failed: {} {}", reply.code, reply.message());
+        }
+        let port = ftptest::parse_pasv(reply.message())
+            .ok_or_else(|| anyhow!("bad PASV reply: {}", reply.message()))?
+            .port();
+        let addr = SocketAddr::new(self.control.get_ref().peer_addr()?.ip(), port);
+        time::timeout(self.timeout, TcpStream::connect(addr))
+            .await
+            .map_err(|_| anyhow!("upstream data connection timed out"))?
+            .map_err(anyhow::Error::from)
+    }
+
+    /// Sends a command that transfers data and waits for the server to
+    /// open the transfer.
+    async fn start_transfer(&mut self, line: &str) -> Result<TcpStream> {
+        let data = self.passive().await?;
+        expect(self.command(line).await?, &[125, 150])?;
+        Ok(data)
+    }
+
+    /// Waits for the reply that ends a transfer.
+    async fn finish_transfer(&mut self) -> Result<()> {
+        expect(self.reply().await?, &[226, 250]).map(drop)
+    }
+}
+
+fn expect(reply: Reply, codes: &[u16]) -> Result<Reply> {
+    if !codes.contains(&reply.code) {
+        bail!("upstream replied {} {}", reply.code, reply.message());
+    }
+    Ok(reply)
+}
+
+/// Copies until the end of the reader, failing if it sends nothing for the
+/// timeout or more than `limit` bytes.
+async fn copy(
+    reader: &mut (dyn AsyncRead + Send + Unpin),
+    writer: &mut (dyn AsyncWrite + Send + Unpin),
+    timeout: Duration,
+    limit: u64,
+) -> Result<u64> {
+    let mut buf = vec![0; 64 * 1024];
+    let mut copied = 0;
+    loop {
+        let n = time::timeout(timeout, reader.read(&mut buf))
+            .await
+            .map_err(|_| anyhow!("transfer stalled"))??;
+        if n == 0 {
+            writer.flush().await?;
+            return Ok(copied);
+        }
+        writer.write_all(&buf[..n]).await?;
+        copied += n as u64;
+        if copied > limit {
+            bail!("more than {limit} bytes");
+        }
+    }
+}
+
+#[derive(Debug)]
+pub struct Gateway {
+    config: GatewayConfig,
+    idle: Mutex<Vec<Upstream>>,
+    permits: Semaphore,
+}
+
+impl Gateway {
+    pub fn new(config: &GatewayConfig) -> Result<Self> {
+        if config.pool_size == 0 {
+            bail!("gateway.pool_size must be at least 1");
+        }
+        Ok(Gateway {
+            config: config.clone(),
+            idle: Mutex::new(Vec::new()),
+            permits: Semaphore::new(config.pool_size),
+        })
+    }
+
+    /// Maps a path of the user to the one on the upstream server. Line
+    /// breaks would let a client smuggle commands to it.
+    fn upstream_path(&self, path: &str) -> Result<String> {
+        if path.contains(['\r', '\n', '\0']) {
+            bail!("bad path");
+        }
+        Ok(protocol::join_path(
+            &self.config.root,
+            protocol::clean_path(path).trim_start_matches('/'),
+        ))
+    }
+
+    /// Takes an idle connection that still answers, or opens a new one.
+    async fn take(&self) -> Result<Upstream> {
+        loop {
+            let Some(mut upstream) = self.idle.lock().await.pop() else {
+                return Upstream::connect(&self.config).await;
+            };
+            if upstream.command("NOOP").await.is_ok_and(|r| r.code == 200) {
+                return Ok(upstream);
+            }
+        }
+    }
+
+    async fn put_back(&self, upstream: Upstream) {
+        self.idle.lock().await.push(upstream);
+    }
+
+    /// Runs commands on one connection and returns the last reply. Stops at
+    /// the first reply without one of the expected codes.
+    async fn run(&self, commands: &[(String, &[u16])]) -> Result<Reply> {
+        let _permit = self.permits.acquire().await?;
+        let mut upstream = self.take().await?;
+        let mut last = None;
+        for (line, codes) in commands {
+            // Negative replies leave the connection usable, failed reads
+            // do not.
+            let reply = upstream.command(line).await?;
+            if !codes.contains(&reply.code) {
+                self.put_back(upstream).await;
+                return expect(reply, codes);
+            }
+            last = Some(reply);
+        }
+        self.put_back(upstream).await;
+        last.ok_or_else(|| anyhow!("no command to run"))
+    }
+
+    /// Runs a command that transfers data, keeping the connection only if
+    /// the transfer completed.
+    async fn transfer(
+        &self,
+        line: &str,
+        reader: Option<Reader<'_>>,
+        writer: Option<Writer<'_>>,
+        limit: u64,
+    ) -> Result<u64> {
+        let _permit = self.permits.acquire().await?;
+        let mut upstream = self.take().await?;
+        let mut data = upstream.start_transfer(line).await?;
+        let timeout = self.config.timeout();
+        let copied = match (reader, writer) {
+            (Some(reader), _) => {
+                let copied = copy(reader, &mut data, timeout, limit).await?;
+                data.shutdown().await?;
+                copied
+            }
+            (None, Some(writer)) => copy(&mut data, writer, timeout, limit).await?,
+            (None, None) => bail!("nothing to transfer"),
+        };
+        drop(data);
+        upstream.finish_transfer().await?;
+        self.put_back(upstream).await;
+        Ok(copied)
+    }
+
+    async fn list_lines(&self, path: &str, names_only: bool) -> Result<Vec<String>> {
+        let verb = if names_only { "NLST" } else { "LIST" };
+        let line = format!("{verb} {}", self.upstream_path(path)?);
+        let mut listing = Vec::new();
+        self.transfer(&line, None, Some(&mut listing), MAX_LISTING_SIZE)
+            .await?;
+        Ok(String::from_utf8_lossy(&listing)
+            .lines()
+            .map(String::from)
+            .collect())
+    }
+}
+
+impl Storage for Gateway {
+    fn is_dir<'a>(&'a self, path: &'a str) -> StorageFuture<'a, bool> {
+        Box::pin(async move {
+            let line = format!("CWD {}", self.upstream_path(path)?);
+            Ok(self.run(&[(line, &[250])]).await.is_ok())
+        })
+    }
+
+    fn list<'a>(&'a self, path: &'a str, names_only: bool) -> StorageFuture<'a, Vec<String>> {
+        Box::pin(self.list_lines(path, names_only))
+    }
+
+    fn retrieve<'a>(&'a self, path: &'a str, to: Writer<'a>) -> StorageFuture<'a, u64> {
+        Box::pin(async move {
+            let line = format!("RETR {}", self.upstream_path(path)?);
+            self.transfer(&line, None, Some(to), u64::MAX).await
+        })
+    }
+
+    fn store<'a>(
+        &'a self,
+        path: &'a str,
+        from: Reader<'a>,
+        append: bool,
+    ) -> StorageFuture<'a, u64> {
+        Box::pin(async move {
+            let verb = if append { "APPE" } else { "STOR" };
+            let line = format!("{verb} {}", self.upstream_path(path)?);
+            self.transfer(&line, Some(from), None, u64::MAX).await
+        })
+    }
+
+    fn delete<'a>(&'a self, path: &'a str) -> StorageFuture<'a, ()> {
+        Box::pin(async move {
+            let line = format!("DELE {}", self.upstream_path(path)?);
+            self.run(&[(line, &[250])]).await.map(drop)
+        })
+    }
+
+    fn make_dir<'a>(&'a self, path: &'a str) -> StorageFuture<'a, ()> {
+        Box::pin(async move {
+            let line = format!("MKD {}", self.upstream_path(path)?);
+            self.run(&[(line, &[257])]).await.map(drop)
+        })
+    }
+
+    fn remove_dir<'a>(&'a self, path: &'a str) -> StorageFuture<'a, ()> {
+        Box::pin(async move {
+            let line = format!("RMD {}", self.upstream_path(path)?);
+            self.run(&[(line, &[250])]).await.map(drop)
+        })
+    }
+
+    fn rename<'a>(&'a self, from: &'a str, to: &'a str) -> StorageFuture<'a, ()> {
+        Box::pin(async move {
+            let from = format!("RNFR {}", self.upstream_path(from)?);
+            let to = format!("RNTO {}", self.upstream_path(to)?);
+            self.run(&[(from, &[350]), (to, &[250])]).await.map(drop)
+        })
+    }
+
+    fn size<'a>(&'a self, path: &'a str) -> StorageFuture<'a, u64> {
+        Box::pin(async move {
+            let line = format!("SIZE {}", self.upstream_path(path)?);
+            let reply = self.run(&[(line, &[213])]).await?;
+            reply
+                .message()
+                .trim()
+                .parse()
+                .map_err(|_| anyhow!("bad SIZE reply: {}", reply.message()))
+        })
+    }
+
+    fn modified<'a>(&'a self, path: &'a str) -> StorageFuture<'a, String> {
+        Box::pin(async move {
+            let line = format!("MDTM {}", self.upstream_path(path)?);
+            let reply = self.run(&[(line, &[213])]).await?;
+            let time = reply.message().trim();
+            if time.len() < 14 || !time[..14].bytes().all(|b| b.is_ascii_digit()) {
+                bail!("bad MDTM reply: {time}");
+            }
+            Ok(time[..14].to_string())
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::json;
+
+    use crate::ftptest::{TEST_PASSWORD, TEST_USER, TestServer};
+
+    #[tokio::test]
+    async fn proxies_file_commands() {
+        let upstream = TestServer::start().await.unwrap();
+        std::fs::create_dir(upstream.root().join("shared")).unwrap();
+        std::fs::write(upstream.root().join("shared/a.txt"), "hello").unwrap();
+
+        let config = serde_json::from_value(json!({
+            "users": [{"name": "alice", "password": "secret", "permissions": "All"}],
+            "gateway": {
+                "address": upstream.addr().to_string(),
+                "username": TEST_USER,
+                "password": TEST_PASSWORD,
+                "root": "/shared",
+            },
+        }))
+        .unwrap();
+        let gateway = TestServer::with_config(config).await.unwrap();
+        let mut client = gateway.client().await.unwrap();
+        client.login("alice", "secret").await.unwrap();
+
+        assert_eq!(client.retr("a.txt").await.unwrap(), b"hello");
+        client.stor("/../b.txt", b"world").await.unwrap();
+        assert_eq!(
+            std::fs::read(upstream.root().join("shared/b.txt")).unwrap(),
+            b"world"
+        );
+        assert!(!gateway.root().join("b.txt").exists());
+        let listing = client.list("").await.unwrap();
+        assert!(listing.iter().any(|line| line.ends_with(" b.txt")));
+        assert_eq!(client.command("SIZE b.txt").await.unwrap().code, 213);
+        assert_eq!(client.command("CWD ../..").await.unwrap().code, 250);
+        assert_eq!(client.command("DELE b.txt").await.unwrap().code, 250);
+        assert_eq!(client.command("MLSD").await.unwrap().code, 502);
+        client.quit().await.unwrap();
+    }
+}
@@ -0,0 +1,71 @@
+//! Access policy based on the country of the client address.
+
+use std::net::IpAddr;
+
+use anyhow::{Result, anyhow};
+use maxminddb::{Reader, geoip2};
+use serde::{Deserialize, Serialize};
+
+/// Allowed and denied ISO 3166-1 country codes.
+#[derive(Debug, Serialize, Deserialize, Clone, Default)]
+pub struct CountryPolicy {
+    /// When not empty, only these countries are allowed.
+    #[serde(default)]
+    pub allow: Vec<String>,
+    #[serde(default)]
+    pub deny: Vec<String>,
+}
+
+impl CountryPolicy {
+    /// Checks if the country is permitted. Addresses without a known country
+    /// are permitted only when there is no allow list.
+    pub fn permits(&self, country: Option<&str>) -> bool {
+        match country {
+            Some(code) => {
+                !self.deny.iter().any(|c| c.eq_ignore_ascii_case(code))
+                    && (self.allow.is_empty()
+                        || self.allow.iter().any(|c| c.eq_ignore_ascii_case(code)))
+            }
+            None => self.allow.is_empty(),
+        }
+    }
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct GeoIpConfig {
+    /// Path to a country database in MaxMind DB format.
+    pub database: String,
+    /// Policy for all connections.
+    #[serde(flatten)]
+    pub policy: CountryPolicy,
+}
+
+/// Country database.
+pub struct GeoIp {
+    reader: Reader<Vec<u8>>,
+}
+
+impl std::fmt::Debug for GeoIp {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("GeoIp").finish_non_exhaustive()
+    }
+}
+
+impl GeoIp {
+    pub fn open(path: &str) -> Result<Self> {
+        let reader = Reader::open_readfile(path)
+            .map_err(|e| anyhow!("failed to open GeoIP database: {e}"))?;
+        Ok(GeoIp { reader })
+    }
+
+    /// Returns the country code of the address, if it is known.
+    pub fn country(&self, ip: IpAddr) -> Option<String> {
+        self.reader
+            .lookup::<geoip2::Country>(ip)
+            .ok()
+            .flatten()
+            .and_then(|record| record.country)
+            .and_then(|country| country.iso_code)
+            .map(str::to_string)
+    }
+}
@@ -0,0 +1,243 @@
+//! Shell-style wildcards in listing arguments.
+//!
+//! Patterns follow the usual rules: `*` matches any run of characters, `?`
+//! one character, `[a-z]` and `[^0-9]` a character from a class, and `\`
+//! escapes the next character. Wildcards never match `/`.
+
+/// Checks if the text contains characters with a special meaning.
+pub fn is_pattern(text: &str) -> bool {
+    text.contains(['*', '?', '['])
+}
+
+/// Splits a path into its directory and a pattern in the last component.
+/// Returns `None` when the last component has no wildcards.
+pub fn split(path: &str) -> Option<(&str, &str)> {
+    let (dir, pattern) = match path.rsplit_once('/') {
+        Some(("", pattern)) => ("/", pattern),
+        Some((dir, pattern)) => (dir, pattern),
+        None => ("", path),
+    };
+    is_pattern(pattern).then_some((dir, pattern))
+}
+
+/// Patterns longer than this match nothing.
+pub const MAX_PATTERN_LENGTH: usize = 255;
+/// Patterns with more stars than this match nothing.
+pub const MAX_STARS: usize = 16;
+
+#[derive(Debug, PartialEq, Eq)]
+enum Token {
+    Literal(char),
+    /// `?`
+    Any,
+    /// `*`, consecutive stars are the same as one.
+    Star,
+    Class {
+        negated: bool,
+        ranges: Vec<(char, char)>,
+    },
+}
+
+impl Token {
+    /// Checks if the token matches a single character.
+    fn matches(&self, c: char) -> bool {
+        match self {
+            Token::Literal(literal) => *literal == c,
+            Token::Any => c != '/',
+            Token::Star => false,
+            Token::Class { negated, ranges } => {
+                c != '/' && ranges.iter().any(|&(low, high)| low <= c && c <= high) != *negated
+            }
+        }
+    }
+}
+
+/// Checks if the whole name matches the pattern. Malformed patterns, like an
+/// unclosed class, and overly long ones match nothing.
+///
+/// Takes time proportional to the length of the name times the length of
+/// the pattern at most, whatever the stars.
+pub fn matches(pattern: &str, name: &str) -> bool {
+    let Some(tokens) = tokenize(pattern) else {
+        return false;
+    };
+    let name: Vec<char> = name.chars().collect();
+
+    let (mut t, mut n) = (0, 0);
+    // Token after the last star and the name position it was tried at.
+    let mut backtrack = None;
+    while n < name.len() {
+        match tokens.get(t) {
+            Some(Token::Star) => {
+                t += 1;
+                backtrack = Some((t, n));
+                continue;
+            }
+            Some(token) if token.matches(name[n]) => {
+                t += 1;
+                n += 1;
+                continue;
+            }
+            _ => {}
+        }
+        // Let the last star take one more character, which it can not if
+        // that is a slash. Earlier stars never have to take more.
+        match backtrack {
+            Some((after_star, start)) if name[start] != '/' => {
+                backtrack = Some((after_star, start + 1));
+                t = after_star;
+                n = start + 1;
+            }
+            _ => return false,
+        }
+    }
+    tokens[t..].iter().all(|token| *token == Token::Star)
+}
+
+/// Splits a pattern into tokens, or returns `None` if it is malformed or
+/// over the limits.
+fn tokenize(pattern: &str) -> Option<Vec<Token>> {
+    if pattern.chars().count() > MAX_PATTERN_LENGTH {
+        return None;
+    }
+    let pattern: Vec<char> = pattern.chars().collect();
+    let mut rest = &pattern[..];
+    let mut tokens = Vec::new();
+    let mut stars = 0;
+    while let Some((&first, after)) = rest.split_first() {
+        rest = after;
+        let token = match first {
+            '*' => {
+                if tokens.last() == Some(&Token::Star) {
+                    continue;
+                }
+                stars += 1;
+                Token::Star
+            }
+            '?' => Token::Any,
+            '[' => {
+                let (token, after) = parse_class(rest)?;
+                rest = after;
+                token
+            }
+            '\\' => {
+                let (&escaped, after) = rest.split_first()?;
+                rest = after;
+                Token::Literal(escaped)
+            }
+            literal => Token::Literal(literal),
+        };
+        tokens.push(token);
+    }
+    (stars <= MAX_STARS).then_some(tokens)
+}
+
+/// Parses a character class that starts after `[`. Returns it and the
+/// pattern after the closing `]`.
+fn parse_class(pattern: &[char]) -> Option<(Token, &[char])> {
+    let (negated, mut pattern) = match pattern.split_first() {
+        Some(('^', rest)) => (true, rest),
+        _ => (false, pattern),
+    };
+
+    let mut ranges = Vec::new();
+    loop {
+        let (&next, rest) = pattern.split_first()?;
+        if next == ']' && !ranges.is_empty() {
+            pattern = rest;
+            break;
+        }
+        let (low, rest) = class_char(pattern)?;
+        let (high, rest) = match rest.split_first() {
+            Some(('-', range)) if range.first() != Some(&']') => class_char(range)?,
+            _ => (low, rest),
+        };
+        ranges.push((low, high));
+        pattern = rest;
+    }
+    Some((Token::Class { negated, ranges }, pattern))
+}
+
+fn class_char(pattern: &[char]) -> Option<(char, &[char])> {
+    match pattern.split_first()? {
+        ('\\', rest) => rest.split_first().map(|(&c, rest)| (c, rest)),
+        (&c, rest) => Some((c, rest)),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn matches_wildcards() {
+        let cases = [
+            ("*", "file.txt", true),
+            ("*.txt", "file.txt", true),
+            ("*.txt", "file.txt.gz", false),
+            ("f?le.*", "file.txt", true),
+            ("f?le", "fle", false),
+            ("**a", "banana", true),
+            ("*a*a*a", "banana", true),
+            ("*a*a*a*a", "banana", false),
+            ("[a-c]*", "banana", true),
+            ("[^a-c]*", "banana", false),
+            ("[]]", "]", true),
+            ("[a\\]]", "]", true),
+            ("\\*", "*", true),
+            ("\\*", "a", false),
+            ("", "", true),
+            ("", "a", false),
+        ];
+        for (pattern, name, expected) in cases {
+            assert_eq!(matches(pattern, name), expected, "{pattern} {name}");
+        }
+    }
+
+    #[test]
+    fn never_matches_slashes() {
+        assert!(!matches("*", "dir/file"));
+        assert!(!matches("dir?file", "dir/file"));
+        assert!(!matches("dir[/]file", "dir/file"));
+        assert!(!matches("dir[^a]file", "dir/file"));
+    }
+
+    #[test]
+    fn malformed_patterns_match_nothing() {
+        for pattern in ["[abc", "file\\", "*[", "a*[b", "[]"] {
+            assert!(!matches(pattern, "abc"), "{pattern}");
+            assert!(!matches(pattern, ""), "{pattern}");
+        }
+    }
+
+    #[test]
+    fn stars_do_not_backtrack_exponentially() {
+        let name = "a".repeat(4096);
+        let pattern = format!("{}b", "*a".repeat(MAX_STARS));
+        let started = std::time::Instant::now();
+        assert!(!matches(&pattern, &name));
+        assert!(started.elapsed() < std::time::Duration::from_secs(1));
+        assert!(matches(&"*a".repeat(MAX_STARS), &name));
+    }
+
+    #[test]
+    fn enforces_limits() {
+        let long = "a".repeat(MAX_PATTERN_LENGTH + 1);
+        assert!(matches(&long[1..], &long[1..]));
+        assert!(!matches(&long, &long));
+        let stars = "*".repeat(MAX_STARS + 1);
+        // Consecutive stars count as one.
+        assert!(matches(&stars, "name"));
+        let stars = "*a".repeat(MAX_STARS + 1);
+        assert!(!matches(&stars, &"a".repeat(MAX_STARS + 1)));
+    }
+
+    #[test]
+    fn splits_paths() {
+        assert_eq!(split("/dir/*.txt"), Some(("/dir", "*.txt")));
+        assert_eq!(split("/*.txt"), Some(("/", "*.txt")));
+        assert_eq!(split("*.txt"), Some(("", "*.txt")));
+        assert_eq!(split("/dir/file.txt"), None);
+        assert_eq!(split("/d*r/file.txt"), None);
+    }
+}
@@ -0,0 +1,194 @@
+//! Zero-downtime restarts.
+//!
+//! On `SIGUSR2` the running process starts a new instance of the current
+//! executable and passes it the listening sockets through the `DOCK_LISTEN_FDS`
+//! environment variable, in the order the listeners were configured and
+//! followed by the one for ACME challenges. The old process saves the state
+//! for the new one, stops accepting connections and exits once its active
+//! sessions are finished, or closes them once the drain timeout has passed.
+//! It does not save the state again, as the new process owns it by then.
+//!
+//! The new process is started from the same executable with the same
+//! privileges, so restarts can not be combined with chroot or the sandbox.
+
+use std::{sync::Arc, time::Duration};
+
+use anyhow::Result;
+use serde::Deserialize;
+use tokio::net::TcpListener;
+
+fn default_enabled() -> bool {
+    true
+}
+
+fn default_drain_timeout_secs() -> u64 {
+    3600
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct RestartConfig {
+    /// Restart on `SIGUSR2`. Turned off with a warning when chroot or the
+    /// sandbox is enabled.
+    #[serde(default = "default_enabled")]
+    pub enabled: bool,
+    /// Sessions still open this long after the new process took over are
+    /// closed.
+    #[serde(default = "default_drain_timeout_secs")]
+    pub drain_timeout_secs: u64,
+}
+
+impl Default for RestartConfig {
+    fn default() -> Self {
+        RestartConfig {
+            enabled: default_enabled(),
+            drain_timeout_secs: default_drain_timeout_secs(),
+        }
+    }
+}
+
+impl RestartConfig {
+    pub fn drain_timeout(&self) -> Duration {
+        Duration::from_secs(self.drain_timeout_secs)
+    }
+}
+
+#[cfg(unix)]
+const LISTEN_FDS_ENV: &str = "DOCK_LISTEN_FDS";
+
+/// Returns listeners passed by the previous process, if any.
+#[cfg(unix)]
+pub fn inherited_listeners() -> Vec<std::net::TcpListener> {
+    use std::os::fd::{FromRawFd, RawFd};
+
+    let Ok(fds) = std::env::var(LISTEN_FDS_ENV) else {
+        return Vec::new();
+    };
+
+    fds.split(',')
+        .filter_map(|fd| fd.trim().parse::<RawFd>().ok())
+        // SAFETY: only checks if the descriptor is open.
+        .filter(|&fd| unsafe { libc::fcntl(fd, libc::F_GETFD) } != -1)
+        .map(|fd| {
+            // SAFETY: the descriptor is open and was passed to us by the
+            // previous process exclusively for this purpose.
+            let listener = unsafe { std::net::TcpListener::from_raw_fd(fd) };
+            // The descriptor must not leak into the next successor.
+            // SAFETY: `fd` is owned by `listener`, which is alive.
+            unsafe { libc::fcntl(fd, libc::F_SETFD, libc::FD_CLOEXEC) };
+            listener
+        })
+        .collect()
+}
+
+#[cfg(not(unix))]
+pub fn inherited_listeners() -> Vec<std::net::TcpListener> {
+    Vec::new()
+}
+
+/// Stream of restart requests.
+#[cfg(unix)]
+pub struct RestartSignal(tokio::signal::unix::Signal);
+
+#[cfg(unix)]
+impl RestartSignal {
+    pub fn new() -> Result<Self> {
+        use tokio::signal::unix::{SignalKind, signal};
+
+        Ok(RestartSignal(signal(SignalKind::user_defined2())?))
+    }
+
+    /// Waits for the next restart request.
+    pub async fn recv(&mut self) {
+        self.0.recv().await;
+    }
+}
+
+/// Stream of restart requests. Restarts are not supported on this platform.
+#[cfg(not(unix))]
+pub struct RestartSignal;
+
+#[cfg(not(unix))]
+impl RestartSignal {
+    pub fn new() -> Result<Self> {
+        Ok(RestartSignal)
+    }
+
+    /// Never completes.
+    pub async fn recv(&mut self) {
+        std::future::pending::<()>().await;
+    }
+}
+
+/// Starts a new process and passes the listeners to it.
+///
+/// Returns `true` if the new process is up and the current one should stop
+/// accepting connections.
+#[cfg(unix)]
+pub async fn hand_over(listeners: &[Arc<TcpListener>]) -> bool {
+    use std::{os::fd::AsRawFd, os::unix::process::CommandExt, process::Command};
+    use tracing::{error, info};
+
+    let fds: Vec<_> = listeners.iter().map(|l| l.as_raw_fd()).collect();
+    let fds_value = fds
+        .iter()
+        .map(|fd| fd.to_string())
+        .collect::<Vec<_>>()
+        .join(",");
+    let executable = match std::env::current_exe() {
+        Ok(path) => path,
+        Err(e) => {
+            error!(reason=%e, "Cannot find the executable to restart.");
+            return false;
+        }
+    };
+
+    let mut command = Command::new(executable);
+    command
+        .args(std::env::args_os().skip(1))
+        .env(LISTEN_FDS_ENV, fds_value);
+    // SAFETY: `fcntl` is async-signal-safe and only touches descriptors
+    // that have to survive `exec` in the child.
+    unsafe {
+        command.pre_exec(move || {
+            for &fd in &fds {
+                if libc::fcntl(fd, libc::F_SETFD, 0) == -1 {
+                    return Err(std::io::Error::last_os_error());
+                }
+            }
+            Ok(())
+        });
+    }
+
+    let mut child = match command.spawn() {
+        Ok(c) => c,
+        Err(e) => {
+            error!(reason=%e, "Failed to start new process.");
+            return false;
+        }
+    };
+
+    // Give the new process a moment to fail on a bad config before letting go.
+    tokio::time::sleep(Duration::from_secs(1)).await;
+    match child.try_wait() {
+        Ok(None) => {
+            info!(
+                pid = child.id(),
+                "New process has taken over the listeners."
+            );
+            true
+        }
+        Ok(Some(status)) => {
+            error!(%status, "New process exited during startup.");
+            false
+        }
+        Err(e) => {
+            error!(reason=%e, "Failed to check the new process.");
+            false
+        }
+    }
+}
+
+#[cfg(not(unix))]
+pub async fn hand_over(_listeners: &[Arc<TcpListener>]) -> bool {
+    false
+}
@@ -0,0 +1,195 @@
+use std::{collections::VecDeque, fs::OpenOptions, io::Write, path::PathBuf, sync::Mutex};
+
+use anyhow::{Result, anyhow};
+use serde::{Deserialize, Serialize};
+
+use crate::{datetime::unix_now, protocol};
+
+/// Only this many commands are kept for every session.
+const MAX_RECORDED_COMMANDS: usize = 500;
+
+fn default_capacity() -> usize {
+    100
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct HistoryConfig {
+    /// How many completed sessions are kept in memory.
+    #[serde(default = "default_capacity")]
+    pub capacity: usize,
+    /// File where completed sessions are appended as JSON lines. When chroot
+    /// is enabled, the path is resolved inside the root.
+    #[serde(default)]
+    pub file: Option<String>,
+}
+
+impl Default for HistoryConfig {
+    fn default() -> Self {
+        HistoryConfig {
+            capacity: default_capacity(),
+            file: None,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum Direction {
+    Upload,
+    Download,
+    /// A file moved to another volume by RNTO.
+    Move,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TransferRecord {
+    pub direction: Direction,
+    pub path: String,
+    pub bytes: u64,
+    pub completed: bool,
+    pub finished_at: u64,
+}
+
+/// Everything that happened during a single session.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SessionRecord {
+    pub id: String,
+    pub ip: String,
+    pub username: Option<String>,
+    /// Software the client identified itself as with CLNT.
+    #[serde(default)]
+    pub client: Option<String>,
+    pub started_at: u64,
+    pub ended_at: Option<u64>,
+    pub commands: Vec<String>,
+    pub transfers: Vec<TransferRecord>,
+    pub outcome: Option<String>,
+}
+
+impl SessionRecord {
+    pub fn new(id: &str, ip: &str) -> Self {
+        SessionRecord {
+            id: id.to_string(),
+            ip: ip.to_string(),
+            username: None,
+            client: None,
+            started_at: unix_now(),
+            ended_at: None,
+            commands: Vec::new(),
+            transfers: Vec::new(),
+            outcome: None,
+        }
+    }
+
+    /// Records a command. Passwords are never stored.
+    pub fn add_command(&mut self, command: &str, arg: &str) {
+        if self.commands.len() >= MAX_RECORDED_COMMANDS {
+            return;
+        }
+        let line = if arg.is_empty() {
+            command.to_string()
+        } else {
+            protocol::redact_command(&format!("{command} {arg}"))
+        };
+        self.commands.push(line);
+    }
+
+    pub fn add_transfer(&mut self, direction: Direction, path: &str, bytes: u64, completed: bool) {
+        self.transfers.push(TransferRecord {
+            direction,
+            path: path.to_string(),
+            bytes,
+            completed,
+            finished_at: unix_now(),
+        });
+    }
+}
+
+/// Bounded history of completed sessions.
+#[derive(Debug)]
+pub struct SessionHistory {
+    capacity: usize,
+    file: Option<PathBuf>,
+    records: Mutex<VecDeque<SessionRecord>>,
+}
+
+impl Default for SessionHistory {
+    fn default() -> Self {
+        Self::new(&HistoryConfig::default())
+    }
+}
+
+impl SessionHistory {
+    pub fn new(config: &HistoryConfig) -> Self {
+        SessionHistory {
+            capacity: config.capacity,
+            file: config.file.as_ref().map(PathBuf::from),
+            records: Mutex::new(VecDeque::with_capacity(config.capacity)),
+        }
+    }
+
+    /// Stores a completed session, evicting the oldest one when full.
+    pub fn push(&self, mut record: SessionRecord, outcome: &str) -> Result<()> {
+        record.ended_at = Some(unix_now());
+        record.outcome = Some(outcome.to_string());
+
+        if let Ok(mut records) = self.records.lock()
+            && self.capacity > 0
+        {
+            if records.len() >= self.capacity {
+                records.pop_front();
+            }
+            records.push_back(record.clone());
+        }
+
+        if let Some(path) = &self.file {
+            let mut line = serde_json::to_string(&record)?;
+            line.push('\n');
+            OpenOptions::new()
+                .create(true)
+                .append(true)
+                .open(path)
+                .and_then(|mut f| f.write_all(line.as_bytes()))
+                .map_err(|e| anyhow!("failed to write session history: {e}"))?;
+        }
+        Ok(())
+    }
+
+    /// Returns up to `limit` most recent sessions, newest first.
+    pub fn recent(&self, limit: usize) -> Vec<SessionRecord> {
+        self.records
+            .lock()
+            .map(|records| records.iter().rev().take(limit).cloned().collect())
+            .unwrap_or_default()
+    }
+
+    pub fn get(&self, id: &str) -> Option<SessionRecord> {
+        self.records
+            .lock()
+            .ok()
+            .and_then(|records| records.iter().find(|r| r.id == id).cloned())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn hides_passwords() {
+        let mut record = SessionRecord::new("id", "127.0.0.1");
+        record.add_command("USER", "alice");
+        record.add_command("PASS", "secret");
+        record.add_command("SITE", "PSWD secret better");
+        record.add_command("SITE", "CHMOD 644 file");
+        assert_eq!(
+            record.commands,
+            [
+                "USER alice",
+                "PASS ****",
+                "SITE PSWD ****",
+                "SITE CHMOD 644 file"
+            ]
+        );
+    }
+}
@@ -0,0 +1,148 @@
+//! Users from an htpasswd file, so credentials kept for Apache or nginx can
+//! be reused.
+//!
+//! Every user of the file gets the same permissions and root. The file is
+//! read again when it changes. Unless `auth_backends` says otherwise, users
+//! of the config and the users file take precedence over it.
+
+use std::{
+    collections::HashMap,
+    fs,
+    path::{Path, PathBuf},
+    sync::{Mutex, RwLock},
+    time::SystemTime,
+};
+
+use anyhow::{Result, anyhow, bail};
+use serde::Deserialize;
+
+use crate::{
+    config::{Permissions, User},
+    limits::Limits,
+    users::account_key,
+};
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct HtpasswdConfig {
+    /// File with `user:hash` lines as written by `htpasswd`. Hashes may be
+    /// bcrypt, `$apr1$`, `{SHA}` or plaintext. When chroot is enabled, the
+    /// path is resolved inside the root.
+    pub file: String,
+    /// Permissions of every user in the file.
+    pub permissions: Permissions,
+    /// Root directory of the users, see [`crate::users::expand_root`].
+    /// Defaults to the root of the server.
+    #[serde(default)]
+    pub root: Option<String>,
+    /// Group whose limits apply to the users.
+    #[serde(default)]
+    pub group: Option<String>,
+}
+
+/// Reads `user:hash` lines. Blank lines and lines starting with `#` are
+/// skipped.
+pub fn parse(content: &str) -> Result<Vec<(String, String)>> {
+    let mut entries = Vec::new();
+    for (number, line) in content.lines().enumerate() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        match line.split_once(':') {
+            Some((name, hash)) if !name.is_empty() && !hash.is_empty() => {
+                entries.push((name.to_string(), hash.to_string()));
+            }
+            _ => bail!("line {} is not like user:hash", number + 1),
+        }
+    }
+    Ok(entries)
+}
+
+#[derive(Debug)]
+pub struct Htpasswd {
+    path: PathBuf,
+    config: HtpasswdConfig,
+    /// Tenants the users can log in to, `None` without tenants.
+    tenants: Vec<Option<String>>,
+    /// Users keyed by account, see [`account_key`].
+    users: RwLock<HashMap<String, User>>,
+    /// Modification time of the file when it was last read.
+    modified: Mutex<Option<SystemTime>>,
+}
+
+impl Htpasswd {
+    /// Reads the file. Its users can log in to each of the tenants.
+    pub fn load(config: &HtpasswdConfig, tenants: Vec<Option<String>>) -> Result<Self> {
+        let htpasswd = Htpasswd {
+            path: PathBuf::from(&config.file),
+            config: config.clone(),
+            tenants,
+            users: RwLock::new(HashMap::new()),
+            modified: Mutex::new(None),
+        };
+        htpasswd.reload()?;
+        Ok(htpasswd)
+    }
+
+    pub fn get(&self, key: &str) -> Option<User> {
+        self.users
+            .read()
+            .ok()
+            .and_then(|users| users.get(key).cloned())
+    }
+
+    /// Reads the file again if it has changed since it was read. Returns the
+    /// number of users if it was read. Until the file can be read, the
+    /// previous users are kept.
+    pub fn reload_if_changed(&self) -> Result<Option<usize>> {
+        let modified = modification_time(&self.path);
+        let changed = self.modified.lock().is_ok_and(|last| *last != modified);
+        if !changed {
+            return Ok(None);
+        }
+        self.reload().map(Some)
+    }
+
+    fn reload(&self) -> Result<usize> {
+        let modified = modification_time(&self.path);
+        let content = fs::read_to_string(&self.path)
+            .map_err(|e| anyhow!("failed to read htpasswd file {}: {e}", self.path.display()))?;
+        let entries = parse(&content)
+            .map_err(|e| anyhow!("bad htpasswd file {}: {e}", self.path.display()))?;
+        let count = entries.len();
+
+        let mut users = HashMap::new();
+        for (name, password) in entries {
+            let user = User {
+                name,
+                password,
+                permissions: self.config.permissions.clone(),
+                countries: None,
+                hostnames: None,
+                client_certificates: Vec::new(),
+                root: self.config.root.clone(),
+                quota: None,
+                file_quota: None,
+                transfer_quota: None,
+                enabled: true,
+                expires_at: None,
+                group: self.config.group.clone(),
+                limits: Limits::default(),
+            };
+            for tenant in &self.tenants {
+                users.insert(account_key(tenant.as_deref(), &user.name), user.clone());
+            }
+        }
+        if let Ok(mut current) = self.users.write() {
+            *current = users;
+        }
+        if let Ok(mut last) = self.modified.lock() {
+            *last = modified;
+        }
+        Ok(count)
+    }
+}
+
+fn modification_time(path: &Path) -> Option<SystemTime> {
+    fs::metadata(path).and_then(|m| m.modified()).ok()
+}
@@ -0,0 +1,46 @@
+//! Reply languages negotiated with LANG, see RFC 2640.
+//!
+//! Every language is a catalog that maps the English text of a reply to its
+//! translation. Replies without an entry are sent in English, so catalogs
+//! can be filled in over time.
+
+use std::collections::HashMap;
+
+/// Language of replies that are not translated.
+pub const DEFAULT_LANGUAGE: &str = "EN";
+
+/// Translations keyed by the English text of the reply.
+pub type Catalog = HashMap<String, String>;
+
+/// Finds the catalog of the language tag, like `de` or `pt-BR`, ignoring
+/// case. A tag with a subtag falls back to its primary language. Returns the
+/// configured tag with the catalog.
+pub fn find<'a>(
+    languages: &'a HashMap<String, Catalog>,
+    tag: &str,
+) -> Option<(&'a str, &'a Catalog)> {
+    let lookup = |tag: &str| {
+        languages
+            .iter()
+            .find(|(name, _)| name.eq_ignore_ascii_case(tag))
+            .map(|(name, catalog)| (name.as_str(), catalog))
+    };
+    lookup(tag).or_else(|| lookup(tag.split_once('-')?.0))
+}
+
+/// FEAT line of LANG, with the selected language marked by `*`.
+pub fn feature(languages: &HashMap<String, Catalog>, selected: Option<&str>) -> String {
+    let mut tags: Vec<&str> = languages.keys().map(String::as_str).collect();
+    tags.sort_unstable();
+    let names: Vec<String> = std::iter::once(DEFAULT_LANGUAGE)
+        .chain(tags)
+        .map(|tag| {
+            if tag == selected.unwrap_or(DEFAULT_LANGUAGE) {
+                format!("{}*", tag.to_uppercase())
+            } else {
+                tag.to_uppercase()
+            }
+        })
+        .collect();
+    format!("LANG {}", names.join(";"))
+}
@@ -0,0 +1,213 @@
+//! Login with directory credentials from LDAP or Active Directory.
+//!
+//! The user is found either by putting the name into a DN template, or by
+//! searching for it with a service account. Its password is then checked
+//! by binding as it, and a filter can require membership in a group.
+
+use std::time::Duration;
+
+use anyhow::{Result, anyhow, bail};
+use ldap3::{Ldap, LdapConnAsync, LdapConnSettings, Scope, SearchEntry, dn_escape, ldap_escape};
+use serde::Deserialize;
+use tracing::warn;
+
+use crate::{
+    config::{Permissions, User},
+    limits::Limits,
+};
+
+fn default_timeout_secs() -> u64 {
+    10
+}
+
+fn default_search_filter() -> String {
+    String::from("(uid=%u)")
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct LdapConfig {
+    /// Server like `ldaps://dc.example.com` or `ldap://ldap.example.com:389`.
+    pub url: String,
+    /// Upgrade `ldap://` connections with StartTLS.
+    #[serde(default)]
+    pub starttls: bool,
+    /// DN to bind as, with `%u` for the user name, like
+    /// `uid=%u,ou=people,dc=example,dc=com` or `%u@example.com` for Active
+    /// Directory. Either this or `search` is required.
+    #[serde(default)]
+    pub bind_dn: Option<String>,
+    /// Finds the DN of the user with a search instead.
+    #[serde(default)]
+    pub search: Option<LdapSearch>,
+    /// Filter the entry of the user has to match to log in, like
+    /// `(memberOf=cn=ftp,ou=groups,dc=example,dc=com)`. `%u` is replaced
+    /// with the user name.
+    #[serde(default)]
+    pub group_filter: Option<String>,
+    /// Permissions of every directory user.
+    pub permissions: Permissions,
+    /// Root directory of the users, see [`crate::users::expand_root`].
+    /// Defaults to the root of the server.
+    #[serde(default)]
+    pub root: Option<String>,
+    /// Group whose limits apply to the users.
+    #[serde(default)]
+    pub group: Option<String>,
+    /// Time the server gets to answer each request.
+    #[serde(default = "default_timeout_secs")]
+    pub timeout_secs: u64,
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct LdapSearch {
+    /// DN the search starts at, like `ou=people,dc=example,dc=com`.
+    pub base: String,
+    /// Filter that finds exactly one user, `%u` is replaced with the user
+    /// name. Active Directory needs `(sAMAccountName=%u)`.
+    #[serde(default = "default_search_filter")]
+    pub filter: String,
+    /// Service account the search is done as. Anonymous when unset.
+    #[serde(default)]
+    pub bind_dn: Option<String>,
+    #[serde(default)]
+    pub bind_password: Option<String>,
+}
+
+impl LdapConfig {
+    /// Checks that the user can be found one way or another.
+    pub fn validate(&self) -> Result<()> {
+        match (&self.bind_dn, &self.search) {
+            (Some(_), Some(_)) => bail!("ldap needs either bind_dn or search, not both"),
+            (None, None) => bail!("ldap needs bind_dn or search"),
+            _ => Ok(()),
+        }
+    }
+
+    /// Host and port of the server, with the default port of the scheme.
+    pub fn address(&self) -> Option<String> {
+        let (scheme, rest) = self.url.split_once("://")?;
+        let host = rest.split('/').next().filter(|host| !host.is_empty())?;
+        if host
+            .rsplit_once(':')
+            .is_some_and(|(_, port)| port.parse::<u16>().is_ok())
+        {
+            return Some(host.to_string());
+        }
+        match scheme {
+            "ldap" => Some(format!("{host}:389")),
+            "ldaps" => Some(format!("{host}:636")),
+            _ => None,
+        }
+    }
+
+    fn timeout(&self) -> Duration {
+        Duration::from_secs(self.timeout_secs)
+    }
+}
+
+/// Checks the password of a directory user and its group membership.
+pub async fn authenticate(config: &LdapConfig, username: &str, password: &str) -> Result<User> {
+    // An empty password is an anonymous bind, which most servers accept.
+    if password.is_empty() {
+        bail!("empty password");
+    }
+    let mut ldap = connect(config).await?;
+    let result = check_user(config, &mut ldap, username, password).await;
+    let _ = ldap.unbind().await;
+    result?;
+
+    Ok(User {
+        name: username.to_string(),
+        // Never matches a password, the directory checks them.
+        password: String::new(),
+        permissions: config.permissions.clone(),
+        countries: None,
+        hostnames: None,
+        client_certificates: Vec::new(),
+        root: config.root.clone(),
+        quota: None,
+        file_quota: None,
+        transfer_quota: None,
+        enabled: true,
+        expires_at: None,
+        group: config.group.clone(),
+        limits: Limits::default(),
+    })
+}
+
+/// Opens a connection that is driven in the background until it is
+/// unbound.
+async fn connect(config: &LdapConfig) -> Result<Ldap> {
+    let settings = LdapConnSettings::new()
+        .set_conn_timeout(config.timeout())
+        .set_starttls(config.starttls);
+    let (connection, ldap) = LdapConnAsync::with_settings(settings, &config.url)
+        .await
+        .map_err(|e| anyhow!("failed to connect to {}: {e}", config.url))?;
+    tokio::spawn(async move {
+        if let Err(e) = connection.drive().await {
+            warn!(reason=%e, "LDAP connection failed.");
+        }
+    });
+    Ok(ldap)
+}
+
+async fn check_user(
+    config: &LdapConfig,
+    ldap: &mut Ldap,
+    username: &str,
+    password: &str,
+) -> Result<()> {
+    let dn = match (&config.bind_dn, &config.search) {
+        (Some(template), _) => template.replace("%u", &dn_escape(username)),
+        (None, Some(search)) => find_user(config, search, ldap, username).await?,
+        (None, None) => bail!("ldap needs bind_dn or search"),
+    };
+
+    ldap.with_timeout(config.timeout())
+        .simple_bind(&dn, password)
+        .await?
+        .success()
+        .map_err(|e| anyhow!("bind as {dn} failed: {e}"))?;
+
+    if let Some(filter) = &config.group_filter {
+        let filter = filter.replace("%u", &ldap_escape(username));
+        let (entries, _) = ldap
+            .with_timeout(config.timeout())
+            .search(&dn, Scope::Base, &filter, vec!["1.1"])
+            .await?
+            .success()?;
+        if entries.is_empty() {
+            bail!("{dn} does not match the group filter");
+        }
+    }
+    Ok(())
+}
+
+/// Returns the DN of the only entry the search finds.
+async fn find_user(
+    config: &LdapConfig,
+    search: &LdapSearch,
+    ldap: &mut Ldap,
+    username: &str,
+) -> Result<String> {
+    if let Some(bind_dn) = &search.bind_dn {
+        let bind_password = search.bind_password.as_deref().unwrap_or_default();
+        ldap.with_timeout(config.timeout())
+            .simple_bind(bind_dn, bind_password)
+            .await?
+            .success()
+            .map_err(|e| anyhow!("bind as the search account failed: {e}"))?;
+    }
+    let filter = search.filter.replace("%u", &ldap_escape(username));
+    let (mut entries, _) = ldap
+        .with_timeout(config.timeout())
+        .search(&search.base, Scope::Subtree, &filter, vec!["1.1"])
+        .await?
+        .success()?;
+    match entries.len() {
+        0 => bail!("user not found"),
+        1 => Ok(SearchEntry::construct(entries.remove(0)).dn),
+        _ => bail!("search found more than one user"),
+    }
+}
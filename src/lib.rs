@@ -1,5 +1,60 @@
+pub mod accounts;
+pub mod acme;
+pub mod admin;
+pub mod auth;
+pub mod charset;
+pub mod checksum;
 pub mod cli;
 pub mod commands;
 pub mod config;
+pub mod datetime;
+pub mod disk;
+pub mod doctor;
+pub mod external_auth;
+pub mod facts;
+pub mod ftptest;
+pub mod gateway;
+pub mod geoip;
+pub mod glob;
+pub mod handover;
+pub mod history;
+pub mod htpasswd;
+pub mod language;
+pub mod ldap;
+pub mod limits;
+pub mod listing;
+pub mod maintenance;
+pub mod messages;
+pub mod pam;
+pub mod passive;
+pub mod password;
+#[cfg(unix)]
+pub mod privileges;
+pub mod protocol;
+pub mod quarantine;
+pub mod quirks;
+pub mod rdns;
+pub mod recording;
+pub mod rename;
+#[cfg(target_os = "linux")]
+pub mod sandbox;
 pub mod server;
+#[cfg(windows)]
+pub mod service;
 pub mod session;
+pub mod site;
+pub mod state;
+pub mod stats;
+pub mod storage;
+pub mod storage_cache;
+pub mod tarpit;
+pub mod tls;
+pub mod transfer;
+pub mod transfer_log;
+pub mod uploads;
+#[cfg(target_os = "linux")]
+pub mod uring;
+pub mod user_db;
+pub mod users;
+pub mod virtual_files;
+pub mod x509;
@@ -0,0 +1,245 @@
+//! Session limits that can be overridden per group and per user.
+
+use std::{collections::HashMap, sync::Mutex, time::Duration};
+
+use serde::{Deserialize, Serialize};
+
+use crate::{commands::Commands, datetime::DateTime, history::Direction, messages::LoginMessage};
+
+/// Limits of a session. Unset values are inherited, see [`Limits::overridden_by`].
+#[derive(Debug, Serialize, Deserialize, Clone, Default, PartialEq, Eq)]
+#[serde(deny_unknown_fields)]
+pub struct Limits {
+    /// Sessions are closed after this many seconds without a command. 0
+    /// disables the timeout.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub idle_timeout_secs: Option<u64>,
+    /// Transfers are aborted after this many seconds without data. 0
+    /// disables the timeout.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub stall_timeout_secs: Option<u64>,
+    /// Sessions the user may have at the same time.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_sessions: Option<usize>,
+    /// Download rate of a session, in bytes per second.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_download_rate: Option<u64>,
+    /// Downloads and listings are aborted when the client reads slower than
+    /// this many bytes per second on average, after a short grace period.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub min_download_rate: Option<u64>,
+    /// Upload rate of a session, in bytes per second.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_upload_rate: Option<u64>,
+    /// Commands that may not be run after login, e.g. `DELE`, `SITE` for
+    /// every SITE subcommand or `SITE CHMOD` for one of them. Aliases are
+    /// denied along with their command, so `MKD` denies `XMKD` too.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub denied_commands: Option<Vec<String>>,
+    /// Message shown after login, e.g. a notice for the users of a group.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub login_message: Option<LoginMessage>,
+    /// Allows COMB, which joins uploaded segments into one file and deletes
+    /// them.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub combine_uploads: Option<bool>,
+}
+
+impl Limits {
+    /// Returns these limits with the ones set in `other` replacing them.
+    pub fn overridden_by(&self, other: &Limits) -> Limits {
+        Limits {
+            idle_timeout_secs: other.idle_timeout_secs.or(self.idle_timeout_secs),
+            stall_timeout_secs: other.stall_timeout_secs.or(self.stall_timeout_secs),
+            max_sessions: other.max_sessions.or(self.max_sessions),
+            max_download_rate: other.max_download_rate.or(self.max_download_rate),
+            min_download_rate: other.min_download_rate.or(self.min_download_rate),
+            max_upload_rate: other.max_upload_rate.or(self.max_upload_rate),
+            denied_commands: other
+                .denied_commands
+                .clone()
+                .or_else(|| self.denied_commands.clone()),
+            login_message: other
+                .login_message
+                .clone()
+                .or_else(|| self.login_message.clone()),
+            combine_uploads: other.combine_uploads.or(self.combine_uploads),
+        }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        *self == Limits::default()
+    }
+
+    pub fn idle_timeout(&self) -> Option<Duration> {
+        seconds(self.idle_timeout_secs)
+    }
+
+    pub fn stall_timeout(&self) -> Option<Duration> {
+        seconds(self.stall_timeout_secs)
+    }
+
+    /// Checks if the command is denied, whichever of its verbs was used. A
+    /// SITE subcommand is denied by its own entry or by one for SITE.
+    pub fn denies(&self, command: Commands, subcommand: Option<&str>) -> bool {
+        if command == Commands::Unknown {
+            return false;
+        }
+        self.denied_commands.iter().flatten().any(|entry| {
+            let mut words = entry.split_whitespace();
+            words
+                .next()
+                .is_some_and(|verb| Commands::from(verb.to_ascii_uppercase()) == command)
+                && match words.next() {
+                    Some(sub) => subcommand.is_some_and(|s| s.eq_ignore_ascii_case(sub)),
+                    None => true,
+                }
+        })
+    }
+}
+
+fn seconds(value: Option<u64>) -> Option<Duration> {
+    value.filter(|&s| s > 0).map(Duration::from_secs)
+}
+
+/// Number of sessions every account has logged in.
+#[derive(Debug, Default)]
+pub struct SessionCounter {
+    counts: Mutex<HashMap<String, usize>>,
+}
+
+impl SessionCounter {
+    /// Counts a new session of the account unless it already has `max`.
+    pub fn try_acquire(&self, account: &str, max: Option<usize>) -> bool {
+        let Ok(mut counts) = self.counts.lock() else {
+            return true;
+        };
+        let count = counts.entry(account.to_string()).or_default();
+        if max.is_some_and(|max| *count >= max) {
+            return false;
+        }
+        *count += 1;
+        true
+    }
+
+    /// Returns the number of sessions of every account that has any, sorted
+    /// by account.
+    pub fn counts(&self) -> Vec<(String, usize)> {
+        let mut counts: Vec<(String, usize)> = self
+            .counts
+            .lock()
+            .map(|counts| counts.iter().map(|(a, c)| (a.clone(), *c)).collect())
+            .unwrap_or_default();
+        counts.sort();
+        counts
+    }
+
+    /// Forgets a session counted by `try_acquire`.
+    pub fn release(&self, account: &str) {
+        if let Ok(mut counts) = self.counts.lock()
+            && let Some(count) = counts.get_mut(account)
+        {
+            *count = count.saturating_sub(1);
+            if *count == 0 {
+                counts.remove(account);
+            }
+        }
+    }
+}
+
+/// Length of the period a transfer quota applies to. Periods start at
+/// midnight UTC, weeks on Monday.
+#[derive(Debug, Serialize, Deserialize, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum Period {
+    Day,
+    Week,
+    Month,
+}
+
+impl Period {
+    /// First day of the period that contains `day`. Days are counted from the
+    /// Unix epoch.
+    pub fn first_day(self, day: u64) -> u64 {
+        match self {
+            Period::Day => day,
+            // The epoch was a Thursday.
+            Period::Week => day - (day + 3) % 7,
+            Period::Month => {
+                let date = DateTime::from_unix((day * 86400) as i64);
+                day + 1 - u64::from(date.day)
+            }
+        }
+    }
+
+    pub fn name(self) -> &'static str {
+        match self {
+            Period::Day => "day",
+            Period::Week => "week",
+            Period::Month => "month",
+        }
+    }
+}
+
+/// Bytes a user may transfer in a period.
+#[derive(Debug, Serialize, Deserialize, Clone, Copy, PartialEq, Eq)]
+#[serde(deny_unknown_fields)]
+pub struct TransferQuota {
+    pub period: Period,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub download: Option<u64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub upload: Option<u64>,
+    /// Transfers are slowed down to this rate in bytes per second once the
+    /// quota is used up. They are rejected when it is not set.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub exhausted_rate: Option<u64>,
+}
+
+impl TransferQuota {
+    pub fn limit(&self, direction: Direction) -> Option<u64> {
+        match direction {
+            Direction::Download => self.download,
+            Direction::Upload => self.upload,
+            Direction::Move => None,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn denying(entries: &[&str]) -> Limits {
+        Limits {
+            denied_commands: Some(entries.iter().map(|e| e.to_string()).collect()),
+            ..Limits::default()
+        }
+    }
+
+    #[test]
+    fn denies_aliases_with_their_command() {
+        let limits = denying(&["mkd", "XRMD", "CDUP"]);
+        assert!(limits.denies(Commands::from(String::from("XMKD")), None));
+        assert!(limits.denies(Commands::MakeDir, None));
+        assert!(limits.denies(Commands::RemoveDir, None));
+        assert!(limits.denies(Commands::from(String::from("XCUP")), None));
+        assert!(!limits.denies(Commands::Delete, None));
+    }
+
+    #[test]
+    fn denies_site_subcommands() {
+        let limits = denying(&["SITE chmod"]);
+        assert!(limits.denies(Commands::Site, Some("CHMOD")));
+        assert!(!limits.denies(Commands::Site, Some("UTIME")));
+        assert!(!limits.denies(Commands::Site, None));
+        assert!(denying(&["SITE"]).denies(Commands::Site, Some("UTIME")));
+    }
+
+    #[test]
+    fn ignores_unknown_commands() {
+        let limits = denying(&["FOO"]);
+        assert!(!limits.denies(Commands::Unknown, None));
+        assert!(!limits.denies(Commands::Noop, None));
+    }
+}
@@ -0,0 +1,159 @@
+//! Reading directories for listings within configured limits.
+
+use std::{
+    fs::Metadata,
+    io,
+    path::Path,
+    time::{Duration, Instant},
+};
+
+use serde::Deserialize;
+use tokio::{fs, time};
+
+use crate::datetime::DateTime;
+
+fn default_max_entries() -> usize {
+    100_000
+}
+
+fn default_time_budget() -> u64 {
+    10_000
+}
+
+/// Format of LIST lines.
+#[derive(Debug, Deserialize, Clone, Copy, Default, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum DirStyle {
+    /// Like `ls -l`.
+    #[default]
+    Unix,
+    /// Like IIS, which some Windows clients and scripts expect.
+    Msdos,
+}
+
+/// Formats an entry in the MS-DOS style, e.g.
+/// `10-16-26  08:45PM       <DIR>          name`.
+pub fn format_msdos(is_dir: bool, size: u64, modified: u64, name: &str) -> String {
+    let date = DateTime::from_unix(modified as i64);
+    let (hour, half) = match date.hour {
+        0 => (12, "AM"),
+        hour @ 1..=11 => (hour, "AM"),
+        12 => (12, "PM"),
+        hour => (hour - 12, "PM"),
+    };
+    let size = if is_dir {
+        format!("{:<20}", "      <DIR>")
+    } else {
+        format!("{size:>20}")
+    };
+    format!(
+        "{:02}-{:02}-{:02}  {hour:02}:{:02}{half} {size} {name}",
+        date.month,
+        date.day,
+        date.year.rem_euclid(100),
+        date.minute
+    )
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct ListingLimits {
+    /// Listings stop after this many entries.
+    #[serde(default = "default_max_entries")]
+    pub max_entries: usize,
+    /// Listings stop after the directory has been read for this long, in
+    /// milliseconds.
+    #[serde(default = "default_time_budget")]
+    pub time_budget_ms: u64,
+}
+
+impl Default for ListingLimits {
+    fn default() -> Self {
+        ListingLimits {
+            max_entries: default_max_entries(),
+            time_budget_ms: default_time_budget(),
+        }
+    }
+}
+
+/// Why a listing does not contain every entry of the directory.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Truncated {
+    TooManyEntries,
+    TookTooLong,
+}
+
+#[derive(Debug)]
+pub struct Entry {
+    pub name: String,
+    pub metadata: Metadata,
+}
+
+#[derive(Debug)]
+pub struct Listing {
+    pub entries: Vec<Entry>,
+    pub truncated: Option<Truncated>,
+}
+
+impl Listing {
+    /// Text of the 226 reply that ends the listing.
+    pub fn completion_message(&self) -> String {
+        let count = self.entries.len();
+        match self.truncated {
+            None => String::from("Transfer complete."),
+            Some(Truncated::TooManyEntries) => {
+                format!("Transfer complete, listing truncated to {count} entries.")
+            }
+            Some(Truncated::TookTooLong) => format!(
+                "Transfer complete, listing truncated to {count} entries because it took too long."
+            ),
+        }
+    }
+}
+
+/// Lists the directory, or just the file when the path is not a directory.
+pub async fn read(path: &Path, limits: &ListingLimits) -> io::Result<Listing> {
+    let metadata = fs::metadata(path).await?;
+    if metadata.is_dir() {
+        return read_dir(path, limits).await;
+    }
+    let name = path
+        .file_name()
+        .map(|n| n.to_string_lossy().to_string())
+        .unwrap_or_default();
+    Ok(Listing {
+        entries: vec![Entry { name, metadata }],
+        truncated: None,
+    })
+}
+
+/// Reads entries of the directory until it ends or a limit is reached.
+pub async fn read_dir(path: &Path, limits: &ListingLimits) -> io::Result<Listing> {
+    let deadline = Instant::now() + Duration::from_millis(limits.time_budget_ms);
+    let mut dir = fs::read_dir(path).await?;
+    let mut entries = Vec::new();
+    let mut truncated = None;
+
+    loop {
+        let Ok(next) = time::timeout_at(deadline.into(), dir.next_entry()).await else {
+            truncated = Some(Truncated::TookTooLong);
+            break;
+        };
+        let Some(entry) = next? else {
+            break;
+        };
+        if entries.len() >= limits.max_entries {
+            truncated = Some(Truncated::TooManyEntries);
+            break;
+        }
+        let Ok(metadata) = time::timeout_at(deadline.into(), entry.metadata()).await else {
+            truncated = Some(Truncated::TookTooLong);
+            break;
+        };
+        entries.push(Entry {
+            name: entry.file_name().to_string_lossy().to_string(),
+            metadata: metadata?,
+        });
+    }
+
+    Ok(Listing { entries, truncated })
+}
@@ -1,12 +1,86 @@
-use std::process::exit;
+use std::{
+    io::{IsTerminal, Write},
+    path::Path,
+    process::exit,
+};
 
 use clap::Parser;
-use dock::{cli::Cli, config::load_config, server::Server};
+use dock::{
+    accounts::{self, Format},
+    cli::{Cli, LogAction, ServiceAction, SubCommand, UserAction},
+    config::{Config, load_config},
+    datetime::DateTime,
+    doctor::{self, Status},
+    history::Direction,
+    password,
+    recording::{self, ReplayOptions, ReplayReport},
+    server::{Server, init_logging, init_logging_at, shutdown_signal},
+    stats::read_stats_file,
+    transfer_log::{self, Query, TransferLog},
+    users::UserStore,
+};
 
-#[tokio::main]
-async fn main() {
+fn main() {
     let cli = Cli::parse();
     let config_path = cli.config.unwrap_or(String::from("config.json"));
+
+    if let Some(SubCommand::Service { action }) = cli.command {
+        if let Err(e) = handle_service(action, config_path) {
+            eprintln!("Service error occurred: {e}");
+            exit(1);
+        }
+        return;
+    }
+
+    if let Some(SubCommand::Replay {
+        file,
+        address,
+        user,
+        password,
+        realtime,
+    }) = cli.command
+    {
+        match replay_session(&file, address, user, password, realtime) {
+            Ok(report) if report.mismatches == 0 => return,
+            Ok(_) => exit(2),
+            Err(e) => {
+                eprintln!("failed to replay session: {e}");
+                exit(1);
+            }
+        }
+    }
+
+    if let Some(SubCommand::HashPassword {
+        bcrypt,
+        user,
+        tenant,
+    }) = cli.command
+    {
+        let scheme = if bcrypt {
+            password::Scheme::Bcrypt
+        } else {
+            password::Scheme::Argon2
+        };
+        let hash = match read_password().and_then(|p| password::hash_as(scheme, &p)) {
+            Ok(hash) => hash,
+            Err(e) => {
+                eprintln!("failed to hash password: {e}");
+                exit(1);
+            }
+        };
+        match user {
+            Some(user) => {
+                if let Err(e) = set_config_password(&config_path, tenant.as_deref(), &user, &hash) {
+                    eprintln!("failed to update configuration: {e}");
+                    exit(1);
+                }
+                println!("Stored the password of {user} in {config_path}.");
+            }
+            None => println!("{hash}"),
+        }
+        return;
+    }
+
     let config = match load_config(&config_path) {
         Ok(c) => c,
         Err(e) => {
@@ -15,8 +89,405 @@ async fn main() {
         }
     };
 
-    let server = Server::new(config);
-    if let Err(e) = server.start_server().await {
+    if let Some(SubCommand::Doctor) = cli.command {
+        if !run_doctor(&config) {
+            exit(1);
+        }
+        return;
+    }
+
+    if let Some(SubCommand::User { action }) = cli.command {
+        // The users file is opened from outside of the chroot here.
+        let mut config = config;
+        config.users_file = config.users_file.as_ref().map(|f| {
+            config
+                .outside_chroot(Path::new(f))
+                .to_string_lossy()
+                .to_string()
+        });
+        let result = match action {
+            UserAction::Import {
+                file,
+                format,
+                tenant,
+                replace,
+            } => import_users(&config, &file, format, tenant.as_deref(), replace)
+                .map_err(|e| anyhow::anyhow!("failed to import users: {e}")),
+            UserAction::Export {
+                output,
+                format,
+                tenant,
+            } => export_users(&config, output.as_deref(), format, tenant.as_deref())
+                .map_err(|e| anyhow::anyhow!("failed to export users: {e}")),
+        };
+        if let Err(e) = result {
+            eprintln!("{e}");
+            exit(1);
+        }
+        return;
+    }
+
+    if let Some(SubCommand::Log {
+        action:
+            LogAction::Query {
+                user,
+                path,
+                since,
+                until,
+                limit,
+                json,
+            },
+    }) = cli.command
+    {
+        let query = Query {
+            user,
+            path,
+            since: None,
+            until: None,
+            limit,
+        };
+        if let Err(e) = query_log(&config, query, since, until, json) {
+            eprintln!("failed to query transfer log: {e}");
+            exit(1);
+        }
+        return;
+    }
+
+    if let Some(SubCommand::Stats { user }) = cli.command {
+        if let Err(e) = print_stats(&config, user.as_deref()) {
+            eprintln!("failed to show statistics: {e}");
+            exit(1);
+        }
+        return;
+    }
+
+    // Binding and confinement happen before the runtime spawns its threads,
+    // so that all of them inherit dropped privileges and sandbox rules.
+    init_logging();
+    let mut server = Server::new(config);
+    if let Err(e) = server.prepare() {
+        eprintln!("Server error occurred: {e}");
+        exit(1);
+    }
+
+    let runtime = match tokio::runtime::Runtime::new() {
+        Ok(r) => r,
+        Err(e) => {
+            eprintln!("failed to start runtime: {e}");
+            exit(1);
+        }
+    };
+    if let Err(e) = runtime.block_on(server.start_server_until(shutdown_signal())) {
         eprintln!("Server error occurred: {e}");
     }
 }
+
+fn print_stats(config: &Config, user: Option<&str>) -> anyhow::Result<()> {
+    // Tenants may keep their statistics in files of their own.
+    let mut files: Vec<_> = config
+        .instances()
+        .into_iter()
+        .filter_map(|i| i.stats_file)
+        .collect();
+    files.sort();
+    files.dedup();
+    if files.is_empty() {
+        anyhow::bail!("stats_file is not set in the configuration");
+    }
+    let mut stats = Vec::new();
+    for file in files {
+        stats.extend(read_stats_file(Path::new(&file))?);
+    }
+    stats.sort_by(|a, b| a.0.cmp(&b.0));
+
+    println!(
+        "{:<20} {:>14} {:>14} {:>8} {:>8} {:>8}  LAST LOGIN",
+        "USER", "UPLOADED", "DOWNLOADED", "UP", "DOWN", "FAILED"
+    );
+    for (name, s) in stats {
+        if user.is_some_and(|u| u != name) {
+            continue;
+        }
+        let last_login = s
+            .last_login
+            .map(|t| DateTime::from_unix(t as i64).to_readable())
+            .unwrap_or(String::from("never"));
+        println!(
+            "{:<20} {:>14} {:>14} {:>8} {:>8} {:>8}  {}",
+            name,
+            s.bytes_uploaded,
+            s.bytes_downloaded,
+            s.files_uploaded,
+            s.files_downloaded,
+            s.failed_logins,
+            last_login
+        );
+    }
+    Ok(())
+}
+
+fn query_log(
+    config: &Config,
+    mut query: Query,
+    since: Option<String>,
+    until: Option<String>,
+    json: bool,
+) -> anyhow::Result<()> {
+    let mut files: Vec<_> = config
+        .instances()
+        .into_iter()
+        .filter_map(|i| Some(i.transfer_log?.file))
+        .collect();
+    files.sort();
+    files.dedup();
+    if files.is_empty() {
+        anyhow::bail!("transfer_log is not set in the configuration");
+    }
+    let parse = |value: Option<String>| {
+        value
+            .map(|v| {
+                transfer_log::parse_time(&v).ok_or_else(|| {
+                    anyhow::anyhow!("{v} is not a Unix timestamp or YYYY-MM-DD[ HH:MM:SS]")
+                })
+            })
+            .transpose()
+    };
+    query.since = parse(since)?;
+    query.until = parse(until)?;
+
+    let logs = files
+        .iter()
+        .map(|file| TransferLog::open(&config.outside_chroot(Path::new(file))))
+        .collect::<anyhow::Result<Vec<_>>>()?;
+    let entries = transfer_log::query_all(&logs.iter().collect::<Vec<_>>(), &query)?;
+    if json {
+        println!("{}", serde_json::to_string_pretty(&entries)?);
+        return Ok(());
+    }
+    println!(
+        "{:<19}  {:<16} {:<8} {:>14} {:>10} {:<12} {:<15} PATH",
+        "FINISHED", "USER", "DIR", "BYTES", "MS", "RESULT", "IP"
+    );
+    for entry in entries {
+        let direction = match entry.direction {
+            Direction::Upload => "upload",
+            Direction::Download => "download",
+            Direction::Move => "move",
+        };
+        println!(
+            "{:<19}  {:<16} {:<8} {:>14} {:>10} {:<12} {:<15} {}",
+            DateTime::from_unix(entry.finished_at as i64).to_readable(),
+            entry.username,
+            direction,
+            entry.bytes,
+            entry.duration_ms,
+            entry.result.as_str(),
+            entry.ip,
+            entry.path
+        );
+    }
+    Ok(())
+}
+
+fn import_users(
+    config: &Config,
+    file: &str,
+    format: Option<Format>,
+    tenant: Option<&str>,
+    replace: bool,
+) -> anyhow::Result<()> {
+    if config.users_file.is_none() {
+        anyhow::bail!("users_file is not set in the configuration");
+    }
+    let format = format
+        .or_else(|| Format::from_file_name(file))
+        .ok_or_else(|| anyhow::anyhow!("unknown format of {file}, use --format"))?;
+    let content = std::fs::read_to_string(file)?;
+    let users = accounts::parse(&content, format, config)?;
+    let summary = UserStore::load(config)?.import(tenant, users, replace)?;
+    println!(
+        "{} created, {} replaced, {} skipped",
+        summary.created, summary.replaced, summary.skipped
+    );
+    Ok(())
+}
+
+fn export_users(
+    config: &Config,
+    output: Option<&str>,
+    format: Option<Format>,
+    tenant: Option<&str>,
+) -> anyhow::Result<()> {
+    let format = format
+        .or_else(|| output.and_then(Format::from_file_name))
+        .unwrap_or(Format::Json);
+    let users = UserStore::load(config)?.tenant_users(tenant)?;
+    let partial = users.iter().any(|u| {
+        u.transfer_quota.is_some()
+            || !u.limits.is_empty()
+            || u.countries.is_some()
+            || u.hostnames.is_some()
+    });
+    if format == Format::Csv && partial {
+        eprintln!("warning: transfer quotas, limits and login policies are only exported as JSON");
+    }
+    let content = accounts::format(&users, format)?;
+    match output {
+        Some(path) => std::fs::write(path, content)?,
+        None => print!("{content}"),
+    }
+    Ok(())
+}
+
+/// Reads a password from the terminal without echo, asking twice to catch
+/// typos. When the standard input is not a terminal, its first line is the
+/// password.
+fn read_password() -> anyhow::Result<String> {
+    let stdin = std::io::stdin();
+    if !stdin.is_terminal() {
+        let mut line = String::new();
+        stdin.read_line(&mut line)?;
+        let password = line.trim_end_matches(['\r', '\n']).to_string();
+        if password.is_empty() {
+            anyhow::bail!("no password on the standard input");
+        }
+        return Ok(password);
+    }
+    let password = prompt_hidden("Password: ")?;
+    if password.is_empty() {
+        anyhow::bail!("password is empty");
+    }
+    if prompt_hidden("Repeat password: ")? != password {
+        anyhow::bail!("passwords do not match");
+    }
+    Ok(password)
+}
+
+/// Reads a line from the terminal with echo turned off.
+fn prompt_hidden(prompt: &str) -> anyhow::Result<String> {
+    eprint!("{prompt}");
+    std::io::stderr().flush()?;
+
+    #[cfg(unix)]
+    let saved = {
+        // SAFETY: termios is plain data filled in by tcgetattr.
+        let mut termios: libc::termios = unsafe { std::mem::zeroed() };
+        // SAFETY: the pointer is valid for the duration of the calls.
+        unsafe {
+            if libc::tcgetattr(libc::STDIN_FILENO, &mut termios) != 0 {
+                return Err(std::io::Error::last_os_error().into());
+            }
+            let mut hidden = termios;
+            hidden.c_lflag &= !libc::ECHO;
+            hidden.c_lflag |= libc::ECHONL;
+            libc::tcsetattr(libc::STDIN_FILENO, libc::TCSANOW, &hidden);
+        }
+        termios
+    };
+
+    let mut line = String::new();
+    let result = std::io::stdin().read_line(&mut line);
+
+    #[cfg(unix)]
+    // SAFETY: restores the settings read above.
+    unsafe {
+        libc::tcsetattr(libc::STDIN_FILENO, libc::TCSANOW, &saved);
+    }
+
+    result?;
+    Ok(line.trim_end_matches(['\r', '\n']).to_string())
+}
+
+/// Replaces the password of a user in the config file. Other settings keep
+/// their order, but the file is written with the default formatting.
+fn set_config_password(
+    path: &str,
+    tenant: Option<&str>,
+    user: &str,
+    hash: &str,
+) -> anyhow::Result<()> {
+    let content = std::fs::read_to_string(path)?;
+    let mut config: serde_json::Value =
+        serde_json::from_str(&content).map_err(|e| anyhow::anyhow!("bad config format: {e}"))?;
+    let users = match tenant {
+        Some(tenant) => config
+            .get_mut("tenants")
+            .and_then(|t| t.as_array_mut())
+            .and_then(|t| t.iter_mut().find(|t| t["name"] == tenant))
+            .ok_or_else(|| anyhow::anyhow!("tenant {tenant} is not in the config"))?
+            .get_mut("users"),
+        None => config.get_mut("users"),
+    };
+    let entry = users
+        .and_then(|u| u.as_array_mut())
+        .and_then(|u| u.iter_mut().find(|u| u["name"] == user))
+        .ok_or_else(|| anyhow::anyhow!("user {user} is not in the config"))?;
+    entry["password"] = serde_json::Value::from(hash);
+
+    let temp_path = format!("{path}.tmp");
+    std::fs::write(&temp_path, serde_json::to_string_pretty(&config)? + "\n")?;
+    std::fs::rename(&temp_path, path)?;
+    Ok(())
+}
+
+/// Prints the results of all checks. Returns false if any of them failed.
+fn run_doctor(config: &Config) -> bool {
+    let checks = doctor::run(config);
+    for check in &checks {
+        println!("[{:>4}] {}", check.status, check.message);
+        if let Some(fix) = &check.fix {
+            println!("       fix: {fix}");
+        }
+    }
+    let failures = checks
+        .iter()
+        .filter(|c| c.status == Status::Failure)
+        .count();
+    let warnings = checks
+        .iter()
+        .filter(|c| c.status == Status::Warning)
+        .count();
+    println!("{failures} failures, {warnings} warnings");
+    failures == 0
+}
+
+fn replay_session(
+    file: &str,
+    address: Option<String>,
+    user: Option<String>,
+    password: Option<String>,
+    realtime: bool,
+) -> anyhow::Result<ReplayReport> {
+    let address = address
+        .map(|a| a.parse())
+        .transpose()
+        .map_err(|e| anyhow::anyhow!("bad address: {e}"))?;
+    let options = ReplayOptions {
+        address,
+        user,
+        password,
+        realtime,
+    };
+    // Logs of the test server would be mixed with the replay.
+    init_logging_at("warn");
+    let runtime = tokio::runtime::Runtime::new()?;
+    runtime.block_on(recording::replay(Path::new(file), options))
+}
+
+#[cfg(windows)]
+fn handle_service(action: ServiceAction, config_path: String) -> anyhow::Result<()> {
+    use dock::service;
+
+    match action {
+        ServiceAction::Install => service::install(&config_path),
+        ServiceAction::Uninstall => service::uninstall(),
+        ServiceAction::Start => service::start(),
+        ServiceAction::Stop => service::stop(),
+        ServiceAction::Run => service::run(config_path),
+    }
+}
+
+#[cfg(not(windows))]
+fn handle_service(_action: ServiceAction, _config_path: String) -> anyhow::Result<()> {
+    anyhow::bail!("services are only supported on Windows")
+}
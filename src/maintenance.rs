@@ -0,0 +1,82 @@
+//! Maintenance mode.
+//!
+//! While it is enabled, new connections are refused and sessions that are
+//! still open when the grace period ends are closed.
+
+use std::time::Duration;
+
+use serde::Serialize;
+use tokio::{
+    sync::watch,
+    time::{self, Instant},
+};
+
+use crate::datetime::unix_now;
+
+/// Grace period used when the request does not set one.
+pub const DEFAULT_GRACE_PERIOD: Duration = Duration::from_secs(300);
+
+#[derive(Debug, Clone, Copy, Serialize)]
+pub struct MaintenanceStatus {
+    /// Unix timestamp of when maintenance mode was enabled.
+    pub since: u64,
+    pub grace_secs: u64,
+    #[serde(skip)]
+    deadline: Instant,
+}
+
+#[derive(Debug)]
+pub struct Maintenance {
+    status: watch::Sender<Option<MaintenanceStatus>>,
+}
+
+impl Default for Maintenance {
+    fn default() -> Self {
+        Maintenance {
+            status: watch::Sender::new(None),
+        }
+    }
+}
+
+impl Maintenance {
+    pub fn enable(&self, grace: Duration) -> MaintenanceStatus {
+        let status = MaintenanceStatus {
+            since: unix_now(),
+            grace_secs: grace.as_secs(),
+            deadline: Instant::now() + grace,
+        };
+        self.status.send_replace(Some(status));
+        status
+    }
+
+    pub fn disable(&self) {
+        self.status.send_replace(None);
+    }
+
+    pub fn status(&self) -> Option<MaintenanceStatus> {
+        *self.status.borrow()
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        self.status.borrow().is_some()
+    }
+
+    /// Completes when open sessions have to be closed: maintenance mode is
+    /// enabled and its grace period is over.
+    pub async fn grace_period_over(&self) {
+        let mut status = self.status.subscribe();
+        loop {
+            let deadline = status.borrow_and_update().map(|s| s.deadline);
+            let changed = match deadline {
+                Some(deadline) => tokio::select! {
+                    _ = time::sleep_until(deadline) => return,
+                    changed = status.changed() => changed,
+                },
+                None => status.changed().await,
+            };
+            if changed.is_err() {
+                return std::future::pending().await;
+            }
+        }
+    }
+}
@@ -0,0 +1,76 @@
+//! Configurable reply texts.
+//!
+//! Templates can refer to `{server}`, `{user}`, `{ip}` and `{quota}`, which
+//! is the remaining disk quota of the user in bytes or `unlimited`.
+
+use serde::{Deserialize, Serialize};
+
+#[derive(Debug, Deserialize, Clone)]
+#[serde(default)]
+pub struct Messages {
+    /// Name substituted for `{server}`.
+    pub server_name: String,
+    /// Lines sent before the greeting, e.g. a legal notice.
+    pub banner: Vec<String>,
+    /// Text of the 220 reply on connect.
+    pub greeting: String,
+    /// Text of the 230 reply after a successful login.
+    pub login: String,
+    /// Text of the 530 reply after a failed login.
+    pub login_failed: String,
+    /// Text of the 221 reply to QUIT.
+    pub goodbye: String,
+}
+
+impl Default for Messages {
+    fn default() -> Self {
+        Messages {
+            server_name: String::from("Dock"),
+            banner: Vec::new(),
+            greeting: String::from("{server} is welcoming you!"),
+            login: String::from("Login success."),
+            login_failed: String::from("Authorization failed."),
+            goodbye: String::from("Bye!"),
+        }
+    }
+}
+
+/// Lines shown before the 230 reply to a user or a group, written inline as
+/// `{"text": [...]}` or read from a file with `{"file": "..."}`. Both are
+/// templates.
+#[derive(Debug, Serialize, Deserialize, Clone, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum LoginMessage {
+    Text(Vec<String>),
+    /// When chroot is enabled, the path is resolved inside the root.
+    File(String),
+}
+
+/// Values substituted into templates.
+#[derive(Debug, Default)]
+pub struct Variables<'a> {
+    pub server: &'a str,
+    pub user: &'a str,
+    pub ip: &'a str,
+    pub quota: Option<u64>,
+}
+
+impl Variables<'_> {
+    /// Replaces known variables in the template. Unknown ones are kept as is.
+    pub fn render(&self, template: &str) -> String {
+        let quota = match self.quota {
+            Some(left) => left.to_string(),
+            None => String::from("unlimited"),
+        };
+        template
+            .replace("{server}", self.server)
+            .replace("{user}", self.user)
+            .replace("{ip}", self.ip)
+            .replace("{quota}", &quota)
+    }
+}
+
+/// Checks if the template needs the remaining quota, which is costly to compute.
+pub fn uses_quota(template: &str) -> bool {
+    template.contains("{quota}")
+}
@@ -0,0 +1,284 @@
+//! Login with the system accounts through PAM.
+//!
+//! Only available when built with the `pam` feature, which links libpam.
+//! Users that are not in the config are looked up by PAM with the password
+//! they sent, and get the same permissions.
+
+use std::net::IpAddr;
+
+use anyhow::Result;
+#[cfg(not(all(unix, feature = "pam")))]
+use anyhow::bail;
+use serde::Deserialize;
+
+use crate::config::{Permissions, User};
+#[cfg(all(unix, feature = "pam"))]
+use crate::limits::Limits;
+
+fn default_service() -> String {
+    String::from("dock")
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct PamConfig {
+    /// PAM service, which names the file in `/etc/pam.d` with the rules.
+    #[serde(default = "default_service")]
+    pub service: String,
+    /// Permissions of every system user.
+    pub permissions: Permissions,
+    /// Use the home directory of the system user as root. The root of the
+    /// server is used otherwise.
+    #[serde(default)]
+    pub home_as_root: bool,
+    /// Group whose limits apply to the users.
+    #[serde(default)]
+    pub group: Option<String>,
+}
+
+/// Checks if this build can use PAM.
+pub fn is_supported() -> bool {
+    cfg!(all(unix, feature = "pam"))
+}
+
+/// Checks the password and the account of a system user. The client
+/// address is passed on as the remote host, which PAM modules may check.
+/// PAM modules block and may delay failures, so this runs on a blocking
+/// thread.
+#[cfg(all(unix, feature = "pam"))]
+pub async fn authenticate(
+    config: &PamConfig,
+    username: &str,
+    password: &str,
+    remote: Option<IpAddr>,
+) -> Result<User> {
+    let service = config.service.clone();
+    let name = username.to_string();
+    let password = password.to_string();
+    let home = tokio::task::spawn_blocking(move || {
+        ffi::authenticate(&service, &name, &password, remote)?;
+        Ok::<_, anyhow::Error>(ffi::home_dir(&name))
+    })
+    .await??;
+
+    let root = if config.home_as_root {
+        Some(home.ok_or_else(|| anyhow::anyhow!("user {username} has no home directory"))?)
+    } else {
+        None
+    };
+    Ok(system_user(config, username, root))
+}
+
+#[cfg(not(all(unix, feature = "pam")))]
+pub async fn authenticate(
+    _config: &PamConfig,
+    _username: &str,
+    _password: &str,
+    _remote: Option<IpAddr>,
+) -> Result<User> {
+    bail!("dock was built without PAM support")
+}
+
+#[cfg(all(unix, feature = "pam"))]
+fn system_user(config: &PamConfig, username: &str, root: Option<String>) -> User {
+    User {
+        name: username.to_string(),
+        // Never matches a password, PAM checks them.
+        password: String::new(),
+        permissions: config.permissions.clone(),
+        countries: None,
+        hostnames: None,
+        client_certificates: Vec::new(),
+        root,
+        quota: None,
+        file_quota: None,
+        transfer_quota: None,
+        enabled: true,
+        expires_at: None,
+        group: config.group.clone(),
+        limits: Limits::default(),
+    }
+}
+
+#[cfg(all(unix, feature = "pam"))]
+mod ffi {
+    use std::{
+        ffi::{CStr, CString, c_char, c_int, c_void},
+        net::IpAddr,
+        ptr,
+    };
+
+    use anyhow::{Result, anyhow, bail};
+
+    const PAM_SUCCESS: c_int = 0;
+    const PAM_BUF_ERR: c_int = 5;
+    const PAM_CONV_ERR: c_int = 19;
+    const PAM_PROMPT_ECHO_OFF: c_int = 1;
+    const PAM_PROMPT_ECHO_ON: c_int = 2;
+    const PAM_RHOST: c_int = 4;
+    const PAM_SILENT: c_int = 0x8000;
+    const PAM_DISALLOW_NULL_AUTHTOK: c_int = 0x0001;
+
+    #[repr(C)]
+    struct PamMessage {
+        msg_style: c_int,
+        msg: *const c_char,
+    }
+
+    #[repr(C)]
+    struct PamResponse {
+        resp: *mut c_char,
+        resp_retcode: c_int,
+    }
+
+    type Conversation = extern "C" fn(
+        num_msg: c_int,
+        msg: *mut *const PamMessage,
+        resp: *mut *mut PamResponse,
+        appdata_ptr: *mut c_void,
+    ) -> c_int;
+
+    #[repr(C)]
+    struct PamConv {
+        conv: Conversation,
+        appdata_ptr: *mut c_void,
+    }
+
+    #[link(name = "pam")]
+    unsafe extern "C" {
+        fn pam_start(
+            service_name: *const c_char,
+            user: *const c_char,
+            pam_conversation: *const PamConv,
+            pamh: *mut *mut c_void,
+        ) -> c_int;
+        fn pam_set_item(pamh: *mut c_void, item_type: c_int, item: *const c_void) -> c_int;
+        fn pam_authenticate(pamh: *mut c_void, flags: c_int) -> c_int;
+        fn pam_acct_mgmt(pamh: *mut c_void, flags: c_int) -> c_int;
+        fn pam_end(pamh: *mut c_void, pam_status: c_int) -> c_int;
+        fn pam_strerror(pamh: *mut c_void, errnum: c_int) -> *const c_char;
+    }
+
+    /// Answers every prompt with the password, which `appdata_ptr` points
+    /// to. Informational messages get no answer.
+    extern "C" fn converse(
+        num_msg: c_int,
+        msg: *mut *const PamMessage,
+        resp: *mut *mut PamResponse,
+        appdata_ptr: *mut c_void,
+    ) -> c_int {
+        let Ok(count) = usize::try_from(num_msg) else {
+            return PAM_CONV_ERR;
+        };
+        if count == 0 || msg.is_null() || resp.is_null() {
+            return PAM_CONV_ERR;
+        }
+        // SAFETY: PAM frees the responses with free(3), so they are
+        // allocated with calloc(3) and strdup(3).
+        let responses =
+            unsafe { libc::calloc(count, size_of::<PamResponse>()) as *mut PamResponse };
+        if responses.is_null() {
+            return PAM_BUF_ERR;
+        }
+        let password = appdata_ptr as *const c_char;
+        for i in 0..count {
+            // Linux-PAM passes an array of pointers to messages.
+            // SAFETY: PAM passes `num_msg` valid messages.
+            let style = unsafe { (**msg.add(i)).msg_style };
+            if style == PAM_PROMPT_ECHO_OFF || style == PAM_PROMPT_ECHO_ON {
+                // SAFETY: `password` is the nul-terminated string passed to
+                // pam_start, and `responses` has room for `count` entries.
+                unsafe { (*responses.add(i)).resp = libc::strdup(password) };
+            }
+        }
+        // SAFETY: `resp` was checked to be non-null above.
+        unsafe { *resp = responses };
+        PAM_SUCCESS
+    }
+
+    fn error(pamh: *mut c_void, status: c_int) -> String {
+        // SAFETY: pam_strerror returns a static string for any status.
+        let message = unsafe { pam_strerror(pamh, status) };
+        if message.is_null() {
+            return format!("PAM error {status}");
+        }
+        // SAFETY: checked to be non-null above.
+        unsafe { CStr::from_ptr(message) }
+            .to_string_lossy()
+            .into_owned()
+    }
+
+    pub fn authenticate(
+        service: &str,
+        username: &str,
+        password: &str,
+        remote: Option<IpAddr>,
+    ) -> Result<()> {
+        let service = CString::new(service).map_err(|_| anyhow!("invalid PAM service"))?;
+        let username = CString::new(username).map_err(|_| anyhow!("invalid user name"))?;
+        let password = CString::new(password).map_err(|_| anyhow!("invalid password"))?;
+        let conversation = PamConv {
+            conv: converse,
+            appdata_ptr: password.as_ptr() as *mut c_void,
+        };
+
+        let mut pamh = ptr::null_mut();
+        // SAFETY: every pointer is valid until pam_end, which is called
+        // before they are dropped.
+        let status = unsafe {
+            pam_start(
+                service.as_ptr(),
+                username.as_ptr(),
+                &conversation,
+                &mut pamh,
+            )
+        };
+        if status != PAM_SUCCESS {
+            bail!("failed to start PAM: {}", error(pamh, status));
+        }
+
+        let remote = remote.and_then(|ip| CString::new(ip.to_string()).ok());
+        // SAFETY: `pamh` was set up by pam_start above and is ended below.
+        let status = unsafe {
+            if let Some(remote) = &remote {
+                pam_set_item(pamh, PAM_RHOST, remote.as_ptr() as *const c_void);
+            }
+            match pam_authenticate(pamh, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK) {
+                PAM_SUCCESS => pam_acct_mgmt(pamh, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK),
+                status => status,
+            }
+        };
+        let result = if status == PAM_SUCCESS {
+            Ok(())
+        } else {
+            Err(anyhow!("{}", error(pamh, status)))
+        };
+        // SAFETY: `pamh` is not used after this.
+        unsafe { pam_end(pamh, status) };
+        result
+    }
+
+    /// Looks up the home directory of a system user.
+    pub fn home_dir(username: &str) -> Option<String> {
+        let username = CString::new(username).ok()?;
+        // SAFETY: all-zero is a valid passwd, it is filled in below.
+        let mut passwd: libc::passwd = unsafe { std::mem::zeroed() };
+        let mut buffer = vec![0 as c_char; 16 * 1024];
+        let mut result = ptr::null_mut();
+        // SAFETY: the buffer outlives every use of the strings in `passwd`.
+        let status = unsafe {
+            libc::getpwnam_r(
+                username.as_ptr(),
+                &mut passwd,
+                buffer.as_mut_ptr(),
+                buffer.len(),
+                &mut result,
+            )
+        };
+        if status != 0 || result.is_null() || passwd.pw_dir.is_null() {
+            return None;
+        }
+        // SAFETY: checked to be non-null above, and points into `buffer`.
+        let home = unsafe { CStr::from_ptr(passwd.pw_dir) };
+        Some(home.to_string_lossy().into_owned()).filter(|home| !home.is_empty())
+    }
+}
@@ -0,0 +1,90 @@
+//! Listeners for passive data connections.
+//!
+//! Behind NAT or a TCP load balancer, clients have to be told an address
+//! they can reach, and the balancer has to know which instance a data
+//! connection belongs to. Giving every instance a port range of its own and
+//! the address to advertise solves both.
+
+use std::{
+    io,
+    net::{Ipv4Addr, SocketAddr},
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+use serde::Deserialize;
+use tokio::net::TcpListener;
+
+#[derive(Debug, Deserialize, Clone, Default)]
+#[serde(deny_unknown_fields)]
+pub struct PassiveConfig {
+    /// Ports passive listeners are bound to, like `50000-50099`. Ports are
+    /// picked by the system when unset.
+    #[serde(default)]
+    pub ports: Option<PortRange>,
+    /// Address advertised in replies to PASV instead of the local address
+    /// of the control connection.
+    #[serde(default)]
+    pub address: Option<Ipv4Addr>,
+}
+
+/// Inclusive range of ports, written as `first-last` in config.
+#[derive(Debug, Deserialize, Clone, Copy, PartialEq, Eq)]
+#[serde(try_from = "String")]
+pub struct PortRange {
+    pub first: u16,
+    pub last: u16,
+}
+
+impl PortRange {
+    /// Number of ports in the range.
+    pub fn count(&self) -> usize {
+        usize::from(self.last - self.first) + 1
+    }
+}
+
+impl TryFrom<String> for PortRange {
+    type Error = String;
+
+    fn try_from(value: String) -> Result<Self, Self::Error> {
+        let (first, last) = value
+            .split_once('-')
+            .ok_or_else(|| format!("port range should be like 50000-50099, not {value}"))?;
+        let parse = |port: &str| {
+            port.trim()
+                .parse::<u16>()
+                .ok()
+                .filter(|p| *p != 0)
+                .ok_or_else(|| format!("invalid port in range: {port}"))
+        };
+        let (first, last) = (parse(first)?, parse(last)?);
+        if first > last {
+            return Err(format!("port range is reversed: {value}"));
+        }
+        Ok(PortRange { first, last })
+    }
+}
+
+/// Binds a passive listener to a free port of the range, or to any port
+/// when there is no range. Ports are tried from a random starting point so
+/// concurrent sessions rarely race for the same one.
+pub async fn bind(range: Option<PortRange>) -> io::Result<TcpListener> {
+    let Some(range) = range else {
+        return TcpListener::bind("0.0.0.0:0").await;
+    };
+
+    let start = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.subsec_nanos() as usize)
+        .unwrap_or(0)
+        % range.count();
+    for offset in 0..range.count() {
+        let port = range.first + ((start + offset) % range.count()) as u16;
+        if let Ok(listener) = TcpListener::bind(SocketAddr::from(([0, 0, 0, 0], port))).await {
+            return Ok(listener);
+        }
+    }
+    Err(io::Error::new(
+        io::ErrorKind::AddrInUse,
+        "every port of the passive range is in use",
+    ))
+}
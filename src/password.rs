@@ -0,0 +1,348 @@
+//! Stored password schemes and rules for passwords that users choose
+//! themselves with SITE PSWD.
+//!
+//! Passwords can be stored as argon2id hashes in PHC form (`$argon2id$...`),
+//! as bcrypt hashes (`$2b$...`), as `{MD5}` followed by the hex digest, in
+//! the `$apr1$` and `{SHA}` forms of Apache's htpasswd, or in plaintext,
+//! which is deprecated. Every scheme is accepted at the same time,
+//! so entries can be migrated one by one.
+
+use std::sync::OnceLock;
+
+use anyhow::{Result, anyhow, bail};
+use argon2::{
+    Argon2, PasswordHash, PasswordHasher, PasswordVerifier,
+    password_hash::{SaltString, rand_core::OsRng},
+};
+use base64::{Engine, engine::general_purpose::STANDARD};
+use md5::{Digest, Md5};
+use ring::digest::{self, SHA1_FOR_LEGACY_USE_ONLY};
+use serde::Deserialize;
+use subtle::ConstantTimeEq;
+use tokio::task;
+
+const MD5_PREFIX: &str = "{MD5}";
+const SHA1_PREFIX: &str = "{SHA}";
+const APR1_PREFIX: &str = "$apr1$";
+/// Alphabet of the base64 variant crypt(3) hashes are written in.
+const CRYPT_ALPHABET: &[u8; 64] =
+    b"./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz";
+
+/// How a password is stored, recognized by its prefix.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Scheme {
+    Plaintext,
+    Md5,
+    /// Base64 of the SHA-1 digest, as written by `htpasswd -s`.
+    Sha1,
+    /// MD5 based crypt of Apache, as written by `htpasswd -m`.
+    Apr1,
+    Bcrypt,
+    Argon2,
+}
+
+impl Scheme {
+    pub fn of(stored: &str) -> Self {
+        if stored.starts_with("$argon2") {
+            Scheme::Argon2
+        } else if ["$2a$", "$2b$", "$2y$"]
+            .iter()
+            .any(|prefix| stored.starts_with(prefix))
+        {
+            Scheme::Bcrypt
+        } else if stored.strip_prefix(MD5_PREFIX).is_some_and(|digest| {
+            digest.len() == 32 && digest.chars().all(|c| c.is_ascii_hexdigit())
+        }) {
+            Scheme::Md5
+        } else if stored.starts_with(SHA1_PREFIX) {
+            Scheme::Sha1
+        } else if stored.starts_with(APR1_PREFIX) {
+            Scheme::Apr1
+        } else {
+            Scheme::Plaintext
+        }
+    }
+
+    /// Checks if passwords in this scheme should be hashed again.
+    pub fn is_legacy(self) -> bool {
+        matches!(
+            self,
+            Scheme::Plaintext | Scheme::Md5 | Scheme::Sha1 | Scheme::Apr1
+        )
+    }
+}
+
+/// Checks a password against its stored form in any scheme. Hashing is slow
+/// on purpose, so it runs on a blocking thread.
+pub async fn verify(stored: &str, password: &str) -> bool {
+    let stored = stored.to_string();
+    let password = password.to_string();
+    task::spawn_blocking(move || match Scheme::of(&stored) {
+        Scheme::Plaintext => constant_time_eq(&stored, &password),
+        Scheme::Md5 => {
+            let digest: String = Md5::digest(password.as_bytes())
+                .iter()
+                .map(|b| format!("{b:02x}"))
+                .collect();
+            constant_time_eq(&stored[MD5_PREFIX.len()..].to_ascii_lowercase(), &digest)
+        }
+        Scheme::Sha1 => {
+            let digest = digest::digest(&SHA1_FOR_LEGACY_USE_ONLY, password.as_bytes());
+            constant_time_eq(&stored[SHA1_PREFIX.len()..], &STANDARD.encode(digest))
+        }
+        Scheme::Apr1 => {
+            let salt = stored[APR1_PREFIX.len()..]
+                .split('$')
+                .next()
+                .unwrap_or_default();
+            constant_time_eq(&stored, &apr1(password.as_bytes(), salt.as_bytes()))
+        }
+        Scheme::Bcrypt => bcrypt::verify(password.as_bytes(), &stored).unwrap_or(false),
+        Scheme::Argon2 => PasswordHash::new(&stored).is_ok_and(|hash| {
+            Argon2::default()
+                .verify_password(password.as_bytes(), &hash)
+                .is_ok()
+        }),
+    })
+    .await
+    .unwrap_or(false)
+}
+
+/// Hash that passwords of unknown users are checked against.
+fn dummy_hash() -> &'static str {
+    static HASH: OnceLock<String> = OnceLock::new();
+    HASH.get_or_init(|| hash_as(Scheme::Argon2, &cuid2::cuid()).unwrap_or_default())
+}
+
+/// Checks a password against a dummy argon2id hash, so that logins of users
+/// who do not exist take as long as the others and do not reveal that.
+pub async fn verify_dummy(password: &str) {
+    let password = password.to_string();
+    let _ = task::spawn_blocking(move || {
+        PasswordHash::new(dummy_hash()).is_ok_and(|hash| {
+            Argon2::default()
+                .verify_password(password.as_bytes(), &hash)
+                .is_ok()
+        })
+    })
+    .await;
+}
+
+/// Compares without returning early, so the time taken does not tell how
+/// much of a guess was right.
+pub fn constant_time_eq(a: &str, b: &str) -> bool {
+    a.as_bytes().ct_eq(b.as_bytes()).into()
+}
+
+/// Computes the `$apr1$` hash of a password, which is the MD5 based crypt
+/// of FreeBSD with another prefix.
+fn apr1(password: &[u8], salt: &[u8]) -> String {
+    let salt = &salt[..salt.len().min(8)];
+    let mut context = Md5::new();
+    context.update(password);
+    context.update(APR1_PREFIX.as_bytes());
+    context.update(salt);
+    let alternate = Md5::new()
+        .chain_update(password)
+        .chain_update(salt)
+        .chain_update(password)
+        .finalize();
+    for chunk in password.chunks(16) {
+        context.update(&alternate[..chunk.len()]);
+    }
+    let mut length = password.len();
+    while length > 0 {
+        if length & 1 == 1 {
+            context.update([0]);
+        } else {
+            context.update(&password[..1]);
+        }
+        length >>= 1;
+    }
+    let mut digest = context.finalize();
+
+    // Rounds that are only there to make guessing slower.
+    for round in 0..1000 {
+        let mut context = Md5::new();
+        if round & 1 == 1 {
+            context.update(password);
+        } else {
+            context.update(digest);
+        }
+        if round % 3 != 0 {
+            context.update(salt);
+        }
+        if round % 7 != 0 {
+            context.update(password);
+        }
+        if round & 1 == 1 {
+            context.update(digest);
+        } else {
+            context.update(password);
+        }
+        digest = context.finalize();
+    }
+
+    let mut hash = format!("{APR1_PREFIX}{}$", String::from_utf8_lossy(salt));
+    let mut push = |mut value: u32, count: usize| {
+        for _ in 0..count {
+            hash.push(char::from(CRYPT_ALPHABET[(value & 0x3f) as usize]));
+            value >>= 6;
+        }
+    };
+    for [a, b, c] in [[0, 6, 12], [1, 7, 13], [2, 8, 14], [3, 9, 15], [4, 10, 5]] {
+        let value = u32::from(digest[a]) << 16 | u32::from(digest[b]) << 8 | u32::from(digest[c]);
+        push(value, 4);
+    }
+    push(u32::from(digest[11]), 2);
+    hash
+}
+
+/// Hashes a password with argon2id, the scheme passwords are upgraded to.
+pub async fn hash(password: &str) -> Result<String> {
+    let password = password.to_string();
+    task::spawn_blocking(move || hash_as(Scheme::Argon2, &password)).await?
+}
+
+/// Hashes a password in the scheme, which has to be argon2id or bcrypt.
+/// Blocks the thread while hashing.
+pub fn hash_as(scheme: Scheme, password: &str) -> Result<String> {
+    match scheme {
+        Scheme::Argon2 => {
+            let salt = SaltString::generate(&mut OsRng);
+            Argon2::default()
+                .hash_password(password.as_bytes(), &salt)
+                .map(|hash| hash.to_string())
+                .map_err(|e| anyhow!("failed to hash password: {e}"))
+        }
+        Scheme::Bcrypt => bcrypt::hash(password, bcrypt::DEFAULT_COST)
+            .map_err(|e| anyhow!("failed to hash password: {e}")),
+        Scheme::Plaintext | Scheme::Md5 | Scheme::Sha1 | Scheme::Apr1 => {
+            bail!("passwords are only hashed with argon2id or bcrypt")
+        }
+    }
+}
+
+fn default_min_length() -> usize {
+    8
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct PasswordPolicy {
+    /// Minimum number of characters.
+    #[serde(default = "default_min_length")]
+    pub min_length: usize,
+    /// Require at least one digit.
+    #[serde(default)]
+    pub require_digit: bool,
+    /// Require both lower and upper case letters.
+    #[serde(default)]
+    pub require_mixed_case: bool,
+    /// Require at least one character that is neither a letter nor a digit.
+    #[serde(default)]
+    pub require_symbol: bool,
+}
+
+impl Default for PasswordPolicy {
+    fn default() -> Self {
+        PasswordPolicy {
+            min_length: default_min_length(),
+            require_digit: false,
+            require_mixed_case: false,
+            require_symbol: false,
+        }
+    }
+}
+
+impl PasswordPolicy {
+    /// Checks a new password of the user. Returns why it is rejected.
+    pub fn check(&self, username: &str, password: &str) -> Result<(), String> {
+        if password.chars().count() < self.min_length {
+            return Err(format!(
+                "Password must be at least {} characters long.",
+                self.min_length
+            ));
+        }
+        if password.eq_ignore_ascii_case(username) {
+            return Err(String::from("Password must differ from the user name."));
+        }
+        if self.require_digit && !password.chars().any(|c| c.is_ascii_digit()) {
+            return Err(String::from("Password must contain a digit."));
+        }
+        if self.require_mixed_case
+            && !(password.chars().any(char::is_lowercase)
+                && password.chars().any(char::is_uppercase))
+        {
+            return Err(String::from(
+                "Password must contain lower and upper case letters.",
+            ));
+        }
+        if self.require_symbol && password.chars().all(char::is_alphanumeric) {
+            return Err(String::from("Password must contain a symbol."));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn apr1_matches_htpasswd() {
+        // openssl passwd -apr1 -salt saltsalt hunter2
+        assert_eq!(
+            apr1(b"hunter2", b"saltsalt"),
+            "$apr1$saltsalt$r/QcFGT5pNL28bNkeDMHR."
+        );
+        // Salts are cut to 8 characters.
+        assert_eq!(
+            apr1(b"hunter2", b"saltsaltsalt"),
+            "$apr1$saltsalt$r/QcFGT5pNL28bNkeDMHR."
+        );
+    }
+
+    #[test]
+    fn recognizes_schemes() {
+        assert_eq!(Scheme::of("$apr1$saltsalt$x"), Scheme::Apr1);
+        assert_eq!(Scheme::of("{SHA}x"), Scheme::Sha1);
+        assert_eq!(
+            Scheme::of("{MD5}2ab96390c7dbe3439de74d0c9b0b1767"),
+            Scheme::Md5
+        );
+        // Not a digest, so a plaintext password that looks like one.
+        assert_eq!(Scheme::of("{MD5}x"), Scheme::Plaintext);
+        assert_eq!(Scheme::of("hunter2"), Scheme::Plaintext);
+        assert!(Scheme::of("hunter2").is_legacy());
+    }
+
+    #[tokio::test]
+    async fn verifies_legacy_schemes() {
+        for stored in [
+            "hunter2",
+            "{MD5}2ab96390c7dbe3439de74d0c9b0b1767",
+            "{SHA}87u9ZqY9S/F0eUBXjsPQEDUw4h0=",
+            "$apr1$saltsalt$r/QcFGT5pNL28bNkeDMHR.",
+        ] {
+            assert!(verify(stored, "hunter2").await, "{stored}");
+            assert!(!verify(stored, "hunter3").await, "{stored}");
+        }
+    }
+
+    #[test]
+    fn compares_in_constant_time() {
+        assert!(constant_time_eq("token", "token"));
+        assert!(!constant_time_eq("token", "tokeN"));
+        assert!(!constant_time_eq("token", "token2"));
+    }
+
+    #[test]
+    fn dummy_hash_costs_like_new_hashes() {
+        let hash = PasswordHash::new(dummy_hash()).unwrap();
+        assert_eq!(hash.algorithm.as_str(), "argon2id");
+        assert_eq!(
+            argon2::Params::try_from(&hash).unwrap(),
+            argon2::Params::default()
+        );
+    }
+}
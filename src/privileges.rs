@@ -0,0 +1,91 @@
+use std::{ffi::CString, os::unix::ffi::OsStrExt, path::Path, ptr};
+
+use anyhow::{Result, anyhow, bail};
+
+use crate::config::RunAs;
+
+/// Numeric user and group the process switches to.
+#[derive(Debug, Clone, Copy)]
+pub struct Credentials {
+    uid: libc::uid_t,
+    gid: libc::gid_t,
+}
+
+/// Looks up the configured user and group in the system databases.
+///
+/// Has to be called before `chroot`, because `/etc/passwd` and `/etc/group`
+/// are usually not reachable from inside the new root.
+pub fn resolve(run_as: &RunAs) -> Result<Credentials> {
+    let user = CString::new(run_as.user.as_str()).map_err(|_| anyhow!("invalid user name"))?;
+
+    // SAFETY: `user` is a valid nul-terminated string. The returned pointer is
+    // only read before any other call that could overwrite it.
+    let passwd = unsafe { libc::getpwnam(user.as_ptr()) };
+    if passwd.is_null() {
+        bail!("user '{}' does not exist", run_as.user);
+    }
+    // SAFETY: `passwd` was checked to be non-null above.
+    let (uid, mut gid) = unsafe { ((*passwd).pw_uid, (*passwd).pw_gid) };
+
+    if let Some(group_name) = &run_as.group {
+        let group = CString::new(group_name.as_str()).map_err(|_| anyhow!("invalid group name"))?;
+        // SAFETY: `group` is a valid nul-terminated string.
+        let entry = unsafe { libc::getgrnam(group.as_ptr()) };
+        if entry.is_null() {
+            bail!("group '{group_name}' does not exist");
+        }
+        // SAFETY: `entry` was checked to be non-null above.
+        gid = unsafe { (*entry).gr_gid };
+    }
+
+    Ok(Credentials { uid, gid })
+}
+
+/// Confines the process to the given directory with chroot(2).
+pub fn chroot(path: &Path) -> Result<()> {
+    let c_path =
+        CString::new(path.as_os_str().as_bytes()).map_err(|_| anyhow!("invalid root path"))?;
+
+    // SAFETY: `c_path` is a valid nul-terminated string.
+    unsafe {
+        if libc::chroot(c_path.as_ptr()) != 0 {
+            bail!("failed to chroot: {}", std::io::Error::last_os_error());
+        }
+    }
+    std::env::set_current_dir("/").map_err(|e| anyhow!("failed to enter new root: {e}"))?;
+    Ok(())
+}
+
+/// Switches the process to the resolved user and group.
+///
+/// Supplementary groups are cleared first, then the group and the user are
+/// changed, in this order, because changing the group requires root.
+pub fn drop_privileges(credentials: &Credentials) -> Result<()> {
+    // SAFETY: plain syscalls without pointers to Rust memory.
+    unsafe {
+        // Already switched, e.g. when the listener was inherited on restart.
+        if libc::getuid() == credentials.uid && libc::getgid() == credentials.gid {
+            return Ok(());
+        }
+        if libc::setgroups(0, ptr::null()) != 0 {
+            bail!(
+                "failed to clear supplementary groups: {}",
+                std::io::Error::last_os_error()
+            );
+        }
+        if libc::setgid(credentials.gid) != 0 {
+            bail!(
+                "failed to change group: {}",
+                std::io::Error::last_os_error()
+            );
+        }
+        if libc::setuid(credentials.uid) != 0 {
+            bail!("failed to change user: {}", std::io::Error::last_os_error());
+        }
+        if credentials.uid != 0 && libc::setuid(0) == 0 {
+            bail!("root privileges can still be regained");
+        }
+    }
+
+    Ok(())
+}
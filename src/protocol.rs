@@ -0,0 +1,419 @@
+//! Parsing and formatting of the FTP control channel.
+//!
+//! Everything here works on untrusted input and must never panic.
+
+use std::net::{IpAddr, Ipv4Addr, SocketAddr, SocketAddrV4};
+
+/// Command lines longer than this are rejected.
+pub const MAX_LINE_LENGTH: usize = 4096;
+
+/// Collects bytes from the control connection into command lines.
+#[derive(Debug, Default)]
+pub struct LineBuffer {
+    buf: Vec<u8>,
+}
+
+/// The client sent more than [`MAX_LINE_LENGTH`] bytes without a line break.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct LineTooLong;
+
+impl LineBuffer {
+    pub fn push(&mut self, data: &[u8]) {
+        self.buf.extend_from_slice(data);
+    }
+
+    /// Takes the next complete line without the line break. Both `\r\n` and a
+    /// bare `\n` end a line, and so does a `\r` that ends the received
+    /// data. Invalid UTF-8 is replaced.
+    pub fn next_line(&mut self) -> Result<Option<String>, LineTooLong> {
+        let line = self.next_raw_line()?;
+        Ok(line.map(|line| String::from_utf8_lossy(&line).to_string()))
+    }
+
+    /// Same as [`LineBuffer::next_line`], but returns the bytes as received.
+    pub fn next_raw_line(&mut self) -> Result<Option<Vec<u8>>, LineTooLong> {
+        match self.buf.iter().position(|&b| b == b'\n') {
+            Some(end) if end <= MAX_LINE_LENGTH => {
+                let mut line: Vec<u8> = self.buf.drain(..=end).collect();
+                line.pop();
+                if line.last() == Some(&b'\r') {
+                    line.pop();
+                }
+                Ok(Some(line))
+            }
+            Some(_) => Err(LineTooLong),
+            None if self.buf.len() > MAX_LINE_LENGTH => Err(LineTooLong),
+            // Clients that send ABOR as urgent data lose the `\n` to the
+            // urgent mark. If it does arrive, it is an empty line.
+            None if self.buf.last() == Some(&b'\r') => {
+                let mut line = std::mem::take(&mut self.buf);
+                line.pop();
+                Ok(Some(line))
+            }
+            None => Ok(None),
+        }
+    }
+}
+
+/// Telnet "interpret as command" byte.
+const IAC: u8 = 0xFF;
+
+/// Removes Telnet commands from a command line, like the Interrupt Process
+/// and Synch clients send ahead of ABOR. `IAC IAC` stands for a 0xFF byte.
+pub fn strip_telnet(line: Vec<u8>) -> Vec<u8> {
+    if !line.contains(&IAC) {
+        return line;
+    }
+    let mut stripped = Vec::with_capacity(line.len());
+    let mut bytes = line.into_iter();
+    while let Some(byte) = bytes.next() {
+        if byte != IAC {
+            stripped.push(byte);
+            continue;
+        }
+        match bytes.next() {
+            Some(IAC) => stripped.push(IAC),
+            // WILL, WONT, DO and DONT are followed by an option.
+            Some(251..=254) => {
+                bytes.next();
+            }
+            Some(240..=250) | None => {}
+            // Not a command. Synch ends with a Data Mark sent as urgent
+            // data, which does not arrive inline, so the IAC before it may
+            // be followed by the command itself.
+            Some(other) => stripped.push(other),
+        }
+    }
+    stripped
+}
+
+/// Splits a command line into an upper-cased verb and its argument.
+pub fn parse_command(line: &str) -> Option<(String, String)> {
+    let line = line.trim_end_matches(['\r', '\n']);
+    let (verb, arg) = line.split_once(' ').unwrap_or((line, ""));
+    if verb.is_empty() {
+        return None;
+    }
+    Some((verb.to_ascii_uppercase(), arg.to_string()))
+}
+
+/// Hides the passwords of PASS and SITE PSWD in a command line, so it can be
+/// stored.
+pub fn redact_command(line: &str) -> String {
+    let mut words = line.splitn(3, ' ');
+    match (words.next(), words.next(), words.next()) {
+        (Some(verb), Some(_), _) if verb.eq_ignore_ascii_case("PASS") => format!("{verb} ****"),
+        (Some(verb), Some(sub), Some(_))
+            if verb.eq_ignore_ascii_case("SITE") && sub.eq_ignore_ascii_case("PSWD") =>
+        {
+            format!("{verb} {sub} ****")
+        }
+        _ => line.to_string(),
+    }
+}
+
+/// Parses the argument of PORT: `h1,h2,h3,h4,p1,p2`.
+pub fn parse_port(arg: &str) -> Option<SocketAddr> {
+    let numbers: Vec<u8> = arg
+        .split(',')
+        .map(|n| n.trim().parse().ok())
+        .collect::<Option<_>>()?;
+    let [h1, h2, h3, h4, p1, p2] = numbers.as_slice() else {
+        return None;
+    };
+    let port = u16::from(*p1) << 8 | u16::from(*p2);
+    Some(SocketAddr::V4(SocketAddrV4::new(
+        Ipv4Addr::new(*h1, *h2, *h3, *h4),
+        port,
+    )))
+}
+
+/// Formats an address as in the reply to PASV: `h1,h2,h3,h4,p1,p2`.
+pub fn format_pasv(addr: SocketAddrV4) -> String {
+    let [h1, h2, h3, h4] = addr.ip().octets();
+    let port = addr.port();
+    format!("{h1},{h2},{h3},{h4},{},{}", port >> 8, port & 0xff)
+}
+
+/// Parses the argument of EPRT (RFC 2428): `|1|132.235.1.2|6275|`. Any
+/// printable character can be used as the delimiter.
+pub fn parse_eprt(arg: &str) -> Option<SocketAddr> {
+    let delimiter = arg.chars().next()?;
+    if !delimiter.is_ascii_graphic() || delimiter.is_ascii_digit() {
+        return None;
+    }
+    let parts: Vec<&str> = arg.split(delimiter).collect();
+    let ["", protocol, address, port, ""] = parts.as_slice() else {
+        return None;
+    };
+    let ip: IpAddr = match *protocol {
+        "1" => IpAddr::V4(address.parse().ok()?),
+        "2" => IpAddr::V6(address.parse().ok()?),
+        _ => return None,
+    };
+    Some(SocketAddr::new(ip, port.parse().ok()?))
+}
+
+/// Formats the port as in the reply to EPSV: `(|||6446|)`.
+pub fn format_epsv(port: u16) -> String {
+    format!("(|||{port}|)")
+}
+
+/// Splits the arguments of XCRC and friends into the path and an optional
+/// byte range, like `"my file.txt" 0 1024`. Paths with spaces have to be
+/// quoted when a range follows.
+pub fn parse_path_range(arg: &str) -> Option<(&str, u64, Option<u64>)> {
+    let (path, rest) = match arg.strip_prefix('"') {
+        Some(quoted) => {
+            let (path, rest) = quoted.split_once('"')?;
+            (path, rest)
+        }
+        None => arg.split_once(' ').unwrap_or((arg, "")),
+    };
+    let mut numbers = rest.split_whitespace().map(|n| n.parse::<u64>());
+    let start = numbers.next().transpose().ok()?.unwrap_or(0);
+    let end = numbers.next().transpose().ok()?;
+    if path.is_empty() || numbers.next().is_some() {
+        return None;
+    }
+    Some((path, start, end))
+}
+
+/// Splits arguments separated by spaces, like the paths of COMB. Arguments
+/// with spaces are quoted. Returns `None` if a quote is not closed.
+pub fn split_arguments(arg: &str) -> Option<Vec<&str>> {
+    let mut arguments = Vec::new();
+    let mut rest = arg.trim_start();
+    while !rest.is_empty() {
+        let (argument, next) = match rest.strip_prefix('"') {
+            Some(quoted) => quoted.split_once('"')?,
+            None => rest.split_once(' ').unwrap_or((rest, "")),
+        };
+        arguments.push(argument);
+        rest = next.trim_start();
+    }
+    Some(arguments)
+}
+
+/// Quotes a path for a 257 reply, doubling quotes inside it.
+pub fn quote_path(path: &str) -> String {
+    format!("\"{}\"", path.replace('"', "\"\""))
+}
+
+/// Normalizes a virtual path: makes it absolute, removes empty and `.`
+/// segments and resolves `..` without ever going above `/`.
+pub fn clean_path(path: &str) -> String {
+    let mut segments: Vec<&str> = Vec::new();
+    for segment in path.split(['/', '\\']) {
+        match segment {
+            "" | "." => {}
+            ".." => {
+                segments.pop();
+            }
+            segment => segments.push(segment),
+        }
+    }
+    format!("/{}", segments.join("/"))
+}
+
+/// Resolves a path given by the client against the current directory.
+pub fn join_path(current_dir: &str, path: &str) -> String {
+    if path.starts_with('/') {
+        clean_path(path)
+    } else {
+        clean_path(&format!("{current_dir}/{path}"))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_commands() {
+        let cases = [
+            ("USER alice", Some(("USER", "alice"))),
+            ("user alice\r\n", Some(("USER", "alice"))),
+            ("STOR my file.txt", Some(("STOR", "my file.txt"))),
+            ("NOOP", Some(("NOOP", ""))),
+            ("PASS ", Some(("PASS", ""))),
+            ("", None),
+            ("\r\n", None),
+            (" USER alice", None),
+        ];
+        for (line, expected) in cases {
+            let parsed = parse_command(line);
+            let parsed = parsed.as_ref().map(|(c, a)| (c.as_str(), a.as_str()));
+            assert_eq!(parsed, expected, "{line:?}");
+        }
+    }
+
+    #[test]
+    fn redacts_passwords() {
+        let cases = [
+            ("PASS secret", "PASS ****"),
+            ("pass secret with spaces", "pass ****"),
+            ("PASS", "PASS"),
+            ("SITE PSWD old new", "SITE PSWD ****"),
+            ("site pswd old", "site pswd ****"),
+            ("SITE PSWD", "SITE PSWD"),
+            ("SITE CHMOD 644 file", "SITE CHMOD 644 file"),
+            ("USER alice", "USER alice"),
+        ];
+        for (line, expected) in cases {
+            assert_eq!(redact_command(line), expected, "{line:?}");
+        }
+    }
+
+    #[test]
+    fn parses_port() {
+        let cases = [
+            ("127,0,0,1,4,1", Some("127.0.0.1:1025")),
+            (" 10, 0, 0, 2, 0, 21 ", Some("10.0.0.2:21")),
+            ("127,0,0,1,4", None),
+            ("127,0,0,1,4,1,1", None),
+            ("256,0,0,1,4,1", None),
+            ("127,0,0,1,-1,1", None),
+            ("", None),
+        ];
+        for (arg, expected) in cases {
+            let expected = expected.map(|a| a.parse::<SocketAddr>().unwrap());
+            assert_eq!(parse_port(arg), expected, "{arg:?}");
+        }
+    }
+
+    #[test]
+    fn parses_eprt() {
+        let cases = [
+            ("|1|132.235.1.2|6275|", Some("132.235.1.2:6275")),
+            ("|2|::1|21|", Some("[::1]:21")),
+            ("!1!10.0.0.1!21!", Some("10.0.0.1:21")),
+            ("|1|::1|21|", None),
+            ("|2|10.0.0.1|21|", None),
+            ("|3|10.0.0.1|21|", None),
+            ("|1|10.0.0.1|70000|", None),
+            ("|1|10.0.0.1|21", None),
+            ("1|1|10.0.0.1|21|", None),
+            (" 1 10.0.0.1 21 ", None),
+            ("", None),
+        ];
+        for (arg, expected) in cases {
+            let expected = expected.map(|a| a.parse::<SocketAddr>().unwrap());
+            assert_eq!(parse_eprt(arg), expected, "{arg:?}");
+        }
+    }
+
+    #[test]
+    fn formats_passive_replies() {
+        let addr = SocketAddrV4::new(Ipv4Addr::new(192, 168, 1, 2), 50000);
+        assert_eq!(format_pasv(addr), "192,168,1,2,195,80");
+        assert_eq!(parse_port(&format_pasv(addr)), Some(SocketAddr::V4(addr)));
+        assert_eq!(format_epsv(6446), "(|||6446|)");
+    }
+
+    #[test]
+    fn cleans_paths() {
+        let cases = [
+            ("", "/"),
+            ("/", "/"),
+            ("a/b", "/a/b"),
+            ("/a//b/", "/a/b"),
+            ("/a/./b", "/a/b"),
+            ("/a/../b", "/b"),
+            ("/../../etc", "/etc"),
+            ("..", "/"),
+            ("a\\..\\..\\b", "/b"),
+        ];
+        for (path, expected) in cases {
+            assert_eq!(clean_path(path), expected, "{path:?}");
+        }
+    }
+
+    #[test]
+    fn joins_paths() {
+        let cases = [
+            ("/home", "file", "/home/file"),
+            ("/home", "/file", "/file"),
+            ("/home", "..", "/"),
+            ("/home", "../../..", "/"),
+            ("/", "a/./b/..", "/a"),
+            ("/home", "", "/home"),
+        ];
+        for (current, path, expected) in cases {
+            assert_eq!(join_path(current, path), expected, "{current:?} {path:?}");
+        }
+    }
+
+    #[test]
+    fn strips_telnet_commands() {
+        let cases: [(&[u8], &[u8]); 7] = [
+            (b"ABOR", b"ABOR"),
+            // Interrupt Process and Synch ahead of ABOR.
+            (b"\xff\xf4\xff\xf2ABOR", b"ABOR"),
+            (b"\xff\xf4\xffABOR", b"ABOR"),
+            (b"a\xff\xffb", b"a\xffb"),
+            // WILL with an option.
+            (b"\xff\xfb\x01NOOP", b"NOOP"),
+            (b"NOOP\xff", b"NOOP"),
+            (b"NOOP\xff\xfb", b"NOOP"),
+        ];
+        for (line, expected) in cases {
+            assert_eq!(strip_telnet(line.to_vec()), expected, "{line:?}");
+        }
+    }
+
+    #[test]
+    fn splits_lines() {
+        let mut buffer = LineBuffer::default();
+        buffer.push(b"USER alice\r\nPASS se");
+        assert_eq!(buffer.next_line(), Ok(Some(String::from("USER alice"))));
+        assert_eq!(buffer.next_line(), Ok(None));
+        buffer.push(b"cret\nNOOP\r");
+        assert_eq!(buffer.next_line(), Ok(Some(String::from("PASS secret"))));
+        // A `\r` at the end of the received data ends the line.
+        assert_eq!(buffer.next_line(), Ok(Some(String::from("NOOP"))));
+        assert_eq!(buffer.next_line(), Ok(None));
+
+        buffer.push(b"\xffABOR\n");
+        assert_eq!(buffer.next_line(), Ok(Some(String::from("\u{fffd}ABOR"))));
+        buffer.push(b"\xe9t\xe9\n");
+        assert_eq!(buffer.next_raw_line(), Ok(Some(b"\xe9t\xe9".to_vec())));
+    }
+
+    #[test]
+    fn rejects_long_lines() {
+        let mut buffer = LineBuffer::default();
+        buffer.push(&vec![b'a'; MAX_LINE_LENGTH]);
+        buffer.push(b"\n");
+        assert_eq!(
+            buffer.next_line().map(|l| l.map(|l| l.len())),
+            Ok(Some(MAX_LINE_LENGTH))
+        );
+
+        buffer.push(&vec![b'a'; MAX_LINE_LENGTH + 1]);
+        assert_eq!(buffer.next_line(), Err(LineTooLong));
+        let mut buffer = LineBuffer::default();
+        buffer.push(&vec![b'a'; MAX_LINE_LENGTH + 1]);
+        buffer.push(b"\n");
+        assert_eq!(buffer.next_line(), Err(LineTooLong));
+    }
+
+    #[test]
+    fn splits_arguments() {
+        assert_eq!(
+            split_arguments(r#"target "my part" part2"#),
+            Some(vec!["target", "my part", "part2"])
+        );
+        assert_eq!(split_arguments("  a   b "), Some(vec!["a", "b"]));
+        assert_eq!(split_arguments(""), Some(vec![]));
+        assert_eq!(split_arguments(r#"a "b"#), None);
+        assert_eq!(
+            parse_path_range(r#""my file" 10 20"#),
+            Some(("my file", 10, Some(20)))
+        );
+        assert_eq!(parse_path_range("file"), Some(("file", 0, None)));
+        assert_eq!(parse_path_range("file x"), None);
+        assert_eq!(parse_path_range("file 1 2 3"), None);
+        assert_eq!(quote_path(r#"/a "b""#), r#""/a ""b""""#);
+    }
+}
@@ -0,0 +1,223 @@
+//! Uploads held back until they are approved.
+//!
+//! While quarantine is enabled, finished uploads are kept in a directory of
+//! their own instead of their target path, so no user can see them. An
+//! administrator approves or rejects them through the admin API, or a hook
+//! command decides for every upload.
+
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    sync::{
+        Arc, Mutex,
+        atomic::{AtomicBool, AtomicU64, Ordering},
+    },
+    time::Duration,
+};
+
+use anyhow::{Result, anyhow};
+use serde::{Deserialize, Serialize};
+use tokio::{process::Command, time};
+use tracing::{info, warn};
+
+use crate::{datetime::unix_now, rename};
+
+/// Hooks that run longer are killed and their uploads wait for an admin.
+const HOOK_TIMEOUT: Duration = Duration::from_secs(300);
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct QuarantineConfig {
+    /// Directory uploads are kept in until approved. It should not be inside
+    /// the root of any user. When chroot is enabled, the path is resolved
+    /// inside the root.
+    pub dir: String,
+    /// File where quarantined uploads are persisted, resolved like `dir`.
+    #[serde(default)]
+    pub file: Option<String>,
+    /// Command run for every upload with the quarantined file, the virtual
+    /// path and the account as arguments. Exit code 0 approves the upload,
+    /// 1 rejects it and anything else leaves it for an administrator.
+    #[serde(default)]
+    pub hook: Option<String>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+pub struct QuarantinedUpload {
+    pub id: String,
+    /// Account that uploaded the file.
+    pub owner: String,
+    /// Virtual path the file was uploaded to.
+    pub path: String,
+    /// Real path the file is moved to once approved.
+    pub target: PathBuf,
+    /// Real path of the file in quarantine.
+    pub file: PathBuf,
+    pub size: u64,
+    /// Unix timestamp of the upload.
+    pub uploaded: u64,
+}
+
+impl QuarantinedUpload {
+    /// Creates an entry for an upload that is about to be written to `dir`.
+    pub fn new(dir: &Path, owner: &str, path: &str, target: PathBuf) -> Self {
+        let id = cuid2::cuid();
+        QuarantinedUpload {
+            file: dir.join(&id),
+            id,
+            owner: owner.to_string(),
+            path: path.to_string(),
+            target,
+            size: 0,
+            uploaded: unix_now(),
+        }
+    }
+}
+
+/// Uploads waiting for approval, optionally persisted to a JSON file.
+#[derive(Debug, Default)]
+pub struct Quarantine {
+    path: Option<PathBuf>,
+    uploads: Mutex<Vec<QuarantinedUpload>>,
+    dirty: AtomicBool,
+}
+
+impl Quarantine {
+    /// Loads uploads from the file, or starts empty if it does not exist yet.
+    pub fn load(path: Option<PathBuf>) -> Result<Self> {
+        let uploads = match &path {
+            Some(p) if p.exists() => {
+                let content =
+                    fs::read_to_string(p).map_err(|_| anyhow!("failed to read quarantine file"))?;
+                serde_json::from_str(&content)
+                    .map_err(|e| anyhow!("bad quarantine file format: {e}"))?
+            }
+            _ => Vec::new(),
+        };
+
+        Ok(Quarantine {
+            path,
+            uploads: Mutex::new(uploads),
+            dirty: AtomicBool::new(false),
+        })
+    }
+
+    /// Returns all uploads waiting for approval, oldest first.
+    pub fn list(&self) -> Vec<QuarantinedUpload> {
+        self.uploads
+            .lock()
+            .map(|uploads| uploads.clone())
+            .unwrap_or_default()
+    }
+
+    pub fn add(&self, upload: QuarantinedUpload) {
+        if let Ok(mut uploads) = self.uploads.lock() {
+            uploads.push(upload);
+            self.dirty.store(true, Ordering::Relaxed);
+        }
+    }
+
+    fn take(&self, id: &str) -> Option<QuarantinedUpload> {
+        let mut uploads = self.uploads.lock().ok()?;
+        let index = uploads.iter().position(|u| u.id == id)?;
+        self.dirty.store(true, Ordering::Relaxed);
+        Some(uploads.remove(index))
+    }
+
+    /// Moves the upload to its target. Returns `None` if there is no upload
+    /// with the id.
+    pub async fn approve(&self, id: &str) -> Option<std::io::Result<QuarantinedUpload>> {
+        let upload = self.take(id)?;
+        if let Some(parent) = upload.target.parent()
+            && let Err(e) = tokio::fs::create_dir_all(parent).await
+        {
+            self.add(upload);
+            return Some(Err(e));
+        }
+        let copied = Arc::new(AtomicU64::new(0));
+        match rename::rename(&upload.file, &upload.target, copied).await {
+            Ok(()) => Some(Ok(upload)),
+            Err(e) => {
+                self.add(upload);
+                Some(Err(e))
+            }
+        }
+    }
+
+    /// Deletes the upload. Returns `None` if there is no upload with the id.
+    pub async fn reject(&self, id: &str) -> Option<std::io::Result<QuarantinedUpload>> {
+        let upload = self.take(id)?;
+        match tokio::fs::remove_file(&upload.file).await {
+            Err(e) if e.kind() != std::io::ErrorKind::NotFound => {
+                self.add(upload);
+                Some(Err(e))
+            }
+            _ => Some(Ok(upload)),
+        }
+    }
+
+    /// Runs the hook for the upload and applies its verdict.
+    pub async fn run_hook(&self, hook: &str, upload: &QuarantinedUpload) {
+        let status = time::timeout(
+            HOOK_TIMEOUT,
+            Command::new(hook)
+                .arg(&upload.file)
+                .arg(&upload.path)
+                .arg(&upload.owner)
+                .kill_on_drop(true)
+                .status(),
+        )
+        .await;
+        let (verdict, result) = match status {
+            Ok(Ok(status)) if status.code() == Some(0) => {
+                ("approved", self.approve(&upload.id).await)
+            }
+            Ok(Ok(status)) if status.code() == Some(1) => {
+                ("rejected", self.reject(&upload.id).await)
+            }
+            Ok(Ok(status)) => {
+                info!(id=%upload.id, status=%status, "Quarantine hook left the upload for review.");
+                return;
+            }
+            Ok(Err(e)) => {
+                warn!(id=%upload.id, reason=%e, "Failed to run quarantine hook.");
+                return;
+            }
+            Err(_) => {
+                warn!(id=%upload.id, "Quarantine hook timed out.");
+                return;
+            }
+        };
+        match result {
+            Some(Ok(upload)) => {
+                info!(id=%upload.id, file=%upload.path, verdict=%verdict, "Quarantine hook decided on the upload.")
+            }
+            Some(Err(e)) => {
+                warn!(id=%upload.id, verdict=%verdict, reason=%e, "Failed to apply verdict of quarantine hook.")
+            }
+            // Decided by an administrator in the meantime.
+            None => {}
+        }
+    }
+
+    /// Writes uploads to the file if anything has changed since the last save.
+    pub fn save(&self) -> Result<()> {
+        let Some(path) = &self.path else {
+            return Ok(());
+        };
+        if !self.dirty.swap(false, Ordering::Relaxed) {
+            return Ok(());
+        }
+
+        let content = match self.uploads.lock() {
+            Ok(uploads) => serde_json::to_string_pretty(&*uploads)?,
+            Err(_) => return Ok(()),
+        };
+        let temp_path = path.with_extension("tmp");
+        fs::write(&temp_path, content)
+            .and_then(|_| fs::rename(&temp_path, path))
+            .map_err(|e| {
+                self.dirty.store(true, Ordering::Relaxed);
+                anyhow!("failed to save quarantine: {e}")
+            })
+    }
+}
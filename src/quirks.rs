@@ -0,0 +1,32 @@
+//! Workarounds for clients that identify themselves with CLNT.
+//!
+//! Some clients depend on behaviour the server does not have by default.
+//! Profiles in `client_quirks` are matched against the identification and
+//! the first one that matches applies for the rest of the session.
+
+use serde::Deserialize;
+
+use crate::listing::DirStyle;
+
+#[derive(Debug, Deserialize, Clone, Default)]
+#[serde(deny_unknown_fields)]
+pub struct ClientQuirks {
+    /// Text the identification sent with CLNT has to contain, ignoring case.
+    pub client: String,
+    /// Format of directory listings, e.g. `msdos` for Windows Explorer.
+    /// Clients can still switch it with SITE DIRSTYLE.
+    #[serde(default)]
+    pub dir_style: Option<DirStyle>,
+    /// Send the 150 reply before waiting for the client to connect to the
+    /// passive port, as old clients only connect after they got it.
+    #[serde(default)]
+    pub reply_before_accept: bool,
+}
+
+/// Finds the first profile that matches the client identification.
+pub fn find<'a>(quirks: &'a [ClientQuirks], client: &str) -> Option<&'a ClientQuirks> {
+    let client = client.to_lowercase();
+    quirks
+        .iter()
+        .find(|q| client.contains(&q.client.to_lowercase()))
+}
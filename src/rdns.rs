@@ -0,0 +1,198 @@
+//! Reverse DNS lookups and access policy based on the host name of the client.
+//!
+//! A name is only trusted when it resolves back to the address it was looked
+//! up for, because whoever controls the address also controls its PTR record.
+
+use std::{
+    collections::HashMap,
+    net::IpAddr,
+    sync::Mutex,
+    time::{Duration, Instant},
+};
+
+use serde::{Deserialize, Serialize};
+use tokio::{net, task, time};
+
+/// The cache is pruned when it grows beyond this many addresses.
+const MAX_CACHE_ENTRIES: usize = 10_000;
+
+/// Allowed and denied host names. A pattern is either a full name or
+/// `*.example.com`, which matches every name below `example.com`.
+#[derive(Debug, Serialize, Deserialize, Clone, Default)]
+pub struct HostnamePolicy {
+    /// When not empty, only matching host names are allowed.
+    #[serde(default)]
+    pub allow: Vec<String>,
+    #[serde(default)]
+    pub deny: Vec<String>,
+}
+
+impl HostnamePolicy {
+    /// Checks if the host name is permitted. Clients without a confirmed name
+    /// are permitted only when there is no allow list.
+    pub fn permits(&self, hostname: Option<&str>) -> bool {
+        match hostname {
+            Some(name) => {
+                !self.deny.iter().any(|p| matches(p, name))
+                    && (self.allow.is_empty() || self.allow.iter().any(|p| matches(p, name)))
+            }
+            None => self.allow.is_empty(),
+        }
+    }
+}
+
+fn matches(pattern: &str, hostname: &str) -> bool {
+    let pattern = pattern.trim_end_matches('.').to_ascii_lowercase();
+    let hostname = hostname.trim_end_matches('.').to_ascii_lowercase();
+    match pattern.strip_prefix("*.") {
+        Some(domain) => hostname
+            .strip_suffix(domain)
+            .is_some_and(|prefix| prefix.len() > 1 && prefix.ends_with('.')),
+        None => hostname == pattern,
+    }
+}
+
+fn default_cache_secs() -> u64 {
+    3600
+}
+
+fn default_timeout() -> u64 {
+    3000
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct ReverseDnsConfig {
+    /// How long lookup results are reused, in seconds.
+    #[serde(default = "default_cache_secs")]
+    pub cache_secs: u64,
+    /// Lookups that take longer are treated as failed, in milliseconds.
+    #[serde(default = "default_timeout")]
+    pub timeout_ms: u64,
+    /// Policy for all connections.
+    #[serde(flatten)]
+    pub policy: HostnamePolicy,
+}
+
+#[derive(Debug)]
+struct CachedName {
+    hostname: Option<String>,
+    expires: Instant,
+}
+
+/// Host names of recent clients, including addresses without one.
+#[derive(Debug, Default)]
+pub struct HostnameCache {
+    entries: Mutex<HashMap<IpAddr, CachedName>>,
+}
+
+impl HostnameCache {
+    /// Returns the confirmed host name of the address.
+    pub async fn resolve(&self, ip: IpAddr, config: &ReverseDnsConfig) -> Option<String> {
+        let ip = ip.to_canonical();
+        if let Some(cached) = self.get(ip) {
+            return cached;
+        }
+
+        let timeout = Duration::from_millis(config.timeout_ms);
+        // Timeouts are not cached, the resolver may answer next time.
+        let hostname = time::timeout(timeout, confirmed_name(ip)).await.ok()?;
+        self.insert(ip, hostname.clone(), Duration::from_secs(config.cache_secs));
+        hostname
+    }
+
+    fn get(&self, ip: IpAddr) -> Option<Option<String>> {
+        let entries = self.entries.lock().ok()?;
+        entries
+            .get(&ip)
+            .filter(|cached| cached.expires > Instant::now())
+            .map(|cached| cached.hostname.clone())
+    }
+
+    fn insert(&self, ip: IpAddr, hostname: Option<String>, ttl: Duration) {
+        let Ok(mut entries) = self.entries.lock() else {
+            return;
+        };
+        let now = Instant::now();
+        if entries.len() >= MAX_CACHE_ENTRIES {
+            entries.retain(|_, cached| cached.expires > now);
+            if entries.len() >= MAX_CACHE_ENTRIES {
+                entries.clear();
+            }
+        }
+        entries.insert(
+            ip,
+            CachedName {
+                hostname,
+                expires: now + ttl,
+            },
+        );
+    }
+}
+
+/// Looks up the PTR record of the address and checks that the name resolves
+/// back to it.
+async fn confirmed_name(ip: IpAddr) -> Option<String> {
+    let hostname = task::spawn_blocking(move || lookup_ptr(ip))
+        .await
+        .ok()
+        .flatten()?;
+    let confirmed = net::lookup_host((hostname.as_str(), 0))
+        .await
+        .ok()?
+        .any(|addr| addr.ip().to_canonical() == ip);
+    confirmed.then_some(hostname)
+}
+
+#[cfg(unix)]
+fn lookup_ptr(ip: IpAddr) -> Option<String> {
+    use std::{ffi::CStr, mem};
+
+    // SAFETY: all-zero bytes are a valid value for these plain C structs.
+    let mut storage: libc::sockaddr_storage = unsafe { mem::zeroed() };
+    let length = match ip {
+        IpAddr::V4(v4) => {
+            // SAFETY: `sockaddr_storage` is large enough and suitably aligned
+            // for every socket address type.
+            let addr = unsafe { &mut *(&mut storage as *mut _ as *mut libc::sockaddr_in) };
+            addr.sin_family = libc::AF_INET as libc::sa_family_t;
+            addr.sin_addr.s_addr = u32::from_ne_bytes(v4.octets());
+            mem::size_of::<libc::sockaddr_in>()
+        }
+        IpAddr::V6(v6) => {
+            // SAFETY: as above.
+            let addr = unsafe { &mut *(&mut storage as *mut _ as *mut libc::sockaddr_in6) };
+            addr.sin6_family = libc::AF_INET6 as libc::sa_family_t;
+            addr.sin6_addr.s6_addr = v6.octets();
+            mem::size_of::<libc::sockaddr_in6>()
+        }
+    };
+
+    let mut host = [0 as libc::c_char; libc::NI_MAXHOST as usize];
+    // SAFETY: `storage` holds an initialized address of `length` bytes and
+    // `host` is a writable buffer of the given size.
+    let result = unsafe {
+        libc::getnameinfo(
+            &storage as *const _ as *const libc::sockaddr,
+            length as libc::socklen_t,
+            host.as_mut_ptr(),
+            host.len() as libc::socklen_t,
+            std::ptr::null_mut(),
+            0,
+            libc::NI_NAMEREQD,
+        )
+    };
+    if result != 0 {
+        return None;
+    }
+
+    // SAFETY: `getnameinfo` succeeded, so `host` is nul-terminated.
+    let host = unsafe { CStr::from_ptr(host.as_ptr()) };
+    host.to_str()
+        .ok()
+        .map(|h| h.trim_end_matches('.').to_string())
+}
+
+#[cfg(not(unix))]
+fn lookup_ptr(_ip: IpAddr) -> Option<String> {
+    None
+}
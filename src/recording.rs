@@ -0,0 +1,442 @@
+//! Recording of sessions and replaying them against a server.
+//!
+//! A recording is a file of JSON lines, one per event: the raw command lines
+//! sent by the client, the replies exactly as they were sent and metadata of
+//! file transfers. Passwords are never written. `dock replay` re-drives the
+//! recorded commands against a server and reports replies that differ, which
+//! helps to reproduce client-specific bugs without the client.
+
+use std::{
+    fs::{self, File, OpenOptions},
+    io::{BufRead, BufReader as StdBufReader, Write},
+    net::SocketAddr,
+    path::{Path, PathBuf},
+    time::{Duration, Instant},
+};
+
+use anyhow::{Result, anyhow};
+use serde::{Deserialize, Serialize};
+use tokio::{
+    io::{AsyncReadExt, AsyncWriteExt, BufReader},
+    net::{TcpListener, TcpStream},
+    time,
+};
+
+use crate::{
+    ftptest::{self, Reply, TEST_PASSWORD, TEST_USER, TestServer},
+    history::Direction,
+    protocol,
+};
+
+/// How long replay waits for a reply or a data connection.
+const REPLAY_TIMEOUT: Duration = Duration::from_secs(10);
+/// Commands that transfer data from the server.
+const DOWNLOAD_COMMANDS: [&str; 4] = ["RETR", "LIST", "NLST", "MLSD"];
+/// Commands that transfer data to the server.
+const UPLOAD_COMMANDS: [&str; 3] = ["STOR", "APPE", "STOU"];
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(tag = "event", rename_all = "lowercase")]
+pub enum Event {
+    Connect {
+        client: String,
+    },
+    /// Command line as it was received, without the line break.
+    Command {
+        line: String,
+    },
+    /// Reply as it was sent, including line breaks.
+    Reply {
+        text: String,
+    },
+    Transfer {
+        direction: Direction,
+        /// Virtual path of the file.
+        path: String,
+        bytes: u64,
+        completed: bool,
+    },
+    Close {
+        outcome: String,
+    },
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Entry {
+    /// Milliseconds since the session started.
+    pub elapsed_ms: u64,
+    #[serde(flatten)]
+    pub event: Event,
+}
+
+/// Writes events of a single session to its recording file.
+#[derive(Debug)]
+pub struct Recorder {
+    file: File,
+    path: PathBuf,
+    started: Instant,
+}
+
+impl Recorder {
+    /// Creates `<dir>/<session id>.jsonl`.
+    pub fn create(dir: &Path, session_id: &str) -> Result<Self> {
+        let path = dir.join(format!("{session_id}.jsonl"));
+        let file = OpenOptions::new()
+            .create_new(true)
+            .write(true)
+            .open(&path)
+            .map_err(|e| anyhow!("failed to create recording {}: {e}", path.display()))?;
+        Ok(Recorder {
+            file,
+            path,
+            started: Instant::now(),
+        })
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    pub fn record(&mut self, event: Event) -> Result<()> {
+        let entry = Entry {
+            elapsed_ms: self.started.elapsed().as_millis() as u64,
+            event,
+        };
+        let mut line = serde_json::to_string(&entry)?;
+        line.push('\n');
+        self.file
+            .write_all(line.as_bytes())
+            .map_err(|e| anyhow!("failed to write recording: {e}"))
+    }
+
+    /// Records a command line with the passwords of PASS and SITE PSWD hidden.
+    pub fn record_command(&mut self, line: &str) -> Result<()> {
+        let line = protocol::redact_command(line);
+        self.record(Event::Command { line })
+    }
+}
+
+/// Reads all entries of a recording.
+pub fn read_recording(path: &Path) -> Result<Vec<Entry>> {
+    let file = File::open(path).map_err(|e| anyhow!("failed to open recording: {e}"))?;
+    let mut entries = Vec::new();
+    for (number, line) in StdBufReader::new(file).lines().enumerate() {
+        let line = line?;
+        if line.trim().is_empty() {
+            continue;
+        }
+        let entry = serde_json::from_str(&line)
+            .map_err(|e| anyhow!("bad recording entry on line {}: {e}", number + 1))?;
+        entries.push(entry);
+    }
+    Ok(entries)
+}
+
+#[derive(Debug, Default)]
+pub struct ReplayOptions {
+    /// Server to replay against. A test server with the files downloaded in
+    /// the recording is started when not set.
+    pub address: Option<SocketAddr>,
+    /// Replaces the argument of USER.
+    pub user: Option<String>,
+    /// Sent with PASS instead of the hidden password.
+    pub password: Option<String>,
+    /// Keep the delays between commands as recorded.
+    pub realtime: bool,
+}
+
+#[derive(Debug, Default)]
+pub struct ReplayReport {
+    pub commands: usize,
+    /// Replies whose code differs from the recorded one.
+    pub mismatches: usize,
+}
+
+/// A command with everything that was recorded after it.
+#[derive(Debug)]
+struct Step {
+    line: String,
+    elapsed_ms: u64,
+    replies: Vec<String>,
+    transfer: Option<(Direction, u64)>,
+}
+
+/// Replays a recording and prints every exchange to stdout.
+pub async fn replay(path: &Path, options: ReplayOptions) -> Result<ReplayReport> {
+    let entries = read_recording(path)?;
+    let (greeting, steps) = split_steps(&entries);
+
+    let (server, addr) = match options.address {
+        Some(addr) => (None, addr),
+        None => {
+            let server = TestServer::start().await?;
+            prepare_files(server.root(), &entries)?;
+            let addr = server.addr();
+            (Some(server), addr)
+        }
+    };
+    // The test server only knows its own user.
+    let user = options
+        .user
+        .or_else(|| server.as_ref().map(|_| String::from(TEST_USER)));
+    let password = options
+        .password
+        .or_else(|| server.as_ref().map(|_| String::from(TEST_PASSWORD)));
+
+    println!("Replaying {} against {addr}", path.display());
+    let mut replayer = Replayer {
+        control: BufReader::new(TcpStream::connect(addr).await?),
+        passive: None,
+        active: None,
+        report: ReplayReport::default(),
+    };
+    let reply = replayer.reply().await?;
+    replayer.compare(greeting.as_deref(), &reply);
+
+    let started = Instant::now();
+    for step in steps {
+        if options.realtime {
+            let due = Duration::from_millis(step.elapsed_ms);
+            if let Some(wait) = due.checked_sub(started.elapsed()) {
+                time::sleep(wait).await;
+            }
+        }
+        let line = substitute(&step.line, user.as_deref(), password.as_deref());
+        replayer.run(line, &step).await?;
+    }
+
+    let Replayer { report, .. } = replayer;
+    if let Some(server) = server {
+        server.stop().await?;
+    }
+    println!(
+        "{} commands replayed, {} replies differ",
+        report.commands, report.mismatches
+    );
+    Ok(report)
+}
+
+/// Groups entries by command. Returns the greeting and the commands.
+fn split_steps(entries: &[Entry]) -> (Option<String>, Vec<Step>) {
+    let mut greetings = Vec::new();
+    let mut steps: Vec<Step> = Vec::new();
+    for entry in entries {
+        match &entry.event {
+            Event::Command { line } => steps.push(Step {
+                line: line.clone(),
+                elapsed_ms: entry.elapsed_ms,
+                replies: Vec::new(),
+                transfer: None,
+            }),
+            Event::Reply { text } => {
+                let replies = match steps.last_mut() {
+                    Some(step) => &mut step.replies,
+                    None => &mut greetings,
+                };
+                // Lines of a multiline reply can be written one by one.
+                match replies.last_mut() {
+                    Some(last) if !is_complete(last) => last.push_str(text),
+                    _ => replies.push(text.clone()),
+                }
+            }
+            Event::Transfer {
+                direction, bytes, ..
+            } => {
+                if let Some(step) = steps.last_mut() {
+                    step.transfer = Some((*direction, *bytes));
+                }
+            }
+            Event::Connect { .. } | Event::Close { .. } => {}
+        }
+    }
+    (greetings.into_iter().next(), steps)
+}
+
+/// Checks if the reply text ends with the final line of a reply.
+fn is_complete(text: &str) -> bool {
+    let code = text.get(..3);
+    let last = text.trim_end_matches(['\r', '\n']).lines().last();
+    last.is_some_and(|line| line.get(..3) == code && line.as_bytes().get(3) != Some(&b'-'))
+}
+
+/// Creates files that were downloaded in the recording, filled with zeros.
+fn prepare_files(root: &Path, entries: &[Entry]) -> Result<()> {
+    for entry in entries {
+        if let Event::Transfer {
+            direction: Direction::Download,
+            path,
+            bytes,
+            ..
+        } = &entry.event
+        {
+            let virtual_path = protocol::clean_path(path);
+            let real_path = root.join(virtual_path.trim_start_matches('/'));
+            if let Some(parent) = real_path.parent() {
+                fs::create_dir_all(parent)?;
+            }
+            File::create(&real_path)?.set_len(*bytes)?;
+        }
+    }
+    Ok(())
+}
+
+/// Replaces credentials in USER and PASS.
+fn substitute(line: &str, user: Option<&str>, password: Option<&str>) -> String {
+    let Some((verb, _)) = protocol::parse_command(line) else {
+        return line.to_string();
+    };
+    match (verb.as_str(), user, password) {
+        ("USER", Some(user), _) => format!("USER {user}"),
+        ("PASS", _, Some(password)) => format!("PASS {password}"),
+        _ => line.to_string(),
+    }
+}
+
+struct Replayer {
+    control: BufReader<TcpStream>,
+    /// Address from the last reply to PASV or EPSV.
+    passive: Option<SocketAddr>,
+    /// Listener announced with PORT or EPRT.
+    active: Option<TcpListener>,
+    report: ReplayReport,
+}
+
+impl Replayer {
+    async fn run(&mut self, mut line: String, step: &Step) -> Result<()> {
+        let (verb, _) = protocol::parse_command(&line).unwrap_or_default();
+
+        // The recorded address belonged to the client, announce our own.
+        if verb == "PORT" || verb == "EPRT" {
+            let local = self.control.get_ref().local_addr()?;
+            let listener = TcpListener::bind(SocketAddr::new(local.ip(), 0)).await?;
+            let addr = listener.local_addr()?;
+            line = match addr {
+                SocketAddr::V4(v4) if verb == "PORT" => {
+                    format!("PORT {}", protocol::format_pasv(v4))
+                }
+                _ => {
+                    let family = if addr.is_ipv4() { 1 } else { 2 };
+                    format!("EPRT |{family}|{}|{}|", addr.ip(), addr.port())
+                }
+            };
+            self.active = Some(listener);
+        }
+
+        println!("> {line}");
+        self.report.commands += 1;
+        self.control
+            .get_mut()
+            .write_all(format!("{line}\r\n").as_bytes())
+            .await?;
+
+        let transfers =
+            DOWNLOAD_COMMANDS.contains(&verb.as_str()) || UPLOAD_COMMANDS.contains(&verb.as_str());
+        let mut data = match self.passive.take() {
+            Some(addr) if transfers => Some(TcpStream::connect(addr).await?),
+            passive => {
+                self.passive = passive;
+                None
+            }
+        };
+
+        if step.replies.is_empty() {
+            return Ok(());
+        }
+        let mut index = 0;
+        loop {
+            let reply = self.reply().await?;
+            self.compare(step.replies.get(index).map(String::as_str), &reply);
+            index += 1;
+            match reply.code {
+                227 => self.passive = protocol::parse_port(between(reply.message(), '(', ')')),
+                229 => {
+                    let port = between(reply.message(), '(', ')')
+                        .trim_matches('|')
+                        .parse()
+                        .ok();
+                    let ip = self.control.get_ref().peer_addr()?.ip();
+                    self.passive = port.map(|port| SocketAddr::new(ip, port));
+                }
+                125 | 150 if transfers => {
+                    let stream = match (data.take(), self.active.take()) {
+                        (Some(stream), _) => Some(stream),
+                        (None, Some(listener)) => Some(
+                            time::timeout(REPLAY_TIMEOUT, listener.accept())
+                                .await
+                                .map_err(|_| anyhow!("server did not open the data connection"))??
+                                .0,
+                        ),
+                        (None, None) => None,
+                    };
+                    if let Some(stream) = stream {
+                        let upload = step.transfer.filter(|(d, _)| *d == Direction::Upload);
+                        let bytes = transfer(stream, upload.map(|(_, bytes)| bytes)).await?;
+                        println!("  {bytes} bytes transferred");
+                    }
+                }
+                _ => {}
+            }
+            // A preliminary reply is always followed by another one. An error
+            // ends the exchange even if more replies were recorded.
+            if reply.code >= 200 && (index >= step.replies.len() || reply.code >= 400) {
+                break;
+            }
+        }
+        Ok(())
+    }
+
+    async fn reply(&mut self) -> Result<Reply> {
+        time::timeout(REPLAY_TIMEOUT, ftptest::read_reply(&mut self.control))
+            .await
+            .map_err(|_| anyhow!("timed out waiting for a reply"))?
+    }
+
+    fn compare(&mut self, recorded: Option<&str>, reply: &Reply) {
+        println!("< {} {}", reply.code, reply.message());
+        let expected = recorded.and_then(|text| text.get(..3)?.parse::<u16>().ok());
+        if let Some(expected) = expected
+            && expected != reply.code
+        {
+            self.report.mismatches += 1;
+            let recorded = recorded
+                .unwrap_or_default()
+                .lines()
+                .last()
+                .unwrap_or_default();
+            println!("! recorded: {recorded}");
+        }
+    }
+}
+
+/// Sends `upload` bytes or, when not set, reads everything. Returns the
+/// number of bytes transferred.
+async fn transfer(mut stream: TcpStream, upload: Option<u64>) -> Result<u64> {
+    match upload {
+        Some(size) => {
+            let chunk = vec![0u8; 64 * 1024];
+            let mut left = size;
+            while left > 0 {
+                let n = left.min(chunk.len() as u64) as usize;
+                stream.write_all(&chunk[..n]).await?;
+                left -= n as u64;
+            }
+            stream.shutdown().await?;
+            Ok(size)
+        }
+        None => {
+            let mut content = Vec::new();
+            time::timeout(REPLAY_TIMEOUT, stream.read_to_end(&mut content))
+                .await
+                .map_err(|_| anyhow!("timed out reading the data connection"))??;
+            Ok(content.len() as u64)
+        }
+    }
+}
+
+fn between(text: &str, open: char, close: char) -> &str {
+    let Some(start) = text.find(open) else {
+        return "";
+    };
+    let rest = &text[start + 1..];
+    &rest[..rest.find(close).unwrap_or(rest.len())]
+}
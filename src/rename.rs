@@ -0,0 +1,202 @@
+//! Renaming that also works across file systems.
+//!
+//! When the source and the target are on different volumes, the source is
+//! copied next to the target under a temporary name, moved into place and
+//! only then removed, so a failed or cancelled copy leaves everything as it
+//! was.
+
+use std::{
+    fs::{self, File},
+    io::{self, Read, Write},
+    path::{Path, PathBuf},
+    sync::{
+        Arc,
+        atomic::{AtomicBool, AtomicU64, Ordering},
+    },
+};
+
+use tokio::task;
+
+/// Size of a single read while copying.
+const BUFFER_SIZE: usize = 64 * 1024;
+
+/// Renames a file or a directory. Falls back to copying when the target is
+/// on another volume; `copied` counts the bytes copied so far. Dropping the
+/// future, e.g. by aborting its task, stops the copy.
+pub async fn rename(from: &Path, to: &Path, copied: Arc<AtomicU64>) -> io::Result<()> {
+    match tokio::fs::rename(from, to).await {
+        Err(e) if e.kind() == io::ErrorKind::CrossesDevices => {}
+        result => return result,
+    }
+
+    let (from, to) = (from.to_path_buf(), to.to_path_buf());
+    let stop = StopOnDrop(Arc::new(AtomicBool::new(false)));
+    let stopped = Arc::clone(&stop.0);
+    task::spawn_blocking(move || move_across(&from, &to, &copied, &stopped))
+        .await
+        .map_err(io::Error::other)?
+}
+
+/// Tells the copy on the blocking thread to stop when the future that waits
+/// for it is dropped.
+struct StopOnDrop(Arc<AtomicBool>);
+
+impl Drop for StopOnDrop {
+    fn drop(&mut self) {
+        self.0.store(true, Ordering::Relaxed);
+    }
+}
+
+fn move_across(from: &Path, to: &Path, copied: &AtomicU64, stop: &AtomicBool) -> io::Result<()> {
+    let metadata = fs::symlink_metadata(from)?;
+    if metadata.is_dir() && fs::symlink_metadata(to).is_ok() {
+        return Err(io::Error::new(
+            io::ErrorKind::AlreadyExists,
+            "target directory already exists",
+        ));
+    }
+
+    let temporary = temporary_path(to)?;
+    if let Err(e) = copy(from, &temporary, copied, stop).and_then(|()| fs::rename(&temporary, to)) {
+        let _ = remove(&temporary);
+        return Err(e);
+    }
+
+    remove(from).map_err(|e| {
+        io::Error::new(
+            e.kind(),
+            format!("copied, but failed to remove the source: {e}"),
+        )
+    })
+}
+
+/// Returns an unused path next to the target.
+fn temporary_path(to: &Path) -> io::Result<PathBuf> {
+    let name = to
+        .file_name()
+        .ok_or_else(|| io::Error::new(io::ErrorKind::InvalidInput, "target has no file name"))?
+        .to_string_lossy();
+    (0..100)
+        .map(|attempt| to.with_file_name(format!(".{name}.moving-{attempt}")))
+        .find(|path| fs::symlink_metadata(path).is_err())
+        .ok_or_else(|| io::Error::new(io::ErrorKind::AlreadyExists, "no temporary name is free"))
+}
+
+fn copy(from: &Path, to: &Path, copied: &AtomicU64, stop: &AtomicBool) -> io::Result<()> {
+    let metadata = fs::symlink_metadata(from)?;
+    let file_type = metadata.file_type();
+
+    if file_type.is_dir() {
+        fs::create_dir(to)?;
+        for entry in fs::read_dir(from)? {
+            let entry = entry?;
+            copy(&entry.path(), &to.join(entry.file_name()), copied, stop)?;
+        }
+    } else if file_type.is_symlink() {
+        copy_symlink(from, to)?;
+        return Ok(());
+    } else {
+        copy_file(from, to, copied, stop)?;
+    }
+
+    fs::set_permissions(to, metadata.permissions())?;
+    if let Ok(modified) = metadata.modified() {
+        let _ = File::open(to).and_then(|f| f.set_modified(modified));
+    }
+    Ok(())
+}
+
+fn copy_file(from: &Path, to: &Path, copied: &AtomicU64, stop: &AtomicBool) -> io::Result<()> {
+    let mut source = File::open(from)?;
+    let mut target = File::create_new(to)?;
+    let mut buffer = vec![0u8; BUFFER_SIZE];
+    loop {
+        if stop.load(Ordering::Relaxed) {
+            return Err(io::Error::new(
+                io::ErrorKind::Interrupted,
+                "move was cancelled",
+            ));
+        }
+        let read = source.read(&mut buffer)?;
+        if read == 0 {
+            break;
+        }
+        target.write_all(&buffer[..read])?;
+        copied.fetch_add(read as u64, Ordering::Relaxed);
+    }
+    target.sync_all()
+}
+
+#[cfg(unix)]
+fn copy_symlink(from: &Path, to: &Path) -> io::Result<()> {
+    std::os::unix::fs::symlink(fs::read_link(from)?, to)
+}
+
+#[cfg(not(unix))]
+fn copy_symlink(_from: &Path, _to: &Path) -> io::Result<()> {
+    Err(io::Error::new(
+        io::ErrorKind::Unsupported,
+        "symbolic links cannot be moved across volumes",
+    ))
+}
+
+fn remove(path: &Path) -> io::Result<()> {
+    if fs::symlink_metadata(path)?.is_dir() {
+        fs::remove_dir_all(path)
+    } else {
+        fs::remove_file(path)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Directories on two volumes, if the system has a tmpfs besides the
+    /// temporary directory.
+    #[cfg(target_os = "linux")]
+    fn volumes() -> Option<(PathBuf, PathBuf)> {
+        use std::os::unix::fs::MetadataExt;
+
+        let other = Path::new("/dev/shm");
+        let temp = std::env::temp_dir();
+        if fs::metadata(other).ok()?.dev() == fs::metadata(&temp).ok()?.dev() {
+            return None;
+        }
+        let id = cuid2::cuid();
+        let (from, to) = (
+            other.join(format!("dock-{id}")),
+            temp.join(format!("dock-{id}")),
+        );
+        fs::create_dir(&from).ok()?;
+        fs::create_dir(&to).ok()?;
+        Some((from, to))
+    }
+
+    #[cfg(target_os = "linux")]
+    #[test]
+    fn moves_across_volumes_and_stops_when_asked() {
+        let Some((from, to)) = volumes() else {
+            return;
+        };
+        fs::write(from.join("file"), vec![1u8; 3 * BUFFER_SIZE]).unwrap();
+
+        let copied = AtomicU64::new(0);
+        let stop = AtomicBool::new(true);
+        let result = move_across(&from.join("file"), &to.join("file"), &copied, &stop);
+        assert_eq!(result.unwrap_err().kind(), io::ErrorKind::Interrupted);
+        assert!(from.join("file").exists());
+        assert_eq!(fs::read_dir(&to).unwrap().count(), 0);
+
+        stop.store(false, Ordering::Relaxed);
+        move_across(&from.join("file"), &to.join("file"), &copied, &stop).unwrap();
+        assert_eq!(copied.load(Ordering::Relaxed), 3 * BUFFER_SIZE as u64);
+        assert!(!from.join("file").exists());
+        assert_eq!(
+            fs::metadata(to.join("file")).unwrap().len(),
+            3 * BUFFER_SIZE as u64
+        );
+        fs::remove_dir_all(from).unwrap();
+        fs::remove_dir_all(to).unwrap();
+    }
+}
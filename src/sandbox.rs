@@ -0,0 +1,105 @@
+use std::{collections::BTreeMap, path::Path};
+
+use anyhow::{Result, anyhow};
+use landlock::{
+    ABI, Access, AccessFs, Ruleset, RulesetAttr, RulesetCreatedAttr, RulesetStatus,
+    path_beneath_rules,
+};
+use seccompiler::{BpfProgram, SeccompAction, SeccompFilter, SeccompRule, TargetArch};
+
+const LANDLOCK_ABI: ABI = ABI::V3;
+
+/// Files of the system that are read after confinement: the resolver
+/// configuration for host names of reverse DNS, LDAP, webhooks and the
+/// gateway, and the CA certificates LDAP over TLS trusts.
+const SYSTEM_FILES: [&str; 9] = [
+    "/etc/resolv.conf",
+    "/etc/hosts",
+    "/etc/nsswitch.conf",
+    "/etc/host.conf",
+    "/etc/gai.conf",
+    "/etc/ssl",
+    "/etc/pki",
+    "/etc/ca-certificates",
+    "/usr/share/ca-certificates",
+];
+
+/// Syscalls that are never needed once the server is initialized.
+const BLOCKED_SYSCALLS: [i64; 30] = [
+    libc::SYS_execve,
+    libc::SYS_execveat,
+    libc::SYS_ptrace,
+    libc::SYS_process_vm_readv,
+    libc::SYS_process_vm_writev,
+    libc::SYS_mount,
+    libc::SYS_umount2,
+    libc::SYS_pivot_root,
+    libc::SYS_chroot,
+    libc::SYS_unshare,
+    libc::SYS_setns,
+    libc::SYS_setuid,
+    libc::SYS_setgid,
+    libc::SYS_setreuid,
+    libc::SYS_setregid,
+    libc::SYS_setresuid,
+    libc::SYS_setresgid,
+    libc::SYS_setgroups,
+    libc::SYS_init_module,
+    libc::SYS_finit_module,
+    libc::SYS_delete_module,
+    libc::SYS_kexec_load,
+    libc::SYS_reboot,
+    libc::SYS_swapon,
+    libc::SYS_swapoff,
+    libc::SYS_bpf,
+    libc::SYS_keyctl,
+    libc::SYS_add_key,
+    libc::SYS_request_key,
+    libc::SYS_personality,
+];
+
+/// Restricts file system access of the current thread and threads spawned
+/// after it to the given directories using Landlock. The `read_only` files
+/// and [`SYSTEM_FILES`] can still be read. Paths that do not exist are
+/// skipped.
+///
+/// Returns `false` if the kernel does not support Landlock.
+pub fn restrict_filesystem(paths: &[&Path], read_only: &[&Path]) -> Result<bool> {
+    let access = AccessFs::from_all(LANDLOCK_ABI);
+    let read_only = read_only
+        .iter()
+        .copied()
+        .chain(SYSTEM_FILES.iter().map(Path::new));
+    let status = Ruleset::default()
+        .handle_access(access)?
+        .create()?
+        .add_rules(path_beneath_rules(paths, access))?
+        .add_rules(path_beneath_rules(
+            read_only,
+            AccessFs::from_read(LANDLOCK_ABI),
+        ))?
+        .restrict_self()?;
+
+    Ok(!matches!(status.ruleset, RulesetStatus::NotEnforced))
+}
+
+/// Installs a seccomp filter on every thread of the process that denies
+/// syscalls from `BLOCKED_SYSCALLS` with `EPERM`.
+pub fn restrict_syscalls() -> Result<()> {
+    let rules: BTreeMap<i64, Vec<SeccompRule>> = BLOCKED_SYSCALLS
+        .iter()
+        .map(|&syscall| (syscall, Vec::new()))
+        .collect();
+    let arch = TargetArch::try_from(std::env::consts::ARCH)
+        .map_err(|_| anyhow!("seccomp is not supported on this architecture"))?;
+
+    let filter = SeccompFilter::new(
+        rules,
+        SeccompAction::Allow,
+        SeccompAction::Errno(libc::EPERM as u32),
+        arch,
+    )?;
+    let program: BpfProgram = filter.try_into()?;
+    seccompiler::apply_filter_all_threads(&program)?;
+    Ok(())
+}
@@ -1,71 +1,630 @@
-use std::sync::Arc;
+use std::{
+    future::Future,
+    net::SocketAddr,
+    sync::{Arc, atomic::Ordering},
+    time::Duration,
+};
 
+#[cfg(not(target_os = "linux"))]
+use anyhow::bail;
 use anyhow::{Result, anyhow};
-use tokio::net::TcpListener;
-use tracing::{error, info};
+use tokio::{
+    io::AsyncWriteExt,
+    net::{TcpListener, TcpStream},
+    sync::mpsc,
+    task::JoinSet,
+    time,
+};
+use tracing::{Instrument, Span, error, info, info_span, warn};
 use tracing_subscriber::{EnvFilter, fmt};
 
+#[cfg(unix)]
+use crate::privileges;
+#[cfg(target_os = "linux")]
+use crate::sandbox;
 use crate::{
+    acme, admin,
     config::Config,
+    geoip::GeoIp,
+    handover::{self, RestartSignal},
+    pam, password,
     session::{ConnectionError, Session},
+    state::SharedState,
+    tls::{self, Stream, Tls},
 };
 
+/// How often persistent state is written to disk.
+const STATE_FLUSH_INTERVAL: Duration = Duration::from_secs(30);
+/// How often certificate files are checked for changes.
+const CERTIFICATE_CHECK_INTERVAL: Duration = Duration::from_secs(60);
+/// How often the htpasswd file is checked for changes.
+const HTPASSWD_CHECK_INTERVAL: Duration = Duration::from_secs(5);
+/// Pause after a failed accept, e.g. when running out of file descriptors.
+const ACCEPT_ERROR_DELAY: Duration = Duration::from_millis(100);
+
+/// Connection accepted by a listener, with the instance it belongs to.
+type Accepted = (TcpStream, SocketAddr, Arc<Config>);
+
 pub struct Server {
     config: Config,
+    /// Bound listeners with the config of the instance they serve.
+    listeners: Vec<(Config, std::net::TcpListener)>,
+    /// Listener for ACME HTTP-01 challenges, bound before privileges are
+    /// dropped.
+    acme_listener: Option<std::net::TcpListener>,
+    state: Option<Arc<SharedState>>,
 }
 
-fn init_logging() {
-    let filter = EnvFilter::try_from_default_env().unwrap_or_else(|_| EnvFilter::new("info"));
-    fmt()
+/// Initializes logging. Does nothing if logging was already initialized.
+pub fn init_logging() {
+    init_logging_at("info");
+}
+
+/// Initializes logging with the level used when `RUST_LOG` is not set.
+pub fn init_logging_at(default_level: &str) {
+    let filter =
+        EnvFilter::try_from_default_env().unwrap_or_else(|_| EnvFilter::new(default_level));
+    let _ = fmt()
         .with_env_filter(filter)
         .with_target(false)
         .with_level(true)
         .compact()
-        .init();
+        .try_init();
+}
+
+/// Completes when the process is asked to terminate with Ctrl-C or `SIGTERM`.
+pub async fn shutdown_signal() {
+    #[cfg(unix)]
+    {
+        use tokio::signal::unix::{SignalKind, signal};
+
+        match signal(SignalKind::terminate()) {
+            Ok(mut terminate) => {
+                tokio::select! {
+                    _ = tokio::signal::ctrl_c() => {}
+                    _ = terminate.recv() => {}
+                }
+            }
+            Err(_) => {
+                let _ = tokio::signal::ctrl_c().await;
+            }
+        }
+    }
+    #[cfg(not(unix))]
+    {
+        let _ = tokio::signal::ctrl_c().await;
+    }
 }
 
 impl Server {
     pub fn new(config: Config) -> Self {
-        Server { config }
+        Server {
+            config,
+            listeners: Vec::new(),
+            acme_listener: None,
+            state: None,
+        }
     }
 
-    pub async fn start_server(&self) -> Result<()> {
+    /// Binds listeners and applies confinement requested by the config.
+    ///
+    /// Should be called before the async runtime is started, so that every
+    /// runtime thread inherits the restrictions. If it was not called,
+    /// `start_server` calls it itself.
+    pub fn prepare(&mut self) -> Result<()> {
+        let mut inherited = handover::inherited_listeners().into_iter();
+        if inherited.len() > 0 {
+            info!("Took over the listeners from the previous process.");
+        }
+
+        // Instances with implicit FTPS get a second listener of their own.
+        let instances = self.config.instances();
+        let implicit: Vec<Config> = instances
+            .iter()
+            .filter_map(|instance| {
+                let address = instance.tls.as_ref()?.implicit_address.clone()?;
+                Some(Config {
+                    address,
+                    implicit_tls: true,
+                    ..instance.clone()
+                })
+            })
+            .collect();
+
+        // Tenants on the same address share a listener and are told apart by
+        // HOST. The first of them serves clients that do not send it.
+        let mut groups: Vec<Vec<Config>> = Vec::new();
+        for instance in instances.into_iter().chain(implicit) {
+            match groups.iter_mut().find(|g| {
+                g[0].address == instance.address && g[0].implicit_tls == instance.implicit_tls
+            }) {
+                Some(group) => group.push(instance),
+                None => groups.push(vec![instance]),
+            }
+        }
+
+        for hosts in groups {
+            let mut instance = hosts[0].clone();
+            instance.virtual_hosts = Arc::new(hosts);
+            let listener = match inherited.next() {
+                Some(listener) => listener,
+                None => std::net::TcpListener::bind(&instance.address).map_err(|_| {
+                    anyhow!("failed to bind to given address ({})", instance.address)
+                })?,
+            };
+            listener
+                .set_nonblocking(true)
+                .map_err(|_| anyhow!("failed to configure listener"))?;
+            let mode = if instance.implicit_tls {
+                " with implicit TLS"
+            } else {
+                ""
+            };
+            match &instance.tenant {
+                Some(tenant) => info!(tenant=%tenant, "Listening on {}{mode}", instance.address),
+                None => info!("Listening on {}{mode}", instance.address),
+            }
+            self.listeners.push((instance, listener));
+        }
+
+        // The database and the certificate have to be read while they are
+        // still reachable.
+        let geoip = match &self.config.geoip {
+            Some(geoip) => Some(GeoIp::open(&geoip.database)?),
+            None => None,
+        };
+        let tls = self.config.tls.as_ref().map(Tls::load).transpose()?;
+        if self.config.pam.is_some() && !pam::is_supported() {
+            anyhow::bail!("pam requires dock to be built with the pam feature");
+        }
+        if let Some(acme) = self.config.tls.as_ref().and_then(|t| t.acme.as_ref()) {
+            if self.config.chroot {
+                anyhow::bail!("acme can not be used with chroot");
+            }
+            std::fs::create_dir_all(&acme.cache_dir)
+                .map_err(|e| anyhow!("failed to create {}: {e}", acme.cache_dir))?;
+            // Port 80 can only be bound while privileged, so the listener is
+            // kept for every renewal and handed over on restarts after the
+            // others.
+            let listener = match inherited.next() {
+                Some(listener) => listener,
+                None => std::net::TcpListener::bind(&acme.http_address)
+                    .map_err(|e| anyhow!("failed to bind {}: {e}", acme.http_address))?,
+            };
+            listener
+                .set_nonblocking(true)
+                .map_err(|_| anyhow!("failed to configure listener"))?;
+            self.acme_listener = Some(listener);
+        }
+        if self.config.restart.enabled && !self.config.supports_restarts() {
+            warn!("Restarts are disabled, they can not be used with chroot or sandbox.");
+            self.config.restart.enabled = false;
+        }
+
+        let conflicts = self.config.sandbox_conflicts();
+        if self.config.sandbox && !conflicts.is_empty() {
+            anyhow::bail!(
+                "sandbox can not be used with {}, they run programs",
+                conflicts.join(", ")
+            );
+        }
+
+        self.confine()?;
+        let mut state = SharedState::new(&self.config)?;
+        let plaintext: Vec<_> = state
+            .users
+            .snapshot()
+            .into_iter()
+            .filter(|(_, user)| password::Scheme::of(&user.password) == password::Scheme::Plaintext)
+            .map(|(account, _)| account)
+            .collect();
+        if !plaintext.is_empty() {
+            warn!(users=%plaintext.join(", "), "Plaintext passwords are deprecated, store argon2id or bcrypt hashes instead.");
+        }
+        state.geoip = geoip;
+        state.tls = tls;
+        self.state = Some(Arc::new(state));
+        Ok(())
+    }
+
+    /// Addresses the server is listening on. Empty until `prepare` is called.
+    pub fn local_addrs(&self) -> Vec<std::net::SocketAddr> {
+        self.listeners
+            .iter()
+            .filter_map(|(_, listener)| listener.local_addr().ok())
+            .collect()
+    }
+
+    /// Applies chroot, privilege dropping and sandboxing requested by the config.
+    /// Updates the config to how it should be seen from inside the confinement.
+    #[cfg(unix)]
+    fn confine(&mut self) -> Result<()> {
+        let credentials = self
+            .config
+            .run_as
+            .as_ref()
+            .map(privileges::resolve)
+            .transpose()?;
+
+        if self.config.chroot {
+            if self.config.instances().len() != 1 {
+                anyhow::bail!("chroot can not be used with multiple tenants");
+            }
+            let root = std::path::Path::new(&self.listeners[0].0.root)
+                .canonicalize()
+                .map_err(|_| anyhow!("root directory not found"))?;
+            privileges::chroot(&root)?;
+            self.config.root = String::from("/");
+            for (instance, _) in &mut self.listeners {
+                instance.root = String::from("/");
+                for host in Arc::make_mut(&mut instance.virtual_hosts) {
+                    host.root = String::from("/");
+                }
+            }
+            info!(root=%root.display(), "Confined to root directory.");
+        }
+
+        if let (Some(credentials), Some(run_as)) = (credentials, &self.config.run_as) {
+            privileges::drop_privileges(&credentials)?;
+            info!(user=%run_as.user, "Dropped privileges.");
+        }
+
+        if self.config.sandbox {
+            #[cfg(target_os = "linux")]
+            {
+                let mut paths: Vec<_> = self
+                    .listeners
+                    .iter()
+                    .flat_map(|(instance, _)| instance.virtual_hosts.iter())
+                    .map(|host| std::path::Path::new(&host.root))
+                    .collect();
+                let (writable, read_only) = self.config.sandbox_paths()?;
+                paths.extend(writable.iter().map(|p| p.as_path()));
+                let read_only: Vec<_> = read_only.iter().map(|p| p.as_path()).collect();
+                if sandbox::restrict_filesystem(&paths, &read_only)? {
+                    info!("File system access is restricted with Landlock.");
+                } else {
+                    warn!("Landlock is not supported by the kernel.");
+                }
+                sandbox::restrict_syscalls()?;
+                info!("System calls are restricted with seccomp.");
+            }
+            #[cfg(not(target_os = "linux"))]
+            bail!("sandbox is only supported on Linux");
+        }
+
+        Ok(())
+    }
+
+    #[cfg(not(unix))]
+    fn confine(&mut self) -> Result<()> {
+        if self.config.run_as.is_some() || self.config.chroot || self.config.sandbox {
+            bail!("run_as, chroot and sandbox are only supported on Unix");
+        }
+        Ok(())
+    }
+
+    pub async fn start_server(&mut self) -> Result<()> {
+        self.start_server_until(std::future::pending()).await
+    }
+
+    /// Runs the server until the `shutdown` future completes.
+    pub async fn start_server_until(&mut self, shutdown: impl Future<Output = ()>) -> Result<()> {
         init_logging();
         info!("Dock FTP Server {}", env!("CARGO_PKG_VERSION"));
-        let listener = TcpListener::bind(&self.config.address)
-            .await
-            .map_err(|_| anyhow!("failed to bind to given address"))?;
-        info!("Listening on {}", self.config.address);
+        if self.listeners.is_empty() {
+            self.prepare()?;
+        }
+        let mut listeners = Vec::new();
+        for (instance, listener) in self.listeners.drain(..) {
+            let listener = TcpListener::from_std(listener)
+                .map_err(|_| anyhow!("failed to register listener"))?;
+            listeners.push((Arc::new(instance), Arc::new(listener)));
+        }
 
-        let arc_config = Arc::new(self.config.clone());
+        let state = self
+            .state
+            .clone()
+            .ok_or_else(|| anyhow!("server state is not initialized"))?;
 
-        loop {
-            let (socket, addr) = listener
-                .accept()
-                .await
-                .map_err(|_| anyhow!("cannot accept connection"))?;
+        if let Some(admin) = self.config.admin.clone() {
+            let admin_state = Arc::clone(&state);
+            tokio::spawn(async move {
+                if let Err(e) = admin::serve(admin, admin_state).await {
+                    error!(reason=%e, "Admin API failed.");
+                }
+            });
+        }
 
-            info!(ip=%addr, "Got new connection.");
-            let arc_config_cloned = Arc::clone(&arc_config);
+        let flush_state = Arc::clone(&state);
+        let upload_expiry = self.config.upload_resume.as_ref().map(|r| r.expire_secs);
+        // Tenants can keep their transfers for different periods.
+        let log_retention: Vec<_> = self
+            .config
+            .instances()
+            .into_iter()
+            .filter_map(|i| Some((i.tenant, i.transfer_log?.retention_days?)))
+            .collect();
+        let flush_task = tokio::spawn(async move {
+            let mut interval = time::interval(STATE_FLUSH_INTERVAL);
+            loop {
+                interval.tick().await;
+                if let Some(max_age) = upload_expiry {
+                    let expired = flush_state.uploads.expire(max_age);
+                    if expired > 0 {
+                        info!(count = expired, "Deleted expired incomplete uploads.");
+                    }
+                }
+                for (tenant, days) in &log_retention {
+                    let Some(log) = flush_state.transfer_log(tenant.as_deref()) else {
+                        continue;
+                    };
+                    match log.expire(*days) {
+                        Ok(0) => {}
+                        Ok(count) => info!(count = count, "Deleted old transfers from the log."),
+                        Err(e) => warn!(reason=%e, "Failed to delete old transfers from the log."),
+                    }
+                }
+                if let Err(e) = flush_state.save() {
+                    warn!(reason=%e, "Failed to save server state.");
+                }
+            }
+        });
+        let acme_listener = self
+            .acme_listener
+            .take()
+            .map(|listener| {
+                TcpListener::from_std(listener)
+                    .map(Arc::new)
+                    .map_err(|_| anyhow!("failed to register listener"))
+            })
+            .transpose()?;
+        let acme_task = match (
+            self.config.tls.as_ref().and_then(|t| t.acme.clone()),
+            &acme_listener,
+        ) {
+            (Some(acme), Some(listener)) => Some(tokio::spawn(acme::keep_renewed(
+                acme,
+                Arc::clone(listener),
+                Arc::clone(&state),
+            ))),
+            _ => None,
+        };
+        // Files outside the root can not be reached after chroot.
+        if !self.config.chroot {
+            let tls_state = Arc::clone(&state);
+            tokio::spawn(async move {
+                let Some(tls) = &tls_state.tls else {
+                    return;
+                };
+                let mut interval = time::interval(CERTIFICATE_CHECK_INTERVAL);
+                loop {
+                    interval.tick().await;
+                    match tls.reload_if_changed() {
+                        Ok(true) => info!("Reloaded TLS certificate."),
+                        Ok(false) => {}
+                        Err(e) => warn!(reason=%e, "Failed to reload TLS certificate."),
+                    }
+                }
+            });
+        }
 
+        if !state.users.htpasswd().is_empty() {
+            let htpasswd_state = Arc::clone(&state);
             tokio::spawn(async move {
-                let session_id = cuid2::cuid();
-                let mut session = Session::new(&session_id, socket, (*arc_config_cloned).clone());
-                info!(session_id=%session_id, ip=%addr, "Initiated new session.");
-                if let Err(e) = session.run_session().await {
-                    match e {
-                        ConnectionError::ClosedByQuit => {
-                            info!(session_id=%session_id, "Session was closed by user.");
-                        }
-                        ConnectionError::Disconnected => {
-                            info!(session_id=%session_id, "Session was closed because user had disconnected.");
-                        }
-                        _ => {
-                            error!(session_id=%session_id, reason=%e, "Session failed.");
+                let mut interval = time::interval(HTPASSWD_CHECK_INTERVAL);
+                loop {
+                    interval.tick().await;
+                    for htpasswd in htpasswd_state.users.htpasswd() {
+                        match htpasswd.reload_if_changed() {
+                            Ok(Some(count)) => info!(count = count, "Reloaded htpasswd file."),
+                            Ok(None) => {}
+                            Err(e) => warn!(reason=%e, "Failed to reload htpasswd file."),
                         }
                     }
                 }
             });
         }
+
+        // Every listener accepts in its own task and hands connections over here.
+        let (accepted_tx, mut accepted_rx) = mpsc::channel(64);
+        let mut acceptors = spawn_acceptors(&listeners, &accepted_tx);
+
+        let listener_handles: Vec<_> = listeners
+            .iter()
+            .map(|(_, l)| Arc::clone(l))
+            .chain(acme_listener)
+            .collect();
+        let mut sessions = JoinSet::new();
+        let mut restart = RestartSignal::new()?;
+        let restart_enabled = self.config.restart.enabled;
+
+        tokio::pin!(shutdown);
+
+        loop {
+            let (socket, addr, instance) = tokio::select! {
+                Some(accepted) = accepted_rx.recv() => accepted,
+                Some(_) = sessions.join_next(), if !sessions.is_empty() => continue,
+                _ = restart.recv(), if restart_enabled => {
+                    info!("Restart requested.");
+                    // Connections that arrive during the hand-over wait in
+                    // the backlog of the listeners for whichever process
+                    // accepts next. Those accepted already are served here.
+                    acceptors.shutdown().await;
+                    while let Ok((socket, addr, instance)) = accepted_rx.try_recv() {
+                        spawn_session(&mut sessions, &state, socket, addr, instance);
+                    }
+                    // The new process loads persistent state on startup.
+                    if let Err(e) = state.save() {
+                        warn!(reason=%e, "Failed to save server state.");
+                    }
+                    if handover::hand_over(&listener_handles).await {
+                        break;
+                    }
+                    acceptors = spawn_acceptors(&listeners, &accepted_tx);
+                    continue;
+                }
+                _ = &mut shutdown => {
+                    info!("Shutting down.");
+                    return state.save();
+                }
+            };
+            spawn_session(&mut sessions, &state, socket, addr, instance);
+        }
+
+        // The new process renews the certificate and writes the state from
+        // now on. Saving here would overwrite its newer state.
+        if let Some(task) = acme_task {
+            task.abort();
+        }
+        flush_task.abort();
+        drop(listener_handles);
+        drop(listeners);
+        info!(
+            sessions = sessions.len(),
+            "Waiting for active sessions to finish."
+        );
+        let drained = time::timeout(self.config.restart.drain_timeout(), async {
+            while sessions.join_next().await.is_some() {}
+        })
+        .await;
+        match drained {
+            Ok(()) => info!("All sessions are finished, exiting."),
+            Err(_) => {
+                warn!(
+                    sessions = sessions.len(),
+                    "Closing sessions that did not finish in time."
+                );
+                sessions.shutdown().await;
+            }
+        }
+        Ok(())
     }
 }
+
+/// Accepts connections on every listener until the returned tasks are shut
+/// down.
+fn spawn_acceptors(
+    listeners: &[(Arc<Config>, Arc<TcpListener>)],
+    accepted_tx: &mpsc::Sender<Accepted>,
+) -> JoinSet<()> {
+    let mut acceptors = JoinSet::new();
+    for (instance, listener) in listeners {
+        let (instance, listener) = (Arc::clone(instance), Arc::clone(listener));
+        let accepted_tx = accepted_tx.clone();
+        acceptors.spawn(async move {
+            loop {
+                match listener.accept().await {
+                    Ok((socket, addr)) => {
+                        if accepted_tx
+                            .send((socket, addr, Arc::clone(&instance)))
+                            .await
+                            .is_err()
+                        {
+                            return;
+                        }
+                    }
+                    Err(e) => {
+                        error!(reason=%e, "Cannot accept connection.");
+                        time::sleep(ACCEPT_ERROR_DELAY).await;
+                    }
+                }
+            }
+        });
+    }
+    acceptors
+}
+
+/// Runs a session for an accepted connection, or refuses it during
+/// maintenance.
+fn spawn_session(
+    sessions: &mut JoinSet<()>,
+    state: &Arc<SharedState>,
+    socket: TcpStream,
+    addr: SocketAddr,
+    instance: Arc<Config>,
+) {
+    if state.maintenance.is_enabled() {
+        info!(ip=%addr, "Refused connection during maintenance.");
+        tokio::spawn(refuse_connection(socket));
+        return;
+    }
+
+    info!(ip=%addr, "Got new connection.");
+    let session_state = Arc::clone(state);
+    let span = match &instance.tenant {
+        Some(tenant) => info_span!("tenant", name=%tenant),
+        None => Span::none(),
+    };
+
+    sessions.spawn(
+        async move {
+            let connection = if instance.implicit_tls {
+                match accept_tls(&session_state, socket).await {
+                    Ok(connection) => connection,
+                    Err(e) => {
+                        info!(ip=%addr, reason=%e, "TLS handshake failed.");
+                        return;
+                    }
+                }
+            } else {
+                Stream::Plain(socket)
+            };
+            let session_id = cuid2::cuid();
+            let state = Arc::clone(&session_state);
+            state.active_sessions.fetch_add(1, Ordering::Relaxed);
+            let mut session =
+                Session::new(&session_id, connection, (*instance).clone(), session_state);
+            info!(session_id=%session_id, ip=%addr, "Initiated new session.");
+            let outcome = match session.run_session().await {
+                Ok(()) => String::from("closed"),
+                Err(ConnectionError::ClosedByQuit) => {
+                    info!(session_id=%session_id, "Session was closed by user.");
+                    String::from("quit")
+                }
+                Err(ConnectionError::Disconnected) => {
+                    info!(session_id=%session_id, "Session was closed because user had disconnected.");
+                    String::from("disconnected")
+                }
+                Err(ConnectionError::IdleTimeout) => {
+                    info!(session_id=%session_id, "Session was closed because it was idle.");
+                    String::from("idle")
+                }
+                Err(ConnectionError::ClosedForMaintenance) => {
+                    info!(session_id=%session_id, "Session was closed for maintenance.");
+                    String::from("maintenance")
+                }
+                Err(ConnectionError::AccountLocked) => {
+                    info!(session_id=%session_id, "Session was closed because the account was disabled or has expired.");
+                    String::from("locked")
+                }
+                Err(e) => {
+                    error!(session_id=%session_id, reason=%e, "Session failed.");
+                    format!("failed: {e}")
+                }
+            };
+            session.finish(&outcome);
+            state.active_sessions.fetch_sub(1, Ordering::Relaxed);
+        }
+        .instrument(span),
+    );
+}
+
+/// Performs the handshake of a connection to the implicit FTPS listener.
+async fn accept_tls(state: &SharedState, socket: TcpStream) -> std::io::Result<Stream> {
+    let tls = state
+        .tls
+        .as_ref()
+        .ok_or_else(|| std::io::Error::other("TLS is not configured"))?;
+    time::timeout(tls::HANDSHAKE_TIMEOUT, tls.accept(socket))
+        .await
+        .map_err(|_| std::io::Error::new(std::io::ErrorKind::TimedOut, "handshake timed out"))?
+}
+
+/// Tells the client that the server does not accept sessions right now.
+async fn refuse_connection(mut socket: TcpStream) {
+    let _ = socket
+        .write_all(b"421 Service unavailable, try later.\r\n")
+        .await;
+    let _ = socket.shutdown().await;
+}
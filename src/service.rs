@@ -0,0 +1,173 @@
+use std::{
+    ffi::{OsStr, OsString},
+    path::Path,
+    sync::{Mutex, OnceLock},
+    time::Duration,
+};
+
+use anyhow::{Result, anyhow};
+use tokio::sync::oneshot;
+use windows_service::{
+    define_windows_service,
+    service::{
+        ServiceAccess, ServiceControl, ServiceControlAccept, ServiceErrorControl, ServiceExitCode,
+        ServiceInfo, ServiceStartType, ServiceState, ServiceStatus, ServiceType,
+    },
+    service_control_handler::{self, ServiceControlHandlerResult, ServiceStatusHandle},
+    service_dispatcher,
+    service_manager::{ServiceManager, ServiceManagerAccess},
+};
+
+use crate::{config::load_config, server::Server};
+
+const SERVICE_NAME: &str = "dock";
+const SERVICE_DISPLAY_NAME: &str = "Dock FTP Server";
+const SERVICE_TYPE: ServiceType = ServiceType::OWN_PROCESS;
+
+/// Configuration path passed to the service entry point by the dispatcher.
+static CONFIG_PATH: OnceLock<String> = OnceLock::new();
+
+define_windows_service!(ffi_service_main, service_main);
+
+/// Registers Dock as an automatically started service using the given config.
+pub fn install(config_path: &str) -> Result<()> {
+    let config_path = Path::new(config_path)
+        .canonicalize()
+        .map_err(|_| anyhow!("configuration file not found"))?;
+    let manager = ServiceManager::local_computer(
+        None::<&str>,
+        ServiceManagerAccess::CONNECT | ServiceManagerAccess::CREATE_SERVICE,
+    )?;
+
+    let info = ServiceInfo {
+        name: OsString::from(SERVICE_NAME),
+        display_name: OsString::from(SERVICE_DISPLAY_NAME),
+        service_type: SERVICE_TYPE,
+        start_type: ServiceStartType::AutoStart,
+        error_control: ServiceErrorControl::Normal,
+        executable_path: std::env::current_exe()?,
+        launch_arguments: vec![
+            OsString::from("--config"),
+            config_path.into_os_string(),
+            OsString::from("service"),
+            OsString::from("run"),
+        ],
+        dependencies: vec![],
+        account_name: None,
+        account_password: None,
+    };
+    let service = manager.create_service(&info, ServiceAccess::CHANGE_CONFIG)?;
+    service.set_description(env!("CARGO_PKG_DESCRIPTION"))?;
+    Ok(())
+}
+
+/// Stops the service if it is running and removes it.
+pub fn uninstall() -> Result<()> {
+    let manager = ServiceManager::local_computer(None::<&str>, ServiceManagerAccess::CONNECT)?;
+    let service = manager.open_service(
+        SERVICE_NAME,
+        ServiceAccess::QUERY_STATUS | ServiceAccess::STOP | ServiceAccess::DELETE,
+    )?;
+
+    if service.query_status()?.current_state != ServiceState::Stopped {
+        service.stop()?;
+    }
+    service.delete()?;
+    Ok(())
+}
+
+/// Starts the installed service.
+pub fn start() -> Result<()> {
+    let manager = ServiceManager::local_computer(None::<&str>, ServiceManagerAccess::CONNECT)?;
+    let service = manager.open_service(SERVICE_NAME, ServiceAccess::START)?;
+    service.start(&[] as &[&OsStr])?;
+    Ok(())
+}
+
+/// Asks the running service to stop.
+pub fn stop() -> Result<()> {
+    let manager = ServiceManager::local_computer(None::<&str>, ServiceManagerAccess::CONNECT)?;
+    let service = manager.open_service(SERVICE_NAME, ServiceAccess::STOP)?;
+    service.stop()?;
+    Ok(())
+}
+
+/// Hands the current thread over to the service control manager.
+/// Blocks until the service is stopped.
+pub fn run(config_path: String) -> Result<()> {
+    let _ = CONFIG_PATH.set(config_path);
+    service_dispatcher::start(SERVICE_NAME, ffi_service_main)?;
+    Ok(())
+}
+
+fn service_main(_arguments: Vec<OsString>) {
+    if let Err(e) = run_service() {
+        eprintln!("Service error occurred: {e}");
+    }
+}
+
+fn set_state(handle: &ServiceStatusHandle, state: ServiceState, exit_code: u32) -> Result<()> {
+    let controls_accepted = if state == ServiceState::Running {
+        ServiceControlAccept::STOP | ServiceControlAccept::SHUTDOWN
+    } else {
+        ServiceControlAccept::empty()
+    };
+
+    handle.set_service_status(ServiceStatus {
+        service_type: SERVICE_TYPE,
+        current_state: state,
+        controls_accepted,
+        exit_code: ServiceExitCode::Win32(exit_code),
+        checkpoint: 0,
+        wait_hint: Duration::from_secs(10),
+        process_id: None,
+    })?;
+    Ok(())
+}
+
+fn run_service() -> Result<()> {
+    let (shutdown_tx, shutdown_rx) = oneshot::channel::<()>();
+    let shutdown_tx = Mutex::new(Some(shutdown_tx));
+
+    let event_handler = move |event| match event {
+        ServiceControl::Stop | ServiceControl::Shutdown => {
+            if let Some(tx) = shutdown_tx.lock().ok().and_then(|mut tx| tx.take()) {
+                let _ = tx.send(());
+            }
+            ServiceControlHandlerResult::NoError
+        }
+        ServiceControl::Interrogate => ServiceControlHandlerResult::NoError,
+        _ => ServiceControlHandlerResult::NotImplemented,
+    };
+    let status_handle = service_control_handler::register(SERVICE_NAME, event_handler)?;
+    set_state(&status_handle, ServiceState::StartPending, 0)?;
+
+    let config_path = CONFIG_PATH
+        .get()
+        .cloned()
+        .unwrap_or(String::from("config.json"));
+    let config = match load_config(&config_path) {
+        Ok(c) => c,
+        Err(e) => {
+            set_state(&status_handle, ServiceState::Stopped, 1)?;
+            return Err(e);
+        }
+    };
+
+    let runtime = tokio::runtime::Runtime::new()?;
+    set_state(&status_handle, ServiceState::Running, 0)?;
+
+    let mut server = Server::new(config);
+    let result = runtime.block_on(server.start_server_until(async {
+        let _ = shutdown_rx.await;
+    }));
+
+    set_state(&status_handle, ServiceState::StopPending, 0)?;
+    runtime.shutdown_timeout(Duration::from_secs(5));
+    set_state(
+        &status_handle,
+        ServiceState::Stopped,
+        if result.is_ok() { 0 } else { 1 },
+    )?;
+    result
+}
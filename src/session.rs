@@ -1,8 +1,11 @@
 use std::{
+    borrow::Cow,
+    collections::HashMap,
     fs::Permissions,
-    net::{Ipv4Addr, SocketAddr},
+    net::{IpAddr, Ipv4Addr, SocketAddr, SocketAddrV4},
     path::{Path, PathBuf},
-    time::Duration,
+    sync::Arc,
+    time::{Duration, Instant},
 };
 
 #[cfg(unix)]
@@ -12,16 +15,48 @@ use anyhow::{Result, anyhow, bail};
 use thiserror::Error;
 use tokio::{
     fs::{self, File},
-    io::{self, AsyncReadExt, AsyncSeekExt, AsyncWriteExt, SeekFrom},
-    net::{TcpListener, TcpStream},
+    io::{AsyncReadExt, AsyncSeekExt, AsyncWriteExt, SeekFrom},
+    net::{TcpListener, TcpSocket, TcpStream},
+    task::{JoinError, JoinHandle},
     time,
 };
-use tracing::info;
-
-use crate::{commands::Commands, config::Config};
+use tracing::{info, warn};
+
+use crate::{
+    auth::{self, AuthBackend, AuthError},
+    charset::{self, Charset},
+    checksum,
+    commands::{COMMAND_TABLE, Commands},
+    config::{Config, User},
+    datetime::{self, DateTime},
+    disk::{self, DirectoryUsage},
+    facts::{self, UserAccess},
+    glob,
+    history::{Direction, SessionRecord},
+    language,
+    limits::{Limits, TransferQuota},
+    listing::{self, DirStyle},
+    messages::{self, LoginMessage, Variables},
+    passive, password,
+    protocol::{self, LineBuffer},
+    quarantine::QuarantinedUpload,
+    quirks::{self, ClientQuirks},
+    recording::{self, Recorder},
+    rename, site,
+    state::SharedState,
+    stats, storage,
+    tls::{self, Stream},
+    transfer::{self, Progress, Stop, TransferSettings, TransferType, UploadLimits},
+    transfer_log::{Outcome, TransferEntry},
+    uploads::{self, PartialUpload},
+    users::{self, UserUpdate},
+    virtual_files::{self, VirtualFile},
+    x509,
+};
 
-const SERVER_FEATURES: [&str; 4] = ["UTF8", "MLST type*;size*;modify*;perm*;", "PASV", "PORT"];
 const DISALLOWED_FILENAMES: [&str; 2] = ["..", "."];
+/// Message files larger than this are not shown.
+const MAX_MESSAGE_FILE_SIZE: u64 = 16 * 1024;
 
 macro_rules! reply {
     ($self:expr, $code:expr, $message:expr) => {
@@ -45,6 +80,9 @@ macro_rules! require_authorization {
     };
 }
 
+mod site_commands;
+mod storage_commands;
+
 #[derive(Debug, Error, PartialEq, Eq)]
 pub enum ConnectionError {
     #[error("user has disconnected")]
@@ -64,32 +102,255 @@ pub enum ConnectionError {
 
     #[error("file system error occurred")]
     FileSystemError,
+
+    #[error("session was idle for too long")]
+    IdleTimeout,
+
+    #[error("session was closed for maintenance")]
+    ClosedForMaintenance,
+
+    #[error("account was disabled or has expired")]
+    AccountLocked,
+
+    #[error("TLS handshake failed: {0}")]
+    TlsFailed(String),
+}
+
+/// Outcome of a transfer task: bytes transferred and why it stopped early.
+type TransferResult = Result<std::io::Result<(u64, Option<Stop>)>, JoinError>;
+
+/// Transfer running in the background while commands are read.
+#[derive(Debug)]
+struct ActiveTransfer {
+    progress: Arc<Progress>,
+    task: JoinHandle<std::io::Result<(u64, Option<Stop>)>>,
+    /// Upload into a temporary file that can be resumed.
+    upload: Option<PartialUpload>,
+    /// Upload that is held back until approved.
+    quarantined: Option<QuarantinedUpload>,
+    /// Size of the file before APPE or a restarted STOR, which it is cut
+    /// back to when the upload is refused.
+    append_offset: Option<u64>,
+    /// Cancelled by the client with ABOR.
+    aborted: bool,
+    /// Disk space was reserved for the upload after ALLO.
+    preallocated: bool,
+    /// Files the upload replaces, to work out how it changes disk usage.
+    replaced: DirectoryUsage,
+    /// Name picked by STOU, repeated in the final reply.
+    unique_name: Option<String>,
+}
+
+/// How an upload treats its target.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum StoreMode {
+    /// STOR: create the file or replace it.
+    Replace,
+    /// APPE: add to the end of the file.
+    Append,
+    /// STOU: create a file under a new name picked by the server.
+    Unique,
+}
+
+/// What listings show of every entry.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum ListFormat {
+    /// LIST and STAT: a line in the style of `ls -l` or MS-DOS.
+    Long,
+    /// NLST: the name alone.
+    Names,
+}
+
+/// What the command loop has been woken up by.
+enum Event {
+    Command(Result<String, ConnectionError>),
+    TransferFinished(TransferResult),
+    IdleTimeout,
+    Maintenance,
+}
+
+/// Waits for the transfer to finish. Never completes when there is none.
+async fn wait_for_transfer(active: &mut Option<ActiveTransfer>) -> TransferResult {
+    match active {
+        Some(active) => (&mut active.task).await,
+        None => std::future::pending().await,
+    }
+}
+
+/// Sleeps for the duration. Never completes without one.
+async fn sleep_for(duration: Option<Duration>) {
+    match duration {
+        Some(duration) => time::sleep(duration).await,
+        None => std::future::pending().await,
+    }
+}
+
+/// Reads the message file of a directory. Users can create it, so a
+/// symbolic link is not followed, as it could point outside of the root.
+async fn read_message_file(path: &Path) -> Option<String> {
+    let mut options = fs::OpenOptions::new();
+    options.read(true);
+    #[cfg(unix)]
+    options.custom_flags(libc::O_NOFOLLOW | libc::O_NONBLOCK);
+    #[cfg(not(unix))]
+    if fs::symlink_metadata(path).await.ok()?.is_symlink() {
+        return None;
+    }
+    let file = options.open(path).await.ok()?;
+    let metadata = file.metadata().await.ok()?;
+    if !metadata.is_file() || metadata.len() > MAX_MESSAGE_FILE_SIZE {
+        return None;
+    }
+    let mut content = String::new();
+    file.take(MAX_MESSAGE_FILE_SIZE)
+        .read_to_string(&mut content)
+        .await
+        .ok()?;
+    Some(content)
+}
+
+/// Reads the next command line. Cancel safe: bytes that were read are kept
+/// in `lines`.
+async fn read_command(
+    connection: &mut Stream,
+    lines: &mut LineBuffer,
+    charset: Option<Charset>,
+    strict: bool,
+) -> Result<String, ConnectionError> {
+    let mut buf = [0u8; 1024];
+    loop {
+        if let Some(line) = lines
+            .next_raw_line()
+            .map_err(|_| ConnectionError::ReadFailed(String::from("command line is too long")))?
+        {
+            let line = protocol::strip_telnet(line);
+            return Ok(match charset {
+                Some(charset) if strict => charset.decode(&line),
+                _ => charset::decode_line(line, charset),
+            });
+        }
+        let n = match connection.read(&mut buf).await {
+            Ok(0) => return Err(ConnectionError::Disconnected),
+            Ok(n) => n,
+            Err(e) => return Err(ConnectionError::ReadFailed(e.to_string())),
+        };
+        lines.push(&buf[..n]);
+    }
 }
 
 #[derive(Debug)]
 pub struct Session {
     username: String,
+    /// User authenticated by a backend outside of the user store.
+    external_user: Option<User>,
     authorized: bool,
+    /// PBSZ was sent, which has to come before PROT.
+    protection_buffer: bool,
+    /// Data connections are encrypted, selected with PROT.
+    protect_data: bool,
+    /// Format of LIST lines, switched with SITE DIRSTYLE.
+    dir_style: DirStyle,
+    /// UTF-8 was turned off with OPTS, so commands are decoded with the
+    /// charset only.
+    utf8_disabled: bool,
+    /// Facts sent by MLST and MLSD, selected with OPTS MLST.
+    mlst_facts: Vec<&'static str>,
+    /// Language of replies selected with LANG, English when unset.
+    language: Option<String>,
+    /// Workarounds for the client, selected by CLNT.
+    quirks: Option<ClientQuirks>,
+    /// The 150 reply was sent while waiting for the data connection.
+    preliminary_sent: bool,
+    transfer_type: TransferType,
     current_dir: PathBuf,
-    connection: TcpStream,
+    /// Root directory of the session, either of the server or of the user.
+    root: String,
+    connection: Stream,
+    /// Bytes received on the control connection that are not a complete line yet.
+    lines: LineBuffer,
     rest_offset: u64,
+    /// Size announced with ALLO for the next upload.
+    allocate: Option<u64>,
+    /// Real path given with RNFR, waiting for RNTO.
+    rename_from: Option<PathBuf>,
+    /// Algorithm used by HASH, selected with OPTS HASH.
+    hash_algorithm: checksum::Algorithm,
+    /// SHA-256 checksums announced for uploads, keyed by real path.
+    expected_checksums: HashMap<PathBuf, String>,
     active_addr: Option<SocketAddr>,
     passive_listener: Option<TcpListener>,
+    active_transfer: Option<ActiveTransfer>,
     config: Config,
+    state: Arc<SharedState>,
+    record: SessionRecord,
+    /// Country of the client, when GeoIP is configured.
+    country: Option<String>,
+    /// Confirmed host name of the client, when reverse DNS is configured.
+    hostname: Option<String>,
+    recorder: Option<Recorder>,
+    /// Limits of the server until login, then of the user.
+    limits: Limits,
+    /// Charset of the client until it enables UTF-8.
+    charset: Option<Charset>,
     id: String,
 }
 
 impl Session {
-    pub fn new(id: &String, connection: TcpStream, config: Config) -> Self {
+    pub fn new(id: &String, connection: Stream, config: Config, state: Arc<SharedState>) -> Self {
+        let peer_ip = connection.peer_addr().map(|a| a.ip()).ok();
+        let ip = peer_ip.map(|ip| ip.to_string()).unwrap_or_default();
+        let country = match (&state.geoip, peer_ip) {
+            (Some(geoip), Some(ip)) => geoip.country(ip),
+            _ => None,
+        };
+        let recorder = config.record_dir.as_ref().and_then(|dir| {
+            let mut recorder = match Recorder::create(Path::new(dir), id) {
+                Ok(recorder) => recorder,
+                Err(e) => {
+                    warn!(session_id=%id, reason=%e, "Failed to start recording.");
+                    return None;
+                }
+            };
+            let event = recording::Event::Connect { client: ip.clone() };
+            recorder.record(event).ok()?;
+            info!(session_id=%id, file=%recorder.path().display(), "Recording session.");
+            Some(recorder)
+        });
         Self {
             id: id.to_owned(),
+            record: SessionRecord::new(id, &ip),
+            country,
+            hostname: None,
+            recorder,
+            // Clients of implicit FTPS expect encrypted data connections
+            // without asking for them.
+            protection_buffer: connection.is_tls(),
+            protect_data: connection.is_tls(),
             connection,
+            lines: LineBuffer::default(),
+            root: config.root.clone(),
+            limits: config.limits.clone(),
+            dir_style: config.dir_style,
+            utf8_disabled: false,
+            mlst_facts: facts::supported(),
+            language: None,
+            quirks: None,
+            preliminary_sent: false,
+            transfer_type: TransferType::default(),
+            charset: config.client_encoding,
             config,
+            state,
             rest_offset: 0,
+            allocate: None,
+            rename_from: None,
+            hash_algorithm: checksum::Algorithm::default(),
+            expected_checksums: HashMap::new(),
             active_addr: None,
             passive_listener: None,
+            active_transfer: None,
             current_dir: PathBuf::from("/"),
             username: String::new(),
+            external_user: None,
             authorized: false,
         }
     }
@@ -130,95 +391,752 @@ impl Session {
         perms
     }
 
-    async fn receive(&mut self) -> Result<String, ConnectionError> {
-        let mut buf = [0u8; 1024];
-        let n = match self.connection.read(&mut buf).await {
-            Ok(0) => return Err(ConnectionError::Disconnected),
-            Ok(n) => n,
-            Err(e) => return Err(ConnectionError::ReadFailed(e.to_string())),
+    /// Runs the transfer in the background and makes it visible to the admin API.
+    fn start_transfer(&mut self, active: ActiveTransfer) {
+        self.state.transfers.register(
+            &self.id,
+            &self.account(),
+            Arc::clone(&active.progress),
+            active.task.abort_handle(),
+        );
+        self.active_transfer = Some(active);
+    }
+
+    /// Records a finished transfer and sends the final reply.
+    async fn finish_transfer(
+        &mut self,
+        active: ActiveTransfer,
+        result: TransferResult,
+    ) -> Result<(), ConnectionError> {
+        let ActiveTransfer {
+            progress,
+            upload,
+            quarantined,
+            append_offset,
+            aborted,
+            preallocated,
+            replaced,
+            unique_name,
+            ..
+        } = active;
+        self.state.transfers.remove(&self.id);
+        self.rest_offset = 0;
+        let path = progress.path.to_string_lossy().to_string();
+        if progress.direction == Direction::Move {
+            match result {
+                Ok(Ok(_)) => {
+                    info!(session_id=%self.id, to=%path, username=%self.username, "User renamed file.");
+                    reply!(self, 250, "Rename successful.");
+                }
+                Err(e) if e.is_cancelled() => {
+                    info!(session_id=%self.id, to=%path, "Rename was aborted.");
+                    reply!(self, 451, "Rename aborted.");
+                }
+                Ok(Err(e)) => {
+                    warn!(session_id=%self.id, to=%path, reason=%e, "Failed to rename file.");
+                    reply!(self, 550, "Failed to rename file.");
+                }
+                Err(e) => {
+                    warn!(session_id=%self.id, to=%path, reason=%e, "Rename task failed.");
+                    reply!(self, 550, "Failed to rename file.");
+                }
+            }
+            return Ok(());
+        }
+        let completed = matches!(result, Ok(Ok((_, None))));
+        if progress.direction == Direction::Upload && !(completed && quarantined.is_none()) {
+            self.state.usage.changed(Path::new(&self.root));
+        }
+        // File the data was written to.
+        let written = upload
+            .as_ref()
+            .map_or(progress.path.clone(), |u| u.temp_file.clone());
+        // Space reserved beyond the end of a shorter upload is given back.
+        if preallocated
+            && let Ok(file) = fs::OpenOptions::new().write(true).open(&written).await
+            && let Ok(metadata) = file.metadata().await
+        {
+            let _ = file.set_len(metadata.len()).await;
+        }
+        if let Some(upload) = upload {
+            match &result {
+                Ok(Ok((_, None))) => {
+                    self.state.uploads.remove(&upload.owner, &upload.path);
+                    if let Err(e) = fs::rename(&upload.temp_file, &upload.target).await {
+                        warn!(session_id=%self.id, file=%path, reason=%e, "Failed to move finished upload into place.");
+                        let _ = fs::remove_file(&upload.temp_file).await;
+                        reply_ok!(self, 451, "Transfer aborted, local error in processing.");
+                    }
+                }
+                Ok(Ok((_, Some(Stop::OverQuota)))) => {
+                    self.state.uploads.remove(&upload.owner, &upload.path);
+                }
+                _ => {
+                    let received = fs::metadata(&upload.temp_file)
+                        .await
+                        .map(|m| m.len())
+                        .unwrap_or_default();
+                    info!(session_id=%self.id, file=%path, bytes=received, "Upload can be resumed.");
+                    self.state.uploads.put(PartialUpload {
+                        received,
+                        updated: datetime::unix_now(),
+                        ..upload
+                    });
+                }
+            }
+        }
+        let (bytes, stop) = match result {
+            Ok(Ok(outcome)) => outcome,
+            Ok(Err(e)) => {
+                warn!(session_id=%self.id, file=%path, reason=%e, "Transfer failed.");
+                self.record_transfer(&progress, progress.transferred(), Outcome::Failed);
+                reply_ok!(self, 426, "Connection closed, transfer aborted.");
+            }
+            Err(e) if e.is_cancelled() && aborted => {
+                info!(session_id=%self.id, file=%path, "Transfer was aborted by the client.");
+                self.record_transfer(&progress, progress.transferred(), Outcome::Aborted);
+                reply_ok!(self, 426, "Connection closed, transfer aborted.");
+            }
+            Err(e) if e.is_cancelled() => {
+                info!(session_id=%self.id, file=%path, "Transfer was aborted by an administrator.");
+                self.record_transfer(&progress, progress.transferred(), Outcome::Aborted);
+                reply_ok!(self, 426, "Transfer aborted by an administrator.");
+            }
+            Err(e) => {
+                warn!(session_id=%self.id, file=%path, reason=%e, "Transfer task failed.");
+                self.record_transfer(&progress, progress.transferred(), Outcome::Failed);
+                reply_ok!(self, 451, "Transfer aborted, local error in processing.");
+            }
         };
-        let data = String::from_utf8_lossy(&buf[..n]);
 
-        Ok(data.to_string())
+        let outcome = match stop {
+            None => Outcome::Completed,
+            Some(Stop::OutOfSpace) => Outcome::OutOfSpace,
+            Some(Stop::OverQuota | Stop::OverTransferQuota) => Outcome::OverQuota,
+        };
+        self.record_transfer(&progress, bytes, outcome);
+        match progress.direction {
+            Direction::Download => {
+                self.state.stats.record_download(&self.account(), bytes);
+                reply!(self, 226, "Done.");
+            }
+            Direction::Upload => {
+                self.state.stats.record_upload(&self.account(), bytes);
+                match stop {
+                    Some(Stop::OutOfSpace) => {
+                        warn!(session_id=%self.id, file=%path, "Upload aborted because free space is below the limit.");
+                        reply_ok!(self, 452, "Insufficient storage space, transfer aborted.");
+                    }
+                    Some(Stop::OverQuota) => {
+                        match append_offset {
+                            Some(len) => {
+                                if let Ok(file) =
+                                    fs::OpenOptions::new().write(true).open(&written).await
+                                {
+                                    let _ = file.set_len(len).await;
+                                }
+                            }
+                            None => {
+                                let _ = fs::remove_file(&written).await;
+                            }
+                        }
+                        warn!(session_id=%self.id, file=%path, "Upload aborted because disk quota is exceeded.");
+                        reply_ok!(self, 552, "Disk quota exceeded, transfer aborted.");
+                    }
+                    Some(Stop::OverTransferQuota) => {
+                        warn!(session_id=%self.id, file=%path, "Upload aborted because transfer quota is exceeded.");
+                        reply_ok!(self, 552, "Transfer quota exceeded, transfer aborted.");
+                    }
+                    None => {
+                        // Checksums are expected for the path the client sees.
+                        let target = quarantined
+                            .as_ref()
+                            .map_or(progress.path.clone(), |q| q.target.clone());
+                        if let Some(expected) = self.expected_checksums.remove(&target) {
+                            match self.verify_sha256(&progress.path, &expected).await {
+                                Ok(true) => {}
+                                Ok(false) => {
+                                    self.state.usage.changed(&progress.path);
+                                    reply_ok!(self, 550, "Checksum mismatch, file was deleted.");
+                                }
+                                Err(e) => {
+                                    warn!(session_id=%self.id, file=%path, reason=%e, "Failed to verify checksum.");
+                                    reply_ok!(self, 451, "Failed to verify checksum.");
+                                }
+                            }
+                        }
+                        if let Some(quarantined) = quarantined {
+                            self.quarantine(QuarantinedUpload {
+                                size: bytes,
+                                ..quarantined
+                            });
+                            let message = match &unique_name {
+                                Some(name) => format!(
+                                    "Transfer complete (unique file name: {name}), the file is held for approval."
+                                ),
+                                None => String::from(
+                                    "Transfer complete, the file is held for approval.",
+                                ),
+                            };
+                            reply_ok!(self, 226, &message);
+                        }
+                        match fs::symlink_metadata(&progress.path).await {
+                            Ok(metadata) => self.state.usage.adjust(
+                                &progress.path,
+                                metadata.len() as i64 - replaced.bytes as i64,
+                                1 - replaced.files as i64,
+                            ),
+                            Err(_) => self.state.usage.changed(&progress.path),
+                        }
+                        let message = match &unique_name {
+                            Some(name) => format!("Transfer complete (unique file name: {name})."),
+                            None => String::from("Transfer complete."),
+                        };
+                        reply!(self, 226, &message);
+                    }
+                }
+            }
+            // Moves reply above.
+            Direction::Move => {}
+        }
+        Ok(())
     }
 
-    fn split_data(&self, data: String) -> Option<(String, String)> {
-        let trimmed = data.trim_end();
-        let splitted = trimmed
-            .splitn(2, ' ')
-            .map(String::from)
-            .collect::<Vec<String>>();
-        if splitted.is_empty() {
-            return None;
+    /// Holds a finished upload back and runs the hook for it, if there is one.
+    fn quarantine(&self, upload: QuarantinedUpload) {
+        info!(session_id=%self.id, id=%upload.id, file=%upload.path, username=%self.username, "Upload was quarantined.");
+        self.state.quarantine.add(upload.clone());
+        if let Some(hook) = self.config.quarantine.as_ref().and_then(|q| q.hook.clone()) {
+            let state = Arc::clone(&self.state);
+            tokio::spawn(async move {
+                state.quarantine.run_hook(&hook, &upload).await;
+                state.usage.changed(&upload.target);
+            });
         }
+    }
 
-        let command = splitted.first().unwrap().to_owned();
-        let arg = if splitted.len() > 1 {
-            splitted.last().unwrap().to_owned()
-        } else {
-            String::new()
+    /// Compares the file with the expected SHA-256 and deletes it on mismatch.
+    async fn verify_sha256(&self, path: &Path, expected: &str) -> std::io::Result<bool> {
+        let actual = checksum::sha256_file(path).await?;
+        if actual == expected {
+            info!(session_id=%self.id, file=%path.display(), "Checksum verified.");
+            return Ok(true);
+        }
+        warn!(session_id=%self.id, file=%path.display(), expected=%expected, actual=%actual, "Checksum mismatch, deleting file.");
+        fs::remove_file(path).await?;
+        Ok(false)
+    }
+
+    /// Adds a transfer to the session history and the recording.
+    fn record_transfer(&mut self, progress: &Progress, bytes: u64, outcome: Outcome) {
+        let completed = outcome == Outcome::Completed;
+        let path = progress.path.to_string_lossy();
+        self.record
+            .add_transfer(progress.direction, &path, bytes, completed);
+        let virtual_path = match progress.path.strip_prefix(&self.root) {
+            Ok(relative) => format!("/{}", relative.to_string_lossy()),
+            Err(_) => path.to_string(),
+        };
+        let tenant = self.config.tenant.clone();
+        if self.state.transfer_log(tenant.as_deref()).is_some() {
+            let entry = TransferEntry::new(
+                &self.account(),
+                &virtual_path,
+                progress.direction,
+                bytes,
+                progress.elapsed(),
+                outcome,
+                &self.record.ip,
+            );
+            let state = Arc::clone(&self.state);
+            let id = self.id.clone();
+            tokio::task::spawn_blocking(move || {
+                if let Some(log) = state.transfer_log(tenant.as_deref())
+                    && let Err(e) = log.record(&entry)
+                {
+                    warn!(session_id=%id, reason=%e, "Failed to write transfer log.");
+                }
+            });
+        }
+        if self.recorder.is_some() {
+            self.record_event(recording::Event::Transfer {
+                direction: progress.direction,
+                path: virtual_path,
+                bytes,
+                completed,
+            });
+        }
+    }
+
+    /// Writes an event to the recording. Recording stops after a write error.
+    fn record_event(&mut self, event: recording::Event) {
+        if let Some(recorder) = &mut self.recorder
+            && let Err(e) = recorder.record(event)
+        {
+            warn!(session_id=%self.id, reason=%e, "Recording stopped.");
+            self.recorder = None;
+        }
+    }
+
+    /// Writes a formatted reply to the control connection.
+    async fn send_reply(&mut self, text: &str) -> Result<(), ConnectionError> {
+        if self.recorder.is_some() {
+            self.record_event(recording::Event::Reply {
+                text: text.to_string(),
+            });
+        }
+        let text = self.encode(text);
+        let written = match self.connection.write_all(&text).await {
+            Ok(()) => self.connection.flush().await,
+            Err(e) => Err(e),
         };
-        Some((command, arg))
+        written.map_err(|e| ConnectionError::WriteError(e.to_string()))
+    }
+
+    /// Encodes text for the client in its charset.
+    fn encode<'a>(&self, text: &'a str) -> Cow<'a, [u8]> {
+        match self.charset {
+            Some(charset) => Cow::Owned(charset.encode(text)),
+            None => Cow::Borrowed(text.as_bytes()),
+        }
+    }
+
+    /// Sends the 220 greeting, preceded by the banner.
+    async fn greet(&mut self) -> Result<(), ConnectionError> {
+        let greeting = self.render(&self.config.messages.greeting).await;
+        match self.config.messages.banner.split_first() {
+            Some((first, rest)) => {
+                let first = self.render(first).await;
+                let mut lines = Vec::with_capacity(rest.len());
+                for line in rest {
+                    lines.push(self.render(line).await);
+                }
+                self.reply_multiline(220, &first, &lines, &greeting).await
+            }
+            None => self.reply(220, &greeting).await,
+        }
+    }
+
+    /// Returns the message in the language of the session, if it is
+    /// translated.
+    fn translate<'a>(&'a self, message: &'a str) -> &'a str {
+        self.language
+            .as_deref()
+            .and_then(|tag| language::find(&self.config.languages, tag))
+            .and_then(|(_, catalog)| catalog.get(message))
+            .map_or(message, String::as_str)
     }
 
     async fn reply(&mut self, code: u16, message: &str) -> Result<(), ConnectionError> {
-        let formatted_message = format!("{code} {message}\r\n");
-        if let Err(e) = self
-            .connection
-            .write_all(formatted_message.as_bytes())
-            .await
+        let formatted_message = format!("{code} {}\r\n", self.translate(message));
+        self.send_reply(&formatted_message).await
+    }
+
+    /// Sends a multiline reply. Every line except the last one is sent as continuation.
+    async fn reply_multiline(
+        &mut self,
+        code: u16,
+        header: &str,
+        lines: &[String],
+        footer: &str,
+    ) -> Result<(), ConnectionError> {
+        let mut formatted_message = format!("{code}-{}\r\n", self.translate(header));
+        for line in lines {
+            formatted_message.push_str(&format!(" {line}\r\n"));
+        }
+        formatted_message.push_str(&format!("{code} {}\r\n", self.translate(footer)));
+        self.send_reply(&formatted_message).await
+    }
+
+    /// Lines of a listing of the path, which may end with a wildcard,
+    /// without line endings. Returns `None` if the path cannot be resolved.
+    async fn listing_lines(
+        &self,
+        arg: &str,
+        format: ListFormat,
+    ) -> Result<Option<(Vec<String>, listing::Listing)>, ConnectionError> {
+        let mut virtual_path = self.virtual_path(arg);
+        // Wildcards in the last component select entries of its
+        // directory, unless a file with that very name exists.
+        let mut pattern = None;
+        if let Some((dir, last)) = glob::split(&virtual_path)
+            && self.resolve_path(virtual_path.clone()).is_err()
         {
-            return Err(ConnectionError::WriteError(e.to_string()));
+            pattern = Some(last.to_string());
+            virtual_path = dir.to_string();
+        }
+        let selected = |name: &str| pattern.as_deref().is_none_or(|p| glob::matches(p, name));
+
+        let Ok(real_path) = self.resolve_path(virtual_path.clone()) else {
+            return Ok(None);
+        };
+
+        // Pseudo values. I dont think clients really care about it.
+        let links = "1";
+        let owner = "root";
+        let group = "group";
+
+        let listing = listing::read(&real_path, &self.config.listing)
+            .await
+            .map_err(|_| ConnectionError::FileSystemError)?;
+        if let Some(reason) = listing.truncated {
+            warn!(session_id=%self.id, path=%real_path.display(), entries=listing.entries.len(), reason=?reason, "Listing truncated.");
+        }
+
+        let mut listing_strings: Vec<String> = Vec::new();
+
+        let virtual_files: Vec<VirtualFile> =
+            virtual_files::in_directory(&self.config.virtual_files, &virtual_path)
+                .cloned()
+                .collect();
+        let now = datetime::unix_now();
+        for file in virtual_files.iter().filter(|f| selected(f.name())) {
+            if format == ListFormat::Names {
+                listing_strings.push(file.name().to_string());
+                continue;
+            }
+            let size = self.render(&file.content).await.len();
+            if self.dir_style == DirStyle::Msdos {
+                let line = listing::format_msdos(false, size as u64, now, file.name());
+                listing_strings.push(line);
+                continue;
+            }
+            listing_strings.push(format!(
+                "-r--r--r-- {} {} {} {:>12} {} {}",
+                links,
+                owner,
+                group,
+                size,
+                format_timestamp(now),
+                file.name()
+            ));
+        }
+
+        for entry in &listing.entries {
+            let name = &entry.name;
+            let metadata = &entry.metadata;
+            // Virtual files hide real ones with the same name.
+            if virtual_files.iter().any(|file| file.name() == name) || !selected(name) {
+                continue;
+            }
+            if self.config.upload_resume.is_some() && uploads::is_temp_name(name) {
+                continue;
+            }
+            if format == ListFormat::Names {
+                listing_strings.push(name.clone());
+                continue;
+            }
+
+            let is_dir = metadata.is_dir();
+            let size = metadata.len();
+            let perms = Self::format_unix_permissions(is_dir, &metadata.permissions());
+
+            // Format: permissions links owner group size month day time name
+            // Example: drwxr-xr-x 1 root group 4096 Jan 01 12:00 dirname
+            let modified = metadata
+                .modified()
+                .ok()
+                .and_then(|t| t.duration_since(std::time::UNIX_EPOCH).ok())
+                .map(|d| d.as_secs())
+                .unwrap_or(0);
+
+            if self.dir_style == DirStyle::Msdos {
+                let line = listing::format_msdos(is_dir, size, modified, name);
+                listing_strings.push(line);
+                continue;
+            }
+
+            // Simple timestamp formatting (could be improved with chrono)
+            let timestamp = format_timestamp(modified);
+
+            let line = format!(
+                "{} {} {} {} {:>12} {} {}",
+                perms, links, owner, group, size, timestamp, name
+            );
+            listing_strings.push(line);
         }
+        Ok(Some((listing_strings, listing)))
+    }
+
+    /// Sends lines of a listing over the data connection and closes it.
+    async fn send_lines(&self, data: &mut Stream, lines: &[String]) -> std::io::Result<()> {
+        let settings = self.transfer_settings(Direction::Download);
+        let started = Instant::now();
+        let mut written = 0;
+        for line in lines {
+            let line = format!("{line}\r\n");
+            let line = self.encode(&line);
+            settings.write(data, &line, started, written).await?;
+            written += line.len() as u64;
+        }
+        let _ = data.shutdown().await;
         Ok(())
     }
-    async fn reply_without_code(&mut self, message: &str) -> Result<(), ConnectionError> {
-        let formatted_message = format!("{message}\r\n");
-        if let Err(e) = self
-            .connection
-            .write_all(formatted_message.as_bytes())
-            .await
-        {
-            return Err(ConnectionError::WriteError(e.to_string()));
+
+    /// Sends generated content of a virtual file over the data connection.
+    async fn send_virtual_file(
+        &mut self,
+        virtual_path: &str,
+        content: String,
+    ) -> Result<(), ConnectionError> {
+        let offset = std::mem::take(&mut self.rest_offset) as usize;
+        let Some(content) = content.as_bytes().get(offset..) else {
+            reply_ok!(self, 550, "Invalid restart position.");
+        };
+        let content = match self.transfer_type {
+            TransferType::Ascii => Cow::Owned(transfer::encode_ascii(content, &mut false)),
+            TransferType::Binary => Cow::Borrowed(content),
+        };
+        let opening = format!(
+            "Opening {} mode data connection for {virtual_path} ({} bytes).",
+            self.transfer_type.name(),
+            content.len()
+        );
+        let Ok(mut data) = self.open_data_connection(&opening).await else {
+            reply_ok!(self, 425, "Cant open data connection.");
+        };
+        info!(session_id=%self.id, file=%virtual_path, username=%self.username, "User is retriving virtual file.");
+        let settings = self.transfer_settings(Direction::Download);
+        let sent = settings.write(&mut data, &content, Instant::now(), 0).await;
+        let _ = data.shutdown().await;
+        if let Err(e) = &sent {
+            warn!(session_id=%self.id, file=%virtual_path, reason=%e, "Transfer failed.");
+        }
+        let completed = sent.is_ok();
+        self.record.add_transfer(
+            Direction::Download,
+            virtual_path,
+            content.len() as u64,
+            completed,
+        );
+        if completed {
+            reply!(self, 226, "Done.");
+        } else {
+            reply!(self, 426, "Connection closed, transfer aborted.");
         }
         Ok(())
     }
 
+    /// Enters the directory for CWD and CDUP.
+    async fn change_dir(&mut self, virtual_path: String) -> Result<(), ConnectionError> {
+        let real_path = match self.resolve_path(virtual_path.clone()) {
+            Ok(p) => p,
+            Err(_) => {
+                reply_ok!(self, 550, "Failed to change directory.");
+            }
+        };
+
+        if !real_path.is_dir() {
+            reply_ok!(self, 550, "Not a directory.");
+        }
+
+        self.current_dir = PathBuf::from(virtual_path);
+        self.reply_directory_changed(&real_path).await
+    }
+
+    /// Replies to a directory change, showing the message file of the
+    /// directory if there is one.
+    async fn reply_directory_changed(&mut self, dir: &Path) -> Result<(), ConnectionError> {
+        // Only a file right in the directory is shown.
+        let Some(name) = Path::new(&self.config.message_file).file_name() else {
+            return self.reply(250, "Directory changed.").await;
+        };
+
+        let content = read_message_file(&dir.join(name)).await.unwrap_or_default();
+        let mut lines = Vec::new();
+        for line in content.lines() {
+            lines.push(self.render(line.trim_end()).await);
+        }
+
+        match lines.split_first() {
+            Some((first, rest)) => {
+                self.reply_multiline(250, first, rest, "Directory changed.")
+                    .await
+            }
+            None => self.reply(250, "Directory changed.").await,
+        }
+    }
+
     #[must_use = "there could be a connection related error"]
     pub async fn run_session(&mut self) -> Result<(), ConnectionError> {
-        self.reply(220, "Dock is welcoming you!").await?;
+        if let Some(geoip) = &self.config.geoip {
+            let country = self.country.as_deref().unwrap_or("unknown");
+            if !geoip.policy.permits(self.country.as_deref()) {
+                warn!(session_id=%self.id, country=%country, "Connection denied by GeoIP policy.");
+                self.reply(421, "Access denied.").await?;
+                return Ok(());
+            }
+            info!(session_id=%self.id, country=%country, "Connection allowed by GeoIP policy.");
+        }
+
+        if let Some(reverse_dns) = &self.config.reverse_dns {
+            if let Ok(addr) = self.connection.peer_addr() {
+                self.hostname = self.state.hostnames.resolve(addr.ip(), reverse_dns).await;
+            }
+            let hostname = self.hostname.as_deref().unwrap_or("unknown");
+            info!(session_id=%self.id, hostname=%hostname, "Resolved client host name.");
+            if !reverse_dns.policy.permits(self.hostname.as_deref()) {
+                warn!(session_id=%self.id, hostname=%hostname, "Connection denied by host name policy.");
+                self.reply(421, "Access denied.").await?;
+                return Ok(());
+            }
+        }
+
+        self.greet().await?;
         loop {
-            let data = self.receive().await?;
-            let (cmd, arg) = if let Some((c, a)) = self.split_data(data) {
+            // Sessions are not idle while a transfer is running.
+            let idle = self
+                .limits
+                .idle_timeout()
+                .filter(|_| self.active_transfer.is_none());
+            let event = tokio::select! {
+                data = read_command(&mut self.connection, &mut self.lines, self.charset, self.utf8_disabled) => Event::Command(data),
+                result = wait_for_transfer(&mut self.active_transfer) => Event::TransferFinished(result),
+                _ = sleep_for(idle) => Event::IdleTimeout,
+                _ = self.state.maintenance.grace_period_over() => Event::Maintenance,
+            };
+            let data = match event {
+                Event::Command(data) => data?,
+                Event::TransferFinished(result) => {
+                    if let Some(active) = self.active_transfer.take() {
+                        self.finish_transfer(active, result).await?;
+                    }
+                    continue;
+                }
+                Event::IdleTimeout => {
+                    self.reply(421, "Idle timeout, closing control connection.")
+                        .await?;
+                    return Err(ConnectionError::IdleTimeout);
+                }
+                Event::Maintenance => {
+                    self.reply(421, "Service is going down for maintenance.")
+                        .await?;
+                    return Err(ConnectionError::ClosedForMaintenance);
+                }
+            };
+            if let Some(recorder) = &mut self.recorder
+                && let Err(e) = recorder.record_command(&data)
+            {
+                warn!(session_id=%self.id, reason=%e, "Recording stopped.");
+                self.recorder = None;
+            }
+            let (cmd, arg) = if let Some((c, a)) = protocol::parse_command(&data) {
                 (c, a)
             } else {
                 continue;
             };
 
-            let command: Commands = cmd.into();
+            let command: Commands = cmd.clone().into();
+            // Keepalives would crowd out the commands worth seeing.
+            if command != Commands::Noop {
+                self.record.add_command(&cmd, &arg);
+            }
+
+            // Accounts can be disabled or expire while logged in.
+            if self.authorized && self.user().is_none_or(|u| u.is_locked()) {
+                warn!(session_id=%self.id, username=%self.username, "Closing session of disabled or expired user.");
+                self.reply(421, "Account disabled, closing control connection.")
+                    .await?;
+                return Err(ConnectionError::AccountLocked);
+            }
+
+            // Only STAT, NOOP and ABOR are answered while a transfer is
+            // running, other commands wait for it to finish.
+            if !matches!(command, Commands::Status | Commands::Noop | Commands::Abort)
+                && let Some(mut active) = self.active_transfer.take()
+            {
+                let result = (&mut active.task).await;
+                self.finish_transfer(active, result).await?;
+            }
+            if self.authorized && self.limits.denies(command, None) {
+                info!(session_id=%self.id, username=%self.username, command=%cmd, "Command denied for user.");
+                self.reply(533, "Command is not allowed for your account.")
+                    .await?;
+                continue;
+            }
             self.handle_command(command, arg).await?;
         }
     }
 
+    /// Stores the session in the history. Should be called once the session is over.
+    pub fn finish(&mut self, outcome: &str) {
+        if let Some(active) = self.active_transfer.take() {
+            self.state.transfers.remove(&self.id);
+            active.task.abort();
+            // Moves are not transfers of the user.
+            if active.progress.direction != Direction::Move {
+                self.record_transfer(
+                    &active.progress,
+                    active.progress.transferred(),
+                    Outcome::Failed,
+                );
+            }
+            if let Some(upload) = active.upload {
+                let received = std::fs::metadata(&upload.temp_file)
+                    .map(|m| m.len())
+                    .unwrap_or_default();
+                self.state.uploads.put(PartialUpload { received, ..upload });
+            }
+        }
+        self.record_event(recording::Event::Close {
+            outcome: outcome.to_string(),
+        });
+        if self.authorized {
+            self.record.username = Some(self.account());
+            self.state.sessions.release(&self.account());
+        }
+        let record = std::mem::replace(&mut self.record, SessionRecord::new(&self.id, ""));
+        if let Err(e) = self.state.history.push(record, outcome) {
+            warn!(session_id=%self.id, reason=%e, "Failed to store session history.");
+        }
+    }
+
     async fn handle_command(&mut self, cmd: Commands, arg: String) -> Result<(), ConnectionError> {
+        // RNFR only applies to the command right after it.
+        let rename_from = self.rename_from.take();
+        if self.authorized
+            && let Some(storage) = self.state.storage.clone()
+            && (storage::is_file_command(cmd) || cmd == Commands::Status && !arg.is_empty())
+        {
+            return self
+                .handle_storage_command(storage, cmd, arg, rename_from)
+                .await;
+        }
         match cmd {
             Commands::User => {
                 if self.authorized {
                     reply_ok!(self, 230, "Already logged in.");
                 }
 
-                if arg.is_empty() {
-                    reply_ok!(self, 501, "Username is required.");
+                if self.config.require_tls && !self.connection.is_tls() {
+                    reply_ok!(self, 550, "SSL/TLS required on the control channel.");
                 }
 
-                if !self.config.check_user(&arg) {
-                    reply_ok!(self, 530, "Authorization failed.");
+                if arg.is_empty() {
+                    reply_ok!(self, 501, "Username is required.");
                 }
 
+                // Unknown users are only refused after PASS, so the reply does
+                // not tell which accounts exist.
                 self.username = arg;
+                self.external_user = None;
+                if let Some(user) = self.user()
+                    && let Some(name) = self.certificate_login(&user)
+                {
+                    info!(session_id=%self.id, username=%self.username, certificate=%name, "User authenticated with a client certificate.");
+                    if user.is_locked() {
+                        warn!(session_id=%self.id, username=%self.username, "Disabled or expired user tried to log in.");
+                        reply_ok!(self, 530, "Account disabled.");
+                    }
+                    return self.log_in(user, 232).await;
+                }
                 reply!(self, 331, "Password is required");
             }
             Commands::Password => {
+                if self.config.require_tls && !self.connection.is_tls() {
+                    reply_ok!(self, 550, "SSL/TLS required on the control channel.");
+                }
+
                 if self.username.is_empty() {
                     reply_ok!(self, 501, "Username is required.");
                 }
@@ -227,21 +1145,49 @@ impl Session {
                     reply_ok!(self, 501, "Password is required");
                 }
 
-                if !self.config.check_password(&self.username, &arg) {
-                    reply_ok!(self, 530, "Authorization failed.");
+                let peer_ip = self.connection.peer_addr().map(|a| a.ip()).ok();
+                let Some((backend, user)) = self.authenticate(&arg, peer_ip).await else {
+                    self.state.stats.record_failed_login(&self.account());
+                    if let Some(ip) = peer_ip {
+                        let delay = self.state.tarpit.record_failure(ip);
+                        if !delay.is_zero() {
+                            warn!(session_id=%self.id, ip=%ip, delay_ms=delay.as_millis() as u64, "Delaying reply to failed login.");
+                            time::sleep(delay).await;
+                        }
+                    }
+                    let text = self.render(&self.config.messages.login_failed).await;
+                    reply_ok!(self, 530, &text);
+                };
+
+                if let Some(ip) = peer_ip {
+                    self.state.tarpit.clear(ip);
+                }
+
+                if user.is_locked() {
+                    warn!(session_id=%self.id, username=%self.username, "Disabled or expired user tried to log in.");
+                    reply_ok!(self, 530, "Account disabled.");
                 }
 
-                self.authorized = true;
-                info!(session_id=%self.id, username=%self.username, "User authorized.");
-                reply!(self, 230, "Login success.");
+                if !backend.is_stored() {
+                    self.external_user = Some(user.clone());
+                }
+                if self.config.upgrade_password_hashes
+                    && backend == AuthBackend::Users
+                    && self.config.users_file.is_some()
+                    && password::Scheme::of(&user.password).is_legacy()
+                {
+                    self.upgrade_password_hash(&arg).await;
+                }
+
+                self.log_in(user, 230).await?;
             }
             Commands::WorkingDir => {
                 reply!(
                     self,
                     257,
                     format!(
-                        "\"{}\" is the current directory.",
-                        self.current_dir.to_string_lossy()
+                        "{} is the current directory.",
+                        protocol::quote_path(&self.current_dir.to_string_lossy())
                     )
                     .as_str()
                 );
@@ -253,29 +1199,46 @@ impl Session {
                     reply_ok!(self, 501, "Path is required");
                 }
 
-                let new_virtual = self.current_dir.join(&arg).to_string_lossy().to_string();
-                let real_path = match self.resolve_path(new_virtual.clone()) {
-                    Ok(p) => p,
-                    Err(_) => {
-                        reply_ok!(self, 550, "Failed to change directory.");
-                    }
-                };
-
-                if !real_path.is_dir() {
-                    reply_ok!(self, 550, "Not a directory.");
-                }
-
-                self.current_dir = PathBuf::from(new_virtual);
-                reply!(self, 250, "Directory changed.");
+                let new_virtual = self.virtual_path(&arg);
+                self.change_dir(new_virtual).await?;
             }
             Commands::Option => {
                 if arg.is_empty() {
                     reply_ok!(self, 501, "Argument is required");
                 }
 
-                match arg.as_str() {
-                    "UTF8" => {
-                        reply!(self, 200, "UTF-8 is enabled by default.");
+                match arg.to_ascii_uppercase().as_str() {
+                    "UTF8" | "UTF8 ON" => {
+                        self.charset = None;
+                        self.utf8_disabled = false;
+                        reply!(self, 200, "UTF-8 is enabled.");
+                    }
+                    // Paths are then taken as bytes of the configured
+                    // charset, or of Latin-1, which keeps every byte.
+                    "UTF8 OFF" => {
+                        self.charset = Some(self.config.client_encoding.unwrap_or(Charset::Latin1));
+                        self.utf8_disabled = true;
+                        reply!(self, 200, "UTF-8 is disabled.");
+                    }
+                    "HASH" => {
+                        reply!(self, 200, self.hash_algorithm.name());
+                    }
+                    option if option.starts_with("HASH ") => {
+                        match checksum::Algorithm::from_name(option[5..].trim()) {
+                            Some(algorithm) => {
+                                self.hash_algorithm = algorithm;
+                                reply!(self, 200, algorithm.name());
+                            }
+                            None => {
+                                reply!(self, 504, "Unknown hash algorithm.");
+                            }
+                        }
+                    }
+                    option if option == "MLST" || option.starts_with("MLST ") => {
+                        self.mlst_facts = facts::parse_selection(&option[4..]);
+                        let selected: String =
+                            self.mlst_facts.iter().map(|f| format!("{f};")).collect();
+                        reply!(self, 200, format!("MLST OPTS {selected}").trim_end());
                     }
                     _ => {
                         reply!(self, 501, "Unknown option");
@@ -284,92 +1247,404 @@ impl Session {
             }
             Commands::List => {
                 require_authorization!(self);
-                let mut data_connection = self
-                    .open_data_connection()
-                    .await
-                    .map_err(|e| ConnectionError::DataConnectionFailed(e.to_string()))?;
-                reply!(self, 150, "Listing of directory");
+                let Ok(mut data_connection) =
+                    self.open_data_connection("Listing of directory").await
+                else {
+                    reply_ok!(self, 425, "Cant open data connection.");
+                };
 
-                let virtual_path = if arg.is_empty() {
-                    self.current_dir.to_string_lossy().to_string()
-                } else {
-                    self.current_dir.join(&arg).to_string_lossy().to_string()
+                let Some((listing_strings, listing)) =
+                    self.listing_lines(&arg, ListFormat::Long).await?
+                else {
+                    reply_ok!(self, 550, "Failed to list directory.");
                 };
 
-                let real_path = match self.resolve_path(virtual_path) {
+                if let Err(e) = self
+                    .send_lines(&mut data_connection, &listing_strings)
+                    .await
+                {
+                    warn!(session_id=%self.id, reason=%e, "Listing failed.");
+                    reply_ok!(self, 426, "Connection closed, transfer aborted.");
+                }
+                reply!(self, 226, &listing.completion_message());
+            }
+            Commands::NameList => {
+                require_authorization!(self);
+                let Some((names, listing)) = self.listing_lines(&arg, ListFormat::Names).await?
+                else {
+                    reply_ok!(self, 550, "No files found.");
+                };
+                let Ok(mut data_connection) = self.open_data_connection("Listing of names").await
+                else {
+                    reply_ok!(self, 425, "Cant open data connection.");
+                };
+                if let Err(e) = self.send_lines(&mut data_connection, &names).await {
+                    warn!(session_id=%self.id, reason=%e, "Listing failed.");
+                    reply_ok!(self, 426, "Connection closed, transfer aborted.");
+                }
+                reply!(self, 226, &listing.completion_message());
+            }
+            Commands::MachineList => {
+                require_authorization!(self);
+
+                let virtual_path = PathBuf::from(self.virtual_path(&arg));
+                let real_path = match self.resolve_path(virtual_path.to_string_lossy().to_string())
+                {
                     Ok(p) => p,
                     Err(_) => {
-                        reply!(self, 550, "Failed to list directory.");
-                        return Ok(());
+                        reply_ok!(self, 550, "File unavailable.");
                     }
                 };
-
-                // Pseudo values. I dont think clients really care about it.
-                let links = "1";
-                let owner = "root";
-                let group = "group";
-
-                let mut entries = fs::read_dir(real_path)
+                let metadata = fs::metadata(&real_path)
                     .await
                     .map_err(|_| ConnectionError::FileSystemError)?;
 
-                let mut listing_strings: Vec<String> = Vec::new();
-
-                while let Some(entry) = entries
-                    .next_entry()
-                    .await
-                    .map_err(|_| ConnectionError::FileSystemError)?
-                {
-                    let name = entry.file_name().to_string_lossy().to_string();
-                    let metadata = entry
-                        .metadata()
-                        .await
-                        .map_err(|_| ConnectionError::FileSystemError)?;
-
-                    let is_dir = metadata.is_dir();
-                    let size = metadata.len();
-                    let perms = Self::format_unix_permissions(is_dir, &metadata.permissions());
-
-                    // Format: permissions links owner group size month day time name
-                    // Example: drwxr-xr-x 1 root group 4096 Jan 01 12:00 dirname
-                    let modified = metadata
-                        .modified()
-                        .ok()
-                        .and_then(|t| t.duration_since(std::time::UNIX_EPOCH).ok())
-                        .map(|d| d.as_secs())
-                        .unwrap_or(0);
+                let facts = facts::format_facts(
+                    &real_path,
+                    &metadata,
+                    self.user_access(),
+                    &virtual_path.to_string_lossy(),
+                    &self.mlst_facts,
+                );
+                self.reply_multiline(250, "Listing", &[facts], "End")
+                    .await?;
+            }
+            Commands::MachineListDir => {
+                require_authorization!(self);
 
-                    // Simple timestamp formatting (could be improved with chrono)
-                    let timestamp = format_timestamp(modified);
+                let virtual_path = self.virtual_path(&arg);
+                let Ok(real_path) = self.resolve_path(virtual_path.clone()) else {
+                    reply_ok!(self, 550, "Directory not found.");
+                };
+                let metadata = match fs::metadata(&real_path).await {
+                    Ok(metadata) if metadata.is_dir() => metadata,
+                    Ok(_) => {
+                        reply_ok!(self, 501, "Not a directory, use MLST for files.");
+                    }
+                    Err(_) => {
+                        reply_ok!(self, 550, "Directory not found.");
+                    }
+                };
+                let Ok(listing) = listing::read_dir(&real_path, &self.config.listing).await else {
+                    reply_ok!(self, 550, "Failed to list directory.");
+                };
+                if let Some(reason) = listing.truncated {
+                    warn!(session_id=%self.id, path=%real_path.display(), entries=listing.entries.len(), reason=?reason, "Listing truncated.");
+                }
 
-                    let line = format!(
-                        "{} {} {} {} {:>12} {} {}\r\n",
-                        perms, links, owner, group, size, timestamp, name
-                    );
-                    listing_strings.push(line);
+                let access = self.user_access();
+                let selected = &self.mlst_facts;
+                let mut lines = vec![facts::format_cdir_facts(
+                    &real_path, &metadata, access, selected,
+                )];
+                let virtual_files: Vec<VirtualFile> =
+                    virtual_files::in_directory(&self.config.virtual_files, &virtual_path)
+                        .cloned()
+                        .collect();
+                let now = datetime::unix_now();
+                for file in &virtual_files {
+                    let size = self.render(&file.content).await.len() as u64;
+                    lines.push(facts::format_virtual_facts(
+                        size,
+                        now,
+                        file.name(),
+                        &self.mlst_facts,
+                    ));
+                }
+                for entry in &listing.entries {
+                    let name = &entry.name;
+                    // Virtual files hide real ones with the same name.
+                    if virtual_files.iter().any(|file| file.name() == name) {
+                        continue;
+                    }
+                    if self.config.upload_resume.is_some() && uploads::is_temp_name(name) {
+                        continue;
+                    }
+                    lines.push(facts::format_facts(
+                        &real_path.join(name),
+                        &entry.metadata,
+                        access,
+                        name,
+                        &self.mlst_facts,
+                    ));
                 }
 
-                // Send listing through data connection
-                for entry in listing_strings {
-                    data_connection
-                        .write_all(entry.as_bytes())
-                        .await
-                        .map_err(|e| ConnectionError::WriteError(e.to_string()))?;
+                let Ok(mut data_connection) =
+                    self.open_data_connection("Listing of directory").await
+                else {
+                    reply_ok!(self, 425, "Cant open data connection.");
+                };
+                if let Err(e) = self.send_lines(&mut data_connection, &lines).await {
+                    warn!(session_id=%self.id, reason=%e, "Listing failed.");
+                    reply_ok!(self, 426, "Connection closed, transfer aborted.");
+                }
+                reply!(self, 226, &listing.completion_message());
+            }
+            Commands::Status => {
+                if !arg.is_empty() {
+                    require_authorization!(self);
+                    let Some((lines, _)) = self.listing_lines(&arg, ListFormat::Long).await? else {
+                        reply_ok!(self, 550, "File not found.");
+                    };
+                    let header = format!("Status of {}:", self.virtual_path(&arg));
+                    self.reply_multiline(213, &header, &lines, "End").await?;
+                    return Ok(());
+                }
+                let Some(active) = &self.active_transfer else {
+                    let user = if self.authorized {
+                        format!("Logged in as {}", self.username)
+                    } else {
+                        String::from("Not logged in")
+                    };
+                    let data_connection = if self.passive_listener.is_some() {
+                        "Passive listener waiting for a data connection"
+                    } else if self.active_addr.is_some() {
+                        "Active data connection set up with PORT"
+                    } else {
+                        "No data connection"
+                    };
+                    let lines = vec![
+                        format!("Dock {}", env!("CARGO_PKG_VERSION")),
+                        format!("Connected from {}", self.record.ip),
+                        user,
+                        format!(
+                            "TYPE: {}, MODE: Stream, STRU: File",
+                            self.transfer_type.name()
+                        ),
+                        String::from(data_connection),
+                        String::from("No transfer in progress"),
+                    ];
+                    self.reply_multiline(211, "Server status:", &lines, "End")
+                        .await?;
+                    return Ok(());
+                };
+                let progress = &active.progress;
+                let name = progress
+                    .path
+                    .file_name()
+                    .map(|n| n.to_string_lossy().to_string())
+                    .unwrap_or_default();
+                let transferred = match progress.size {
+                    Some(size) => format!("{} of {} bytes", progress.transferred(), size),
+                    None => format!("{} bytes", progress.transferred()),
+                };
+                let direction = match progress.direction {
+                    Direction::Download => "Sending",
+                    Direction::Upload => "Receiving",
+                    Direction::Move => "Moving",
+                };
+                let lines = vec![
+                    format!("{direction} {name}"),
+                    format!("Transferred: {transferred}"),
+                    format!("Rate: {} bytes/s", progress.rate()),
+                ];
+                self.reply_multiline(213, "Transfer in progress:", &lines, "End")
+                    .await?;
+            }
+            Commands::Abort => {
+                let Some(mut active) = self.active_transfer.take() else {
+                    // A data connection set up for a transfer that never
+                    // started is dropped.
+                    self.passive_listener = None;
+                    self.active_addr = None;
+                    reply_ok!(self, 225, "No transfer to abort.");
+                };
+                active.task.abort();
+                active.aborted = true;
+                let result = (&mut active.task).await;
+                self.finish_transfer(active, result).await?;
+                reply!(self, 226, "ABOR command successful.");
+            }
+            Commands::Reinitialize => {
+                if self.authorized {
+                    info!(session_id=%self.id, username=%self.username, "User logged out with REIN.");
+                    self.record.username = Some(self.account());
+                    self.state.sessions.release(&self.account());
+                }
+                self.reset();
+                reply!(self, 220, "Service ready for new user.");
+            }
+            Commands::Host => {
+                if self.authorized || !self.username.is_empty() {
+                    reply_ok!(self, 503, "HOST must be sent before USER.");
+                }
+                if arg.is_empty() {
+                    reply_ok!(self, 501, "Host name is required.");
+                }
+
+                let name = arg.trim_start_matches('[').trim_end_matches(']');
+                let hosts = Arc::clone(&self.config.virtual_hosts);
+                let Some(host) = hosts
+                    .iter()
+                    .find(|h| h.host_names.iter().any(|n| n.eq_ignore_ascii_case(name)))
+                else {
+                    reply_ok!(self, 504, "Unknown virtual host.");
+                };
+                self.config = Config {
+                    virtual_hosts: Arc::clone(&hosts),
+                    ..host.clone()
+                };
+                self.reset();
+                let tenant = self.config.tenant.as_deref().unwrap_or_default();
+                info!(session_id=%self.id, host=%name, tenant=%tenant, "Client selected virtual host.");
+                self.greet().await?;
+            }
+            Commands::Authenticate => {
+                let state = Arc::clone(&self.state);
+                let Some(tls) = &state.tls else {
+                    reply_ok!(self, 502, "TLS is not configured.");
+                };
+                if self.connection.is_tls() {
+                    reply_ok!(self, 503, "Already using TLS.");
+                }
+                if !matches!(arg.to_ascii_uppercase().as_str(), "TLS" | "TLS-C" | "SSL") {
+                    reply_ok!(self, 504, "Unknown security mechanism.");
                 }
 
-                let _ = data_connection.shutdown().await;
-                reply!(self, 226, "Transfer complete.");
+                reply!(self, 234, "AUTH TLS successful.");
+                // Commands sent before the handshake must not be taken as
+                // if they were encrypted.
+                self.lines = LineBuffer::default();
+                time::timeout(tls::HANDSHAKE_TIMEOUT, self.connection.upgrade(tls))
+                    .await
+                    .map_err(|_| ConnectionError::TlsFailed(String::from("timed out")))?
+                    .map_err(|e| ConnectionError::TlsFailed(e.to_string()))?;
+                info!(session_id=%self.id, "Control connection is encrypted.");
+            }
+            Commands::ProtectionBufferSize => {
+                if !self.connection.is_tls() {
+                    reply_ok!(self, 503, "Use AUTH TLS first.");
+                }
+                if arg.parse::<u64>().is_err() {
+                    reply_ok!(self, 501, "Buffer size must be a number.");
+                }
+                // TLS does its own buffering, so the size is always 0.
+                self.protection_buffer = true;
+                reply!(self, 200, "PBSZ=0");
+            }
+            Commands::DataProtection => {
+                if !self.protection_buffer {
+                    reply_ok!(self, 503, "Use PBSZ first.");
+                }
+                match arg.to_ascii_uppercase().as_str() {
+                    "C" => {
+                        self.protect_data = false;
+                        reply!(self, 200, "Data connections are not protected.");
+                    }
+                    "P" => {
+                        self.protect_data = true;
+                        reply!(self, 200, "Data connections are protected.");
+                    }
+                    "S" | "E" => {
+                        reply!(self, 536, "Protection level is not supported.");
+                    }
+                    _ => {
+                        reply!(self, 504, "Unknown protection level.");
+                    }
+                }
+            }
+            Commands::Allocate => {
+                require_authorization!(self);
+                // The size may be followed by a record size, as in `ALLO 1024 R 128`.
+                let Some(Ok(size)) = arg.split_whitespace().next().map(str::parse::<u64>) else {
+                    reply_ok!(self, 501, "Syntax error in parameters.");
+                };
+                if self.quota_left().await.is_some_and(|left| size > left) {
+                    reply_ok!(self, 552, "Disk quota exceeded.");
+                }
+                if !self.config.preallocate_uploads {
+                    reply_ok!(self, 202, "No storage allocation necessary.");
+                }
+                self.allocate = Some(size);
+                reply!(
+                    self,
+                    200,
+                    &format!("Allocating {size} bytes for the next upload.")
+                );
+            }
+            Commands::Noop => {
+                // A keepalive between RNFR and RNTO does not cancel the rename.
+                self.rename_from = rename_from;
+                reply!(self, 200, "NOOP ok.");
             }
             Commands::Quit => {
-                reply!(self, 221, "Bye!");
+                let text = self.render(&self.config.messages.goodbye).await;
+                reply!(self, 221, &text);
                 return Err(ConnectionError::ClosedByQuit);
             }
             Commands::Features => {
-                reply!(self, 211, "Features");
-                for i in SERVER_FEATURES {
-                    self.reply_without_code(i).await?;
+                let lines = self.features();
+                self.reply_multiline(211, "Features:", &lines, "End")
+                    .await?;
+            }
+            Commands::Client => {
+                if arg.is_empty() {
+                    reply_ok!(self, 501, "Client name is required.");
+                }
+
+                info!(session_id=%self.id, client=%arg, "Client identified itself.");
+                self.quirks = quirks::find(&self.config.client_quirks, &arg).cloned();
+                if let Some(quirks) = &self.quirks {
+                    info!(session_id=%self.id, client=%arg, profile=%quirks.client, "Applying quirks profile.");
+                    if let Some(dir_style) = quirks.dir_style {
+                        self.dir_style = dir_style;
+                    }
+                }
+                self.record.client = Some(arg);
+                reply!(self, 200, "Noted.");
+            }
+            Commands::Language => {
+                if arg.is_empty() || arg.eq_ignore_ascii_case(language::DEFAULT_LANGUAGE) {
+                    self.language = None;
+                    reply_ok!(self, 200, "Language set to EN.");
+                }
+                let Some((tag, _)) = language::find(&self.config.languages, &arg) else {
+                    reply_ok!(self, 504, "Unsupported language.");
+                };
+                self.language = Some(tag.to_string());
+                let message = format!("Language set to {}.", tag.to_uppercase());
+                reply!(self, 200, &message);
+            }
+            Commands::Site => {
+                require_authorization!(self);
+                self.handle_site(arg).await?;
+            }
+            Commands::Help if !arg.is_empty() => {
+                let (verb, rest) = arg.split_once(' ').unwrap_or((&arg, ""));
+                let verb = verb.to_ascii_uppercase();
+                let command = Commands::from(verb.clone());
+                if command == Commands::Site && !rest.trim().is_empty() {
+                    let Some(site_command) = site::find(rest.trim()) else {
+                        reply_ok!(self, 502, &format!("Unknown command SITE {}.", rest.trim()));
+                    };
+                    reply_ok!(self, 214, &format!("Syntax: {}", site_command.syntax));
+                }
+                let syntax = match command {
+                    Commands::Unknown => {
+                        reply_ok!(self, 502, &format!("Unknown command {verb}."));
+                    }
+                    command if command.syntax().is_empty() => verb,
+                    command => format!("{verb} {}", command.syntax()),
+                };
+                reply!(self, 214, &format!("Syntax: {syntax}"));
+            }
+            Commands::Help => {
+                let mut verbs: Vec<&str> = COMMAND_TABLE.iter().map(|(verb, _)| *verb).collect();
+                verbs.sort_unstable();
+                let mut lines: Vec<String> = verbs.chunks(8).map(|c| c.join(" ")).collect();
+
+                if self.authorized {
+                    let site_verbs: Vec<&str> =
+                        site::allowed(self.user_access()).map(|c| c.name).collect();
+                    lines.push(format!("SITE {}", site_verbs.join(" ")));
                 }
-                reply!(self, 211, "End");
+                self.reply_multiline(
+                    214,
+                    "The following commands are recognized:",
+                    &lines,
+                    "Help OK.",
+                )
+                .await?;
             }
             Commands::Unknown => {
                 reply!(self, 502, "Unknown command.");
@@ -377,8 +1652,30 @@ impl Session {
             Commands::System => {
                 reply!(self, 215, "UNIX Type: L8");
             }
+            Commands::Structure => match arg.to_ascii_uppercase().as_str() {
+                "F" => {
+                    reply!(self, 200, "Structure set to File.");
+                }
+                "R" | "P" => {
+                    reply!(self, 504, "Only File structure is supported.");
+                }
+                _ => {
+                    reply!(self, 501, "Unknown structure.");
+                }
+            },
             Commands::Type => {
-                reply!(self, 200, "OK");
+                let transfer_type = match arg.to_ascii_uppercase().as_str() {
+                    "A" | "A N" => TransferType::Ascii,
+                    "I" | "L 8" => TransferType::Binary,
+                    "" => {
+                        reply_ok!(self, 501, "Type is required.");
+                    }
+                    _ => {
+                        reply_ok!(self, 504, "Only types A and I are supported.");
+                    }
+                };
+                self.transfer_type = transfer_type;
+                reply!(self, 200, &format!("Type set to {}.", transfer_type.name()));
             }
             Commands::Size => {
                 require_authorization!(self);
@@ -386,7 +1683,19 @@ impl Session {
                     reply_ok!(self, 501, "Path is required");
                 }
 
-                let virtual_path = self.current_dir.join(&arg).to_string_lossy().to_string();
+                let virtual_path = self.virtual_path(&arg);
+                if let Some(file) = virtual_files::find(&self.config.virtual_files, &virtual_path) {
+                    let size = self.render(&file.content.clone()).await.len();
+                    reply_ok!(self, 213, &size.to_string());
+                }
+                // An incomplete upload reports how much of it was received,
+                // which is where the client has to continue.
+                if self.config.upload_resume.is_some()
+                    && let Some(upload) = self.state.uploads.get(&self.account(), &virtual_path)
+                    && let Ok(metadata) = fs::metadata(&upload.temp_file).await
+                {
+                    reply_ok!(self, 213, &metadata.len().to_string());
+                }
                 let real_path = match self.resolve_path(virtual_path) {
                     Ok(p) => p,
                     Err(_) => {
@@ -403,62 +1712,251 @@ impl Session {
                 }
                 reply!(self, 213, format!("{}", metadata.len()).as_str());
             }
-            Commands::ChangeDirectoryUp => {
+            Commands::Crc32 | Commands::Md5 | Commands::Sha256 => {
                 require_authorization!(self);
+                if arg.is_empty() {
+                    reply_ok!(self, 501, "Path is required");
+                }
+                let algorithm = match cmd {
+                    Commands::Crc32 => checksum::Algorithm::Crc32,
+                    Commands::Md5 => checksum::Algorithm::Md5,
+                    _ => checksum::Algorithm::Sha256,
+                };
 
-                let parent = if let Some(p) = self.current_dir.parent() {
-                    p.to_path_buf()
+                // A path with spaces names the file as a whole when it exists.
+                let parsed = if !arg.starts_with('"')
+                    && self.resolve_path(self.virtual_path(&arg)).is_ok()
+                {
+                    Some((arg.as_str(), 0, None))
                 } else {
-                    PathBuf::from("/")
+                    protocol::parse_path_range(&arg)
+                };
+                let Some((path, start, end)) = parsed else {
+                    reply_ok!(self, 501, "Syntax error in arguments");
+                };
+                if end.is_some_and(|end| end < start) {
+                    reply_ok!(self, 501, "Invalid byte range.");
+                }
+
+                let virtual_path = self.virtual_path(path);
+                if let Some(file) = virtual_files::find(&self.config.virtual_files, &virtual_path) {
+                    let content = self.render(&file.content.clone()).await;
+                    let len = content.len() as u64;
+                    let range = start.min(len) as usize..end.unwrap_or(len).min(len) as usize;
+                    let digest = checksum::digest(algorithm, &content.as_bytes()[range]);
+                    reply_ok!(self, 250, &digest.to_ascii_uppercase());
+                }
+                let real_path = match self.resolve_path(virtual_path) {
+                    Ok(p) if p.is_file() => p,
+                    _ => {
+                        reply_ok!(self, 550, "File unavailable.");
+                    }
                 };
-                self.current_dir = parent;
-                reply!(self, 250, "Directory changed.");
+                match checksum::digest_file(&real_path, algorithm, start, end).await {
+                    Ok(digest) => {
+                        reply!(self, 250, &digest.to_ascii_uppercase());
+                    }
+                    Err(e) => {
+                        warn!(session_id=%self.id, file=%real_path.display(), reason=%e, "Failed to compute checksum.");
+                        reply!(self, 451, "Failed to compute checksum.");
+                    }
+                }
             }
-            Commands::Port => {
+            Commands::Hash => {
                 require_authorization!(self);
-
                 if arg.is_empty() {
-                    reply_ok!(self, 501, "Address is required");
+                    reply_ok!(self, 501, "Path is required");
                 }
 
-                let splitted: Vec<String> = arg.split(',').map(String::from).collect();
-                if splitted.len() != 6 {
-                    reply_ok!(self, 501, "Syntax error in arguments");
+                let algorithm = self.hash_algorithm;
+                let virtual_path = self.virtual_path(&arg);
+                if let Some(file) = virtual_files::find(&self.config.virtual_files, &virtual_path) {
+                    let content = self.render(&file.content.clone()).await;
+                    let digest = checksum::digest(algorithm, content.as_bytes());
+                    let message =
+                        format!("{} 0-{} {digest} {arg}", algorithm.name(), content.len());
+                    reply_ok!(self, 213, &message);
+                }
+                let (real_path, len) = match self.resolve_path(virtual_path) {
+                    Ok(p) => match fs::metadata(&p).await {
+                        Ok(metadata) if metadata.is_file() => (p, metadata.len()),
+                        _ => {
+                            reply_ok!(self, 550, "Not a file.");
+                        }
+                    },
+                    Err(_) => {
+                        reply_ok!(self, 550, "File unavailable.");
+                    }
+                };
+                match checksum::digest_file(&real_path, algorithm, 0, Some(len)).await {
+                    Ok(digest) => {
+                        let message = format!("{} 0-{len} {digest} {arg}", algorithm.name());
+                        reply!(self, 213, &message);
+                    }
+                    Err(e) => {
+                        warn!(session_id=%self.id, file=%real_path.display(), reason=%e, "Failed to compute checksum.");
+                        reply!(self, 451, "Failed to compute checksum.");
+                    }
+                }
+            }
+            Commands::Available => {
+                require_authorization!(self);
+                if !self.user_access().write {
+                    reply_ok!(self, 550, "No permission to write.");
                 }
 
-                let h1 = splitted[0].trim();
-                let h2 = splitted[1].trim();
-                let h3 = splitted[2].trim();
-                let h4 = splitted[3].trim();
+                let dir = match arg.as_str() {
+                    "" => self.current_dir.to_string_lossy().to_string(),
+                    path => self.virtual_path(path),
+                };
+                let real_path = match self.resolve_path(dir) {
+                    Ok(p) if p.is_dir() => p,
+                    _ => {
+                        reply_ok!(self, 550, "Not a directory.");
+                    }
+                };
+                let free = match disk::disk_space(&real_path) {
+                    Ok(space) => space.free,
+                    Err(e) => {
+                        warn!(session_id=%self.id, reason=%e, "Failed to get free disk space.");
+                        reply_ok!(self, 550, "Failed to get free disk space.");
+                    }
+                };
+                // Uploads stop at the quota long before the disk is full.
+                let available = match self.quota_left().await {
+                    Some(left) => free.min(left),
+                    None => free,
+                };
+                reply!(self, 213, &available.to_string());
+            }
+            Commands::ModificationTime => {
+                require_authorization!(self);
+                if arg.is_empty() {
+                    reply_ok!(self, 501, "Path is required");
+                }
 
-                if let (Ok(p1), Ok(p2)) = (
-                    splitted[4].trim().parse::<u16>(),
-                    splitted[5].trim().parse::<u16>(),
-                ) {
-                    if p1 > 255 || p2 > 255 {
-                        reply_ok!(self, 501, "Invalid port");
+                // Legacy clients set the time with "MDTM YYYYMMDDHHMMSS path"
+                // instead of MFMT. A file whose name looks like that wins.
+                let set = match arg.split_once(' ') {
+                    Some((time, path))
+                        if !path.is_empty()
+                            && self.resolve_path(self.virtual_path(&arg)).is_err() =>
+                    {
+                        DateTime::parse_ftp(time).map(|time| (time, path.to_string()))
                     }
+                    _ => None,
+                };
 
-                    let port = p1 * 256 + p2;
-                    let ip_string = format!("{h1}.{h2}.{h3}.{h4}:{port}");
-                    let addr: SocketAddr = ip_string.parse().unwrap();
+                let Some((time, path)) = set else {
+                    let real_path = match self.resolve_path(self.virtual_path(&arg)) {
+                        Ok(p) => p,
+                        Err(_) => {
+                            reply_ok!(self, 550, "File unavailable.");
+                        }
+                    };
+                    let modified = match fs::metadata(&real_path).await {
+                        Ok(metadata) if metadata.is_file() => metadata.modified().ok(),
+                        _ => {
+                            reply_ok!(self, 550, "Not a file.");
+                        }
+                    };
+                    let seconds = modified
+                        .and_then(|t| t.duration_since(std::time::UNIX_EPOCH).ok())
+                        .map(|d| d.as_secs())
+                        .unwrap_or(0);
+                    reply_ok!(self, 213, &DateTime::from_unix(seconds as i64).to_ftp());
+                };
 
-                    if let Some(pasv) = self.passive_listener.take() {
-                        drop(pasv);
-                        self.passive_listener = None;
+                if !self.user_access().write {
+                    reply_ok!(self, 550, "Permission denied.");
+                }
+                let virtual_path = self.virtual_path(&path);
+                let real_path = match self.resolve_path(virtual_path.clone()) {
+                    Ok(p) if p.is_file() => p,
+                    _ => {
+                        reply_ok!(self, 550, "File unavailable.");
+                    }
+                };
+                let modified =
+                    std::time::UNIX_EPOCH + Duration::from_secs(time.to_unix().max(0) as u64);
+                let result = tokio::task::spawn_blocking(move || {
+                    std::fs::File::open(&real_path)?.set_modified(modified)
+                })
+                .await;
+                match result {
+                    Ok(Ok(())) => {
+                        info!(session_id=%self.id, file=%virtual_path, "Modification time changed.");
+                        reply!(
+                            self,
+                            213,
+                            &format!("Modify={}; {}", time.to_ftp(), virtual_path)
+                        );
                     }
+                    _ => {
+                        reply!(self, 550, "Could not change modification time.");
+                    }
+                }
+            }
+            Commands::ChangeDirectoryUp => {
+                require_authorization!(self);
 
-                    self.active_addr = Some(addr);
-                    reply!(self, 200, "PORT command success.");
-                } else {
-                    reply!(self, 501, "Syntax error in arguments ");
+                let parent = self.virtual_path("..");
+                self.change_dir(parent).await?;
+            }
+            Commands::Port => {
+                require_authorization!(self);
+
+                if arg.is_empty() {
+                    reply_ok!(self, 501, "Address is required");
+                }
+
+                let Some(addr) = protocol::parse_port(&arg) else {
+                    reply_ok!(self, 501, "Syntax error in arguments");
+                };
+                if !self.is_client_port(addr) {
+                    reply_ok!(
+                        self,
+                        504,
+                        "Only unprivileged ports of the client are allowed."
+                    );
+                }
+
+                self.passive_listener = None;
+                self.active_addr = Some(addr);
+                reply!(self, 200, "PORT command success.");
+            }
+            Commands::ExtendedPort => {
+                require_authorization!(self);
+
+                let Some(addr) = protocol::parse_eprt(&arg) else {
+                    // The second field names the address family.
+                    let family = arg.chars().next().and_then(|d| arg.split(d).nth(1));
+                    if family.is_some_and(|f| f != "1" && f != "2") {
+                        reply_ok!(self, 522, "Network protocol not supported, use (1,2).");
+                    }
+                    reply_ok!(self, 501, "Syntax error in arguments");
+                };
+                if !self.is_client_port(addr) {
+                    reply_ok!(
+                        self,
+                        504,
+                        "Only unprivileged ports of the client are allowed."
+                    );
                 }
+
+                self.passive_listener = None;
+                self.active_addr = Some(addr);
+                reply!(self, 200, "EPRT command success.");
             }
             Commands::Passive => {
                 require_authorization!(self);
-                let ln = TcpListener::bind("0.0.0.0:0")
-                    .await
-                    .map_err(|_| ConnectionError::FileSystemError)?;
+                let ln = match passive::bind(self.config.passive.ports).await {
+                    Ok(ln) => ln,
+                    Err(e) => {
+                        warn!(session_id=%self.id, reason=%e, "Failed to open passive listener.");
+                        reply_ok!(self, 425, "Can't open passive connection.");
+                    }
+                };
                 let addr: SocketAddr = ln
                     .local_addr()
                     .map_err(|_| ConnectionError::FileSystemError)?;
@@ -466,25 +1964,24 @@ impl Session {
 
                 self.passive_listener = Some(ln);
 
-                let ip = match self
-                    .connection
-                    .local_addr()
-                    .map_err(|_| ConnectionError::FileSystemError)?
-                {
-                    SocketAddr::V4(v4) if !v4.ip().is_unspecified() => *v4.ip(),
-                    _ => Ipv4Addr::new(127, 0, 0, 1),
+                let ip = match self.config.passive.address {
+                    Some(ip) => ip,
+                    None => match self
+                        .connection
+                        .local_addr()
+                        .map_err(|_| ConnectionError::FileSystemError)?
+                    {
+                        SocketAddr::V4(v4) if !v4.ip().is_unspecified() => *v4.ip(),
+                        _ => Ipv4Addr::new(127, 0, 0, 1),
+                    },
                 };
 
-                let [h1, h2, h3, h4] = ip.octets();
-                let p1 = port / 256;
-                let p2 = port % 256;
-
                 reply!(
                     self,
                     227,
                     format!(
-                        "Entering Passive Mode ({},{},{},{},{},{})",
-                        h1, h2, h3, h4, p1, p2
+                        "Entering Passive Mode ({})",
+                        protocol::format_pasv(SocketAddrV4::new(ip, port))
                     )
                     .as_str()
                 );
@@ -496,13 +1993,20 @@ impl Session {
                     reply_ok!(self, 501, "Argument is required.");
                 }
 
-                self.rest_offset = arg.parse().unwrap();
-                reply!(self, 350, "Restarting at sepcific bytes.");
+                let Ok(offset) = arg.parse::<u64>() else {
+                    reply_ok!(self, 501, "Restart position must be a number of bytes.");
+                };
+                self.rest_offset = offset;
+                reply!(
+                    self,
+                    350,
+                    &format!("Restarting at {offset}. Send STOR, APPE or RETR to continue.")
+                );
             }
             Commands::Retrive => {
                 require_authorization!(self);
 
-                if !self.config.can_user_read(&self.username) {
+                if !self.user_access().read {
                     reply_ok!(self, 501, "No permission to read.");
                 }
 
@@ -510,20 +2014,23 @@ impl Session {
                     reply_ok!(self, 501, "Argument is required.");
                 }
 
-                let virtual_path = self.current_dir.join(&arg).to_string_lossy().to_string();
+                let virtual_path = self.virtual_path(&arg);
+                if let Some(file) = virtual_files::find(&self.config.virtual_files, &virtual_path) {
+                    let content = self.render(&file.content.clone()).await;
+                    return self.send_virtual_file(&virtual_path, content).await;
+                }
                 let real_path = match self.resolve_path(virtual_path) {
                     Ok(p) => p,
                     Err(_) => {
                         reply_ok!(self, 550, "File unavailable.");
                     }
                 };
-                let mut file = File::open(&real_path)
-                    .await
-                    .map_err(|_| ConnectionError::FileSystemError)?;
-                let meta = file
-                    .metadata()
-                    .await
-                    .map_err(|_| ConnectionError::FileSystemError)?;
+                let Ok(mut file) = File::open(&real_path).await else {
+                    reply_ok!(self, 550, "File unavailable.");
+                };
+                let Ok(meta) = file.metadata().await else {
+                    reply_ok!(self, 550, "File unavailable.");
+                };
                 let size = meta.len();
 
                 if self.rest_offset > 0 {
@@ -531,28 +2038,61 @@ impl Session {
                         self.rest_offset = 0;
                         reply_ok!(self, 550, "Invalid restart position.");
                     }
-                    file.seek(SeekFrom::Start(self.rest_offset))
-                        .await
-                        .map_err(|_| ConnectionError::FileSystemError)?;
+                    if file.seek(SeekFrom::Start(self.rest_offset)).await.is_err() {
+                        self.rest_offset = 0;
+                        reply_ok!(self, 550, "Invalid restart position.");
+                    }
                 }
 
-                if let Ok(mut data) = self.open_data_connection().await {
-                    reply!(self, 150, "Ready to transfer...");
+                let mut settings = self.transfer_settings(Direction::Download);
+                if let Some((left, quota)) = self.transfer_left(Direction::Download)
+                    && left < size - self.rest_offset
+                {
+                    let Some(rate) = quota.exhausted_rate else {
+                        self.rest_offset = 0;
+                        reply_ok!(self, 552, "Transfer quota exceeded.");
+                    };
+                    info!(session_id=%self.id, username=%self.username, "Download is throttled because transfer quota is used up.");
+                    settings.limit_rate(rate);
+                }
+
+                // Clients show progress based on the size in this reply.
+                let opening = format!(
+                    "Opening {} mode data connection for {arg} ({} bytes).",
+                    self.transfer_type.name(),
+                    size - self.rest_offset
+                );
+                if let Ok(data) = self.open_data_connection(&opening).await {
                     info!(session_id=%self.id, file=%real_path.to_string_lossy() , username=%self.username, "User is retriving file.");
-                    io::copy(&mut file, &mut data).await.map_err(|_| {
-                        ConnectionError::DataConnectionFailed(String::from("I/O operation failed"))
-                    })?;
-                    let _ = data.shutdown().await;
-                    self.rest_offset = 0;
-                    reply!(self, 226, "Done.");
+                    let progress = Arc::new(Progress::new(
+                        real_path,
+                        Direction::Download,
+                        Some(size - self.rest_offset),
+                    ));
+                    let task_progress = Arc::clone(&progress);
+                    let task = tokio::spawn(async move {
+                        let sent = transfer::send(file, data, task_progress, settings).await?;
+                        Ok((sent, None))
+                    });
+                    self.start_transfer(ActiveTransfer {
+                        progress,
+                        task,
+                        upload: None,
+                        quarantined: None,
+                        append_offset: None,
+                        aborted: false,
+                        preallocated: false,
+                        replaced: DirectoryUsage::default(),
+                        unique_name: None,
+                    });
                 } else {
                     reply!(self, 425, "Cant open data connection.");
                 }
             }
-            Commands::Store => {
+            Commands::Delete => {
                 require_authorization!(self);
 
-                if !self.config.can_user_write(&self.username) {
+                if !self.user_access().write {
                     reply_ok!(self, 550, "No permission to write.");
                 }
 
@@ -560,58 +2100,667 @@ impl Session {
                     reply_ok!(self, 501, "Argument is required.");
                 }
 
-                if DISALLOWED_FILENAMES.contains(&arg.as_str()) {
-                    reply_ok!(self, 553, "File name not allowed.");
+                let virtual_path = self.virtual_path(&arg);
+                if virtual_files::find(&self.config.virtual_files, &virtual_path).is_some() {
+                    reply_ok!(self, 550, "File is read-only.");
+                }
+                let Ok(real_path) = self.resolve_entry(&virtual_path) else {
+                    reply_ok!(self, 550, "File not found.");
+                };
+                let size = match fs::symlink_metadata(&real_path).await {
+                    Ok(metadata) if metadata.is_dir() => {
+                        reply_ok!(self, 550, "Is a directory, use RMD to remove it.");
+                    }
+                    Ok(metadata) => metadata.len(),
+                    Err(_) => {
+                        reply_ok!(self, 550, "File not found.");
+                    }
+                };
+                match fs::remove_file(&real_path).await {
+                    Ok(()) => {
+                        self.state.usage.adjust(&real_path, -(size as i64), -1);
+                        info!(session_id=%self.id, file=%real_path.display(), username=%self.username, "User deleted file.");
+                        reply!(self, 250, "File deleted.");
+                    }
+                    Err(e) => {
+                        warn!(session_id=%self.id, file=%real_path.display(), reason=%e, "Failed to delete file.");
+                        reply!(self, 550, "Failed to delete file.");
+                    }
                 }
+            }
+            Commands::Combine => {
+                require_authorization!(self);
 
-                let file_path = self.get_real_path().join(arg);
-                let parent_dir = file_path.parent().unwrap_or(Path::new(""));
-                fs::create_dir_all(parent_dir)
-                    .await
-                    .map_err(|_| ConnectionError::FileSystemError)?;
-                let mut file = File::create(&file_path)
-                    .await
-                    .map_err(|_| ConnectionError::FileSystemError)?;
+                if !self.user_access().write {
+                    reply_ok!(self, 550, "No permission to write.");
+                }
+                if self.limits.combine_uploads != Some(true) {
+                    reply_ok!(
+                        self,
+                        550,
+                        "Combining uploads is not allowed for your account."
+                    );
+                }
+                let Some(paths) = protocol::split_arguments(&arg).filter(|p| p.len() >= 2) else {
+                    reply_ok!(self, 501, "Usage: COMB <target> <segment> [<segment> ...]");
+                };
+                if !self.has_free_space(Path::new(&self.root)) {
+                    reply_ok!(self, 452, "Insufficient storage space.");
+                }
 
-                if let Ok(mut data) = self.open_data_connection().await {
-                    reply!(self, 150, "Ready to receive.");
-                    info!(session_id=%self.id, file=%file_path.to_string_lossy() , username=%self.username, "User is sending file.");
-                    io::copy(&mut data, &mut file).await.map_err(|_| {
-                        ConnectionError::DataConnectionFailed(String::from("I/O operation failed"))
-                    })?;
+                let target = self.virtual_path(paths[0]);
+                if virtual_files::find(&self.config.virtual_files, &target).is_some() {
+                    reply_ok!(self, 550, "File is read-only.");
+                }
+                let Ok(target_path) = self.resolve_new_path(&target) else {
+                    reply_ok!(self, 553, "File name not allowed.");
+                };
+                let mut segments = Vec::with_capacity(paths.len() - 1);
+                for path in &paths[1..] {
+                    let virtual_path = self.virtual_path(path);
+                    match self.resolve_path(virtual_path.clone()) {
+                        Ok(p) if p == target_path => {
+                            reply_ok!(self, 550, "Target can not be one of the segments.");
+                        }
+                        Ok(p) if p.is_file() => segments.push(p),
+                        _ => {
+                            reply_ok!(self, 550, &format!("Segment {virtual_path} not found."));
+                        }
+                    }
+                }
 
-                    self.rest_offset = 0;
-                    let _ = data.shutdown().await;
-                    reply!(self, 226, "Transfer complete.");
-                } else {
-                    reply!(self, 425, "Cant open data connection.");
+                let result = combine_files(&target_path, &segments).await;
+                self.state.usage.changed(&target_path);
+                match result {
+                    Ok(bytes) => {
+                        for segment in &segments {
+                            if let Err(e) = fs::remove_file(segment).await {
+                                warn!(session_id=%self.id, file=%segment.display(), reason=%e, "Failed to delete combined segment.");
+                            }
+                        }
+                        info!(session_id=%self.id, file=%target_path.display(), username=%self.username, segments=segments.len(), bytes=bytes, "User combined uploaded segments.");
+                        reply!(self, 250, "COMB command successful.");
+                    }
+                    Err(e) => {
+                        warn!(session_id=%self.id, file=%target_path.display(), reason=%e, "Failed to combine segments.");
+                        reply!(self, 451, "Failed to combine segments.");
+                    }
                 }
             }
-        }
-        Ok(())
-    }
+            Commands::MakeDir => {
+                require_authorization!(self);
 
-    async fn open_data_connection(&mut self) -> Result<TcpStream, anyhow::Error> {
-        let timeout = Duration::from_secs(10);
+                if !self.user_access().write {
+                    reply_ok!(self, 550, "No permission to write.");
+                }
 
-        // Active Mode (PORT)
-        if let Some(addr) = self.active_addr.take() {
-            let stream = time::timeout(timeout, TcpStream::connect(&addr))
-                .await
-                .map_err(|_| anyhow!("data connection timeout"))?
-                .map_err(anyhow::Error::from)?;
-            return Ok(stream);
-        }
+                if arg.is_empty() {
+                    reply_ok!(self, 501, "Argument is required.");
+                }
 
-        // Passive Mode (PASV)
-        let listener = match self.passive_listener.take() {
-            Some(l) => l,
-            None => bail!("use PASV or PORT first"),
-        };
+                let virtual_path = self.virtual_path(&arg);
+                let Ok(real_path) = self.resolve_new_path(&virtual_path) else {
+                    reply_ok!(self, 550, "Directory name not allowed.");
+                };
+                if fs::symlink_metadata(&real_path).await.is_ok() {
+                    reply_ok!(self, 550, "Directory already exists.");
+                }
+                match fs::create_dir(&real_path).await {
+                    Ok(()) => {
+                        info!(session_id=%self.id, dir=%real_path.display(), username=%self.username, "User created directory.");
+                        reply!(
+                            self,
+                            257,
+                            &format!("{} created.", protocol::quote_path(&virtual_path))
+                        );
+                    }
+                    Err(e) => {
+                        warn!(session_id=%self.id, dir=%real_path.display(), reason=%e, "Failed to create directory.");
+                        reply!(self, 550, "Failed to create directory.");
+                    }
+                }
+            }
+            Commands::RemoveDir => {
+                require_authorization!(self);
 
+                if !self.user_access().write {
+                    reply_ok!(self, 550, "No permission to write.");
+                }
+
+                if arg.is_empty() {
+                    reply_ok!(self, 501, "Argument is required.");
+                }
+
+                let virtual_path = self.virtual_path(&arg);
+                let Ok(real_path) = self.resolve_entry(&virtual_path) else {
+                    reply_ok!(self, 550, "Directory not found.");
+                };
+                match fs::symlink_metadata(&real_path).await {
+                    Ok(metadata) if metadata.is_dir() => {}
+                    Ok(_) => {
+                        reply_ok!(self, 550, "Not a directory.");
+                    }
+                    Err(_) => {
+                        reply_ok!(self, 550, "Directory not found.");
+                    }
+                }
+                let result = if self.config.recursive_rmd {
+                    fs::remove_dir_all(&real_path).await
+                } else {
+                    fs::remove_dir(&real_path).await
+                };
+                self.state.usage.changed(&real_path);
+                match result {
+                    Ok(()) => {
+                        info!(session_id=%self.id, dir=%real_path.display(), username=%self.username, "User removed directory.");
+                        reply!(self, 250, "Directory removed.");
+                    }
+                    Err(e) if e.kind() == std::io::ErrorKind::DirectoryNotEmpty => {
+                        reply!(self, 550, "Directory is not empty.");
+                    }
+                    Err(e) => {
+                        warn!(session_id=%self.id, dir=%real_path.display(), reason=%e, "Failed to remove directory.");
+                        reply!(self, 550, "Failed to remove directory.");
+                    }
+                }
+            }
+            Commands::RenameFrom => {
+                require_authorization!(self);
+
+                if !self.user_access().write {
+                    reply_ok!(self, 550, "No permission to write.");
+                }
+
+                if arg.is_empty() {
+                    reply_ok!(self, 501, "Argument is required.");
+                }
+
+                let virtual_path = self.virtual_path(&arg);
+                if virtual_files::find(&self.config.virtual_files, &virtual_path).is_some() {
+                    reply_ok!(self, 550, "File is read-only.");
+                }
+                let Ok(real_path) = self.resolve_entry(&virtual_path) else {
+                    reply_ok!(self, 550, "File not found.");
+                };
+                if fs::symlink_metadata(&real_path).await.is_err() {
+                    reply_ok!(self, 550, "File not found.");
+                }
+                self.rename_from = Some(real_path);
+                reply!(self, 350, "Ready for destination name.");
+            }
+            Commands::RenameTo => {
+                require_authorization!(self);
+
+                let Some(from) = rename_from else {
+                    reply_ok!(self, 503, "Use RNFR first.");
+                };
+
+                if arg.is_empty() {
+                    reply_ok!(self, 501, "Argument is required.");
+                }
+
+                let virtual_path = self.virtual_path(&arg);
+                if virtual_path == "/"
+                    || virtual_files::find(&self.config.virtual_files, &virtual_path).is_some()
+                {
+                    reply_ok!(self, 553, "File name not allowed.");
+                }
+                let Ok(to) = self.resolve_new_path(&virtual_path) else {
+                    reply_ok!(self, 553, "File name not allowed.");
+                };
+                // Moves to another volume copy the file, which can take a
+                // while, so they run like transfers and STAT and ABOR work.
+                let size = match fs::symlink_metadata(&from).await {
+                    Ok(metadata) if metadata.is_file() => Some(metadata.len()),
+                    _ => None,
+                };
+                info!(session_id=%self.id, from=%from.display(), to=%to.display(), username=%self.username, "User is renaming file.");
+                let progress = Arc::new(Progress::new(to.clone(), Direction::Move, size));
+                let copied = progress.counter();
+                let task = tokio::spawn(async move {
+                    rename::rename(&from, &to, Arc::clone(&copied))
+                        .await
+                        .map(|()| (copied.load(std::sync::atomic::Ordering::Relaxed), None))
+                });
+                self.start_transfer(ActiveTransfer {
+                    progress,
+                    task,
+                    upload: None,
+                    quarantined: None,
+                    append_offset: None,
+                    aborted: false,
+                    preallocated: false,
+                    replaced: DirectoryUsage::default(),
+                    unique_name: None,
+                });
+            }
+            Commands::Store => self.store(arg, StoreMode::Replace).await?,
+            Commands::Append => self.store(arg, StoreMode::Append).await?,
+            Commands::StoreUnique => {
+                // The client leaves the name to the server.
+                let name = format!("upload-{}", cuid2::cuid());
+                self.store(name, StoreMode::Unique).await?
+            }
+        }
+        Ok(())
+    }
+
+    /// Receives a file for STOR, APPE or STOU.
+    async fn store(&mut self, arg: String, mode: StoreMode) -> Result<(), ConnectionError> {
+        require_authorization!(self);
+        let allocate = self.allocate.take();
+
+        if !self.user_access().write {
+            reply_ok!(self, 550, "No permission to write.");
+        }
+
+        if arg.is_empty() {
+            reply_ok!(self, 501, "Argument is required.");
+        }
+
+        if DISALLOWED_FILENAMES.contains(&arg.as_str()) {
+            reply_ok!(self, 553, "File name not allowed.");
+        }
+
+        if !self.has_free_space(Path::new(&self.root)) {
+            reply_ok!(self, 452, "Insufficient storage space.");
+        }
+
+        let quota_left = self.quota_left().await;
+        if quota_left == Some(0) {
+            reply_ok!(self, 552, "Disk quota exceeded.");
+        }
+
+        let mut settings = self.transfer_settings(Direction::Upload);
+        let mut transfer_left = None;
+        if let Some((left, quota)) = self.transfer_left(Direction::Upload) {
+            match (left, quota.exhausted_rate) {
+                (0, None) => {
+                    reply_ok!(self, 552, "Transfer quota exceeded.");
+                }
+                (0, Some(rate)) => {
+                    info!(session_id=%self.id, username=%self.username, "Upload is throttled because transfer quota is used up.");
+                    settings.limit_rate(rate);
+                }
+                // Once throttling is configured, uploads are never cut off.
+                (_, Some(_)) => {}
+                (left, None) => transfer_left = Some(left),
+            }
+        }
+
+        let virtual_path = self.virtual_path(&arg);
+        if virtual_path == "/" {
+            reply_ok!(self, 553, "File name not allowed.");
+        }
+        if virtual_files::find(&self.config.virtual_files, &virtual_path).is_some() {
+            reply_ok!(self, 550, "File is read-only.");
+        }
+        let Ok(file_path) = self.resolve_new_path(&virtual_path) else {
+            reply_ok!(self, 553, "File name not allowed.");
+        };
+        // Files the upload replaces, to work out how it changes disk usage.
+        let mut replaced = match fs::symlink_metadata(&file_path).await {
+            Ok(metadata) => DirectoryUsage {
+                bytes: metadata.len(),
+                files: 1,
+            },
+            Err(_) => DirectoryUsage::default(),
+        };
+        if let Some(limit) = self.user().and_then(|u| u.file_quota)
+            && replaced.files == 0
+            && self.state.usage.get(Path::new(&self.root)).await.files >= limit
+        {
+            reply_ok!(self, 552, "File quota exceeded.");
+        }
+        if mode == StoreMode::Append && self.config.quarantine.is_some() {
+            reply_ok!(
+                self,
+                550,
+                "Appending is not possible while uploads are held for approval."
+            );
+        }
+        // Quarantined uploads are written outside of the root.
+        let quarantined = self.config.quarantine.as_ref().map(|q| {
+            QuarantinedUpload::new(
+                Path::new(&q.dir),
+                &self.account(),
+                &virtual_path,
+                file_path.clone(),
+            )
+        });
+        let file_path = quarantined.as_ref().map_or(file_path, |q| q.file.clone());
+        let parent_dir = file_path.parent().unwrap_or(Path::new(""));
+        if let Err(e) = fs::create_dir_all(parent_dir).await {
+            warn!(session_id=%self.id, file=%file_path.display(), reason=%e, "Failed to create upload directory.");
+            reply_ok!(self, 550, "Cannot create file.");
+        }
+        let offset = std::mem::take(&mut self.rest_offset);
+        let (mut file, upload) = match &self.config.upload_resume {
+            // Unless an incomplete upload is waiting in a temporary file, REST
+            // continues the target itself at the offset, dropping whatever
+            // follows it.
+            _ if offset > 0
+                && mode != StoreMode::Unique
+                && (mode == StoreMode::Append
+                    || self.config.upload_resume.is_none()
+                    || self
+                        .state
+                        .uploads
+                        .get(&self.account(), &virtual_path)
+                        .is_none()) =>
+            {
+                if quarantined.is_some() {
+                    reply_ok!(
+                        self,
+                        550,
+                        "Restarting is not possible while uploads are held for approval."
+                    );
+                }
+                let Ok(mut file) = fs::OpenOptions::new().write(true).open(&file_path).await else {
+                    reply_ok!(self, 550, "Failed to resume upload.");
+                };
+                let size = file
+                    .metadata()
+                    .await
+                    .map_err(|_| ConnectionError::FileSystemError)?
+                    .len();
+                if offset > size {
+                    reply_ok!(self, 554, "Invalid restart position.");
+                }
+                file.set_len(offset)
+                    .await
+                    .map_err(|_| ConnectionError::FileSystemError)?;
+                file.seek(SeekFrom::Start(offset))
+                    .await
+                    .map_err(|_| ConnectionError::FileSystemError)?;
+                info!(session_id=%self.id, file=%file_path.to_string_lossy(), offset=offset, "Resuming upload.");
+                (file, None)
+            }
+            // Appends go straight to the target, they can not be resumed.
+            _ if mode == StoreMode::Append => {
+                // Writes with io_uring carry offsets, which O_APPEND ignores.
+                settings.use_uring = false;
+                let file = match fs::OpenOptions::new()
+                    .append(true)
+                    .create(true)
+                    .open(&file_path)
+                    .await
+                {
+                    Ok(file) => file,
+                    Err(e) => {
+                        warn!(session_id=%self.id, file=%file_path.display(), reason=%e, "Failed to open file for appending.");
+                        reply_ok!(self, 550, "Cannot open file.");
+                    }
+                };
+                (file, None)
+            }
+            // The name is fresh, but another upload must never be replaced.
+            _ if mode == StoreMode::Unique => {
+                let file = match fs::OpenOptions::new()
+                    .write(true)
+                    .create_new(true)
+                    .open(&file_path)
+                    .await
+                {
+                    Ok(file) => file,
+                    Err(e) => {
+                        warn!(session_id=%self.id, file=%file_path.display(), reason=%e, "Failed to create unique file.");
+                        reply_ok!(self, 450, "Cannot create a unique file.");
+                    }
+                };
+                (file, None)
+            }
+            Some(_) => {
+                let owner = self.account();
+                let previous = self.state.uploads.get(&owner, &virtual_path);
+                match previous {
+                    Some(upload) if offset > 0 => {
+                        let Ok(mut file) = fs::OpenOptions::new()
+                            .write(true)
+                            .open(&upload.temp_file)
+                            .await
+                        else {
+                            reply_ok!(self, 550, "Failed to resume upload.");
+                        };
+                        let size = file
+                            .metadata()
+                            .await
+                            .map_err(|_| ConnectionError::FileSystemError)?
+                            .len();
+                        if offset > size {
+                            reply_ok!(self, 554, "Invalid restart position.");
+                        }
+                        replaced.bytes += size;
+                        replaced.files += 1;
+                        file.set_len(offset)
+                            .await
+                            .map_err(|_| ConnectionError::FileSystemError)?;
+                        file.seek(SeekFrom::Start(offset))
+                            .await
+                            .map_err(|_| ConnectionError::FileSystemError)?;
+                        info!(session_id=%self.id, file=%file_path.to_string_lossy(), offset=offset, "Resuming upload.");
+                        (file, Some(upload))
+                    }
+                    previous => {
+                        if let Some(previous) = previous {
+                            let _ = fs::remove_file(&previous.temp_file).await;
+                        }
+                        let upload = PartialUpload::new(&owner, &virtual_path, file_path.clone());
+                        let file = match File::create(&upload.temp_file).await {
+                            Ok(file) => file,
+                            Err(e) => {
+                                warn!(session_id=%self.id, file=%file_path.display(), reason=%e, "Failed to create file.");
+                                reply_ok!(self, 550, "Cannot create file.");
+                            }
+                        };
+                        (file, Some(upload))
+                    }
+                }
+            }
+            None => {
+                let file = match File::create(&file_path).await {
+                    Ok(file) => file,
+                    Err(e) => {
+                        warn!(session_id=%self.id, file=%file_path.display(), reason=%e, "Failed to create file.");
+                        reply_ok!(self, 550, "Cannot create file.");
+                    }
+                };
+                (file, None)
+            }
+        };
+        // A resumed upload continues in the file it was started in.
+        let quarantined = quarantined.map(|q| QuarantinedUpload {
+            file: upload.as_ref().map_or(q.file.clone(), |u| u.target.clone()),
+            ..q
+        });
+        if let Some(upload) = &upload {
+            self.state.uploads.put(PartialUpload {
+                updated: datetime::unix_now(),
+                ..upload.clone()
+            });
+        }
+
+        let append_offset = if mode == StoreMode::Append || (offset > 0 && upload.is_none()) {
+            let metadata = file
+                .metadata()
+                .await
+                .map_err(|_| ConnectionError::FileSystemError)?;
+            Some(metadata.len())
+        } else {
+            None
+        };
+        let mut preallocated = false;
+        if let Some(size) = allocate {
+            let offset = match append_offset {
+                Some(offset) => offset,
+                None => file
+                    .stream_position()
+                    .await
+                    .map_err(|_| ConnectionError::FileSystemError)?,
+            };
+            // Uploads work without the reservation, so failures are only logged.
+            match disk::preallocate(&file, offset, size.saturating_sub(offset)) {
+                Ok(()) => preallocated = true,
+                Err(e) => {
+                    warn!(session_id=%self.id, file=%file_path.display(), bytes=size, reason=%e, "Failed to preallocate upload.")
+                }
+            }
+        }
+
+        let opening = if mode == StoreMode::Unique {
+            // RFC 1123 names the file in the preliminary reply.
+            format!("FILE: {arg}")
+        } else {
+            String::from("Ready to receive.")
+        };
+        if let Ok(data) = self.open_data_connection(&opening).await {
+            info!(session_id=%self.id, file=%file_path.to_string_lossy() , username=%self.username, "User is sending file.");
+
+            let limits = UploadLimits::new(
+                file_path.clone(),
+                self.config.min_free_space,
+                quota_left,
+                transfer_left,
+            );
+            let progress = Arc::new(Progress::new(file_path, Direction::Upload, None));
+            let task_progress = Arc::clone(&progress);
+            let task = tokio::spawn(transfer::receive(
+                data,
+                file,
+                limits,
+                task_progress,
+                settings,
+            ));
+            self.start_transfer(ActiveTransfer {
+                progress,
+                task,
+                upload,
+                quarantined,
+                append_offset,
+                aborted: false,
+                preallocated,
+                replaced,
+                unique_name: (mode == StoreMode::Unique).then_some(arg),
+            });
+        } else {
+            reply!(self, 425, "Cant open data connection.");
+        }
+        Ok(())
+    }
+
+    async fn handle_site(&mut self, arg: String) -> Result<(), ConnectionError> {
+        let (subcommand, args) = arg.split_once(' ').unwrap_or((arg.as_str(), ""));
+
+        let Some(command) = site::find(subcommand) else {
+            reply_ok!(self, 504, "Unknown SITE command.");
+        };
+        if !command.is_allowed(self.user_access()) {
+            reply_ok!(self, 550, "Permission denied.");
+        }
+        if command.uses_root && self.state.storage.is_some() {
+            reply_ok!(self, 502, "Not supported by the storage backend.");
+        }
+        if self.limits.denies(Commands::Site, Some(command.name)) {
+            info!(session_id=%self.id, username=%self.username, command=%command.name, "SITE command denied for user.");
+            reply_ok!(self, 533, "Command is not allowed for your account.");
+        }
+
+        (command.handler)(self, args).await
+    }
+
+    /// Connects to the client for an active mode transfer.
+    async fn connect_active(&self, addr: SocketAddr) -> std::io::Result<TcpStream> {
+        let local = self.connection.local_addr()?;
+        // The control connection can only lend its port to data connections
+        // of the same address family.
+        if self.config.active_source_port
+            && local.is_ipv4() == addr.is_ipv4()
+            && let Some(port) = local.port().checked_sub(1).filter(|&p| p > 0)
+        {
+            let socket = match local {
+                SocketAddr::V4(_) => TcpSocket::new_v4()?,
+                SocketAddr::V6(_) => TcpSocket::new_v6()?,
+            };
+            socket.set_reuseaddr(true)?;
+            match socket.bind(SocketAddr::new(local.ip(), port)) {
+                Ok(()) => return socket.connect(addr).await,
+                Err(e) => {
+                    warn!(session_id=%self.id, port=port, reason=%e, "Failed to bind active mode source port, using any port.");
+                }
+            }
+        }
+        TcpStream::connect(addr).await
+    }
+
+    /// Opens the data connection and sends the 150 reply with the message.
+    /// The connection is encrypted if PROT P was sent, which clients only
+    /// start once they have the reply.
+    async fn open_data_connection(&mut self, message: &str) -> Result<Stream, anyhow::Error> {
+        let stream = self.connect_data().await?;
+        self.reply_preliminary(message)
+            .await
+            .map_err(anyhow::Error::from)?;
+        if !self.protect_data {
+            return Ok(Stream::Plain(stream));
+        }
+        let tls = self
+            .state
+            .tls
+            .as_ref()
+            .ok_or_else(|| anyhow!("TLS is not configured"))?;
+        time::timeout(tls::HANDSHAKE_TIMEOUT, tls.accept(stream))
+            .await
+            .map_err(|_| anyhow!("data connection TLS handshake timeout"))?
+            .map_err(anyhow::Error::from)
+    }
+
+    /// Checks that PORT and EPRT name an unprivileged port of the client, so
+    /// the server can not be used to connect to other hosts.
+    fn is_client_port(&self, addr: SocketAddr) -> bool {
+        addr.port() >= 1024
+            && self
+                .connection
+                .peer_addr()
+                .is_ok_and(|peer| peer.ip().to_canonical() == addr.ip().to_canonical())
+    }
+
+    async fn connect_data(&mut self) -> Result<TcpStream, anyhow::Error> {
+        let timeout = Duration::from_secs(10);
+        self.preliminary_sent = false;
+
+        // Active Mode (PORT)
+        if let Some(addr) = self.active_addr.take() {
+            let stream = time::timeout(timeout, self.connect_active(addr))
+                .await
+                .map_err(|_| anyhow!("data connection timeout"))?
+                .map_err(anyhow::Error::from)?;
+            return Ok(stream);
+        }
+
+        // Passive Mode (PASV)
+        let listener = match self.passive_listener.take() {
+            Some(l) => l,
+            None => bail!("use PASV or PORT first"),
+        };
+
+        if self.quirks.as_ref().is_some_and(|q| q.reply_before_accept) {
+            self.reply(150, "Opening data connection.")
+                .await
+                .map_err(anyhow::Error::from)?;
+            self.preliminary_sent = true;
+        }
+
+        // Connections from other hosts could steal or inject the data.
+        let client_ip = self.connection.peer_addr()?.ip().to_canonical();
+        let session_id = self.id.clone();
         let accept_fn = async move {
-            let (stream, _) = listener.accept().await?;
-            Ok::<TcpStream, anyhow::Error>(stream)
+            loop {
+                let (stream, peer) = listener.accept().await?;
+                if peer.ip().to_canonical() == client_ip {
+                    return Ok::<TcpStream, anyhow::Error>(stream);
+                }
+                warn!(session_id=%session_id, peer=%peer, "Refused data connection from another host.");
+            }
         };
 
         let stream = time::timeout(timeout, accept_fn)
@@ -621,19 +2770,340 @@ impl Session {
         Ok(stream)
     }
 
+    /// Features listed by FEAT, following the config. Commands denied to
+    /// the user are left out.
+    fn features(&self) -> Vec<String> {
+        let mut features = vec![String::from("UTF8"), facts::feature(&self.mlst_facts)];
+        features.extend(["SIZE", "MDTM", "PASV", "PORT", "EPRT", "REST STREAM"].map(String::from));
+        if cfg!(unix) {
+            features.push(String::from("SITE CHMOD"));
+        }
+        features.extend(["AVBL", "CLNT", "XCRC", "XMD5", "XSHA256"].map(String::from));
+        features.push(checksum::hash_feature(self.hash_algorithm));
+        if self.state.tls.is_some() {
+            features.extend(["AUTH TLS", "PBSZ", "PROT"].map(String::from));
+        }
+        if self
+            .config
+            .virtual_hosts
+            .iter()
+            .any(|h| !h.host_names.is_empty())
+        {
+            features.push(String::from("HOST"));
+        }
+        if !self.config.languages.is_empty() {
+            features.push(language::feature(
+                &self.config.languages,
+                self.language.as_deref(),
+            ));
+        }
+        features.retain(|feature| {
+            let mut words = feature.split_whitespace();
+            let verb = words.next().unwrap_or_default();
+            let command = Commands::from(verb.to_string());
+            !self
+                .limits
+                .denies(command, words.next().filter(|_| command == Commands::Site))
+        });
+        features
+    }
+
+    /// Logs the user out and restores the state the session started with,
+    /// for REIN and HOST.
+    fn reset(&mut self) {
+        self.authorized = false;
+        self.username.clear();
+        self.external_user = None;
+        self.root = self.config.root.clone();
+        self.limits = self.config.limits.clone();
+        self.dir_style = self
+            .quirks
+            .as_ref()
+            .and_then(|q| q.dir_style)
+            .unwrap_or(self.config.dir_style);
+        self.transfer_type = TransferType::default();
+        self.charset = self.config.client_encoding;
+        self.current_dir = PathBuf::from("/");
+        self.rest_offset = 0;
+        self.allocate = None;
+        self.hash_algorithm = checksum::Algorithm::default();
+        self.language = None;
+        self.utf8_disabled = false;
+        self.mlst_facts = facts::supported();
+        self.expected_checksums.clear();
+        self.active_addr = None;
+        self.passive_listener = None;
+    }
+
+    /// Sends the 150 reply once the data connection is open, unless it was
+    /// sent while waiting for the client to connect.
+    async fn reply_preliminary(&mut self, message: &str) -> Result<(), ConnectionError> {
+        if std::mem::take(&mut self.preliminary_sent) {
+            return Ok(());
+        }
+        self.reply(150, message).await
+    }
+
+    /// Key of the current user in shared state.
+    fn account(&self) -> String {
+        self.config.account_key(&self.username)
+    }
+
+    /// Finishes the login of an authenticated user: checks the policies
+    /// of the user, prepares the root and replies with `code`.
+    async fn log_in(&mut self, user: User, code: u16) -> Result<(), ConnectionError> {
+        if self.config.geoip.is_some()
+            && let Some(policy) = &user.countries
+        {
+            let country = self.country.as_deref().unwrap_or("unknown");
+            if !policy.permits(self.country.as_deref()) {
+                warn!(session_id=%self.id, username=%self.username, country=%country, "Login denied by GeoIP policy.");
+                reply_ok!(self, 530, "Login is not allowed from your location.");
+            }
+            info!(session_id=%self.id, username=%self.username, country=%country, "Login allowed by GeoIP policy.");
+        }
+
+        if self.config.reverse_dns.is_some()
+            && let Some(policy) = &user.hostnames
+        {
+            let hostname = self.hostname.as_deref().unwrap_or("unknown");
+            if !policy.permits(self.hostname.as_deref()) {
+                warn!(session_id=%self.id, username=%self.username, hostname=%hostname, "Login denied by host name policy.");
+                reply_ok!(self, 530, "Login is not allowed from your host.");
+            }
+            info!(session_id=%self.id, username=%self.username, hostname=%hostname, "Login allowed by host name policy.");
+        }
+
+        let root = match &user.root {
+            Some(template) => {
+                let root = match users::expand_root(template, &user.name, DateTime::now()) {
+                    Ok(root) => root,
+                    Err(e) => {
+                        warn!(session_id=%self.id, username=%self.username, reason=%e, "Failed to expand user root.");
+                        reply_ok!(self, 530, "Your home directory is unavailable.");
+                    }
+                };
+                if self.config.create_user_roots
+                    && let Err(e) = fs::create_dir_all(&root).await
+                {
+                    warn!(session_id=%self.id, username=%self.username, root=%root, reason=%e, "Failed to create user root.");
+                    reply_ok!(self, 530, "Your home directory is unavailable.");
+                }
+                Some(root)
+            }
+            None => None,
+        };
+
+        let limits = self.config.limits_for(&user);
+        if !self
+            .state
+            .sessions
+            .try_acquire(&self.account(), limits.max_sessions)
+        {
+            warn!(session_id=%self.id, username=%self.username, "Login denied because the user has too many sessions.");
+            reply_ok!(self, 530, "Too many sessions for this user.");
+        }
+        self.limits = limits;
+
+        if let Some(root) = root {
+            self.root = root;
+        }
+        self.authorized = true;
+        self.state.stats.record_login(&self.account());
+        info!(session_id=%self.id, username=%self.username, "User authorized.");
+        let text = self.render(&self.config.messages.login).await;
+        let lines = self.login_message_lines().await;
+        match lines.split_first() {
+            Some((first, rest)) => self.reply_multiline(code, first, rest, &text).await?,
+            None => self.reply(code, &text).await?,
+        }
+        Ok(())
+    }
+
+    /// Returns the name in the client certificate that is mapped to the
+    /// user, if the client presented one.
+    fn certificate_login(&self, user: &User) -> Option<String> {
+        if user.client_certificates.is_empty() {
+            return None;
+        }
+        let certificate = self.connection.peer_certificate()?;
+        x509::names(certificate)
+            .into_iter()
+            .find(|name| user.client_certificates.contains(name))
+    }
+
+    /// Asks the backends for the password of the user until one of them
+    /// knows the user. Returns the user and the backend that accepted it.
+    async fn authenticate(
+        &self,
+        password: &str,
+        peer_ip: Option<IpAddr>,
+    ) -> Option<(AuthBackend, User)> {
+        for (backend, authenticator) in auth::authenticators(&self.config, &self.state) {
+            match authenticator
+                .authenticate(&self.username, password, peer_ip)
+                .await
+            {
+                Ok(user) => {
+                    info!(session_id=%self.id, username=%self.username, backend=%backend, "User authenticated.");
+                    return Some((backend, user));
+                }
+                Err(AuthError::UnknownUser) => {}
+                Err(AuthError::WrongPassword) => return None,
+                Err(AuthError::Failed(e)) => {
+                    info!(session_id=%self.id, username=%self.username, backend=%backend, reason=%e, "Authentication failed.");
+                }
+            }
+        }
+        None
+    }
+
+    /// Current state of the user, which can be changed through the admin API.
+    fn user(&self) -> Option<User> {
+        self.external_user
+            .clone()
+            .or_else(|| self.state.users.get(&self.account()))
+    }
+
+    /// Replaces the stored password of the user with an argon2id hash. Login
+    /// goes on if that fails, the upgrade is tried again next time.
+    async fn upgrade_password_hash(&self, password: &str) {
+        let hash = match password::hash(password).await {
+            Ok(hash) => hash,
+            Err(e) => {
+                warn!(session_id=%self.id, username=%self.username, reason=%e, "Failed to upgrade password hash.");
+                return;
+            }
+        };
+        let update = UserUpdate {
+            password: Some(hash),
+            ..UserUpdate::default()
+        };
+        match self.state.users.update(&self.account(), update) {
+            Ok(_) => {
+                info!(session_id=%self.id, username=%self.username, "Upgraded password hash to argon2id.")
+            }
+            Err(e) => {
+                warn!(session_id=%self.id, username=%self.username, reason=%e, "Failed to upgrade password hash.")
+            }
+        }
+    }
+
+    /// Remaining disk quota of the user in bytes, if the user has a quota.
+    async fn quota_left(&self) -> Option<u64> {
+        let quota = self.user()?.quota?;
+        let used = self.state.usage.get(Path::new(&self.root)).await.bytes;
+        Some(quota.saturating_sub(used))
+    }
+
+    /// Bytes the user may still transfer in the direction in the current
+    /// period, with the quota that limits them.
+    fn transfer_left(&self, direction: Direction) -> Option<(u64, TransferQuota)> {
+        let quota = self.user()?.transfer_quota?;
+        let limit = quota.limit(direction)?;
+        let first_day = quota.period.first_day(stats::today());
+        let used = self
+            .state
+            .stats
+            .get(&self.account())
+            .transferred_since(first_day, direction);
+        Some((limit.saturating_sub(used), quota))
+    }
+
+    /// Returns the rendered login message of the user, if there is one.
+    async fn login_message_lines(&self) -> Vec<String> {
+        let content = match &self.limits.login_message {
+            Some(LoginMessage::Text(lines)) => lines.join("\n"),
+            Some(LoginMessage::File(path)) => match fs::metadata(path).await {
+                Ok(metadata) if metadata.len() <= MAX_MESSAGE_FILE_SIZE => {
+                    fs::read_to_string(path).await.unwrap_or_default()
+                }
+                Ok(_) => {
+                    warn!(session_id=%self.id, file=%path, "Login message file is too large.");
+                    String::new()
+                }
+                Err(e) => {
+                    warn!(session_id=%self.id, file=%path, reason=%e, "Failed to read login message file.");
+                    String::new()
+                }
+            },
+            None => String::new(),
+        };
+        let mut lines = Vec::new();
+        for line in content.lines() {
+            lines.push(self.render(line.trim_end()).await);
+        }
+        lines
+    }
+
+    /// Expands a reply template for the current session.
+    async fn render(&self, template: &str) -> String {
+        let quota = if messages::uses_quota(template) {
+            self.quota_left().await
+        } else {
+            None
+        };
+        Variables {
+            server: &self.config.messages.server_name,
+            user: &self.username,
+            ip: &self.record.ip,
+            quota,
+        }
+        .render(template)
+    }
+
+    /// Returns what the configured permissions allow the current user to do.
+    fn user_access(&self) -> UserAccess {
+        let user = self.user();
+        UserAccess {
+            read: user.as_ref().is_some_and(User::can_read),
+            write: user.as_ref().is_some_and(User::can_write),
+        }
+    }
+
+    fn transfer_settings(&self, direction: Direction) -> TransferSettings {
+        TransferSettings {
+            use_uring: self.config.io_uring,
+            stall_timeout: self.limits.stall_timeout(),
+            max_rate: match direction {
+                Direction::Download => self.limits.max_download_rate,
+                Direction::Upload => self.limits.max_upload_rate,
+                Direction::Move => None,
+            },
+            min_rate: match direction {
+                Direction::Download => self.limits.min_download_rate,
+                Direction::Upload | Direction::Move => None,
+            },
+            transfer_type: self.transfer_type,
+        }
+    }
+
+    /// Checks if the volume holding the path has more free space than configured minimum.
+    fn has_free_space(&self, path: &Path) -> bool {
+        let Some(threshold) = self.config.min_free_space else {
+            return true;
+        };
+
+        match disk::disk_space(path) {
+            Ok(space) => threshold.is_satisfied(&space),
+            Err(e) => {
+                warn!(session_id=%self.id, reason=%e, "Failed to check free disk space.");
+                true
+            }
+        }
+    }
+
     pub fn id(&self) -> &String {
         &self.id
     }
 
-    fn get_real_path(&mut self) -> PathBuf {
-        let temp_cwd = &self.current_dir;
-        let temp_cwd_string = temp_cwd.to_string_lossy().to_string();
-        let temp_cwd_trimmed = temp_cwd_string.trim_start_matches('/');
-        Path::new(&self.config.root).join(temp_cwd_trimmed)
+    /// Resolves a path given by the client against the current directory.
+    fn virtual_path(&self, path: &str) -> String {
+        protocol::join_path(&self.current_dir.to_string_lossy(), path)
     }
 
     fn resolve_path(&self, path: String) -> Result<PathBuf, ConnectionError> {
-        let root = Path::new(&self.config.root);
+        let root = Path::new(&self.root);
         let candidate = root.join(path.strip_prefix("/").unwrap_or(&path));
         let canon = candidate
             .canonicalize()
@@ -653,6 +3123,71 @@ impl Session {
 
         Ok(canon)
     }
+
+    /// Resolves the entry itself rather than what a symbolic link at the end
+    /// of the path points to, for commands that act on links.
+    fn resolve_entry(&self, path: &str) -> Result<PathBuf, ConnectionError> {
+        let path = protocol::clean_path(path);
+        let path = Path::new(&path);
+        let (Some(parent), Some(name)) = (path.parent(), path.file_name()) else {
+            return Err(ConnectionError::FileSystemError);
+        };
+        Ok(self
+            .resolve_path(parent.to_string_lossy().to_string())?
+            .join(name))
+    }
+
+    /// Resolves a path that may not exist yet, like the target of an upload.
+    /// Its deepest existing ancestor has to resolve inside the root, so
+    /// symbolic links can not lead writes outside of it.
+    fn resolve_new_path(&self, path: &str) -> Result<PathBuf, ConnectionError> {
+        let path = protocol::clean_path(path);
+        let mut missing = Vec::new();
+        for ancestor in Path::new(&path).ancestors() {
+            let candidate =
+                Path::new(&self.root).join(ancestor.strip_prefix("/").unwrap_or(ancestor));
+            if std::fs::symlink_metadata(&candidate).is_ok() {
+                let mut resolved = self.resolve_path(ancestor.to_string_lossy().to_string())?;
+                resolved.extend(missing.iter().rev());
+                return Ok(resolved);
+            }
+            if let Some(name) = ancestor.file_name() {
+                missing.push(name);
+            }
+        }
+        Err(ConnectionError::FileSystemError)
+    }
+}
+
+/// Writes the segments one after another into the target, replacing it.
+/// Returns the size of the target. They are written to a temporary file
+/// next to it first, so a failure leaves the target as it was.
+async fn combine_files(target: &Path, segments: &[PathBuf]) -> std::io::Result<u64> {
+    let name = target
+        .file_name()
+        .ok_or_else(|| std::io::Error::other("target has no file name"))?
+        .to_string_lossy();
+    let temporary = target.with_file_name(format!(".{name}.combining-{}", cuid2::cuid()));
+    let result = async {
+        let mut file = fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .open(&temporary)
+            .await?;
+        let mut total = 0;
+        for segment in segments {
+            let mut segment = File::open(segment).await?;
+            total += tokio::io::copy(&mut segment, &mut file).await?;
+        }
+        file.flush().await?;
+        fs::rename(&temporary, target).await?;
+        Ok(total)
+    }
+    .await;
+    if result.is_err() {
+        let _ = fs::remove_file(&temporary).await;
+    }
+    result
 }
 
 /// Formats a Unix timestamp into a simple date-time string
@@ -689,3 +3224,522 @@ fn format_timestamp(timestamp: u64) -> String {
         format!("{} {:2} {:02}:{:02}", months[month_idx], day, hour, minute)
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use crate::ftptest::{TEST_PASSWORD, TEST_USER, TestServer};
+
+    #[tokio::test]
+    async fn shows_message_file_but_not_links() {
+        let server = TestServer::start().await.unwrap();
+        let outside = server.root().with_extension("secret");
+        std::fs::write(&outside, "secret").unwrap();
+        std::fs::create_dir(server.root().join("plain")).unwrap();
+        std::fs::write(server.root().join("plain/.message"), "Welcome").unwrap();
+        #[cfg(unix)]
+        {
+            std::fs::create_dir(server.root().join("linked")).unwrap();
+            std::os::unix::fs::symlink(&outside, server.root().join("linked/.message")).unwrap();
+        }
+
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+        let reply = client.command("CWD /plain").await.unwrap();
+        assert_eq!(reply.lines, ["Welcome", "Directory changed."]);
+        #[cfg(unix)]
+        {
+            let reply = client.command("CWD /linked").await.unwrap();
+            assert_eq!(reply.lines, ["Directory changed."]);
+        }
+        std::fs::remove_file(outside).unwrap();
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn writes_stay_inside_the_root() {
+        let server = TestServer::start().await.unwrap();
+        let outside = server.root().with_extension("outside");
+        std::fs::create_dir(&outside).unwrap();
+        std::fs::write(outside.join("target"), "kept").unwrap();
+        std::os::unix::fs::symlink(&outside, server.root().join("escape")).unwrap();
+        std::os::unix::fs::symlink(outside.join("target"), server.root().join("link")).unwrap();
+
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        // New paths are resolved through their deepest existing ancestor.
+        assert!(client.stor("escape/new", b"data").await.is_err());
+        assert!(client.stor("escape/missing/new", b"data").await.is_err());
+        assert!(!outside.join("new").exists());
+        client.stor("../../up", b"data").await.unwrap();
+        assert!(server.root().join("up").exists());
+
+        // Entries are resolved without following a link at the end.
+        assert_eq!(client.command("DELE link").await.unwrap().code, 250);
+        assert!(server.root().join("link").symlink_metadata().is_err());
+        assert_eq!(
+            std::fs::read_to_string(outside.join("target")).unwrap(),
+            "kept"
+        );
+        assert_eq!(client.command("MKD escape/dir").await.unwrap().code, 550);
+        assert!(!outside.join("dir").exists());
+        std::fs::remove_dir_all(outside).unwrap();
+    }
+
+    #[tokio::test]
+    async fn failed_combine_keeps_the_target() {
+        let server = TestServer::start().await.unwrap();
+        let root = server.root();
+        std::fs::write(root.join("target"), "old").unwrap();
+        std::fs::write(root.join("part1"), "new").unwrap();
+
+        let segments = [root.join("part1"), root.join("missing")];
+        assert!(
+            super::combine_files(&root.join("target"), &segments)
+                .await
+                .is_err()
+        );
+        assert_eq!(std::fs::read_to_string(root.join("target")).unwrap(), "old");
+        let mut names: Vec<_> = std::fs::read_dir(root)
+            .unwrap()
+            .map(|entry| entry.unwrap().file_name())
+            .collect();
+        names.sort();
+        assert_eq!(names, ["part1", "target"]);
+
+        let size = super::combine_files(&root.join("target"), &segments[..1])
+            .await
+            .unwrap();
+        assert_eq!(size, 3);
+        assert_eq!(std::fs::read_to_string(root.join("target")).unwrap(), "new");
+    }
+
+    #[tokio::test]
+    async fn unknown_users_are_refused_at_pass() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        for (username, password) in [("nobody", TEST_PASSWORD), (TEST_USER, "wrong")] {
+            let user = client.command(&format!("USER {username}")).await.unwrap();
+            assert_eq!(user.code, 331);
+            let pass = client.command(&format!("PASS {password}")).await.unwrap();
+            assert_eq!(pass.code, 530);
+        }
+    }
+
+    #[tokio::test]
+    async fn data_connections_only_go_to_the_client() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        for command in [
+            "PORT 127,0,0,1,0,21",
+            "PORT 10,0,0,1,195,80",
+            "EPRT |1|10.0.0.1|50000|",
+            "EPRT |2|::2|50000|",
+        ] {
+            assert_eq!(
+                client.command(command).await.unwrap().code,
+                504,
+                "{command}"
+            );
+        }
+        assert_eq!(
+            client.command("PORT 127,0,0,1,195,80").await.unwrap().code,
+            200
+        );
+        assert_eq!(
+            client
+                .command("EPRT |1|127.0.0.1|50000|")
+                .await
+                .unwrap()
+                .code,
+            200
+        );
+    }
+
+    #[cfg(target_os = "linux")]
+    #[tokio::test]
+    async fn passive_connections_from_other_hosts_are_refused() {
+        use tokio::{io::AsyncReadExt, net::TcpSocket};
+
+        let server = TestServer::start().await.unwrap();
+        std::fs::write(server.root().join("file"), "content").unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        let reply = client.command("PASV").await.unwrap();
+        let addr = crate::ftptest::parse_pasv(reply.message()).unwrap();
+        let socket = TcpSocket::new_v4().unwrap();
+        socket.bind("127.0.0.2:0".parse().unwrap()).unwrap();
+        let mut intruder = socket.connect(addr).await.unwrap();
+        let mut data = tokio::net::TcpStream::connect(addr).await.unwrap();
+        assert_eq!(client.command("RETR file").await.unwrap().code, 150);
+
+        let mut content = Vec::new();
+        data.read_to_end(&mut content).await.unwrap();
+        assert_eq!(content, b"content");
+        assert_eq!(client.reply().await.unwrap().code, 226);
+        let mut stolen = Vec::new();
+        let _ = intruder.read_to_end(&mut stolen).await;
+        assert!(stolen.is_empty());
+    }
+
+    #[tokio::test]
+    async fn failed_transfers_keep_the_session() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        // Without PASV or PORT there is no data connection to open.
+        assert_eq!(client.command("LIST").await.unwrap().code, 425);
+        assert_eq!(client.command("NLST").await.unwrap().code, 425);
+        // Sockets can not be opened like files.
+        #[cfg(unix)]
+        {
+            let _socket =
+                std::os::unix::net::UnixListener::bind(server.root().join("socket")).unwrap();
+            assert_eq!(client.command("RETR socket").await.unwrap().code, 550);
+        }
+        assert_eq!(client.command("NOOP").await.unwrap().code, 200);
+    }
+
+    #[tokio::test]
+    async fn renames_reply_once_the_move_is_done() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+        std::fs::write(server.root().join("old"), b"data").unwrap();
+
+        assert_eq!(client.command("RNFR old").await.unwrap().code, 350);
+        assert_eq!(client.command("RNTO new").await.unwrap().code, 250);
+        assert!(!server.root().join("old").exists());
+        assert_eq!(std::fs::read(server.root().join("new")).unwrap(), b"data");
+        // Nothing is left running once the move replied.
+        assert_eq!(client.command("ABOR").await.unwrap().code, 225);
+    }
+
+    #[tokio::test]
+    async fn quotas_keep_count_of_uploads_and_deletions() {
+        let config = serde_json::from_value(serde_json::json!({
+            "users": [{
+                "name": TEST_USER,
+                "password": TEST_PASSWORD,
+                "permissions": "All",
+                "quota": 100,
+                "file_quota": 2,
+            }],
+        }))
+        .unwrap();
+        let server = TestServer::with_config(config).await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+        let usage = async |client: &mut crate::ftptest::Client| {
+            let reply = client.command("SITE QUOTA").await.unwrap();
+            reply.lines[1..3].join(", ")
+        };
+
+        client.stor("a", &[0; 10]).await.unwrap();
+        assert_eq!(
+            usage(&mut client).await,
+            "Disk: 10 of 100 bytes used, 90 left, Files: 1 of 2 used, 1 left"
+        );
+        // The root is not walked again on every upload.
+        std::fs::write(server.root().join("unseen"), [0; 50]).unwrap();
+        client.stor("a", &[0; 20]).await.unwrap();
+        client.stor("b", &[0; 5]).await.unwrap();
+        assert_eq!(
+            usage(&mut client).await,
+            "Disk: 25 of 100 bytes used, 75 left, Files: 2 of 2 used, 0 left"
+        );
+        assert_eq!(client.command("STOR c").await.unwrap().code, 552);
+
+        assert_eq!(client.command("DELE a").await.unwrap().code, 250);
+        assert_eq!(
+            usage(&mut client).await,
+            "Disk: 5 of 100 bytes used, 95 left, Files: 1 of 2 used, 1 left"
+        );
+        // Removing a directory makes the root be walked again.
+        std::fs::create_dir(server.root().join("dir")).unwrap();
+        assert_eq!(client.command("RMD dir").await.unwrap().code, 250);
+        assert_eq!(
+            usage(&mut client).await,
+            "Disk: 55 of 100 bytes used, 45 left, Files: 2 of 2 used, 0 left"
+        );
+    }
+
+    #[tokio::test]
+    async fn unique_uploads_name_the_file_when_done() {
+        use tokio::io::AsyncWriteExt;
+
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        let mut data = client.passive().await.unwrap();
+        let opening = client.command("STOU").await.unwrap();
+        assert_eq!(opening.code, 150);
+        let name = opening
+            .message()
+            .strip_prefix("FILE: ")
+            .unwrap()
+            .to_string();
+        data.write_all(b"data").await.unwrap();
+        data.shutdown().await.unwrap();
+        drop(data);
+        let done = client.reply().await.unwrap();
+        assert_eq!(done.code, 226);
+        assert_eq!(
+            done.message(),
+            format!("Transfer complete (unique file name: {name}).")
+        );
+        assert_eq!(std::fs::read(server.root().join(&name)).unwrap(), b"data");
+    }
+
+    #[tokio::test]
+    async fn stores_files() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        client.stor("a.txt", b"first").await.unwrap();
+        assert_eq!(
+            std::fs::read(server.root().join("a.txt")).unwrap(),
+            b"first"
+        );
+        // Uploads replace the file and create missing directories.
+        client.stor("a.txt", b"second").await.unwrap();
+        assert_eq!(
+            std::fs::read(server.root().join("a.txt")).unwrap(),
+            b"second"
+        );
+        client.stor("dir/b.txt", b"nested").await.unwrap();
+        assert_eq!(
+            std::fs::read(server.root().join("dir/b.txt")).unwrap(),
+            b"nested"
+        );
+        assert_eq!(client.command("STOR").await.unwrap().code, 501);
+    }
+
+    #[tokio::test]
+    async fn deletes_files() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+        std::fs::write(server.root().join("a.txt"), "data").unwrap();
+        std::fs::create_dir(server.root().join("dir")).unwrap();
+
+        assert_eq!(client.command("DELE a.txt").await.unwrap().code, 250);
+        assert!(!server.root().join("a.txt").exists());
+        assert_eq!(client.command("DELE a.txt").await.unwrap().code, 550);
+        let reply = client.command("DELE dir").await.unwrap();
+        assert_eq!(reply.code, 550);
+        assert_eq!(reply.message(), "Is a directory, use RMD to remove it.");
+        assert!(server.root().join("dir").exists());
+        assert_eq!(client.command("DELE").await.unwrap().code, 501);
+    }
+
+    #[tokio::test]
+    async fn makes_and_removes_directories() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        let reply = client.command("MKD dir").await.unwrap();
+        assert_eq!(reply.code, 257);
+        assert_eq!(reply.message(), "\"/dir\" created.");
+        assert!(server.root().join("dir").is_dir());
+        assert_eq!(client.command("MKD dir").await.unwrap().code, 550);
+
+        std::fs::write(server.root().join("dir/a.txt"), "data").unwrap();
+        let reply = client.command("RMD dir").await.unwrap();
+        assert_eq!(reply.code, 550);
+        assert_eq!(reply.message(), "Directory is not empty.");
+        std::fs::remove_file(server.root().join("dir/a.txt")).unwrap();
+        assert_eq!(client.command("RMD dir").await.unwrap().code, 250);
+        assert!(!server.root().join("dir").exists());
+        assert_eq!(client.command("RMD dir").await.unwrap().code, 550);
+    }
+
+    #[tokio::test]
+    async fn renames_files_and_directories() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+        std::fs::write(server.root().join("a.txt"), "data").unwrap();
+        std::fs::create_dir(server.root().join("dir")).unwrap();
+
+        assert_eq!(client.command("RNTO b.txt").await.unwrap().code, 503);
+        assert_eq!(client.command("RNFR missing").await.unwrap().code, 550);
+
+        assert_eq!(client.command("RNFR a.txt").await.unwrap().code, 350);
+        assert_eq!(client.command("RNTO dir/b.txt").await.unwrap().code, 250);
+        assert_eq!(
+            std::fs::read(server.root().join("dir/b.txt")).unwrap(),
+            b"data"
+        );
+        // RNTO uses up the RNFR before it.
+        assert_eq!(client.command("RNTO c.txt").await.unwrap().code, 503);
+
+        assert_eq!(client.command("RNFR dir").await.unwrap().code, 350);
+        assert_eq!(client.command("RNTO other").await.unwrap().code, 250);
+        assert!(server.root().join("other/b.txt").exists());
+        assert!(!server.root().join("dir").exists());
+    }
+
+    #[tokio::test]
+    async fn appends_to_files() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        // A missing file is created.
+        client.appe("a.txt", b"hello").await.unwrap();
+        client.appe("a.txt", b" world").await.unwrap();
+        assert_eq!(
+            std::fs::read(server.root().join("a.txt")).unwrap(),
+            b"hello world"
+        );
+        assert_eq!(client.command("APPE").await.unwrap().code, 501);
+    }
+
+    #[tokio::test]
+    async fn unique_uploads_never_replace_files() {
+        use tokio::io::AsyncWriteExt;
+
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        let mut names = Vec::new();
+        for content in ["first", "second"] {
+            let mut data = client.passive().await.unwrap();
+            let opening = client.command("STOU").await.unwrap();
+            assert_eq!(opening.code, 150);
+            names.push(
+                opening
+                    .message()
+                    .strip_prefix("FILE: ")
+                    .unwrap()
+                    .to_string(),
+            );
+            data.write_all(content.as_bytes()).await.unwrap();
+            data.shutdown().await.unwrap();
+            drop(data);
+            assert_eq!(client.reply().await.unwrap().code, 226);
+        }
+        assert_ne!(names[0], names[1]);
+        assert_eq!(
+            std::fs::read(server.root().join(&names[0])).unwrap(),
+            b"first"
+        );
+        assert_eq!(
+            std::fs::read(server.root().join(&names[1])).unwrap(),
+            b"second"
+        );
+    }
+
+    #[tokio::test]
+    async fn abort_cancels_the_running_transfer() {
+        use tokio::io::AsyncWriteExt;
+
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        assert_eq!(client.command("ABOR").await.unwrap().code, 225);
+
+        let mut data = client.passive().await.unwrap();
+        assert_eq!(client.command("STOR big").await.unwrap().code, 150);
+        data.write_all(&[0; 1024]).await.unwrap();
+        // The data connection stays open, so only ABOR ends the upload.
+        let aborted = client.command("ABOR").await.unwrap();
+        assert_eq!(aborted.code, 426);
+        assert_eq!(client.reply().await.unwrap().code, 226);
+        assert_eq!(client.command("NOOP").await.unwrap().code, 200);
+        drop(data);
+    }
+
+    #[tokio::test]
+    async fn reinitialize_logs_the_user_out() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+        std::fs::create_dir(server.root().join("dir")).unwrap();
+        assert_eq!(client.command("CWD dir").await.unwrap().code, 250);
+        assert_eq!(client.command("TYPE A").await.unwrap().code, 200);
+
+        assert_eq!(client.command("REIN").await.unwrap().code, 220);
+        assert_eq!(client.command("CWD dir").await.unwrap().code, 530);
+        // The same connection logs in again with the settings reset.
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+        assert_eq!(
+            client.command("PWD").await.unwrap().message(),
+            "\"/\" is the current directory."
+        );
+        std::fs::write(server.root().join("a.txt"), "a\nb\n").unwrap();
+        assert_eq!(client.retr("a.txt").await.unwrap(), b"a\nb\n");
+    }
+
+    #[tokio::test]
+    async fn ascii_mode_converts_line_endings() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+        std::fs::write(server.root().join("a.txt"), "a\nb\n").unwrap();
+
+        assert_eq!(client.command("TYPE A").await.unwrap().code, 200);
+        assert_eq!(client.retr("a.txt").await.unwrap(), b"a\r\nb\r\n");
+        client.stor("b.txt", b"x\r\ny\r\n").await.unwrap();
+        assert_eq!(
+            std::fs::read(server.root().join("b.txt")).unwrap(),
+            b"x\ny\n"
+        );
+
+        assert_eq!(client.command("TYPE I").await.unwrap().code, 200);
+        assert_eq!(client.retr("a.txt").await.unwrap(), b"a\nb\n");
+        assert_eq!(client.command("TYPE E").await.unwrap().code, 504);
+        assert_eq!(client.command("TYPE").await.unwrap().code, 501);
+    }
+
+    #[tokio::test]
+    async fn machine_lists_directories() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+        std::fs::write(server.root().join("a.txt"), "hello").unwrap();
+        std::fs::create_dir(server.root().join("sub")).unwrap();
+
+        let lines = client.mlsd("").await.unwrap();
+        assert_eq!(lines.len(), 3);
+        assert!(lines[0].starts_with("type=cdir;") && lines[0].ends_with(" ."));
+        let file = lines.iter().find(|l| l.ends_with(" a.txt")).unwrap();
+        assert!(file.starts_with("type=file;size=5;modify="));
+        let dir = lines.iter().find(|l| l.ends_with(" sub")).unwrap();
+        assert!(dir.starts_with("type=dir;"));
+
+        // Only the selected facts are sent.
+        assert_eq!(
+            client.command("OPTS MLST type;size;").await.unwrap().code,
+            200
+        );
+        let lines = client.mlsd("/").await.unwrap();
+        assert!(lines.contains(&String::from("type=file;size=5; a.txt")));
+        assert_eq!(client.command("MLSD a.txt").await.unwrap().code, 501);
+    }
+
+    #[tokio::test]
+    async fn name_lists_only_names() {
+        let server = TestServer::start().await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+        std::fs::write(server.root().join("a.txt"), "hello").unwrap();
+        std::fs::create_dir(server.root().join("sub")).unwrap();
+        std::fs::write(server.root().join("sub/b.txt"), "world").unwrap();
+
+        let mut names = client.nlst("").await.unwrap();
+        names.sort();
+        assert_eq!(names, ["a.txt", "sub"]);
+        assert_eq!(client.nlst("sub").await.unwrap(), ["b.txt"]);
+    }
+}
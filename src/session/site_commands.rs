@@ -0,0 +1,362 @@
+//! Handlers of SITE subcommands, registered in [`crate::site::SITE_COMMANDS`].
+
+#[cfg(unix)]
+use std::{fs::Permissions, os::unix::fs::PermissionsExt};
+use std::{path::Path, time::Duration};
+
+use tokio::{fs, time};
+use tracing::{info, warn};
+
+use super::{ConnectionError, Session};
+use crate::{
+    checksum,
+    commands::Commands,
+    datetime::DateTime,
+    disk::{self, DirectoryUsage},
+    history::Direction,
+    listing::DirStyle,
+    password, site,
+    users::UserUpdate,
+    virtual_files,
+};
+
+impl Session {
+    /// Records or verifies the SHA-256 of an upload.
+    pub(crate) async fn site_checksum(&mut self, args: &str) -> Result<(), ConnectionError> {
+        const USAGE: &str = "Usage: SITE CHECKSUM EXPECT|VERIFY <sha256> <path>";
+        let mut parts = args.splitn(3, ' ');
+        let (Some(mode), Some(hash), Some(path)) = (parts.next(), parts.next(), parts.next())
+        else {
+            reply_ok!(self, 501, USAGE);
+        };
+        let Some(expected) = checksum::parse_sha256(hash) else {
+            reply_ok!(self, 501, "Checksum must be a SHA-256 in hex.");
+        };
+        let virtual_path = self.virtual_path(path);
+        match mode.to_ascii_uppercase().as_str() {
+            "EXPECT" => {
+                let file_path = Path::new(&self.root).join(virtual_path.trim_start_matches('/'));
+                self.expected_checksums.insert(file_path, expected);
+                reply!(self, 200, "Checksum will be verified after the upload.");
+            }
+            "VERIFY" => {
+                let Ok(real_path) = self.resolve_path(virtual_path) else {
+                    reply_ok!(self, 550, "File unavailable.");
+                };
+                match self.verify_sha256(&real_path, &expected).await {
+                    Ok(true) => {
+                        reply!(self, 200, "Checksum verified.");
+                    }
+                    Ok(false) => {
+                        reply!(self, 550, "Checksum mismatch, file was deleted.");
+                    }
+                    Err(e) => {
+                        warn!(session_id=%self.id, file=%real_path.display(), reason=%e, "Failed to verify checksum.");
+                        reply!(self, 451, "Failed to verify checksum.");
+                    }
+                }
+            }
+            _ => {
+                reply!(self, 501, USAGE);
+            }
+        }
+        Ok(())
+    }
+
+    /// Changes permission bits of a file.
+    pub(crate) async fn site_chmod(&mut self, args: &str) -> Result<(), ConnectionError> {
+        let Some((mode, path)) = args.split_once(' ') else {
+            reply_ok!(self, 501, "Usage: SITE CHMOD <mode> <path>");
+        };
+        let Ok(mode) = u32::from_str_radix(mode, 8) else {
+            reply_ok!(self, 501, "Mode must be octal, like 755.");
+        };
+        if mode > 0o1777 {
+            reply_ok!(self, 550, "Setuid and setgid bits can not be set.");
+        }
+        let virtual_path = self.virtual_path(path);
+        if virtual_files::find(&self.config.virtual_files, &virtual_path).is_some() {
+            reply_ok!(self, 550, "File is read-only.");
+        }
+        let Ok(real_path) = self.resolve_path(virtual_path) else {
+            reply_ok!(self, 550, "File not found.");
+        };
+        #[cfg(unix)]
+        let result = fs::set_permissions(&real_path, Permissions::from_mode(mode)).await;
+        #[cfg(not(unix))]
+        let result: std::io::Result<()> = Err(std::io::ErrorKind::Unsupported.into());
+        match result {
+            Ok(()) => {
+                info!(session_id=%self.id, username=%self.username, file=%real_path.display(), mode=format!("{mode:o}"), "Permissions changed.");
+                reply!(self, 200, "SITE CHMOD command successful.");
+            }
+            Err(e) if e.kind() == std::io::ErrorKind::Unsupported => {
+                reply!(
+                    self,
+                    502,
+                    "Permission bits are not supported on this server."
+                );
+            }
+            Err(e) => {
+                warn!(session_id=%self.id, file=%real_path.display(), reason=%e, "Failed to change permissions.");
+                reply!(self, 550, "Failed to change permissions.");
+            }
+        }
+        Ok(())
+    }
+
+    /// Shows disk usage of the current directory.
+    pub(crate) async fn site_df(&mut self, _args: &str) -> Result<(), ConnectionError> {
+        let dir = self.current_dir.to_string_lossy().to_string();
+        let Ok(path) = self.resolve_path(dir.clone()) else {
+            reply_ok!(self, 550, "Failed to get disk usage.");
+        };
+        let space = match disk::disk_space(&path) {
+            Ok(space) => space,
+            Err(e) => {
+                warn!(session_id=%self.id, reason=%e, "Failed to get disk usage.");
+                reply_ok!(self, 550, "Failed to get disk usage.");
+            }
+        };
+        let used = space.used;
+        let percent = match space.total {
+            0 => 0,
+            total => used * 100 / total,
+        };
+        let mut lines = vec![
+            format!("Total: {} bytes", space.total),
+            format!("Used: {used} bytes ({percent}%)"),
+            format!("Free: {} bytes", space.free),
+        ];
+        if let Some(quota) = self.user().and_then(|u| u.quota) {
+            let used = self.state.usage.get(Path::new(&self.root)).await.bytes;
+            lines.push(format!("Your quota: {used} of {quota} bytes used"));
+        }
+        let header = format!("Disk usage of {dir}");
+        self.reply_multiline(200, &header, &lines, "End").await?;
+        Ok(())
+    }
+
+    /// Switches between Unix and MS-DOS style listings.
+    pub(crate) async fn site_dirstyle(&mut self, args: &str) -> Result<(), ConnectionError> {
+        self.dir_style = match args.trim().to_ascii_uppercase().as_str() {
+            "" if self.dir_style == DirStyle::Msdos => DirStyle::Unix,
+            "" | "MSDOS" => DirStyle::Msdos,
+            "UNIX" => DirStyle::Unix,
+            _ => {
+                reply_ok!(self, 501, "Usage: SITE DIRSTYLE [UNIX|MSDOS]");
+            }
+        };
+        match self.dir_style {
+            DirStyle::Msdos => {
+                reply!(self, 200, "MSDOS-like directory output is on.");
+            }
+            DirStyle::Unix => {
+                reply!(self, 200, "MSDOS-like directory output is off.");
+            }
+        }
+        Ok(())
+    }
+
+    /// Lists SITE commands the user may run.
+    pub(crate) async fn site_help(&mut self, _args: &str) -> Result<(), ConnectionError> {
+        let lines: Vec<String> = site::allowed(self.user_access())
+            .filter(|c| !self.limits.denies(Commands::Site, Some(c.name)))
+            .map(|c| format!("{:<24} {}", c.syntax, c.description))
+            .collect();
+        self.reply_multiline(214, "Available SITE commands:", &lines, "End")
+            .await?;
+        Ok(())
+    }
+
+    /// Changes the password of the user.
+    pub(crate) async fn site_pswd(&mut self, args: &str) -> Result<(), ConnectionError> {
+        let Some(policy) = &self.config.password_change else {
+            reply_ok!(self, 502, "Password changes are not enabled.");
+        };
+        if self.config.users_file.is_none() {
+            warn!(session_id=%self.id, "Password changes require users_file to be set.");
+            reply_ok!(self, 502, "Password changes are not enabled.");
+        }
+        let Some((old, new)) = args.split_once(' ') else {
+            reply_ok!(self, 501, "Usage: SITE PSWD <old password> <new password>");
+        };
+        let current = self.user().map(|u| u.password).unwrap_or_default();
+        if !password::verify(&current, old).await {
+            warn!(session_id=%self.id, username=%self.username, "Wrong current password in password change.");
+            self.state.stats.record_failed_login(&self.account());
+            if let Ok(addr) = self.connection.peer_addr() {
+                let delay = self.state.tarpit.record_failure(addr.ip());
+                time::sleep(delay).await;
+            }
+            reply_ok!(self, 530, "Current password is incorrect.");
+        }
+        if let Err(reason) = policy.check(&self.username, new) {
+            reply_ok!(self, 501, &reason);
+        }
+
+        let hash = match password::hash(new).await {
+            Ok(hash) => hash,
+            Err(e) => {
+                warn!(session_id=%self.id, username=%self.username, reason=%e, "Failed to change password.");
+                reply_ok!(self, 451, "Failed to change password.");
+            }
+        };
+        let update = UserUpdate {
+            password: Some(hash),
+            ..UserUpdate::default()
+        };
+        match self.state.users.update(&self.account(), update) {
+            Ok(_) => {
+                info!(session_id=%self.id, username=%self.username, "User changed their password.");
+                reply!(self, 200, "Password changed.");
+            }
+            Err(e) => {
+                warn!(session_id=%self.id, username=%self.username, reason=%e, "Failed to change password.");
+                reply!(self, 451, "Failed to change password.");
+            }
+        }
+        Ok(())
+    }
+
+    /// Shows disk and transfer quota usage of the user.
+    pub(crate) async fn site_quota(&mut self, _args: &str) -> Result<(), ConnectionError> {
+        let user = self.user();
+        let mut lines = Vec::new();
+        let (quota, file_quota) = user
+            .as_ref()
+            .map_or((None, None), |u| (u.quota, u.file_quota));
+        let usage = match (quota, file_quota) {
+            (None, None) => DirectoryUsage::default(),
+            _ => self.state.usage.get(Path::new(&self.root)).await,
+        };
+        match quota {
+            Some(quota) => lines.push(format!(
+                "Disk: {} of {quota} bytes used, {} left",
+                usage.bytes,
+                quota.saturating_sub(usage.bytes)
+            )),
+            None => lines.push(String::from("Disk: unlimited")),
+        }
+        match file_quota {
+            Some(limit) => lines.push(format!(
+                "Files: {} of {limit} used, {} left",
+                usage.files,
+                limit.saturating_sub(usage.files)
+            )),
+            None => lines.push(String::from("Files: unlimited")),
+        }
+        match user.and_then(|u| u.transfer_quota) {
+            Some(quota) => {
+                for (label, direction) in [
+                    ("Download", Direction::Download),
+                    ("Upload", Direction::Upload),
+                ] {
+                    let line = match (quota.limit(direction), self.transfer_left(direction)) {
+                        (Some(limit), Some((left, _))) => format!(
+                            "{label}: {} of {limit} bytes used this {}, {left} left",
+                            limit - left,
+                            quota.period.name()
+                        ),
+                        _ => format!("{label}: unlimited"),
+                    };
+                    lines.push(line);
+                }
+                if let Some(rate) = quota.exhausted_rate {
+                    lines.push(format!(
+                        "Transfers are slowed down to {rate} bytes/s once the quota is used up"
+                    ));
+                }
+            }
+            None => lines.push(String::from("Transfers: unlimited")),
+        }
+        let header = format!("Quota for {}", self.username);
+        self.reply_multiline(200, &header, &lines, "End").await?;
+        Ok(())
+    }
+
+    /// Shows transfer statistics of the user.
+    pub(crate) async fn site_stats(&mut self, _args: &str) -> Result<(), ConnectionError> {
+        let stats = self.state.stats.get(&self.account());
+        let last_login = stats
+            .last_login
+            .map(|t| format!("{} UTC", DateTime::from_unix(t as i64).to_readable()))
+            .unwrap_or(String::from("never"));
+        let lines = vec![
+            format!("Bytes uploaded: {}", stats.bytes_uploaded),
+            format!("Bytes downloaded: {}", stats.bytes_downloaded),
+            format!("Files uploaded: {}", stats.files_uploaded),
+            format!("Files downloaded: {}", stats.files_downloaded),
+            format!("Failed logins: {}", stats.failed_logins),
+            format!("Last login: {last_login}"),
+        ];
+        let header = format!("Statistics for {}", self.username);
+        self.reply_multiline(200, &header, &lines, "End").await?;
+        Ok(())
+    }
+
+    /// Sets the modification time of a file. Besides the short form, the
+    /// form of ProFTPD with access, modification and creation times is
+    /// accepted, of which only the modification time is used.
+    pub(crate) async fn site_utime(&mut self, args: &str) -> Result<(), ConnectionError> {
+        const USAGE: &str = "Usage: SITE UTIME <YYYYMMDDhhmmss> <path>";
+        let parsed = match args
+            .strip_suffix(" UTC")
+            .map(|a| a.rsplitn(4, ' ').collect::<Vec<_>>())
+        {
+            Some(parts) if parts.len() == 4 => DateTime::parse_ftp(parts[1]).map(|t| (t, parts[3])),
+            _ => args
+                .split_once(' ')
+                .and_then(|(time, path)| DateTime::parse_ftp(time).map(|t| (t, path))),
+        };
+        let Some((time, path)) = parsed.filter(|(_, path)| !path.is_empty()) else {
+            reply_ok!(self, 501, USAGE);
+        };
+        let virtual_path = self.virtual_path(path);
+        if virtual_files::find(&self.config.virtual_files, &virtual_path).is_some() {
+            reply_ok!(self, 550, "File is read-only.");
+        }
+        let Ok(real_path) = self.resolve_path(virtual_path.clone()) else {
+            reply_ok!(self, 550, "File not found.");
+        };
+        let modified = std::time::UNIX_EPOCH + Duration::from_secs(time.to_unix().max(0) as u64);
+        let result = tokio::task::spawn_blocking(move || {
+            std::fs::File::open(&real_path)?.set_modified(modified)
+        })
+        .await;
+        match result {
+            Ok(Ok(())) => {
+                info!(session_id=%self.id, file=%virtual_path, "Modification time changed.");
+                reply!(self, 200, "SITE UTIME command successful.");
+            }
+            _ => {
+                reply!(self, 550, "Could not change modification time.");
+            }
+        }
+        Ok(())
+    }
+
+    /// Lists users that are logged in to the same tenant.
+    pub(crate) async fn site_who(&mut self, _args: &str) -> Result<(), ConnectionError> {
+        let tenant = self.config.tenant.as_ref().map(|t| format!("{t}/"));
+        let lines: Vec<String> = self
+            .state
+            .sessions
+            .counts()
+            .into_iter()
+            .filter_map(|(account, count)| {
+                let name = match &tenant {
+                    Some(prefix) => account.strip_prefix(prefix.as_str())?.to_string(),
+                    None if account.contains('/') => return None,
+                    None => account,
+                };
+                Some(match count {
+                    1 => format!("{name}: 1 session"),
+                    count => format!("{name}: {count} sessions"),
+                })
+            })
+            .collect();
+        self.reply_multiline(200, "Users logged in:", &lines, "End")
+            .await
+    }
+}
@@ -0,0 +1,239 @@
+//! Handlers of the file commands for servers with a storage backend, see
+//! [`crate::storage`].
+
+use std::{path::PathBuf, sync::Arc};
+
+use tokio::io::AsyncWriteExt;
+use tracing::{info, warn};
+
+use super::{ConnectionError, Session};
+use crate::{commands::Commands, history::Direction, storage::Storage};
+
+/// Removes options like `-la` that clients put in front of the path of
+/// LIST and NLST.
+fn strip_list_options(mut arg: &str) -> &str {
+    while arg.starts_with('-') {
+        arg = arg
+            .split_once(' ')
+            .map_or("", |(_, rest)| rest.trim_start());
+    }
+    arg
+}
+
+impl Session {
+    /// Runs a file command against the storage backend. Commands it can not
+    /// run are refused.
+    pub(crate) async fn handle_storage_command(
+        &mut self,
+        storage: Arc<dyn Storage>,
+        cmd: Commands,
+        arg: String,
+        rename_from: Option<PathBuf>,
+    ) -> Result<(), ConnectionError> {
+        if matches!(
+            cmd,
+            Commands::Store
+                | Commands::Append
+                | Commands::Delete
+                | Commands::MakeDir
+                | Commands::RemoveDir
+                | Commands::RenameFrom
+                | Commands::RenameTo
+        ) && !self.user_access().write
+        {
+            reply_ok!(self, 550, "No permission to write.");
+        }
+        let requires_path = matches!(
+            cmd,
+            Commands::ChangeDir
+                | Commands::Size
+                | Commands::ModificationTime
+                | Commands::Retrive
+                | Commands::Store
+                | Commands::Append
+                | Commands::Delete
+                | Commands::MakeDir
+                | Commands::RemoveDir
+                | Commands::RenameFrom
+                | Commands::RenameTo
+        );
+        if requires_path && arg.is_empty() {
+            reply_ok!(self, 501, "Path is required.");
+        }
+
+        match cmd {
+            Commands::ChangeDir | Commands::ChangeDirectoryUp => {
+                let arg = if cmd == Commands::ChangeDir {
+                    arg.as_str()
+                } else {
+                    ".."
+                };
+                let virtual_path = self.virtual_path(arg);
+                match storage.is_dir(&virtual_path).await {
+                    Ok(true) => {
+                        self.current_dir = PathBuf::from(virtual_path);
+                        reply!(self, 250, "Directory changed.");
+                    }
+                    Ok(false) => {
+                        reply!(self, 550, "Failed to change directory.");
+                    }
+                    Err(e) => {
+                        warn!(session_id=%self.id, reason=%e, "Storage backend failed.");
+                        reply!(self, 451, "Failed to change directory.");
+                    }
+                }
+            }
+            Commands::List | Commands::NameList => {
+                let virtual_path = self.virtual_path(strip_list_options(&arg));
+                let lines = match storage.list(&virtual_path, cmd == Commands::NameList).await {
+                    Ok(lines) => lines,
+                    Err(e) => {
+                        warn!(session_id=%self.id, path=%virtual_path, reason=%e, "Listing failed.");
+                        reply_ok!(self, 550, "Failed to list directory.");
+                    }
+                };
+                let Ok(mut data) = self.open_data_connection("Listing of directory").await else {
+                    reply_ok!(self, 425, "Cant open data connection.");
+                };
+                if let Err(e) = self.send_lines(&mut data, &lines).await {
+                    warn!(session_id=%self.id, reason=%e, "Listing failed.");
+                    reply_ok!(self, 426, "Connection closed, transfer aborted.");
+                }
+                reply!(self, 226, "Listing done.");
+            }
+            Commands::Retrive | Commands::Store | Commands::Append => {
+                let virtual_path = self.virtual_path(&arg);
+                let direction = if cmd == Commands::Retrive {
+                    Direction::Download
+                } else {
+                    Direction::Upload
+                };
+                let Ok(mut data) = self.open_data_connection("Opening data connection.").await
+                else {
+                    reply_ok!(self, 425, "Cant open data connection.");
+                };
+                let result = if direction == Direction::Download {
+                    storage.retrieve(&virtual_path, &mut data).await
+                } else {
+                    storage
+                        .store(&virtual_path, &mut data, cmd == Commands::Append)
+                        .await
+                };
+                let _ = data.shutdown().await;
+                drop(data);
+                match result {
+                    Ok(bytes) => {
+                        info!(session_id=%self.id, username=%self.username, file=%virtual_path, bytes=bytes, direction=?direction, "Transfer through storage backend finished.");
+                        self.record
+                            .add_transfer(direction, &virtual_path, bytes, true);
+                        reply!(self, 226, "Transfer complete.");
+                    }
+                    Err(e) => {
+                        warn!(session_id=%self.id, file=%virtual_path, reason=%e, "Transfer failed.");
+                        self.record.add_transfer(direction, &virtual_path, 0, false);
+                        reply!(self, 451, "Transfer failed.");
+                    }
+                }
+            }
+            Commands::RenameFrom => {
+                let virtual_path = self.virtual_path(&arg);
+                self.rename_from = Some(PathBuf::from(virtual_path));
+                reply!(self, 350, "Ready for RNTO.");
+            }
+            Commands::RenameTo => {
+                let Some(from) = rename_from else {
+                    reply_ok!(self, 503, "Use RNFR first.");
+                };
+                let from = from.to_string_lossy().to_string();
+                let to = self.virtual_path(&arg);
+                let result = storage.rename(&from, &to).await;
+                self.reply_storage(result, &to, 250, "Renamed.", "Rename failed.")
+                    .await?;
+            }
+            Commands::Delete => {
+                let virtual_path = self.virtual_path(&arg);
+                let result = storage.delete(&virtual_path).await;
+                self.reply_storage(
+                    result,
+                    &virtual_path,
+                    250,
+                    "File deleted.",
+                    "Failed to delete file.",
+                )
+                .await?;
+            }
+            Commands::MakeDir => {
+                let virtual_path = self.virtual_path(&arg);
+                let result = storage.make_dir(&virtual_path).await;
+                let created = format!("{} created.", crate::protocol::quote_path(&virtual_path));
+                self.reply_storage(
+                    result,
+                    &virtual_path,
+                    257,
+                    &created,
+                    "Failed to create directory.",
+                )
+                .await?;
+            }
+            Commands::RemoveDir => {
+                let virtual_path = self.virtual_path(&arg);
+                let result = storage.remove_dir(&virtual_path).await;
+                self.reply_storage(
+                    result,
+                    &virtual_path,
+                    250,
+                    "Directory removed.",
+                    "Failed to remove directory.",
+                )
+                .await?;
+            }
+            Commands::Size => {
+                let virtual_path = self.virtual_path(&arg);
+                match storage.size(&virtual_path).await {
+                    Ok(size) => {
+                        reply!(self, 213, &size.to_string());
+                    }
+                    Err(_) => {
+                        reply!(self, 550, "File unavailable.");
+                    }
+                }
+            }
+            Commands::ModificationTime => {
+                let virtual_path = self.virtual_path(&arg);
+                match storage.modified(&virtual_path).await {
+                    Ok(time) => {
+                        reply!(self, 213, &time);
+                    }
+                    Err(_) => {
+                        reply!(self, 550, "File unavailable.");
+                    }
+                }
+            }
+            _ => {
+                reply!(self, 502, "Not supported by the storage backend.");
+            }
+        }
+        Ok(())
+    }
+
+    /// Replies to a command that changes files of the storage backend.
+    async fn reply_storage(
+        &mut self,
+        result: anyhow::Result<()>,
+        path: &str,
+        code: u16,
+        done: &str,
+        failed: &str,
+    ) -> Result<(), ConnectionError> {
+        match result {
+            Ok(()) => {
+                info!(session_id=%self.id, username=%self.username, file=%path, "{done}");
+                self.reply(code, done).await
+            }
+            Err(e) => {
+                warn!(session_id=%self.id, file=%path, reason=%e, "{failed}");
+                self.reply(550, failed).await
+            }
+        }
+    }
+}
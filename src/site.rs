@@ -0,0 +1,154 @@
+//! Registry of SITE subcommands.
+//!
+//! A subcommand is plugged in by adding it to [`SITE_COMMANDS`] with the
+//! handler that runs it. Sessions check the access before calling the
+//! handler, and SITE HELP lists whatever the user may run.
+
+use std::{future::Future, pin::Pin};
+
+use crate::{
+    facts::UserAccess,
+    session::{ConnectionError, Session},
+};
+
+/// Future returned by a SITE handler.
+pub type SiteFuture<'a> = Pin<Box<dyn Future<Output = Result<(), ConnectionError>> + Send + 'a>>;
+
+/// Runs a SITE subcommand with the arguments that follow its name. Replies
+/// are sent by the handler.
+pub type SiteHandler = for<'a> fn(&'a mut Session, &'a str) -> SiteFuture<'a>;
+
+/// Permission the user needs to run a SITE subcommand.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SiteAccess {
+    Any,
+    Read,
+    Write,
+}
+
+pub struct SiteCommand {
+    pub name: &'static str,
+    pub syntax: &'static str,
+    pub description: &'static str,
+    pub access: SiteAccess,
+    /// Works on files in the root, which storage backends do not support.
+    pub uses_root: bool,
+    pub handler: SiteHandler,
+}
+
+impl std::fmt::Debug for SiteCommand {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("SiteCommand")
+            .field("name", &self.name)
+            .field("syntax", &self.syntax)
+            .field("access", &self.access)
+            .field("uses_root", &self.uses_root)
+            .finish()
+    }
+}
+
+impl SiteCommand {
+    /// Checks if the user is allowed to run this subcommand.
+    pub fn is_allowed(&self, user: UserAccess) -> bool {
+        match self.access {
+            SiteAccess::Any => true,
+            SiteAccess::Read => user.read,
+            SiteAccess::Write => user.write,
+        }
+    }
+}
+
+pub const SITE_COMMANDS: &[SiteCommand] = &[
+    SiteCommand {
+        name: "CHECKSUM",
+        syntax: "SITE CHECKSUM EXPECT|VERIFY <sha256> <path>",
+        description: "Check an upload against its SHA-256, deleting it on mismatch.",
+        access: SiteAccess::Write,
+        uses_root: true,
+        handler: |session, args| Box::pin(session.site_checksum(args)),
+    },
+    SiteCommand {
+        name: "CHMOD",
+        syntax: "SITE CHMOD <mode> <path>",
+        description: "Change permission bits of a file, like 755.",
+        access: SiteAccess::Write,
+        uses_root: true,
+        handler: |session, args| Box::pin(session.site_chmod(args)),
+    },
+    SiteCommand {
+        name: "DF",
+        syntax: "SITE DF",
+        description: "Show disk usage of the current directory.",
+        access: SiteAccess::Any,
+        uses_root: true,
+        handler: |session, args| Box::pin(session.site_df(args)),
+    },
+    SiteCommand {
+        name: "DIRSTYLE",
+        syntax: "SITE DIRSTYLE [UNIX|MSDOS]",
+        description: "Switch between Unix and MS-DOS style listings.",
+        access: SiteAccess::Any,
+        uses_root: false,
+        handler: |session, args| Box::pin(session.site_dirstyle(args)),
+    },
+    SiteCommand {
+        name: "HELP",
+        syntax: "SITE HELP",
+        description: "Show available SITE commands.",
+        access: SiteAccess::Any,
+        uses_root: false,
+        handler: |session, args| Box::pin(session.site_help(args)),
+    },
+    SiteCommand {
+        name: "PSWD",
+        syntax: "SITE PSWD <old password> <new password>",
+        description: "Change your password.",
+        access: SiteAccess::Any,
+        uses_root: false,
+        handler: |session, args| Box::pin(session.site_pswd(args)),
+    },
+    SiteCommand {
+        name: "QUOTA",
+        syntax: "SITE QUOTA",
+        description: "Show your disk and transfer quota usage.",
+        access: SiteAccess::Any,
+        uses_root: true,
+        handler: |session, args| Box::pin(session.site_quota(args)),
+    },
+    SiteCommand {
+        name: "STATS",
+        syntax: "SITE STATS",
+        description: "Show your transfer statistics.",
+        access: SiteAccess::Any,
+        uses_root: false,
+        handler: |session, args| Box::pin(session.site_stats(args)),
+    },
+    SiteCommand {
+        name: "UTIME",
+        syntax: "SITE UTIME <YYYYMMDDhhmmss> <path>",
+        description: "Set the modification time of a file.",
+        access: SiteAccess::Write,
+        uses_root: true,
+        handler: |session, args| Box::pin(session.site_utime(args)),
+    },
+    SiteCommand {
+        name: "WHO",
+        syntax: "SITE WHO",
+        description: "Show users that are logged in.",
+        access: SiteAccess::Any,
+        uses_root: false,
+        handler: |session, args| Box::pin(session.site_who(args)),
+    },
+];
+
+/// Finds a SITE subcommand by its name, ignoring case.
+pub fn find(name: &str) -> Option<&'static SiteCommand> {
+    SITE_COMMANDS
+        .iter()
+        .find(|c| c.name.eq_ignore_ascii_case(name))
+}
+
+/// Returns SITE subcommands available to the user.
+pub fn allowed(user: UserAccess) -> impl Iterator<Item = &'static SiteCommand> {
+    SITE_COMMANDS.iter().filter(move |c| c.is_allowed(user))
+}
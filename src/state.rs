@@ -0,0 +1,163 @@
+use std::{
+    collections::HashMap,
+    path::{Path, PathBuf},
+    sync::{Arc, atomic::AtomicUsize},
+};
+
+use anyhow::Result;
+
+use crate::{
+    config::Config, disk::UsageCache, gateway::Gateway, geoip::GeoIp, history::SessionHistory,
+    limits::SessionCounter, maintenance::Maintenance, quarantine::Quarantine, rdns::HostnameCache,
+    stats::StatsStore, storage::Storage, storage_cache::StorageCache, tarpit::Tarpit, tls::Tls,
+    transfer::TransferRegistry, transfer_log::TransferLog, uploads::UploadStore, user_db::UserDb,
+    users::UserStore,
+};
+
+/// State shared between the server, sessions and the admin API.
+#[derive(Debug, Default)]
+pub struct SharedState {
+    pub stats: StatsStore,
+    pub history: SessionHistory,
+    /// Transfer log of each tenant that has one, `None` without tenants.
+    /// Tenants with the same file share the log.
+    pub transfer_logs: HashMap<Option<String>, Arc<TransferLog>>,
+    /// User database of each tenant that has one, shared like the logs.
+    pub user_dbs: HashMap<Option<String>, Arc<UserDb>>,
+    /// Backend the files are served from instead of the root.
+    pub storage: Option<Arc<dyn Storage>>,
+    pub tarpit: Tarpit,
+    pub geoip: Option<GeoIp>,
+    /// Certificate for AUTH TLS, when TLS is configured.
+    pub tls: Option<Tls>,
+    /// Host names of recent clients, when reverse DNS is configured.
+    pub hostnames: HostnameCache,
+    pub users: UserStore,
+    pub uploads: UploadStore,
+    pub quarantine: Quarantine,
+    /// Logged in sessions per account.
+    pub sessions: SessionCounter,
+    /// Number of open sessions.
+    pub active_sessions: AtomicUsize,
+    pub maintenance: Maintenance,
+    pub transfers: TransferRegistry,
+    /// Disk usage of user roots, for quotas.
+    pub usage: UsageCache,
+}
+
+impl SharedState {
+    pub fn new(config: &Config) -> Result<Self> {
+        Ok(SharedState {
+            stats: StatsStore::load(
+                config
+                    .instances()
+                    .into_iter()
+                    .filter_map(|i| Some((i.tenant, PathBuf::from(i.stats_file?))))
+                    .collect(),
+            )?,
+            history: SessionHistory::new(&config.history),
+            transfer_logs: open_per_tenant(
+                config,
+                |c| c.transfer_log.as_ref(),
+                |l| &l.file,
+                |_, path| TransferLog::open(path),
+            )?,
+            user_dbs: open_per_tenant(config, |c| c.user_db.as_ref(), |d| &d.file, UserDb::open)?,
+            storage: match &config.gateway {
+                Some(gateway) => {
+                    let storage: Arc<dyn Storage> = Arc::new(Gateway::new(gateway)?);
+                    Some(match &gateway.cache {
+                        Some(cache) => Arc::new(StorageCache::new(storage, cache)?),
+                        None => storage,
+                    })
+                }
+                None => None,
+            },
+            tarpit: Tarpit::new(config.tarpit.clone()),
+            geoip: None,
+            tls: None,
+            hostnames: HostnameCache::default(),
+            users: UserStore::load(config)?,
+            uploads: UploadStore::load(
+                config
+                    .upload_resume
+                    .as_ref()
+                    .and_then(|r| r.file.as_ref())
+                    .map(PathBuf::from),
+            )?,
+            quarantine: Quarantine::load(
+                config
+                    .quarantine
+                    .as_ref()
+                    .and_then(|q| q.file.as_ref())
+                    .map(PathBuf::from),
+            )?,
+            sessions: SessionCounter::default(),
+            active_sessions: AtomicUsize::new(0),
+            maintenance: Maintenance::default(),
+            transfers: TransferRegistry::default(),
+            usage: UsageCache::default(),
+        })
+    }
+
+    /// Transfer log of the tenant, `None` without tenants.
+    pub fn transfer_log(&self, tenant: Option<&str>) -> Option<&TransferLog> {
+        self.transfer_logs
+            .get(&tenant.map(String::from))
+            .map(Arc::as_ref)
+    }
+
+    /// Every transfer log once, also when tenants share it.
+    pub fn all_transfer_logs(&self) -> Vec<&TransferLog> {
+        let mut logs: Vec<&Arc<TransferLog>> = Vec::new();
+        for log in self.transfer_logs.values() {
+            if !logs.iter().any(|l| Arc::ptr_eq(l, log)) {
+                logs.push(log);
+            }
+        }
+        logs.into_iter().map(Arc::as_ref).collect()
+    }
+
+    /// User database of the tenant, `None` without tenants.
+    pub fn user_db(&self, tenant: Option<&str>) -> Option<&UserDb> {
+        self.user_dbs
+            .get(&tenant.map(String::from))
+            .map(Arc::as_ref)
+    }
+
+    /// Writes persistent parts of the state to disk.
+    pub fn save(&self) -> Result<()> {
+        let stats = self.stats.save();
+        let uploads = self.uploads.save();
+        let quarantine = self.quarantine.save();
+        stats.and(uploads).and(quarantine)
+    }
+}
+
+/// Opens the file a section of every instance names, once per file, and
+/// keys it by tenant.
+fn open_per_tenant<S, T>(
+    config: &Config,
+    section: impl for<'a> Fn(&'a Config) -> Option<&'a S>,
+    file: impl for<'a> Fn(&'a S) -> &'a str,
+    open: impl Fn(&S, &Path) -> Result<T>,
+) -> Result<HashMap<Option<String>, Arc<T>>> {
+    let mut opened: HashMap<String, Arc<T>> = HashMap::new();
+    let mut by_tenant = HashMap::new();
+    for instance in config.instances() {
+        let Some(section) = section(&instance) else {
+            continue;
+        };
+        let path = file(section);
+        let value = match opened.get(path) {
+            Some(value) => Arc::clone(value),
+            None => {
+                let value = Arc::new(open(section, Path::new(path))?);
+                opened.insert(path.to_string(), Arc::clone(&value));
+                value
+            }
+        };
+        by_tenant.insert(instance.tenant, value);
+    }
+    Ok(by_tenant)
+}
@@ -0,0 +1,224 @@
+use std::{
+    collections::{BTreeMap, HashMap},
+    fs,
+    path::{Path, PathBuf},
+    sync::{
+        Mutex,
+        atomic::{AtomicBool, Ordering},
+    },
+};
+
+use anyhow::{Result, anyhow};
+use serde::{Deserialize, Serialize};
+
+use crate::{datetime::unix_now, history::Direction, users::account_tenant};
+
+/// Daily transfer counters are kept for this many days.
+const DAILY_RETENTION: u64 = 62;
+
+/// Transfer and login counters of a single user.
+#[derive(Debug, Clone, Default, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(default)]
+pub struct UserStats {
+    pub bytes_uploaded: u64,
+    pub bytes_downloaded: u64,
+    pub files_uploaded: u64,
+    pub files_downloaded: u64,
+    pub failed_logins: u64,
+    /// Unix timestamp of the last successful login.
+    pub last_login: Option<u64>,
+    /// Bytes transferred per day, keyed by days since the Unix epoch.
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub daily: BTreeMap<u64, DailyTransfers>,
+}
+
+#[derive(Debug, Clone, Copy, Default, Serialize, Deserialize, PartialEq, Eq)]
+#[serde(default)]
+pub struct DailyTransfers {
+    pub bytes_uploaded: u64,
+    pub bytes_downloaded: u64,
+}
+
+impl UserStats {
+    /// Adds bytes to the counters of today and forgets days that are too old.
+    fn add_daily(&mut self, direction: Direction, bytes: u64) {
+        let today = today();
+        let day = self.daily.entry(today).or_default();
+        match direction {
+            Direction::Upload => day.bytes_uploaded += bytes,
+            Direction::Download => day.bytes_downloaded += bytes,
+            Direction::Move => {}
+        }
+        let oldest = today.saturating_sub(DAILY_RETENTION);
+        self.daily.retain(|&day, _| day >= oldest);
+    }
+
+    /// Bytes transferred in the direction since the day, inclusive.
+    pub fn transferred_since(&self, first_day: u64, direction: Direction) -> u64 {
+        self.daily
+            .range(first_day..)
+            .map(|(_, day)| match direction {
+                Direction::Upload => day.bytes_uploaded,
+                Direction::Download => day.bytes_downloaded,
+                Direction::Move => 0,
+            })
+            .sum()
+    }
+}
+
+/// Days since the Unix epoch.
+pub fn today() -> u64 {
+    unix_now() / 86400
+}
+
+/// Per-user statistics, optionally persisted to JSON files.
+#[derive(Debug, Default)]
+pub struct StatsStore {
+    /// File the users of each tenant are persisted to, `None` without
+    /// tenants. Tenants may share a file.
+    files: HashMap<Option<String>, PathBuf>,
+    users: Mutex<HashMap<String, UserStats>>,
+    dirty: AtomicBool,
+}
+
+impl StatsStore {
+    /// Loads statistics from the files, or starts empty for the ones that
+    /// do not exist yet.
+    pub fn load(files: HashMap<Option<String>, PathBuf>) -> Result<Self> {
+        let mut users = HashMap::new();
+        for path in files.values() {
+            if path.exists() {
+                users.extend(read_stats_file(path)?);
+            }
+        }
+
+        Ok(StatsStore {
+            files,
+            users: Mutex::new(users),
+            dirty: AtomicBool::new(false),
+        })
+    }
+
+    fn update(&self, username: &str, f: impl FnOnce(&mut UserStats)) {
+        if let Ok(mut users) = self.users.lock() {
+            f(users.entry(username.to_string()).or_default());
+            self.dirty.store(true, Ordering::Relaxed);
+        }
+    }
+
+    pub fn record_login(&self, username: &str) {
+        self.update(username, |s| s.last_login = Some(unix_now()));
+    }
+
+    pub fn record_failed_login(&self, username: &str) {
+        self.update(username, |s| s.failed_logins += 1);
+    }
+
+    pub fn record_upload(&self, username: &str, bytes: u64) {
+        self.update(username, |s| {
+            s.bytes_uploaded += bytes;
+            s.files_uploaded += 1;
+            s.add_daily(Direction::Upload, bytes);
+        });
+    }
+
+    pub fn record_download(&self, username: &str, bytes: u64) {
+        self.update(username, |s| {
+            s.bytes_downloaded += bytes;
+            s.files_downloaded += 1;
+            s.add_daily(Direction::Download, bytes);
+        });
+    }
+
+    /// Returns statistics of the user.
+    pub fn get(&self, username: &str) -> UserStats {
+        self.users
+            .lock()
+            .ok()
+            .and_then(|users| users.get(username).cloned())
+            .unwrap_or_default()
+    }
+
+    /// Returns statistics of all users sorted by name.
+    pub fn snapshot(&self) -> BTreeMap<String, UserStats> {
+        self.users
+            .lock()
+            .map(|users| users.iter().map(|(k, v)| (k.clone(), v.clone())).collect())
+            .unwrap_or_default()
+    }
+
+    /// Writes statistics to the files if anything has changed since the
+    /// last save. Users go to the file of their tenant.
+    pub fn save(&self) -> Result<()> {
+        if self.files.is_empty() || !self.dirty.swap(false, Ordering::Relaxed) {
+            return Ok(());
+        }
+
+        let mut contents: BTreeMap<&PathBuf, BTreeMap<String, UserStats>> = self
+            .files
+            .values()
+            .map(|path| (path, BTreeMap::new()))
+            .collect();
+        for (account, stats) in self.snapshot() {
+            let tenant = account_tenant(&account).map(String::from);
+            if let Some(users) = self.files.get(&tenant).and_then(|p| contents.get_mut(p)) {
+                users.insert(account, stats);
+            }
+        }
+        for (path, users) in contents {
+            let content = serde_json::to_string_pretty(&users)?;
+            let temp_path = path.with_extension("tmp");
+            fs::write(&temp_path, content)
+                .and_then(|_| fs::rename(&temp_path, path))
+                .map_err(|e| {
+                    self.dirty.store(true, Ordering::Relaxed);
+                    anyhow!("failed to save statistics: {e}")
+                })?;
+        }
+        Ok(())
+    }
+}
+
+/// Reads statistics file without creating a store.
+pub fn read_stats_file(path: &Path) -> Result<HashMap<String, UserStats>> {
+    let content =
+        fs::read_to_string(path).map_err(|_| anyhow!("failed to read statistics file"))?;
+    serde_json::from_str(&content).map_err(|e| anyhow!("bad statistics format: {e}"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn users_are_saved_to_the_file_of_their_tenant() {
+        let dir = std::env::temp_dir().join(format!("dock-stats-{}", cuid2::cuid()));
+        fs::create_dir_all(&dir).unwrap();
+        let (shared, own) = (dir.join("shared.json"), dir.join("own.json"));
+        let files = HashMap::from([
+            (Some(String::from("a")), shared.clone()),
+            (Some(String::from("b")), shared.clone()),
+            (Some(String::from("c")), own.clone()),
+        ]);
+        let store = StatsStore::load(files.clone()).unwrap();
+        for account in ["a/alice", "b/bob", "c/carol", "d/dave"] {
+            store.record_login(account);
+        }
+        store.save().unwrap();
+
+        let mut users: Vec<_> = read_stats_file(&shared).unwrap().into_keys().collect();
+        users.sort();
+        assert_eq!(users, ["a/alice", "b/bob"]);
+        let users: Vec<_> = read_stats_file(&own).unwrap().into_keys().collect();
+        assert_eq!(users, ["c/carol"]);
+        // Both files are read back.
+        assert!(
+            StatsStore::load(files)
+                .unwrap()
+                .get("c/carol")
+                .last_login
+                .is_some()
+        );
+        fs::remove_dir_all(&dir).unwrap();
+    }
+}
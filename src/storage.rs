@@ -0,0 +1,83 @@
+//! Backends that keep the files of users somewhere else than the root of
+//! the server.
+//!
+//! A backend is plugged in by implementing [`Storage`]. Sessions of a server
+//! with a backend run the file commands it supports against it, with the
+//! virtual paths clients see, and refuse the others. Without one, files are
+//! served from the root.
+
+use std::{fmt::Debug, future::Future, pin::Pin};
+
+use anyhow::Result;
+use tokio::io::{AsyncRead, AsyncWrite};
+
+use crate::commands::Commands;
+
+/// Future returned by a storage backend.
+pub type StorageFuture<'a, T> = Pin<Box<dyn Future<Output = Result<T>> + Send + 'a>>;
+
+/// Data connection of the client a backend reads uploads from.
+pub type Reader<'a> = &'a mut (dyn AsyncRead + Send + Unpin);
+/// Data connection of the client a backend writes downloads to.
+pub type Writer<'a> = &'a mut (dyn AsyncWrite + Send + Unpin);
+
+/// Files of a backend. Paths are absolute and normalized with
+/// [`crate::protocol::clean_path`], so `/` is the root of the user.
+pub trait Storage: Debug + Send + Sync {
+    fn is_dir<'a>(&'a self, path: &'a str) -> StorageFuture<'a, bool>;
+
+    /// Lines of the listing of a directory, only the names if `names_only`.
+    fn list<'a>(&'a self, path: &'a str, names_only: bool) -> StorageFuture<'a, Vec<String>>;
+
+    /// Writes the content of a file and returns its size.
+    fn retrieve<'a>(&'a self, path: &'a str, to: Writer<'a>) -> StorageFuture<'a, u64>;
+
+    /// Writes a file, or appends to it, and returns the number of bytes read.
+    fn store<'a>(&'a self, path: &'a str, from: Reader<'a>, append: bool)
+    -> StorageFuture<'a, u64>;
+
+    fn delete<'a>(&'a self, path: &'a str) -> StorageFuture<'a, ()>;
+
+    fn make_dir<'a>(&'a self, path: &'a str) -> StorageFuture<'a, ()>;
+
+    fn remove_dir<'a>(&'a self, path: &'a str) -> StorageFuture<'a, ()>;
+
+    fn rename<'a>(&'a self, from: &'a str, to: &'a str) -> StorageFuture<'a, ()>;
+
+    fn size<'a>(&'a self, path: &'a str) -> StorageFuture<'a, u64>;
+
+    /// Modification time as in the reply to MDTM, `YYYYMMDDHHMMSS` in UTC.
+    fn modified<'a>(&'a self, path: &'a str) -> StorageFuture<'a, String>;
+}
+
+/// Commands that work on files, which sessions run against the backend
+/// instead of the root.
+pub fn is_file_command(command: Commands) -> bool {
+    matches!(
+        command,
+        Commands::ChangeDir
+            | Commands::ChangeDirectoryUp
+            | Commands::List
+            | Commands::NameList
+            | Commands::MachineList
+            | Commands::MachineListDir
+            | Commands::Size
+            | Commands::ModificationTime
+            | Commands::Retrive
+            | Commands::Store
+            | Commands::Append
+            | Commands::StoreUnique
+            | Commands::Delete
+            | Commands::MakeDir
+            | Commands::RemoveDir
+            | Commands::RenameFrom
+            | Commands::RenameTo
+            | Commands::Rest
+            | Commands::Crc32
+            | Commands::Md5
+            | Commands::Sha256
+            | Commands::Hash
+            | Commands::Available
+            | Commands::Combine
+    )
+}
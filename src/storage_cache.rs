@@ -0,0 +1,578 @@
+//! Local disk cache in front of a storage backend, so hot files are not
+//! fetched from the remote store on every download and uploads finish at
+//! the speed of the local disk.
+//!
+//! Downloads are read through the cache. A cached file is served without
+//! asking the backend for `fresh_secs`, after that only when the backend
+//! reports the same size and modification time. Uploads are written back:
+//! they are stored in the cache and copied to the backend in the background,
+//! one at a time in the order they finished. Commands that list, change or
+//! look at a path wait until the uploads below it are copied. Copied files
+//! are evicted least recently used first once the cache grows over its
+//! size.
+
+use std::{
+    collections::HashMap,
+    fs,
+    path::PathBuf,
+    sync::{
+        Arc, Mutex,
+        atomic::{AtomicU64, Ordering},
+    },
+    time::{Duration, Instant},
+};
+
+use anyhow::{Context, Result};
+use serde::Deserialize;
+use tokio::{io::AsyncWriteExt, sync::Notify, time};
+use tracing::warn;
+
+use crate::storage::{Reader, Storage, StorageFuture, Writer};
+
+/// Longest wait between attempts to copy an upload to the backend.
+const MAX_RETRY_DELAY: Duration = Duration::from_secs(60);
+
+/// Extension of the files of the cache, which are removed at startup.
+const EXTENSION: &str = "cache";
+
+fn default_fresh_secs() -> u64 {
+    60
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct StorageCacheConfig {
+    /// Directory the cached files are kept in.
+    pub dir: String,
+    /// Size of the cache in bytes. Files larger than this are downloaded
+    /// without the cache, uploads not yet copied to the backend are kept
+    /// even when they do not fit.
+    pub max_size: u64,
+    /// How long a cached file is served without checking if it changed on
+    /// the backend, in seconds.
+    #[serde(default = "default_fresh_secs")]
+    pub fresh_secs: u64,
+}
+
+#[derive(Debug)]
+struct Entry {
+    file: PathBuf,
+    size: u64,
+    /// Modification time the backend reported when the file was cached,
+    /// `None` for uploads.
+    modified: Option<String>,
+    checked: Instant,
+    /// Value of the clock when the file was last used.
+    used: u64,
+    /// Upload not yet copied to the backend.
+    dirty: bool,
+    /// Number of the file, which tells apart uploads to the same path.
+    generation: u64,
+}
+
+/// Cached files by path on the backend.
+#[derive(Debug, Default)]
+struct Entries {
+    files: HashMap<String, Entry>,
+    size: u64,
+    clock: u64,
+}
+
+impl Entries {
+    fn touch(&mut self, path: &str) {
+        self.clock += 1;
+        if let Some(entry) = self.files.get_mut(path) {
+            entry.used = self.clock;
+        }
+    }
+
+    /// Adds a file and returns the files that are no longer needed.
+    fn insert(&mut self, path: &str, mut entry: Entry, max_size: u64) -> Vec<PathBuf> {
+        self.clock += 1;
+        entry.used = self.clock;
+        self.size += entry.size;
+        let mut removed: Vec<PathBuf> = self
+            .files
+            .insert(path.to_string(), entry)
+            .map(|old| {
+                self.size -= old.size;
+                old.file
+            })
+            .into_iter()
+            .collect();
+        removed.extend(self.evict(max_size));
+        removed
+    }
+
+    /// Removes the least recently used files that are on the backend until
+    /// the cache fits.
+    fn evict(&mut self, max_size: u64) -> Vec<PathBuf> {
+        let mut removed = Vec::new();
+        while self.size > max_size {
+            let Some(path) = self
+                .files
+                .iter()
+                .filter(|(_, entry)| !entry.dirty)
+                .min_by_key(|(_, entry)| entry.used)
+                .map(|(path, _)| path.clone())
+            else {
+                break;
+            };
+            removed.extend(self.remove(&path));
+        }
+        removed
+    }
+
+    fn remove(&mut self, path: &str) -> Option<PathBuf> {
+        let entry = self.files.remove(path)?;
+        self.size -= entry.size;
+        Some(entry.file)
+    }
+
+    /// Removes the path and everything below it.
+    fn remove_under(&mut self, path: &str) -> Vec<PathBuf> {
+        let paths: Vec<String> = self
+            .files
+            .keys()
+            .filter(|p| is_under(p, path))
+            .cloned()
+            .collect();
+        paths.iter().filter_map(|p| self.remove(p)).collect()
+    }
+
+    fn dirty_under(&self, path: &str) -> bool {
+        self.files
+            .iter()
+            .any(|(p, entry)| entry.dirty && is_under(p, path))
+    }
+}
+
+fn is_under(path: &str, dir: &str) -> bool {
+    path == dir
+        || path
+            .strip_prefix(dir.trim_end_matches('/'))
+            .is_some_and(|rest| rest.starts_with('/'))
+}
+
+fn remove_files(files: Vec<PathBuf>) {
+    for file in files {
+        let _ = fs::remove_file(file);
+    }
+}
+
+/// Parts of the cache the tasks copying uploads share.
+#[derive(Debug)]
+struct Shared {
+    inner: Arc<dyn Storage>,
+    entries: Mutex<Entries>,
+    max_size: u64,
+    /// Held while an upload is copied, tokio hands it out in order.
+    sync: tokio::sync::Mutex<()>,
+    /// Notified when an upload is done being copied.
+    synced: Notify,
+}
+
+impl Shared {
+    fn is_current(&self, path: &str, generation: u64) -> bool {
+        self.entries
+            .lock()
+            .unwrap()
+            .files
+            .get(path)
+            .is_some_and(|entry| entry.generation == generation)
+    }
+
+    /// Copies an upload to the backend, retrying until it is copied or a
+    /// newer upload or a removal replaces it.
+    async fn sync(&self, path: String, generation: u64) {
+        let _turn = self.sync.lock().await;
+        let mut delay = Duration::from_secs(1);
+        loop {
+            let Some(file) = self
+                .entries
+                .lock()
+                .unwrap()
+                .files
+                .get(&path)
+                .filter(|entry| entry.generation == generation)
+                .map(|entry| entry.file.clone())
+            else {
+                break;
+            };
+            let result = async {
+                let mut file = tokio::fs::File::open(&file).await?;
+                self.inner.store(&path, &mut file, false).await
+            }
+            .await;
+            match result {
+                Ok(_) => {
+                    let mut entries = self.entries.lock().unwrap();
+                    if let Some(entry) = entries.files.get_mut(&path)
+                        && entry.generation == generation
+                    {
+                        entry.dirty = false;
+                    }
+                    let evicted = entries.evict(self.max_size);
+                    drop(entries);
+                    remove_files(evicted);
+                    break;
+                }
+                Err(e) if self.is_current(&path, generation) => {
+                    warn!(file=%path, reason=%e, "Copying upload to the storage backend failed, retrying.");
+                    time::sleep(delay).await;
+                    delay = (delay * 2).min(MAX_RETRY_DELAY);
+                }
+                Err(_) => break,
+            }
+        }
+        self.synced.notify_waiters();
+    }
+}
+
+/// Storage backend that caches the files of another one on the local disk.
+#[derive(Debug)]
+pub struct StorageCache {
+    shared: Arc<Shared>,
+    dir: PathBuf,
+    fresh: Duration,
+    next_file: AtomicU64,
+}
+
+impl StorageCache {
+    /// Wraps the backend. Files a previous run left in the directory are
+    /// removed, uploads among them were copied or are lost.
+    pub fn new(inner: Arc<dyn Storage>, config: &StorageCacheConfig) -> Result<Self> {
+        let dir = PathBuf::from(&config.dir);
+        fs::create_dir_all(&dir)
+            .with_context(|| format!("failed to create cache directory {}", dir.display()))?;
+        for entry in fs::read_dir(&dir)?.flatten() {
+            if entry.path().extension().is_some_and(|e| e == EXTENSION) {
+                let _ = fs::remove_file(entry.path());
+            }
+        }
+        Ok(StorageCache {
+            shared: Arc::new(Shared {
+                inner,
+                entries: Mutex::new(Entries::default()),
+                max_size: config.max_size,
+                sync: tokio::sync::Mutex::new(()),
+                synced: Notify::new(),
+            }),
+            dir,
+            fresh: Duration::from_secs(config.fresh_secs),
+            next_file: AtomicU64::new(0),
+        })
+    }
+
+    fn inner(&self) -> &dyn Storage {
+        self.shared.inner.as_ref()
+    }
+
+    fn new_file(&self) -> (PathBuf, u64) {
+        let generation = self.next_file.fetch_add(1, Ordering::Relaxed);
+        (
+            self.dir.join(format!("{generation}.{EXTENSION}")),
+            generation,
+        )
+    }
+
+    /// Waits until the uploads to the path and below it are copied.
+    async fn wait_synced(&self, path: &str) {
+        loop {
+            let synced = self.shared.synced.notified();
+            if !self.shared.entries.lock().unwrap().dirty_under(path) {
+                return;
+            }
+            synced.await;
+        }
+    }
+
+    /// Waits for the uploads below the path and drops it from the cache,
+    /// before it is changed on the backend.
+    async fn forget(&self, path: &str) {
+        self.wait_synced(path).await;
+        let removed = self.shared.entries.lock().unwrap().remove_under(path);
+        remove_files(removed);
+    }
+
+    /// Returns the cached file of the path if it is still up to date.
+    async fn cached(&self, path: &str) -> Option<PathBuf> {
+        let (file, generation, size, modified) = {
+            let mut entries = self.shared.entries.lock().unwrap();
+            let entry = entries.files.get(path)?;
+            if entry.dirty || entry.checked.elapsed() < self.fresh {
+                let file = entry.file.clone();
+                entries.touch(path);
+                return Some(file);
+            }
+            (
+                entry.file.clone(),
+                entry.generation,
+                entry.size,
+                entry.modified.clone(),
+            )
+        };
+        let unchanged = modified.is_some()
+            && self.inner().size(path).await.ok() == Some(size)
+            && self.inner().modified(path).await.ok() == modified;
+        let mut entries = self.shared.entries.lock().unwrap();
+        match entries.files.get_mut(path) {
+            Some(entry) if entry.generation == generation && unchanged => {
+                entry.checked = Instant::now();
+                entries.touch(path);
+                Some(file)
+            }
+            Some(entry) if entry.generation == generation => {
+                let removed = entries.remove(path);
+                drop(entries);
+                remove_files(removed.into_iter().collect());
+                None
+            }
+            _ => None,
+        }
+    }
+
+    /// Downloads a file into the cache, unless it does not fit.
+    async fn fill(&self, path: &str) -> Result<Option<PathBuf>> {
+        let size = self.inner().size(path).await?;
+        if size > self.shared.max_size {
+            return Ok(None);
+        }
+        let modified = self.inner().modified(path).await.ok();
+        let (file, generation) = self.new_file();
+        let result = async {
+            let mut cached = tokio::fs::File::create(&file).await?;
+            let size = self.inner().retrieve(path, &mut cached).await?;
+            cached.flush().await?;
+            Ok::<_, anyhow::Error>(size)
+        }
+        .await;
+        let size = match result {
+            Ok(size) => size,
+            Err(e) => {
+                let _ = tokio::fs::remove_file(&file).await;
+                return Err(e);
+            }
+        };
+        let entry = Entry {
+            file: file.clone(),
+            size,
+            modified,
+            checked: Instant::now(),
+            used: 0,
+            dirty: false,
+            generation,
+        };
+        let removed = self
+            .shared
+            .entries
+            .lock()
+            .unwrap()
+            .insert(path, entry, self.shared.max_size);
+        let evicted_itself = removed.contains(&file);
+        remove_files(removed);
+        Ok((!evicted_itself).then_some(file))
+    }
+
+    async fn retrieve_cached(&self, path: &str, to: Writer<'_>) -> Result<u64> {
+        let file = match self.cached(path).await {
+            Some(file) => Some(file),
+            None => self.fill(path).await?,
+        };
+        // An evicted file is removed, so opening it fails.
+        if let Some(file) = file
+            && let Ok(mut file) = tokio::fs::File::open(&file).await
+        {
+            let size = tokio::io::copy(&mut file, to).await?;
+            to.flush().await?;
+            return Ok(size);
+        }
+        self.inner().retrieve(path, to).await
+    }
+
+    async fn store_cached(&self, path: &str, from: Reader<'_>) -> Result<u64> {
+        let (file, generation) = self.new_file();
+        let result = async {
+            let mut cached = tokio::fs::File::create(&file).await?;
+            let size = tokio::io::copy(from, &mut cached).await?;
+            cached.flush().await?;
+            Ok::<_, anyhow::Error>(size)
+        }
+        .await;
+        let size = match result {
+            Ok(size) => size,
+            Err(e) => {
+                let _ = tokio::fs::remove_file(&file).await;
+                return Err(e);
+            }
+        };
+        let entry = Entry {
+            file,
+            size,
+            modified: None,
+            checked: Instant::now(),
+            used: 0,
+            dirty: true,
+            generation,
+        };
+        let removed = self
+            .shared
+            .entries
+            .lock()
+            .unwrap()
+            .insert(path, entry, self.shared.max_size);
+        remove_files(removed);
+        let shared = self.shared.clone();
+        let path = path.to_string();
+        tokio::spawn(async move { shared.sync(path, generation).await });
+        Ok(size)
+    }
+}
+
+impl Storage for StorageCache {
+    fn is_dir<'a>(&'a self, path: &'a str) -> StorageFuture<'a, bool> {
+        self.inner().is_dir(path)
+    }
+
+    fn list<'a>(&'a self, path: &'a str, names_only: bool) -> StorageFuture<'a, Vec<String>> {
+        Box::pin(async move {
+            self.wait_synced(path).await;
+            self.inner().list(path, names_only).await
+        })
+    }
+
+    fn retrieve<'a>(&'a self, path: &'a str, to: Writer<'a>) -> StorageFuture<'a, u64> {
+        Box::pin(self.retrieve_cached(path, to))
+    }
+
+    fn store<'a>(
+        &'a self,
+        path: &'a str,
+        from: Reader<'a>,
+        append: bool,
+    ) -> StorageFuture<'a, u64> {
+        Box::pin(async move {
+            if append {
+                self.forget(path).await;
+                return self.inner().store(path, from, true).await;
+            }
+            self.store_cached(path, from).await
+        })
+    }
+
+    fn delete<'a>(&'a self, path: &'a str) -> StorageFuture<'a, ()> {
+        Box::pin(async move {
+            self.forget(path).await;
+            self.inner().delete(path).await
+        })
+    }
+
+    fn make_dir<'a>(&'a self, path: &'a str) -> StorageFuture<'a, ()> {
+        self.inner().make_dir(path)
+    }
+
+    fn remove_dir<'a>(&'a self, path: &'a str) -> StorageFuture<'a, ()> {
+        Box::pin(async move {
+            self.forget(path).await;
+            self.inner().remove_dir(path).await
+        })
+    }
+
+    fn rename<'a>(&'a self, from: &'a str, to: &'a str) -> StorageFuture<'a, ()> {
+        Box::pin(async move {
+            self.forget(from).await;
+            self.forget(to).await;
+            self.inner().rename(from, to).await
+        })
+    }
+
+    fn size<'a>(&'a self, path: &'a str) -> StorageFuture<'a, u64> {
+        Box::pin(async move {
+            self.wait_synced(path).await;
+            self.inner().size(path).await
+        })
+    }
+
+    fn modified<'a>(&'a self, path: &'a str) -> StorageFuture<'a, String> {
+        Box::pin(async move {
+            self.wait_synced(path).await;
+            self.inner().modified(path).await
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::json;
+
+    use super::*;
+    use crate::ftptest::{TEST_PASSWORD, TEST_USER, TestServer};
+
+    fn entry(size: u64, dirty: bool) -> Entry {
+        Entry {
+            file: PathBuf::from(format!("{size}.{EXTENSION}")),
+            size,
+            modified: None,
+            checked: Instant::now(),
+            used: 0,
+            dirty,
+            generation: 0,
+        }
+    }
+
+    #[test]
+    fn evicts_least_recently_used_files() {
+        let mut entries = Entries::default();
+        assert!(entries.insert("/a", entry(4, false), 10).is_empty());
+        assert!(entries.insert("/b", entry(5, true), 10).is_empty());
+        entries.touch("/a");
+        // Uploads not yet copied stay, so the older download goes.
+        let removed = entries.insert("/c", entry(3, false), 10);
+        assert_eq!(removed, [PathBuf::from("4.cache")]);
+        assert_eq!(entries.size, 8);
+        assert!(entries.dirty_under("/"));
+        assert!(entries.dirty_under("/b"));
+        assert!(!entries.dirty_under("/b/c"));
+        assert_eq!(entries.remove_under("/").len(), 2);
+        assert_eq!(entries.size, 0);
+    }
+
+    #[tokio::test]
+    async fn caches_downloads_and_writes_uploads_back() {
+        let upstream = TestServer::start().await.unwrap();
+        std::fs::write(upstream.root().join("a.txt"), "hello").unwrap();
+        let cache_dir = std::env::temp_dir().join(format!("dock-cache-{}", cuid2::cuid()));
+
+        let config = serde_json::from_value(json!({
+            "users": [{"name": "alice", "password": "secret", "permissions": "All"}],
+            "gateway": {
+                "address": upstream.addr().to_string(),
+                "username": TEST_USER,
+                "password": TEST_PASSWORD,
+                "cache": {"dir": cache_dir, "max_size": 1024},
+            },
+        }))
+        .unwrap();
+        let gateway = TestServer::with_config(config).await.unwrap();
+        let mut client = gateway.client().await.unwrap();
+        client.login("alice", "secret").await.unwrap();
+
+        assert_eq!(client.retr("a.txt").await.unwrap(), b"hello");
+        std::fs::remove_file(upstream.root().join("a.txt")).unwrap();
+        assert_eq!(client.retr("a.txt").await.unwrap(), b"hello");
+
+        client.stor("b.txt", b"world").await.unwrap();
+        // Listings wait for the upload to reach the upstream server.
+        let listing = client.list("").await.unwrap();
+        assert!(listing.iter().any(|line| line.ends_with(" b.txt")));
+        assert_eq!(
+            std::fs::read(upstream.root().join("b.txt")).unwrap(),
+            b"world"
+        );
+        // Deleting drops the file from the cache, also when the upstream
+        // server no longer has it.
+        assert_eq!(client.command("DELE a.txt").await.unwrap().code, 550);
+        assert!(client.retr("a.txt").await.is_err());
+        client.quit().await.unwrap();
+        let _ = std::fs::remove_dir_all(cache_dir);
+    }
+}
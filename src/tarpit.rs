@@ -0,0 +1,102 @@
+//! Escalating delays for failed logins.
+
+use std::{
+    collections::HashMap,
+    net::IpAddr,
+    sync::Mutex,
+    time::{Duration, Instant},
+};
+
+use serde::Deserialize;
+
+/// Stale entries are dropped once this many addresses are tracked.
+const PRUNE_THRESHOLD: usize = 1024;
+
+fn default_base_delay() -> u64 {
+    1000
+}
+
+fn default_max_delay() -> u64 {
+    30000
+}
+
+fn default_reset_after() -> u64 {
+    600
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct TarpitConfig {
+    /// Delay after the first failed login, in milliseconds. Doubles with
+    /// every following failure.
+    #[serde(default = "default_base_delay")]
+    pub base_delay_ms: u64,
+    /// Upper bound of the delay, in milliseconds.
+    #[serde(default = "default_max_delay")]
+    pub max_delay_ms: u64,
+    /// Failures are forgotten after this many seconds without a new one.
+    #[serde(default = "default_reset_after")]
+    pub reset_after_secs: u64,
+}
+
+#[derive(Debug, Clone, Copy)]
+struct Failures {
+    count: u32,
+    last: Instant,
+}
+
+/// Failed login counters per client address.
+#[derive(Debug, Default)]
+pub struct Tarpit {
+    config: Option<TarpitConfig>,
+    failures: Mutex<HashMap<IpAddr, Failures>>,
+}
+
+impl Tarpit {
+    pub fn new(config: Option<TarpitConfig>) -> Self {
+        Tarpit {
+            config,
+            failures: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Records a failed login and returns how long to wait before replying.
+    pub fn record_failure(&self, ip: IpAddr) -> Duration {
+        let Some(config) = &self.config else {
+            return Duration::ZERO;
+        };
+        let Ok(mut failures) = self.failures.lock() else {
+            return Duration::ZERO;
+        };
+
+        let now = Instant::now();
+        let reset_after = Duration::from_secs(config.reset_after_secs);
+        if failures.len() >= PRUNE_THRESHOLD {
+            failures.retain(|_, f| now.duration_since(f.last) < reset_after);
+        }
+
+        let entry = failures.entry(ip).or_insert(Failures {
+            count: 0,
+            last: now,
+        });
+        if now.duration_since(entry.last) >= reset_after {
+            entry.count = 0;
+        }
+        entry.count = entry.count.saturating_add(1);
+        entry.last = now;
+
+        let factor = 1u64.checked_shl(entry.count - 1).unwrap_or(u64::MAX);
+        Duration::from_millis(
+            config
+                .base_delay_ms
+                .saturating_mul(factor)
+                .min(config.max_delay_ms),
+        )
+    }
+
+    /// Forgets failures of the address after a successful login.
+    pub fn clear(&self, ip: IpAddr) {
+        if let Ok(mut failures) = self.failures.lock() {
+            failures.remove(&ip);
+        }
+    }
+}
@@ -0,0 +1,397 @@
+//! TLS for control and data connections, also known as FTPS.
+//!
+//! Clients encrypt the control connection with AUTH TLS and ask for
+//! encrypted data connections with PBSZ and PROT, as described in RFC 4217.
+
+use std::{
+    fs, io,
+    net::SocketAddr,
+    path::{Path, PathBuf},
+    pin::Pin,
+    sync::{Arc, Mutex, RwLock},
+    task::{Context, Poll},
+    time::{Duration, SystemTime},
+};
+
+use anyhow::{Result, anyhow, bail};
+use rustls::{
+    RootCertStore, ServerConfig, SupportedProtocolVersion,
+    crypto::{CryptoProvider, ring},
+    pki_types::{CertificateDer, PrivateKeyDer, pem::PemObject},
+    server::{ClientHello, ResolvesServerCert, WebPkiClientVerifier, danger::ClientCertVerifier},
+    sign::CertifiedKey,
+    version::{TLS12, TLS13},
+};
+use serde::Deserialize;
+use tokio::{
+    io::{AsyncRead, AsyncWrite, ReadBuf},
+    net::TcpStream,
+};
+use tokio_rustls::{TlsAcceptor, server::TlsStream};
+
+use crate::acme::AcmeConfig;
+
+/// Clients that do not finish the handshake in time are disconnected.
+pub const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(30);
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct TlsConfig {
+    /// PEM file with the certificate chain, starting with the certificate
+    /// of the server. Changes to it and the key are picked up while
+    /// running, unless chroot is enabled. Not needed with `acme`.
+    #[serde(default)]
+    pub cert_file: String,
+    /// PEM file with the private key of the certificate.
+    #[serde(default)]
+    pub key_file: String,
+    /// Obtains and renews the certificate from an ACME CA like Let's
+    /// Encrypt instead of reading `cert_file` and `key_file`.
+    #[serde(default)]
+    pub acme: Option<AcmeConfig>,
+    /// Oldest protocol version clients may use, `1.2` or `1.3`.
+    #[serde(default)]
+    pub min_version: TlsVersion,
+    /// Cipher suites in order of preference, by their IANA names like
+    /// `TLS13_AES_256_GCM_SHA384`. Every suite rustls supports is offered
+    /// when empty.
+    #[serde(default)]
+    pub cipher_suites: Vec<String>,
+    /// Address of a second listener for implicit FTPS, like `0.0.0.0:990`.
+    /// Connections to it start with the handshake instead of AUTH TLS, and
+    /// their data connections are encrypted unless the client sends PROT C.
+    #[serde(default)]
+    pub implicit_address: Option<String>,
+    /// Asks clients for a certificate, which lets them log in without a
+    /// password as the user it is mapped to, see `client_certificates` of
+    /// the users.
+    #[serde(default)]
+    pub client_auth: Option<ClientAuthConfig>,
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct ClientAuthConfig {
+    /// PEM file with the CA certificates client certificates have to be
+    /// issued by.
+    pub ca_file: String,
+    /// Refuses the handshake without a client certificate, also on data
+    /// connections. Otherwise clients without one log in with a password.
+    #[serde(default)]
+    pub required: bool,
+}
+
+#[derive(Debug, Deserialize, Clone, Copy, Default, PartialEq, Eq)]
+pub enum TlsVersion {
+    #[default]
+    #[serde(rename = "1.2")]
+    Tls12,
+    #[serde(rename = "1.3")]
+    Tls13,
+}
+
+impl TlsConfig {
+    /// Files the certificate and its key are read from.
+    pub fn certificate_files(&self) -> (PathBuf, PathBuf) {
+        match &self.acme {
+            Some(acme) => acme.certificate_files(),
+            None => (
+                PathBuf::from(&self.cert_file),
+                PathBuf::from(&self.key_file),
+            ),
+        }
+    }
+}
+
+impl TlsVersion {
+    /// This version and every newer one.
+    fn and_newer(self) -> Vec<&'static SupportedProtocolVersion> {
+        match self {
+            TlsVersion::Tls12 => vec![&TLS13, &TLS12],
+            TlsVersion::Tls13 => vec![&TLS13],
+        }
+    }
+}
+
+/// Certificate and key of the server, replaced when their files change.
+#[derive(Debug)]
+struct Certificate {
+    cert_file: PathBuf,
+    key_file: PathBuf,
+    provider: Arc<CryptoProvider>,
+    /// Missing until ACME has issued the first certificate, which fails
+    /// every handshake.
+    current: RwLock<Option<Arc<CertifiedKey>>>,
+    /// Modification times of the files when they were last loaded.
+    modified: Mutex<[Option<SystemTime>; 2]>,
+}
+
+impl Certificate {
+    fn load(config: &TlsConfig, provider: Arc<CryptoProvider>) -> Result<Self> {
+        let (cert_file, key_file) = config.certificate_files();
+        if config.acme.is_none() && (config.cert_file.is_empty() || config.key_file.is_empty()) {
+            bail!("tls needs cert_file and key_file, or acme");
+        }
+        let modified = modification_times(&cert_file, &key_file);
+        let current = match load_certified_key(&cert_file, &key_file, &provider) {
+            Ok(current) => Some(Arc::new(current)),
+            // Ordered once the server runs.
+            Err(_) if config.acme.is_some() && modified == [None, None] => None,
+            Err(e) => return Err(e),
+        };
+        Ok(Certificate {
+            cert_file,
+            key_file,
+            provider,
+            current: RwLock::new(current),
+            modified: Mutex::new(modified),
+        })
+    }
+
+    /// Reads the files again.
+    fn reload(&self) -> Result<()> {
+        let modified = modification_times(&self.cert_file, &self.key_file);
+        let certified = load_certified_key(&self.cert_file, &self.key_file, &self.provider)?;
+        if let Ok(mut current) = self.current.write() {
+            *current = Some(Arc::new(certified));
+        }
+        if let Ok(mut last) = self.modified.lock() {
+            *last = modified;
+        }
+        Ok(())
+    }
+}
+
+impl ResolvesServerCert for Certificate {
+    fn resolve(&self, _: ClientHello<'_>) -> Option<Arc<CertifiedKey>> {
+        self.current.read().ok().and_then(|current| current.clone())
+    }
+}
+
+fn modification_times(cert_file: &Path, key_file: &Path) -> [Option<SystemTime>; 2] {
+    [cert_file, key_file].map(|file| fs::metadata(file).and_then(|m| m.modified()).ok())
+}
+
+fn load_certified_key(
+    cert_file: &Path,
+    key_file: &Path,
+    provider: &CryptoProvider,
+) -> Result<CertifiedKey> {
+    let chain = CertificateDer::pem_file_iter(cert_file)
+        .and_then(|certificates| certificates.collect::<Result<Vec<_>, _>>())
+        .map_err(|e| anyhow!("failed to read certificate {}: {e}", cert_file.display()))?;
+    if chain.is_empty() {
+        bail!("no certificate found in {}", cert_file.display());
+    }
+    let key = PrivateKeyDer::from_pem_file(key_file)
+        .map_err(|e| anyhow!("failed to read private key {}: {e}", key_file.display()))?;
+    CertifiedKey::from_der(chain, key, provider)
+        .map_err(|e| anyhow!("certificate does not match the key: {e}"))
+}
+
+/// Keeps only the named cipher suites, in the order they are named.
+fn select_cipher_suites(provider: &mut CryptoProvider, names: &[String]) -> Result<()> {
+    if names.is_empty() {
+        return Ok(());
+    }
+    let mut selected = Vec::with_capacity(names.len());
+    for name in names {
+        let suite = provider
+            .cipher_suites
+            .iter()
+            .find(|s| {
+                s.suite()
+                    .as_str()
+                    .is_some_and(|n| n.eq_ignore_ascii_case(name))
+            })
+            .ok_or_else(|| anyhow!("unknown cipher suite {name}"))?;
+        selected.push(*suite);
+    }
+    provider.cipher_suites = selected;
+    Ok(())
+}
+
+fn client_verifier(
+    config: &ClientAuthConfig,
+    provider: Arc<CryptoProvider>,
+) -> Result<Arc<dyn ClientCertVerifier>> {
+    let mut roots = RootCertStore::empty();
+    let certificates = CertificateDer::pem_file_iter(&config.ca_file)
+        .and_then(|certificates| certificates.collect::<Result<Vec<_>, _>>())
+        .map_err(|e| anyhow!("failed to read CA certificates {}: {e}", config.ca_file))?;
+    for certificate in certificates {
+        roots
+            .add(certificate)
+            .map_err(|e| anyhow!("bad CA certificate in {}: {e}", config.ca_file))?;
+    }
+    let builder = WebPkiClientVerifier::builder_with_provider(Arc::new(roots), provider);
+    let builder = if config.required {
+        builder
+    } else {
+        builder.allow_unauthenticated()
+    };
+    builder
+        .build()
+        .map_err(|e| anyhow!("cannot verify client certificates: {e}"))
+}
+
+/// Certificate and settings connections are encrypted with.
+pub struct Tls {
+    acceptor: TlsAcceptor,
+    certificate: Arc<Certificate>,
+}
+
+impl std::fmt::Debug for Tls {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Tls").finish_non_exhaustive()
+    }
+}
+
+impl Tls {
+    /// Loads the certificate and key of the config.
+    pub fn load(config: &TlsConfig) -> Result<Self> {
+        let mut provider = ring::default_provider();
+        select_cipher_suites(&mut provider, &config.cipher_suites)?;
+        let provider = Arc::new(provider);
+        let certificate = Arc::new(Certificate::load(config, Arc::clone(&provider))?);
+        let builder = ServerConfig::builder_with_provider(Arc::clone(&provider))
+            .with_protocol_versions(&config.min_version.and_newer())
+            .map_err(|e| anyhow!("cipher suites do not fit the TLS versions: {e}"))?;
+        let builder = match &config.client_auth {
+            Some(client_auth) => {
+                builder.with_client_cert_verifier(client_verifier(client_auth, provider)?)
+            }
+            None => builder.with_no_client_auth(),
+        };
+        let server_config = builder.with_cert_resolver(certificate.clone());
+        Ok(Tls {
+            acceptor: TlsAcceptor::from(Arc::new(server_config)),
+            certificate,
+        })
+    }
+
+    /// Loads the certificate and key again.
+    pub fn reload(&self) -> Result<()> {
+        self.certificate.reload()
+    }
+
+    /// Loads the certificate and key again if their files have changed
+    /// since they were loaded. Returns whether they were replaced. Until the
+    /// files can be loaded, the previous certificate is kept.
+    pub fn reload_if_changed(&self) -> Result<bool> {
+        let certificate = &self.certificate;
+        let modified = modification_times(&certificate.cert_file, &certificate.key_file);
+        let changed = certificate
+            .modified
+            .lock()
+            .is_ok_and(|last| *last != modified);
+        if !changed {
+            return Ok(false);
+        }
+        certificate.reload()?;
+        Ok(true)
+    }
+
+    /// Performs the handshake as the server of an accepted connection.
+    pub async fn accept(&self, stream: TcpStream) -> io::Result<Stream> {
+        Ok(Stream::Tls(Box::new(self.acceptor.accept(stream).await?)))
+    }
+}
+
+/// A control or data connection, encrypted or not.
+#[derive(Debug)]
+pub enum Stream {
+    Plain(TcpStream),
+    Tls(Box<TlsStream<TcpStream>>),
+    /// Stands in for a connection while it is upgraded. Every operation
+    /// fails.
+    Closed,
+}
+
+impl Stream {
+    /// Encrypts a plain connection. The connection is closed if the
+    /// handshake fails.
+    pub async fn upgrade(&mut self, tls: &Tls) -> io::Result<()> {
+        match std::mem::replace(self, Stream::Closed) {
+            Stream::Plain(stream) => {
+                *self = tls.accept(stream).await?;
+                Ok(())
+            }
+            stream => {
+                *self = stream;
+                Err(io::Error::other("connection is already encrypted"))
+            }
+        }
+    }
+
+    pub fn is_tls(&self) -> bool {
+        matches!(self, Stream::Tls(_))
+    }
+
+    /// Certificate the client presented in the handshake, already verified
+    /// against the CAs of `client_auth`.
+    pub fn peer_certificate(&self) -> Option<&CertificateDer<'static>> {
+        match self {
+            Stream::Tls(stream) => stream.get_ref().1.peer_certificates()?.first(),
+            _ => None,
+        }
+    }
+
+    fn tcp(&self) -> io::Result<&TcpStream> {
+        match self {
+            Stream::Plain(stream) => Ok(stream),
+            Stream::Tls(stream) => Ok(stream.get_ref().0),
+            Stream::Closed => Err(io::ErrorKind::NotConnected.into()),
+        }
+    }
+
+    pub fn peer_addr(&self) -> io::Result<SocketAddr> {
+        self.tcp()?.peer_addr()
+    }
+
+    pub fn local_addr(&self) -> io::Result<SocketAddr> {
+        self.tcp()?.local_addr()
+    }
+}
+
+impl AsyncRead for Stream {
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        match self.get_mut() {
+            Stream::Plain(stream) => Pin::new(stream).poll_read(cx, buf),
+            Stream::Tls(stream) => Pin::new(stream).poll_read(cx, buf),
+            Stream::Closed => Poll::Ready(Err(io::ErrorKind::NotConnected.into())),
+        }
+    }
+}
+
+impl AsyncWrite for Stream {
+    fn poll_write(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        match self.get_mut() {
+            Stream::Plain(stream) => Pin::new(stream).poll_write(cx, buf),
+            Stream::Tls(stream) => Pin::new(stream).poll_write(cx, buf),
+            Stream::Closed => Poll::Ready(Err(io::ErrorKind::NotConnected.into())),
+        }
+    }
+
+    fn poll_flush(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        match self.get_mut() {
+            Stream::Plain(stream) => Pin::new(stream).poll_flush(cx),
+            Stream::Tls(stream) => Pin::new(stream).poll_flush(cx),
+            Stream::Closed => Poll::Ready(Err(io::ErrorKind::NotConnected.into())),
+        }
+    }
+
+    fn poll_shutdown(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        match self.get_mut() {
+            Stream::Plain(stream) => Pin::new(stream).poll_shutdown(cx),
+            Stream::Tls(stream) => Pin::new(stream).poll_shutdown(cx),
+            Stream::Closed => Poll::Ready(Ok(())),
+        }
+    }
+}
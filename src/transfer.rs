@@ -0,0 +1,556 @@
+//! Copying between files and data connections.
+
+use std::{
+    borrow::Cow,
+    collections::HashMap,
+    io,
+    path::PathBuf,
+    sync::{
+        Arc, Mutex,
+        atomic::{AtomicU64, Ordering},
+    },
+    time::{Duration, Instant},
+};
+
+use serde::Serialize;
+use tokio::{
+    fs::File,
+    io::{AsyncReadExt, AsyncWriteExt},
+    task::AbortHandle,
+    time,
+};
+
+use crate::{
+    disk::{self, SpaceThreshold},
+    history::Direction,
+    tls::Stream,
+};
+
+/// How many bytes are received between free space checks during upload.
+const SPACE_CHECK_INTERVAL: u64 = 8 * 1024 * 1024;
+/// The minimum download rate is not enforced before a transfer has been
+/// running for this long, so slow starts are tolerated.
+const MIN_RATE_GRACE: Duration = Duration::from_secs(10);
+/// Size of a single read in the fallback copy loop.
+const BUFFER_SIZE: usize = 64 * 1024;
+/// Smallest read when the rate is limited.
+const MIN_BUFFER_SIZE: usize = 1024;
+
+/// Why an upload was stopped before the client finished sending.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Stop {
+    OutOfSpace,
+    OverQuota,
+    OverTransferQuota,
+}
+
+/// State of a transfer that can be observed while it is running.
+#[derive(Debug)]
+pub struct Progress {
+    /// Real path of the file.
+    pub path: PathBuf,
+    pub direction: Direction,
+    /// Expected number of bytes, known for downloads.
+    pub size: Option<u64>,
+    transferred: Arc<AtomicU64>,
+    started: Instant,
+}
+
+impl Progress {
+    pub fn new(path: PathBuf, direction: Direction, size: Option<u64>) -> Self {
+        Progress {
+            path,
+            direction,
+            size,
+            transferred: Arc::new(AtomicU64::new(0)),
+            started: Instant::now(),
+        }
+    }
+
+    pub fn elapsed(&self) -> Duration {
+        self.started.elapsed()
+    }
+
+    pub fn transferred(&self) -> u64 {
+        self.transferred.load(Ordering::Relaxed)
+    }
+
+    /// Average rate since the start in bytes per second.
+    pub fn rate(&self) -> u64 {
+        let elapsed = self.started.elapsed().as_secs_f64();
+        if elapsed > 0.0 {
+            (self.transferred() as f64 / elapsed) as u64
+        } else {
+            0
+        }
+    }
+
+    /// Counter of the bytes, for work that counts them itself, like moves
+    /// across volumes.
+    pub fn counter(&self) -> Arc<AtomicU64> {
+        Arc::clone(&self.transferred)
+    }
+
+    fn set(&self, transferred: u64) {
+        self.transferred.store(transferred, Ordering::Relaxed);
+    }
+}
+
+/// Transfer as shown by the admin API.
+#[derive(Debug, Clone, Serialize)]
+pub struct TransferInfo {
+    pub session_id: String,
+    pub user: String,
+    pub path: String,
+    pub direction: Direction,
+    pub bytes: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub size: Option<u64>,
+    /// Average rate in bytes per second.
+    pub rate: u64,
+}
+
+#[derive(Debug)]
+struct RunningTransfer {
+    user: String,
+    progress: Arc<Progress>,
+    abort: AbortHandle,
+}
+
+/// Transfers running on the server, keyed by session. A session runs one
+/// transfer at a time.
+#[derive(Debug, Default)]
+pub struct TransferRegistry {
+    transfers: Mutex<HashMap<String, RunningTransfer>>,
+}
+
+impl TransferRegistry {
+    pub fn register(
+        &self,
+        session_id: &str,
+        user: &str,
+        progress: Arc<Progress>,
+        abort: AbortHandle,
+    ) {
+        if let Ok(mut transfers) = self.transfers.lock() {
+            transfers.insert(
+                session_id.to_string(),
+                RunningTransfer {
+                    user: user.to_string(),
+                    progress,
+                    abort,
+                },
+            );
+        }
+    }
+
+    pub fn remove(&self, session_id: &str) {
+        if let Ok(mut transfers) = self.transfers.lock() {
+            transfers.remove(session_id);
+        }
+    }
+
+    /// Returns running transfers sorted by session.
+    pub fn snapshot(&self) -> Vec<TransferInfo> {
+        let Ok(transfers) = self.transfers.lock() else {
+            return Vec::new();
+        };
+        let mut infos: Vec<TransferInfo> = transfers
+            .iter()
+            .map(|(session_id, transfer)| TransferInfo {
+                session_id: session_id.clone(),
+                user: transfer.user.clone(),
+                path: transfer.progress.path.to_string_lossy().to_string(),
+                direction: transfer.progress.direction,
+                bytes: transfer.progress.transferred(),
+                size: transfer.progress.size,
+                rate: transfer.progress.rate(),
+            })
+            .collect();
+        infos.sort_by(|a, b| a.session_id.cmp(&b.session_id));
+        infos
+    }
+
+    /// Stops the transfer of the session, which closes its data connection.
+    /// Returns false if the session has no transfer running.
+    pub fn abort(&self, session_id: &str) -> bool {
+        let Ok(transfers) = self.transfers.lock() else {
+            return false;
+        };
+        match transfers.get(session_id) {
+            Some(transfer) => {
+                transfer.abort.abort();
+                true
+            }
+            None => false,
+        }
+    }
+}
+
+/// How file data is represented on the data connection, set with TYPE.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum TransferType {
+    /// Lines end with CRLF on the data connection and with LF in files.
+    Ascii,
+    /// Files are sent as they are. Unlike in RFC 959 this is the default,
+    /// because clients that never send TYPE expect files unchanged.
+    #[default]
+    Binary,
+}
+
+impl TransferType {
+    /// Name of the type in replies.
+    pub fn name(self) -> &'static str {
+        match self {
+            TransferType::Ascii => "ASCII",
+            TransferType::Binary => "BINARY",
+        }
+    }
+}
+
+/// Converts bare LF line endings to CRLF for an ASCII download. `after_cr`
+/// tells if the previous chunk ended with CR and is updated for the next one.
+pub fn encode_ascii(chunk: &[u8], after_cr: &mut bool) -> Vec<u8> {
+    let mut encoded = Vec::with_capacity(chunk.len() + chunk.len() / 32);
+    for &byte in chunk {
+        if byte == b'\n' && !*after_cr {
+            encoded.push(b'\r');
+        }
+        encoded.push(byte);
+        *after_cr = byte == b'\r';
+    }
+    encoded
+}
+
+/// Converts CRLF line endings to LF for an ASCII upload. A CR at the end of
+/// the chunk is held back in `pending_cr` until the next chunk shows if LF
+/// follows it.
+pub fn decode_ascii(chunk: &[u8], pending_cr: &mut bool) -> Vec<u8> {
+    let mut decoded = Vec::with_capacity(chunk.len() + 1);
+    for &byte in chunk {
+        if std::mem::take(pending_cr) && byte != b'\n' {
+            decoded.push(b'\r');
+        }
+        if byte == b'\r' {
+            *pending_cr = true;
+        } else {
+            decoded.push(byte);
+        }
+    }
+    decoded
+}
+
+/// How a transfer is carried out.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct TransferSettings {
+    /// Copy with io_uring on Linux. Only used without a stall timeout,
+    /// rate limit and TLS, which the io_uring path does not support.
+    pub use_uring: bool,
+    /// The transfer fails when no data could be moved for this long.
+    pub stall_timeout: Option<Duration>,
+    /// Bytes per second.
+    pub max_rate: Option<u64>,
+    /// Writes fail when the average rate would drop below this many bytes
+    /// per second.
+    pub min_rate: Option<u64>,
+    pub transfer_type: TransferType,
+}
+
+impl TransferSettings {
+    #[cfg(target_os = "linux")]
+    fn uring(&self) -> bool {
+        self.use_uring
+            && self.stall_timeout.is_none()
+            && self.max_rate.is_none()
+            && self.min_rate.is_none()
+            && self.transfer_type == TransferType::Binary
+            && crate::uring::available()
+    }
+
+    /// Reads are about a tenth of a second worth of data when the rate is
+    /// limited, so that it is kept smoothly.
+    fn buffer_size(&self) -> usize {
+        match self.max_rate {
+            Some(rate) => (rate as usize / 10).clamp(MIN_BUFFER_SIZE, BUFFER_SIZE),
+            None => BUFFER_SIZE,
+        }
+    }
+
+    /// Lowers the rate limit to `rate` bytes per second.
+    pub fn limit_rate(&mut self, rate: u64) {
+        self.max_rate = Some(self.max_rate.map_or(rate, |max| max.min(rate)));
+    }
+
+    /// Runs an I/O operation, failing if it takes longer than the stall timeout.
+    async fn io<T>(&self, operation: impl Future<Output = io::Result<T>>) -> io::Result<T> {
+        match self.stall_timeout {
+            Some(timeout) => time::timeout(timeout, operation)
+                .await
+                .map_err(|_| io::Error::new(io::ErrorKind::TimedOut, "transfer stalled"))?,
+            None => operation.await,
+        }
+    }
+
+    /// Writes to the data connection of a transfer that started at `started`
+    /// and has written `written` bytes so far. Fails when the client does not
+    /// read the data before the stall timeout or fast enough to keep the
+    /// minimum rate.
+    pub async fn write(
+        &self,
+        data: &mut Stream,
+        buf: &[u8],
+        started: Instant,
+        written: u64,
+    ) -> io::Result<()> {
+        let stalled = self.stall_timeout.map(|timeout| Instant::now() + timeout);
+        let too_slow = self.min_rate.filter(|&r| r > 0).map(|rate| {
+            let due = Duration::from_secs_f64((written + buf.len() as u64) as f64 / rate as f64);
+            started + due.max(MIN_RATE_GRACE)
+        });
+        let Some(deadline) = stalled.into_iter().chain(too_slow).min() else {
+            return data.write_all(buf).await;
+        };
+        time::timeout_at(deadline.into(), data.write_all(buf))
+            .await
+            .map_err(|_| {
+                let reason = if Some(deadline) == too_slow {
+                    "client reads too slowly"
+                } else {
+                    "transfer stalled"
+                };
+                io::Error::new(io::ErrorKind::TimedOut, reason)
+            })?
+    }
+
+    /// Sleeps until the transfer is back under the rate limit.
+    async fn pace(&self, progress: &Progress) {
+        let Some(rate) = self.max_rate.filter(|&r| r > 0) else {
+            return;
+        };
+        let due = Duration::from_secs_f64(progress.transferred() as f64 / rate as f64);
+        if let Some(wait) = due.checked_sub(progress.started.elapsed()) {
+            time::sleep(wait).await;
+        }
+    }
+}
+
+/// Limits checked while an upload is in progress.
+#[derive(Debug, Clone)]
+pub struct UploadLimits {
+    /// File being written, used to find its volume.
+    pub path: PathBuf,
+    pub min_free_space: Option<SpaceThreshold>,
+    /// Bytes the user may still store.
+    pub quota_left: Option<u64>,
+    /// Bytes the user may still upload in the current transfer quota period.
+    pub transfer_left: Option<u64>,
+    since_check: u64,
+}
+
+impl UploadLimits {
+    pub fn new(
+        path: PathBuf,
+        min_free_space: Option<SpaceThreshold>,
+        quota_left: Option<u64>,
+        transfer_left: Option<u64>,
+    ) -> Self {
+        UploadLimits {
+            path,
+            min_free_space,
+            quota_left,
+            transfer_left,
+            since_check: 0,
+        }
+    }
+
+    /// Checks if a chunk may be written. `total` includes the chunk.
+    fn check(&mut self, total: u64, chunk: u64) -> Option<Stop> {
+        if self.quota_left.is_some_and(|left| total > left) {
+            return Some(Stop::OverQuota);
+        }
+        if self.transfer_left.is_some_and(|left| total > left) {
+            return Some(Stop::OverTransferQuota);
+        }
+
+        self.since_check += chunk;
+        if self.since_check >= SPACE_CHECK_INTERVAL {
+            self.since_check = 0;
+            if let Some(threshold) = self.min_free_space
+                && let Ok(space) = disk::disk_space(&self.path)
+                && !threshold.is_satisfied(&space)
+            {
+                return Some(Stop::OutOfSpace);
+            }
+        }
+        None
+    }
+}
+
+/// Shuts a data connection down when dropped. Copies with io_uring run on a
+/// blocking thread that aborting the transfer can not stop, so instead their
+/// pending reads and writes on the connection are made to fail.
+#[cfg(target_os = "linux")]
+struct ShutdownOnDrop(std::net::TcpStream);
+
+#[cfg(target_os = "linux")]
+impl Drop for ShutdownOnDrop {
+    fn drop(&mut self) {
+        let _ = self.0.shutdown(std::net::Shutdown::Both);
+    }
+}
+
+/// Sends the file from its current position. Returns the number of bytes sent.
+pub async fn send(
+    mut file: File,
+    mut data: Stream,
+    progress: Arc<Progress>,
+    settings: TransferSettings,
+) -> io::Result<u64> {
+    #[cfg(target_os = "linux")]
+    if settings.uring()
+        && let Stream::Plain(data) = data
+    {
+        use std::os::fd::AsRawFd;
+
+        let file = file.into_std().await;
+        let data = data.into_std()?;
+        data.set_nonblocking(false)?;
+        let _abort = ShutdownOnDrop(data.try_clone()?);
+        return tokio::task::spawn_blocking(move || {
+            let sent = crate::uring::copy(file.as_raw_fd(), data.as_raw_fd(), |total, _| {
+                progress.set(total);
+                true
+            })?;
+            let _ = data.shutdown(std::net::Shutdown::Write);
+            Ok(sent)
+        })
+        .await?;
+    }
+    let mut buf = vec![0u8; settings.buffer_size()];
+    let mut sent = 0u64;
+    let mut after_cr = false;
+    loop {
+        let n = file.read(&mut buf).await?;
+        if n == 0 {
+            break;
+        }
+        let chunk = match settings.transfer_type {
+            TransferType::Ascii => Cow::Owned(encode_ascii(&buf[..n], &mut after_cr)),
+            TransferType::Binary => Cow::Borrowed(&buf[..n]),
+        };
+        settings
+            .write(&mut data, &chunk, progress.started, sent)
+            .await?;
+        sent += n as u64;
+        progress.set(sent);
+        settings.pace(&progress).await;
+    }
+    let _ = data.shutdown().await;
+    Ok(sent)
+}
+
+/// Receives data into the file until the client closes the connection or a
+/// limit is reached. Returns the number of bytes written and why the upload
+/// was stopped early, if it was.
+pub async fn receive(
+    mut data: Stream,
+    mut file: File,
+    mut limits: UploadLimits,
+    progress: Arc<Progress>,
+    settings: TransferSettings,
+) -> io::Result<(u64, Option<Stop>)> {
+    #[cfg(target_os = "linux")]
+    if settings.uring()
+        && let Stream::Plain(data) = data
+    {
+        use std::os::fd::AsRawFd;
+
+        let file = file.into_std().await;
+        let data = data.into_std()?;
+        data.set_nonblocking(false)?;
+        let _abort = ShutdownOnDrop(data.try_clone()?);
+        return tokio::task::spawn_blocking(move || {
+            let mut stop = None;
+            let received =
+                crate::uring::copy(data.as_raw_fd(), file.as_raw_fd(), |total, chunk| {
+                    stop = limits.check(total, chunk);
+                    if stop.is_none() {
+                        progress.set(total);
+                    }
+                    stop.is_none()
+                })?;
+            let _ = data.shutdown(std::net::Shutdown::Both);
+            Ok((received, stop))
+        })
+        .await?;
+    }
+    let mut buf = vec![0u8; settings.buffer_size()];
+    let mut received = 0u64;
+    let mut stop = None;
+    let mut pending_cr = false;
+    loop {
+        let n = settings.io(data.read(&mut buf)).await?;
+        if n == 0 {
+            break;
+        }
+        let chunk = match settings.transfer_type {
+            TransferType::Ascii => Cow::Owned(decode_ascii(&buf[..n], &mut pending_cr)),
+            TransferType::Binary => Cow::Borrowed(&buf[..n]),
+        };
+        let len = chunk.len() as u64;
+        stop = limits.check(received + len, len);
+        if stop.is_some() {
+            break;
+        }
+        file.write_all(&chunk).await?;
+        received += len;
+        progress.set(received);
+        settings.pace(&progress).await;
+    }
+    // A CR at the very end has no LF after it.
+    if pending_cr && stop.is_none() {
+        file.write_all(b"\r").await?;
+        received += 1;
+    }
+    file.flush().await?;
+    let _ = data.shutdown().await;
+    Ok((received, stop))
+}
+
+#[cfg(all(test, target_os = "linux"))]
+mod tests {
+    use std::time::Duration;
+
+    use serde_json::json;
+    use tokio::{
+        io::{AsyncReadExt, AsyncWriteExt},
+        time,
+    };
+
+    use crate::ftptest::{TEST_PASSWORD, TEST_USER, TestServer};
+
+    #[tokio::test]
+    async fn abort_stops_io_uring_upload() {
+        if !crate::uring::available() {
+            return;
+        }
+        let config = serde_json::from_value(json!({
+            "users": [{"name": TEST_USER, "password": TEST_PASSWORD, "permissions": "All"}],
+            "io_uring": true,
+        }))
+        .unwrap();
+        let server = TestServer::with_config(config).await.unwrap();
+        let mut client = server.client().await.unwrap();
+        client.login(TEST_USER, TEST_PASSWORD).await.unwrap();
+
+        let mut data = client.passive().await.unwrap();
+        assert_eq!(client.command("STOR file").await.unwrap().code, 150);
+        data.write_all(b"partial").await.unwrap();
+        client.command("ABOR").await.unwrap();
+
+        // The server closes the data connection rather than keep reading.
+        let mut rest = Vec::new();
+        let closed = time::timeout(Duration::from_secs(5), data.read_to_end(&mut rest)).await;
+        assert!(closed.is_ok());
+    }
+}
@@ -0,0 +1,274 @@
+//! Persistent log of every transfer in an SQLite database.
+//!
+//! Unlike the session history, which keeps the latest sessions in memory and
+//! appends them to a text file, the transfer log can be queried by user,
+//! path and time through `dock log query` and the admin API.
+
+use std::{path::Path, sync::Mutex, time::Duration};
+
+use anyhow::{Result, anyhow};
+use rusqlite::{Connection, params, params_from_iter, types::Value};
+use serde::{Deserialize, Serialize};
+
+use crate::{
+    datetime::{DateTime, unix_now},
+    history::Direction,
+};
+
+const SCHEMA: &str = "
+    PRAGMA journal_mode = WAL;
+    CREATE TABLE IF NOT EXISTS transfers (
+        id INTEGER PRIMARY KEY,
+        finished_at INTEGER NOT NULL,
+        username TEXT NOT NULL,
+        path TEXT NOT NULL,
+        direction TEXT NOT NULL,
+        bytes INTEGER NOT NULL,
+        duration_ms INTEGER NOT NULL,
+        result TEXT NOT NULL,
+        ip TEXT NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS transfers_finished_at ON transfers (finished_at);
+    CREATE INDEX IF NOT EXISTS transfers_username ON transfers (username, finished_at);
+";
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct TransferLogConfig {
+    /// SQLite database transfers are written to. When chroot is enabled, the
+    /// path is resolved inside the root.
+    pub file: String,
+    /// Transfers older than this many days are deleted. Kept forever when
+    /// unset.
+    #[serde(default)]
+    pub retention_days: Option<u64>,
+}
+
+#[derive(Debug, Clone, Copy, Serialize, PartialEq, Eq)]
+#[serde(rename_all = "snake_case")]
+pub enum Outcome {
+    Completed,
+    /// The data connection or the file failed.
+    Failed,
+    /// Aborted by an administrator.
+    Aborted,
+    OutOfSpace,
+    OverQuota,
+}
+
+impl Outcome {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Outcome::Completed => "completed",
+            Outcome::Failed => "failed",
+            Outcome::Aborted => "aborted",
+            Outcome::OutOfSpace => "out_of_space",
+            Outcome::OverQuota => "over_quota",
+        }
+    }
+
+    fn parse(value: &str) -> Self {
+        match value {
+            "completed" => Outcome::Completed,
+            "aborted" => Outcome::Aborted,
+            "out_of_space" => Outcome::OutOfSpace,
+            "over_quota" => Outcome::OverQuota,
+            _ => Outcome::Failed,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct TransferEntry {
+    /// Unix timestamp of the end of the transfer.
+    pub finished_at: u64,
+    /// Account of the user, see [`crate::users::account_key`].
+    pub username: String,
+    /// Virtual path of the file.
+    pub path: String,
+    pub direction: Direction,
+    pub bytes: u64,
+    pub duration_ms: u64,
+    pub result: Outcome,
+    pub ip: String,
+}
+
+impl TransferEntry {
+    pub fn new(
+        username: &str,
+        path: &str,
+        direction: Direction,
+        bytes: u64,
+        duration: Duration,
+        result: Outcome,
+        ip: &str,
+    ) -> Self {
+        TransferEntry {
+            finished_at: unix_now(),
+            username: username.to_string(),
+            path: path.to_string(),
+            direction,
+            bytes,
+            duration_ms: duration.as_millis() as u64,
+            result,
+            ip: ip.to_string(),
+        }
+    }
+}
+
+/// Filters of a query. Empty filters match every transfer.
+#[derive(Debug, Clone, Default)]
+pub struct Query {
+    pub user: Option<String>,
+    /// Virtual path of a file, or of a directory to match everything in it.
+    pub path: Option<String>,
+    /// Unix timestamp transfers have finished at or after.
+    pub since: Option<u64>,
+    /// Unix timestamp transfers have finished before.
+    pub until: Option<u64>,
+    pub limit: usize,
+}
+
+/// Parses a time filter: a Unix timestamp, `YYYY-MM-DD` or
+/// `YYYY-MM-DD HH:MM:SS` in UTC.
+pub fn parse_time(value: &str) -> Option<u64> {
+    if let Ok(timestamp) = value.parse::<u64>() {
+        return Some(timestamp);
+    }
+    let time = DateTime::parse_readable(value)?;
+    u64::try_from(time.to_unix()).ok()
+}
+
+#[derive(Debug)]
+pub struct TransferLog {
+    connection: Mutex<Connection>,
+}
+
+impl TransferLog {
+    /// Opens the database and creates the table if it does not exist yet.
+    pub fn open(path: &Path) -> Result<Self> {
+        let connection = Connection::open(path)
+            .map_err(|e| anyhow!("failed to open transfer log {}: {e}", path.display()))?;
+        connection
+            .execute_batch(SCHEMA)
+            .map_err(|e| anyhow!("failed to prepare transfer log: {e}"))?;
+        Ok(TransferLog {
+            connection: Mutex::new(connection),
+        })
+    }
+
+    pub fn record(&self, entry: &TransferEntry) -> Result<()> {
+        let connection = self
+            .connection
+            .lock()
+            .map_err(|_| anyhow!("transfer log is poisoned"))?;
+        let direction = match entry.direction {
+            Direction::Upload => "upload",
+            Direction::Download => "download",
+            Direction::Move => "move",
+        };
+        connection.execute(
+            "INSERT INTO transfers (finished_at, username, path, direction, bytes, duration_ms, result, ip)
+             VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+            params![
+                entry.finished_at as i64,
+                entry.username,
+                entry.path,
+                direction,
+                entry.bytes as i64,
+                entry.duration_ms as i64,
+                entry.result.as_str(),
+                entry.ip,
+            ],
+        )?;
+        Ok(())
+    }
+
+    /// Returns transfers matching the query, newest first.
+    pub fn query(&self, query: &Query) -> Result<Vec<TransferEntry>> {
+        let mut conditions = Vec::new();
+        let mut values = Vec::new();
+        if let Some(user) = &query.user {
+            conditions.push("username = ?");
+            values.push(Value::Text(user.clone()));
+        }
+        if let Some(path) = &query.path {
+            let path = path.trim_end_matches('/');
+            if !path.is_empty() {
+                conditions.push("(path = ? OR substr(path, 1, length(?)) = ?)");
+                let dir = format!("{path}/");
+                values.push(Value::Text(path.to_string()));
+                values.push(Value::Text(dir.clone()));
+                values.push(Value::Text(dir));
+            }
+        }
+        if let Some(since) = query.since {
+            conditions.push("finished_at >= ?");
+            values.push(Value::Integer(since as i64));
+        }
+        if let Some(until) = query.until {
+            conditions.push("finished_at < ?");
+            values.push(Value::Integer(until as i64));
+        }
+        values.push(Value::Integer(query.limit as i64));
+
+        let filter = if conditions.is_empty() {
+            String::new()
+        } else {
+            format!("WHERE {}", conditions.join(" AND "))
+        };
+        let sql = format!(
+            "SELECT finished_at, username, path, direction, bytes, duration_ms, result, ip
+             FROM transfers {filter} ORDER BY finished_at DESC, id DESC LIMIT ?"
+        );
+
+        let connection = self
+            .connection
+            .lock()
+            .map_err(|_| anyhow!("transfer log is poisoned"))?;
+        let mut statement = connection.prepare(&sql)?;
+        let rows = statement.query_map(params_from_iter(values), |row| {
+            let direction: String = row.get(3)?;
+            let result: String = row.get(6)?;
+            Ok(TransferEntry {
+                finished_at: row.get::<_, i64>(0)? as u64,
+                username: row.get(1)?,
+                path: row.get(2)?,
+                direction: match direction.as_str() {
+                    "upload" => Direction::Upload,
+                    "move" => Direction::Move,
+                    _ => Direction::Download,
+                },
+                bytes: row.get::<_, i64>(4)? as u64,
+                duration_ms: row.get::<_, i64>(5)? as u64,
+                result: Outcome::parse(&result),
+                ip: row.get(7)?,
+            })
+        })?;
+        Ok(rows.collect::<Result<_, _>>()?)
+    }
+
+    /// Deletes transfers that finished more than `days` days ago.
+    pub fn expire(&self, days: u64) -> Result<usize> {
+        let oldest = unix_now().saturating_sub(days * 86400);
+        let connection = self
+            .connection
+            .lock()
+            .map_err(|_| anyhow!("transfer log is poisoned"))?;
+        Ok(connection.execute(
+            "DELETE FROM transfers WHERE finished_at < ?",
+            params![oldest as i64],
+        )?)
+    }
+}
+
+/// Runs the query against every log, e.g. of several tenants, and returns
+/// the newest transfers of all of them.
+pub fn query_all(logs: &[&TransferLog], query: &Query) -> Result<Vec<TransferEntry>> {
+    let mut entries = Vec::new();
+    for log in logs {
+        entries.extend(log.query(query)?);
+    }
+    entries.sort_by(|a, b| b.finished_at.cmp(&a.finished_at));
+    entries.truncate(query.limit);
+    Ok(entries)
+}
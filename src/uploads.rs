@@ -0,0 +1,181 @@
+//! Incomplete uploads that can be resumed, even after a restart.
+//!
+//! While resuming is enabled, uploads are written to a hidden temporary file
+//! next to the target, which replaces the target once the upload completes.
+//! A client that lost the connection can ask for the SIZE of the target, which
+//! reports what was received so far, and continue with REST and STOR.
+
+use std::{
+    fs,
+    path::PathBuf,
+    sync::{
+        Mutex,
+        atomic::{AtomicBool, Ordering},
+    },
+};
+
+use anyhow::{Result, anyhow};
+use serde::{Deserialize, Serialize};
+
+use crate::datetime::unix_now;
+
+/// Suffix of temporary files, which are hidden from listings.
+const TEMP_SUFFIX: &str = ".dock-upload";
+
+fn default_expire_secs() -> u64 {
+    86400
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct ResumeConfig {
+    /// File where incomplete uploads are persisted. When chroot is enabled,
+    /// the path is resolved inside the root.
+    #[serde(default)]
+    pub file: Option<String>,
+    /// Incomplete uploads that were not continued for this many seconds are
+    /// deleted.
+    #[serde(default = "default_expire_secs")]
+    pub expire_secs: u64,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+pub struct PartialUpload {
+    /// Account that started the upload.
+    pub owner: String,
+    /// Virtual path the file is uploaded to.
+    pub path: String,
+    /// Real path of the target.
+    pub target: PathBuf,
+    /// Real path of the temporary file with the data received so far.
+    pub temp_file: PathBuf,
+    pub received: u64,
+    /// Unix timestamp of the last upload to the file.
+    pub updated: u64,
+}
+
+impl PartialUpload {
+    pub fn new(owner: &str, path: &str, target: PathBuf) -> Self {
+        let name = target
+            .file_name()
+            .map(|n| n.to_string_lossy().to_string())
+            .unwrap_or_default();
+        let temp_file = target.with_file_name(format!(".{name}.{}{TEMP_SUFFIX}", cuid2::cuid()));
+        PartialUpload {
+            owner: owner.to_string(),
+            path: path.to_string(),
+            target,
+            temp_file,
+            received: 0,
+            updated: unix_now(),
+        }
+    }
+}
+
+/// Checks if the file name belongs to a temporary upload file.
+pub fn is_temp_name(name: &str) -> bool {
+    name.starts_with('.') && name.ends_with(TEMP_SUFFIX)
+}
+
+/// Incomplete uploads, optionally persisted to a JSON file.
+#[derive(Debug, Default)]
+pub struct UploadStore {
+    path: Option<PathBuf>,
+    uploads: Mutex<Vec<PartialUpload>>,
+    dirty: AtomicBool,
+}
+
+impl UploadStore {
+    /// Loads uploads from the file, or starts empty if it does not exist yet.
+    pub fn load(path: Option<PathBuf>) -> Result<Self> {
+        let uploads = match &path {
+            Some(p) if p.exists() => {
+                let content = fs::read_to_string(p)
+                    .map_err(|_| anyhow!("failed to read incomplete uploads file"))?;
+                serde_json::from_str(&content)
+                    .map_err(|e| anyhow!("bad incomplete uploads format: {e}"))?
+            }
+            _ => Vec::new(),
+        };
+
+        Ok(UploadStore {
+            path,
+            uploads: Mutex::new(uploads),
+            dirty: AtomicBool::new(false),
+        })
+    }
+
+    /// Returns the incomplete upload of the owner to the virtual path. Uploads
+    /// whose temporary file is gone are forgotten.
+    pub fn get(&self, owner: &str, path: &str) -> Option<PartialUpload> {
+        let mut uploads = self.uploads.lock().ok()?;
+        let index = uploads
+            .iter()
+            .position(|u| u.owner == owner && u.path == path)?;
+        if !uploads[index].temp_file.exists() {
+            uploads.remove(index);
+            self.dirty.store(true, Ordering::Relaxed);
+            return None;
+        }
+        Some(uploads[index].clone())
+    }
+
+    /// Adds the upload or replaces the one of the same owner and path.
+    pub fn put(&self, upload: PartialUpload) {
+        if let Ok(mut uploads) = self.uploads.lock() {
+            uploads.retain(|u| u.owner != upload.owner || u.path != upload.path);
+            uploads.push(upload);
+            self.dirty.store(true, Ordering::Relaxed);
+        }
+    }
+
+    pub fn remove(&self, owner: &str, path: &str) {
+        if let Ok(mut uploads) = self.uploads.lock() {
+            uploads.retain(|u| u.owner != owner || u.path != path);
+            self.dirty.store(true, Ordering::Relaxed);
+        }
+    }
+
+    /// Deletes uploads that were not continued for `max_age` seconds together
+    /// with their temporary files.
+    pub fn expire(&self, max_age: u64) -> usize {
+        let Ok(mut uploads) = self.uploads.lock() else {
+            return 0;
+        };
+        let oldest = unix_now().saturating_sub(max_age);
+        let before = uploads.len();
+        uploads.retain(|u| {
+            if u.updated >= oldest {
+                return true;
+            }
+            let _ = fs::remove_file(&u.temp_file);
+            false
+        });
+        let expired = before - uploads.len();
+        if expired > 0 {
+            self.dirty.store(true, Ordering::Relaxed);
+        }
+        expired
+    }
+
+    /// Writes uploads to the file if anything has changed since the last save.
+    pub fn save(&self) -> Result<()> {
+        let Some(path) = &self.path else {
+            return Ok(());
+        };
+        if !self.dirty.swap(false, Ordering::Relaxed) {
+            return Ok(());
+        }
+
+        let content = match self.uploads.lock() {
+            Ok(uploads) => serde_json::to_string_pretty(&*uploads)?,
+            Err(_) => return Ok(()),
+        };
+        let temp_path = path.with_extension("tmp");
+        fs::write(&temp_path, content)
+            .and_then(|_| fs::rename(&temp_path, path))
+            .map_err(|e| {
+                self.dirty.store(true, Ordering::Relaxed);
+                anyhow!("failed to save incomplete uploads: {e}")
+            })
+    }
+}
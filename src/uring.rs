@@ -0,0 +1,116 @@
+//! Data copying with io_uring.
+//!
+//! Every write of a chunk is submitted together with the read of the next
+//! one, so a transfer needs about half of the system calls of a plain
+//! read/write loop.
+
+use std::{io, os::fd::RawFd, sync::OnceLock};
+
+use io_uring::{IoUring, opcode, squeue, types};
+
+/// Size of a single read or write.
+const CHUNK_SIZE: usize = 256 * 1024;
+/// Offset that makes io_uring use and update the file position.
+const CURRENT_POSITION: u64 = u64::MAX;
+
+const READ: u64 = 0;
+const WRITE: u64 = 1;
+
+/// Checks once if the kernel allows to create a ring.
+pub fn available() -> bool {
+    static AVAILABLE: OnceLock<bool> = OnceLock::new();
+    *AVAILABLE.get_or_init(|| IoUring::new(2).is_ok())
+}
+
+/// Copies everything from `src` to `dst`, which must be blocking descriptors.
+///
+/// `proceed` is called before every chunk is written with the total size
+/// including this chunk and the size of the chunk. Copying stops when it
+/// returns `false`. Returns the number of bytes written.
+pub fn copy<F>(src: RawFd, dst: RawFd, mut proceed: F) -> io::Result<u64>
+where
+    F: FnMut(u64, u64) -> bool,
+{
+    let mut ring = IoUring::new(2)?;
+    let mut buffers = [vec![0u8; CHUNK_SIZE], vec![0u8; CHUNK_SIZE]];
+    let mut current = 0;
+    let mut total = 0u64;
+
+    let read = read_entry(src, &mut buffers[current]);
+    let mut pending = submit(&mut ring, &[read])?[0];
+
+    while pending > 0 {
+        if !proceed(total + pending as u64, pending as u64) {
+            break;
+        }
+
+        let (left, right) = buffers.split_at_mut(1);
+        let (out, next) = if current == 0 {
+            (&left[0], &mut right[0])
+        } else {
+            (&right[0], &mut left[0])
+        };
+        let results = submit(
+            &mut ring,
+            &[write_entry(dst, &out[..pending]), read_entry(src, next)],
+        )?;
+        let (written, read) = (results[WRITE as usize], results[READ as usize]);
+        write_remaining(&mut ring, dst, &out[written..pending])?;
+
+        total += pending as u64;
+        pending = read;
+        current = 1 - current;
+    }
+
+    Ok(total)
+}
+
+fn read_entry(fd: RawFd, buf: &mut [u8]) -> squeue::Entry {
+    opcode::Read::new(types::Fd(fd), buf.as_mut_ptr(), buf.len() as u32)
+        .offset(CURRENT_POSITION)
+        .build()
+        .user_data(READ)
+}
+
+fn write_entry(fd: RawFd, buf: &[u8]) -> squeue::Entry {
+    opcode::Write::new(types::Fd(fd), buf.as_ptr(), buf.len() as u32)
+        .offset(CURRENT_POSITION)
+        .build()
+        .user_data(WRITE)
+}
+
+/// Finishes a short write.
+fn write_remaining(ring: &mut IoUring, fd: RawFd, mut buf: &[u8]) -> io::Result<()> {
+    while !buf.is_empty() {
+        let written = submit(ring, &[write_entry(fd, buf)])?[WRITE as usize];
+        if written == 0 {
+            return Err(io::ErrorKind::WriteZero.into());
+        }
+        buf = &buf[written..];
+    }
+    Ok(())
+}
+
+/// Submits entries and waits for all of them. Results are indexed by user data.
+fn submit(ring: &mut IoUring, entries: &[squeue::Entry]) -> io::Result<[usize; 2]> {
+    for entry in entries {
+        // SAFETY: buffers referenced by the entries outlive this call, which
+        // waits for every submitted entry to complete.
+        unsafe { ring.submission().push(entry) }
+            .map_err(|_| io::Error::other("io_uring submission queue is full"))?;
+    }
+    ring.submit_and_wait(entries.len())?;
+
+    let mut results = [0usize; 2];
+    let mut error = None;
+    for completion in ring.completion() {
+        match usize::try_from(completion.result()) {
+            Ok(n) => results[completion.user_data() as usize] = n,
+            Err(_) => error = Some(io::Error::from_raw_os_error(-completion.result())),
+        }
+    }
+    match error {
+        Some(e) => Err(e),
+        None => Ok(results),
+    }
+}
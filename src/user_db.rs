@@ -0,0 +1,133 @@
+//! Users from an SQLite database, for user bases too large to keep in the
+//! config or the users file.
+//!
+//! A configurable query looks the user up at login. Unless `auth_backends`
+//! says otherwise, users of the config and the users file take precedence
+//! over it.
+
+use std::{
+    path::Path,
+    sync::{Arc, Mutex},
+};
+
+use anyhow::{Result, anyhow, bail};
+use rusqlite::{Connection, params};
+use serde::Deserialize;
+
+use crate::{
+    config::{Permissions, User},
+    limits::Limits,
+};
+
+fn default_query() -> String {
+    String::from("SELECT password, root, permissions, quota FROM users WHERE name = ?")
+}
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct UserDbConfig {
+    /// SQLite database with the users. When chroot is enabled, the path is
+    /// resolved inside the root.
+    pub file: String,
+    /// Query that gets the user name as its only parameter and returns the
+    /// password hash, the root, the permissions (`read`, `write` or `all`)
+    /// and the quota in bytes, in this order. All but the password may be
+    /// NULL.
+    #[serde(default = "default_query")]
+    pub query: String,
+    /// Permissions of users whose permissions are NULL.
+    pub permissions: Permissions,
+    /// Root of users whose root is NULL, see [`crate::users::expand_root`].
+    /// Defaults to the root of the server.
+    #[serde(default)]
+    pub root: Option<String>,
+    /// Group whose limits apply to the users.
+    #[serde(default)]
+    pub group: Option<String>,
+}
+
+fn parse_permissions(value: &str) -> Option<Permissions> {
+    match value.to_ascii_lowercase().as_str() {
+        "read" => Some(Permissions::Read),
+        "write" => Some(Permissions::Write),
+        "all" => Some(Permissions::All),
+        _ => None,
+    }
+}
+
+#[derive(Debug)]
+pub struct UserDb {
+    config: UserDbConfig,
+    connection: Arc<Mutex<Connection>>,
+}
+
+impl UserDb {
+    /// Opens the database and checks that the query is valid.
+    pub fn open(config: &UserDbConfig, path: &Path) -> Result<Self> {
+        let connection = Connection::open(path)
+            .map_err(|e| anyhow!("failed to open user database {}: {e}", path.display()))?;
+        connection
+            .prepare(&config.query)
+            .map_err(|e| anyhow!("bad user database query: {e}"))?;
+        Ok(UserDb {
+            config: config.clone(),
+            connection: Arc::new(Mutex::new(connection)),
+        })
+    }
+
+    /// Looks a user up. The query blocks, so it runs on a blocking thread.
+    pub async fn find(&self, username: &str) -> Result<Option<User>> {
+        let config = self.config.clone();
+        let connection = Arc::clone(&self.connection);
+        let username = username.to_string();
+        tokio::task::spawn_blocking(move || query_user(&config, &connection, &username)).await?
+    }
+}
+
+/// Runs the query for a user.
+fn query_user(
+    config: &UserDbConfig,
+    connection: &Mutex<Connection>,
+    username: &str,
+) -> Result<Option<User>> {
+    let connection = connection
+        .lock()
+        .map_err(|_| anyhow!("user database is poisoned"))?;
+    let mut statement = connection.prepare(&config.query)?;
+    let rows = statement.query_map(params![username], |row| {
+        Ok((
+            row.get::<_, String>(0)?,
+            row.get::<_, Option<String>>(1)?,
+            row.get::<_, Option<String>>(2)?,
+            row.get::<_, Option<i64>>(3)?,
+        ))
+    })?;
+    let mut rows = rows.collect::<Result<Vec<_>, _>>()?;
+    if rows.len() > 1 {
+        bail!("query found more than one user {username}");
+    }
+    let Some((password, root, permissions, quota)) = rows.pop() else {
+        return Ok(None);
+    };
+
+    let permissions = match permissions {
+        Some(value) => parse_permissions(&value)
+            .ok_or_else(|| anyhow!("user {username} has unknown permissions {value}"))?,
+        None => config.permissions.clone(),
+    };
+    Ok(Some(User {
+        name: username.to_string(),
+        password,
+        permissions,
+        countries: None,
+        hostnames: None,
+        client_certificates: Vec::new(),
+        root: root.or_else(|| config.root.clone()),
+        quota: quota.and_then(|quota| u64::try_from(quota).ok()),
+        file_quota: None,
+        transfer_quota: None,
+        enabled: true,
+        expires_at: None,
+        group: config.group.clone(),
+        limits: Limits::default(),
+    }))
+}
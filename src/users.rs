@@ -0,0 +1,467 @@
+//! Users that can be changed at runtime.
+
+#[cfg(unix)]
+use std::os::unix::fs::{OpenOptionsExt, PermissionsExt};
+use std::{
+    collections::{BTreeMap, HashMap, HashSet},
+    fs::{self, OpenOptions},
+    io::Write,
+    path::{Path, PathBuf},
+    sync::{Mutex, RwLock},
+};
+
+use anyhow::{Result, anyhow, bail};
+use serde::Deserialize;
+use thiserror::Error;
+
+use crate::{
+    config::{Config, Permissions, User},
+    datetime::DateTime,
+    htpasswd::{Htpasswd, HtpasswdConfig},
+    limits::{Limits, TransferQuota},
+};
+
+/// Key that identifies the user across tenants.
+pub fn account_key(tenant: Option<&str>, username: &str) -> String {
+    match tenant {
+        Some(tenant) => format!("{tenant}/{username}"),
+        None => username.to_string(),
+    }
+}
+
+/// Tenant of an account, see [`account_key`].
+pub fn account_tenant(key: &str) -> Option<&str> {
+    key.split_once('/').map(|(tenant, _)| tenant)
+}
+
+/// Checks that a user name clients sent can be a single path component.
+fn is_path_component(name: &str) -> bool {
+    !name.is_empty() && name != "." && !name.contains(['/', '\\', '\0']) && !name.contains("..")
+}
+
+/// Expands a root template at login: `%u` is the user name, `%Y`, `%m` and
+/// `%d` are the current date in UTC and `%%` is a percent sign. Other
+/// sequences are kept as they are. Fails for `%u` when the user name would
+/// lead out of the directory, e.g. with `/` or `..`.
+pub fn expand_root(template: &str, username: &str, now: DateTime) -> Result<String> {
+    let mut root = String::with_capacity(template.len());
+    let mut chars = template.chars();
+    while let Some(c) = chars.next() {
+        if c != '%' {
+            root.push(c);
+            continue;
+        }
+        match chars.next() {
+            Some('u') if is_path_component(username) => root.push_str(username),
+            Some('u') => bail!("user name {username:?} can not be used in a path"),
+            Some('Y') => root.push_str(&format!("{:04}", now.year)),
+            Some('m') => root.push_str(&format!("{:02}", now.month)),
+            Some('d') => root.push_str(&format!("{:02}", now.day)),
+            Some('%') => root.push('%'),
+            Some(other) => {
+                root.push('%');
+                root.push(other);
+            }
+            None => root.push('%'),
+        }
+    }
+    Ok(root)
+}
+
+/// Directory every root a template expands to is in: the part before the
+/// first `%`, cut back to a whole directory.
+pub fn root_base(template: &str) -> &Path {
+    let Some(percent) = template.find('%') else {
+        return Path::new(template);
+    };
+    match template[..percent].rfind('/') {
+        Some(0) => Path::new("/"),
+        Some(slash) => Path::new(&template[..slash]),
+        None => Path::new("."),
+    }
+}
+
+/// Changes applied to an existing user. Missing fields are left as is.
+#[derive(Debug, Deserialize, Default)]
+#[serde(deny_unknown_fields)]
+pub struct UserUpdate {
+    pub password: Option<String>,
+    pub permissions: Option<Permissions>,
+    pub root: Option<String>,
+    pub quota: Option<u64>,
+    pub file_quota: Option<u64>,
+    pub transfer_quota: Option<TransferQuota>,
+    pub enabled: Option<bool>,
+    pub expires_at: Option<DateTime>,
+    pub group: Option<String>,
+    pub limits: Option<Limits>,
+}
+
+impl UserUpdate {
+    fn apply(self, user: &mut User) {
+        if let Some(password) = self.password {
+            user.password = password;
+        }
+        if let Some(permissions) = self.permissions {
+            user.permissions = permissions;
+        }
+        if let Some(root) = self.root {
+            user.root = Some(root);
+        }
+        if let Some(quota) = self.quota {
+            user.quota = Some(quota);
+        }
+        if let Some(file_quota) = self.file_quota {
+            user.file_quota = Some(file_quota);
+        }
+        if let Some(transfer_quota) = self.transfer_quota {
+            user.transfer_quota = Some(transfer_quota);
+        }
+        if let Some(enabled) = self.enabled {
+            user.enabled = enabled;
+        }
+        if let Some(expires_at) = self.expires_at {
+            user.expires_at = Some(expires_at);
+        }
+        if let Some(group) = self.group {
+            user.group = Some(group);
+        }
+        if let Some(limits) = self.limits {
+            user.limits = limits;
+        }
+    }
+}
+
+#[derive(Debug, Error)]
+pub enum UserStoreError {
+    #[error("user already exists")]
+    AlreadyExists,
+    #[error("user not found")]
+    NotFound,
+    #[error("unknown tenant")]
+    UnknownTenant,
+    #[error("{0}")]
+    Persist(String),
+}
+
+/// Outcome of [`UserStore::import`].
+#[derive(Debug, Default)]
+pub struct ImportSummary {
+    pub created: usize,
+    pub replaced: usize,
+    pub skipped: usize,
+}
+
+/// Users of all instances keyed by account, see [`account_key`].
+#[derive(Debug, Default)]
+pub struct UserStore {
+    /// File changes are written to. Users in it override the config.
+    path: Option<PathBuf>,
+    tenants: Vec<String>,
+    users: RwLock<HashMap<String, User>>,
+    /// Accounts written to the users file: the ones read from it and the
+    /// ones changed at runtime. Users of the config stay out of it until
+    /// they are changed, so their passwords are not copied there.
+    persisted: Mutex<HashSet<String>>,
+    /// One per htpasswd file, with the tenants that use it.
+    htpasswd: Vec<Htpasswd>,
+}
+
+impl UserStore {
+    /// Collects users from the config and the users file, if it exists.
+    pub fn load(config: &Config) -> Result<Self> {
+        let mut users = HashMap::new();
+        for instance in config.instances() {
+            for user in &instance.users {
+                users.insert(instance.account_key(&user.name), user.clone());
+            }
+        }
+
+        let path = config.users_file.as_ref().map(PathBuf::from);
+        let mut persisted = HashSet::new();
+        if let Some(path) = &path
+            && path.exists()
+        {
+            let content =
+                fs::read_to_string(path).map_err(|e| anyhow!("failed to read users file: {e}"))?;
+            let stored: HashMap<String, User> = serde_json::from_str(&content)
+                .map_err(|e| anyhow!("bad users file format: {e}"))?;
+            persisted.extend(stored.keys().cloned());
+            users.extend(stored);
+        }
+
+        // Tenants that name the same file share its users.
+        let mut files: Vec<(HtpasswdConfig, Vec<Option<String>>)> = Vec::new();
+        for instance in config.instances() {
+            let Some(htpasswd) = instance.htpasswd else {
+                continue;
+            };
+            match files.iter_mut().find(|(c, _)| c.file == htpasswd.file) {
+                Some((_, tenants)) => tenants.push(instance.tenant),
+                None => files.push((htpasswd, vec![instance.tenant])),
+            }
+        }
+        let htpasswd = files
+            .into_iter()
+            .map(|(htpasswd, tenants)| Htpasswd::load(&htpasswd, tenants))
+            .collect::<Result<_>>()?;
+
+        Ok(UserStore {
+            path,
+            tenants: config.tenants.iter().map(|t| t.name.clone()).collect(),
+            users: RwLock::new(users),
+            persisted: Mutex::new(persisted),
+            htpasswd,
+        })
+    }
+
+    pub fn get(&self, key: &str) -> Option<User> {
+        self.get_stored(key)
+            .or_else(|| self.htpasswd.iter().find_map(|h| h.get(key)))
+    }
+
+    /// User of the config or the users file, without the htpasswd file.
+    pub fn get_stored(&self, key: &str) -> Option<User> {
+        self.users
+            .read()
+            .ok()
+            .and_then(|users| users.get(key).cloned())
+    }
+
+    /// Users of the htpasswd files, which are not part of the store itself.
+    pub fn htpasswd(&self) -> &[Htpasswd] {
+        &self.htpasswd
+    }
+
+    /// Returns all users sorted by account.
+    pub fn snapshot(&self) -> BTreeMap<String, User> {
+        self.users
+            .read()
+            .map(|users| users.clone().into_iter().collect())
+            .unwrap_or_default()
+    }
+
+    /// Checks that users can be added to the tenant, or outside of tenants
+    /// when none are defined.
+    fn check_tenant(&self, tenant: Option<&str>) -> Result<(), UserStoreError> {
+        match tenant {
+            Some(tenant) if !self.tenants.iter().any(|t| t == tenant) => {
+                Err(UserStoreError::UnknownTenant)
+            }
+            None if !self.tenants.is_empty() => Err(UserStoreError::UnknownTenant),
+            _ => Ok(()),
+        }
+    }
+
+    /// Returns the users of the tenant sorted by name.
+    pub fn tenant_users(&self, tenant: Option<&str>) -> Result<Vec<User>, UserStoreError> {
+        self.check_tenant(tenant)?;
+        Ok(self
+            .snapshot()
+            .into_iter()
+            .filter(|(key, user)| *key == account_key(tenant, &user.name))
+            .map(|(_, user)| user)
+            .collect())
+    }
+
+    /// Adds a new user and returns its account key.
+    pub fn create(&self, tenant: Option<&str>, user: User) -> Result<String, UserStoreError> {
+        self.check_tenant(tenant)?;
+
+        let key = account_key(tenant, &user.name);
+        self.modify(|users| {
+            if users.contains_key(&key) {
+                return Err(UserStoreError::AlreadyExists);
+            }
+            users.insert(key.clone(), user);
+            Ok(vec![key.clone()])
+        })?;
+        Ok(key)
+    }
+
+    /// Adds many users with a single write of the users file. Existing users
+    /// are replaced if `replace` is set and kept otherwise.
+    pub fn import(
+        &self,
+        tenant: Option<&str>,
+        imported: Vec<User>,
+        replace: bool,
+    ) -> Result<ImportSummary, UserStoreError> {
+        self.check_tenant(tenant)?;
+
+        let mut summary = ImportSummary::default();
+        self.modify(|users| {
+            let mut changed = Vec::new();
+            for user in imported {
+                let key = account_key(tenant, &user.name);
+                if !users.contains_key(&key) {
+                    summary.created += 1;
+                } else if replace {
+                    summary.replaced += 1;
+                } else {
+                    summary.skipped += 1;
+                    continue;
+                }
+                users.insert(key.clone(), user);
+                changed.push(key);
+            }
+            Ok(changed)
+        })?;
+        Ok(summary)
+    }
+
+    /// Applies changes to an existing user and returns the updated user.
+    pub fn update(&self, key: &str, update: UserUpdate) -> Result<User, UserStoreError> {
+        let mut updated = None;
+        self.modify(|users| {
+            let user = users.get_mut(key).ok_or(UserStoreError::NotFound)?;
+            update.apply(user);
+            updated = Some(user.clone());
+            Ok(vec![key.to_string()])
+        })?;
+        updated.ok_or(UserStoreError::NotFound)
+    }
+
+    /// Changes users under the lock and writes the ones of the users file
+    /// to it. The change returns the accounts it touched.
+    fn modify<F>(&self, change: F) -> Result<(), UserStoreError>
+    where
+        F: FnOnce(&mut HashMap<String, User>) -> Result<Vec<String>, UserStoreError>,
+    {
+        let poisoned = || UserStoreError::Persist(String::from("user store is poisoned"));
+        let mut users = self.users.write().map_err(|_| poisoned())?;
+        let changed = change(&mut users)?;
+
+        let Some(path) = &self.path else {
+            return Ok(());
+        };
+        let mut persisted = self.persisted.lock().map_err(|_| poisoned())?;
+        persisted.extend(changed);
+        let sorted: BTreeMap<_, _> = users
+            .iter()
+            .filter(|(key, _)| persisted.contains(*key))
+            .collect();
+        let content = serde_json::to_string_pretty(&sorted)
+            .map_err(|e| UserStoreError::Persist(e.to_string()))?;
+        let tmp = path.with_extension("tmp");
+        write_private(&tmp, content.as_bytes())
+            .and_then(|_| fs::rename(&tmp, path))
+            .map_err(|e| UserStoreError::Persist(format!("change is applied but not saved: {e}")))
+    }
+}
+
+/// Writes a file only its owner can read, as it holds password hashes.
+fn write_private(path: &Path, content: &[u8]) -> std::io::Result<()> {
+    let mut options = OpenOptions::new();
+    options.write(true).create(true).truncate(true);
+    #[cfg(unix)]
+    options.mode(0o600);
+    let mut file = options.open(path)?;
+    // A file left by an earlier write keeps its mode.
+    #[cfg(unix)]
+    file.set_permissions(fs::Permissions::from_mode(0o600))?;
+    file.write_all(content)?;
+    file.sync_all()
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::json;
+
+    use super::*;
+
+    #[test]
+    fn users_file_only_holds_changed_users() {
+        let dir = std::env::temp_dir().join(format!("dock-users-{}", cuid2::cuid()));
+        fs::create_dir_all(&dir).unwrap();
+        let path = dir.join("users.json");
+        let config: Config = serde_json::from_value(json!({
+            "users": [
+                {"name": "alice", "password": "plain", "permissions": "All"},
+                {"name": "bob", "password": "plain", "permissions": "Read"},
+            ],
+            "users_file": path.to_string_lossy(),
+        }))
+        .unwrap();
+        let store = UserStore::load(&config).unwrap();
+
+        let update = UserUpdate {
+            enabled: Some(false),
+            ..UserUpdate::default()
+        };
+        store.update("bob", update).unwrap();
+
+        let content = fs::read_to_string(&path).unwrap();
+        let stored: HashMap<String, User> = serde_json::from_str(&content).unwrap();
+        assert_eq!(stored.keys().collect::<Vec<_>>(), ["bob"]);
+        #[cfg(unix)]
+        assert_eq!(
+            fs::metadata(&path).unwrap().permissions().mode() & 0o777,
+            0o600
+        );
+
+        // Users read back from the file stay in it.
+        let store = UserStore::load(&config).unwrap();
+        store.update("alice", UserUpdate::default()).unwrap();
+        let content = fs::read_to_string(&path).unwrap();
+        let stored: HashMap<String, User> = serde_json::from_str(&content).unwrap();
+        assert_eq!(stored.len(), 2);
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn root_base_stops_before_the_first_sequence() {
+        assert_eq!(root_base("/srv/ftp/%u"), Path::new("/srv/ftp"));
+        assert_eq!(root_base("/srv/ftp/%u/%Y"), Path::new("/srv/ftp"));
+        assert_eq!(root_base("/srv/ftp/home-%u"), Path::new("/srv/ftp"));
+        assert_eq!(root_base("/%u"), Path::new("/"));
+        assert_eq!(root_base("%u"), Path::new("."));
+        assert_eq!(root_base("/srv/shared"), Path::new("/srv/shared"));
+    }
+
+    #[test]
+    fn expand_root_rejects_names_leaving_the_directory() {
+        let now = DateTime::from_unix(0);
+        assert_eq!(
+            expand_root("/srv/ftp/%u/%Y", "alice", now).unwrap(),
+            "/srv/ftp/alice/1970"
+        );
+        for name in ["", ".", "..", "../bob", "a/b", "a\\b", "a\0b", "x..y"] {
+            assert!(expand_root("/srv/ftp/%u", name, now).is_err(), "{name:?}");
+        }
+        // Names only matter where they are put into the path.
+        assert_eq!(
+            expand_root("/srv/shared", "a/b", now).unwrap(),
+            "/srv/shared"
+        );
+    }
+
+    #[test]
+    fn tenants_only_see_users_of_their_htpasswd_file() {
+        let dir = std::env::temp_dir().join(format!("dock-htpasswd-{}", cuid2::cuid()));
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(dir.join("shared"), "alice:plain\n").unwrap();
+        fs::write(dir.join("own"), "bob:plain\n").unwrap();
+        let tenant = |name: &str, htpasswd: Option<&str>| {
+            let mut tenant = json!({"name": name, "address": "", "root": "", "users": []});
+            if let Some(file) = htpasswd {
+                tenant["htpasswd"] = json!({"file": dir.join(file), "permissions": "Read"});
+            }
+            tenant
+        };
+        let config: Config = serde_json::from_value(json!({
+            "htpasswd": {"file": dir.join("shared"), "permissions": "Read"},
+            "tenants": [tenant("a", None), tenant("b", None), tenant("c", Some("own"))],
+        }))
+        .unwrap();
+        let store = UserStore::load(&config).unwrap();
+
+        assert_eq!(store.htpasswd().len(), 2);
+        assert!(store.get("a/alice").is_some());
+        assert!(store.get("b/alice").is_some());
+        assert!(store.get("c/alice").is_none());
+        assert!(store.get("c/bob").is_some());
+        assert!(store.get("a/bob").is_none());
+        fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,47 @@
+//! Read-only files whose content is generated instead of read from disk.
+//!
+//! Content is a template with the same variables as messages, so a file can
+//! show e.g. the remaining quota of the user.
+
+use serde::Deserialize;
+
+use crate::protocol;
+
+#[derive(Debug, Deserialize, Clone)]
+pub struct VirtualFile {
+    /// Virtual path of the file, e.g. `/README.txt`. The directory has to exist.
+    pub path: String,
+    pub content: String,
+}
+
+impl VirtualFile {
+    pub fn name(&self) -> &str {
+        let path = self.path.trim_end_matches('/');
+        path.rsplit('/').next().unwrap_or(path)
+    }
+
+    fn directory(&self) -> String {
+        let path = protocol::clean_path(&self.path);
+        match path.rsplit_once('/') {
+            Some((dir, _)) => protocol::clean_path(dir),
+            None => String::from("/"),
+        }
+    }
+}
+
+/// Finds the file at the virtual path.
+pub fn find<'a>(files: &'a [VirtualFile], path: &str) -> Option<&'a VirtualFile> {
+    let path = protocol::clean_path(path);
+    files
+        .iter()
+        .find(|file| protocol::clean_path(&file.path) == path)
+}
+
+/// Returns the files placed directly in the virtual directory.
+pub fn in_directory<'a>(
+    files: &'a [VirtualFile],
+    dir: &str,
+) -> impl Iterator<Item = &'a VirtualFile> {
+    let dir = protocol::clean_path(dir);
+    files.iter().filter(move |file| file.directory() == dir)
+}
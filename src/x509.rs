@@ -0,0 +1,176 @@
+//! Reads the few fields of X.509 certificates the server needs.
+//!
+//! Certificates are verified by rustls before they get here, so this only
+//! walks the DER structure and gives up on anything unexpected.
+
+use crate::datetime::DateTime;
+
+const TAG_SEQUENCE: u8 = 0x30;
+const TAG_VERSION: u8 = 0xa0;
+const TAG_EXTENSIONS: u8 = 0xa3;
+const TAG_UTC_TIME: u8 = 0x17;
+const TAG_GENERALIZED_TIME: u8 = 0x18;
+const TAG_EMAIL: u8 = 0x81;
+const TAG_DNS_NAME: u8 = 0x82;
+const OID_COMMON_NAME: &[u8] = &[0x55, 0x04, 0x03];
+const OID_SUBJECT_ALT_NAME: &[u8] = &[0x55, 0x1d, 0x11];
+
+/// Splits the first DER element off the input: its tag, content and what
+/// follows it.
+fn read_der(input: &[u8]) -> Option<(u8, &[u8], &[u8])> {
+    let (&tag, rest) = input.split_first()?;
+    let (&first, rest) = rest.split_first()?;
+    let (len, rest) = if first < 0x80 {
+        (usize::from(first), rest)
+    } else {
+        let count = usize::from(first & 0x7f);
+        if count > 4 || rest.len() < count {
+            return None;
+        }
+        let len = rest[..count]
+            .iter()
+            .fold(0usize, |len, &b| (len << 8) | usize::from(b));
+        (len, &rest[count..])
+    };
+    (rest.len() >= len).then(|| (tag, &rest[..len], &rest[len..]))
+}
+
+/// Every element of a sequence or set, as tag and content.
+fn elements(mut input: &[u8]) -> Option<Vec<(u8, &[u8])>> {
+    let mut elements = Vec::new();
+    while !input.is_empty() {
+        let (tag, content, rest) = read_der(input)?;
+        elements.push((tag, content));
+        input = rest;
+    }
+    Some(elements)
+}
+
+/// Fields of the signed part of a certificate, without the version.
+fn tbs_fields(certificate: &[u8]) -> Option<Vec<(u8, &[u8])>> {
+    let (_, certificate, _) = read_der(certificate)?;
+    let (tag, tbs, _) = read_der(certificate)?;
+    if tag != TAG_SEQUENCE {
+        return None;
+    }
+    let mut fields = elements(tbs)?;
+    if fields.first()?.0 == TAG_VERSION {
+        fields.remove(0);
+    }
+    // Serial number, signature algorithm, issuer, validity, subject and
+    // public key are required.
+    (fields.len() >= 6).then_some(fields)
+}
+
+/// Reads when a DER certificate expires, as a Unix timestamp.
+pub fn not_after(certificate: &[u8]) -> Option<i64> {
+    let fields = tbs_fields(certificate)?;
+    let validity = elements(fields[3].1)?;
+    let (tag, time) = *validity.get(1)?;
+    let time = std::str::from_utf8(time).ok()?.strip_suffix('Z')?;
+    let time = match tag {
+        // UTCTime has two digits for the year.
+        TAG_UTC_TIME if time.get(..2)? < "50" => format!("20{time}"),
+        TAG_UTC_TIME => format!("19{time}"),
+        TAG_GENERALIZED_TIME => time.to_string(),
+        _ => return None,
+    };
+    DateTime::parse_ftp(&time).map(|time| time.to_unix())
+}
+
+/// Names a DER certificate was issued to: common names of the subject, and
+/// DNS names and email addresses of the subject alternative names.
+pub fn names(certificate: &[u8]) -> Vec<String> {
+    let Some(fields) = tbs_fields(certificate) else {
+        return Vec::new();
+    };
+    let mut names = Vec::new();
+
+    // Name ::= SEQUENCE OF SET OF SEQUENCE { type, value }
+    for (_, set) in elements(fields[4].1).unwrap_or_default() {
+        for (_, attribute) in elements(set).unwrap_or_default() {
+            if let Some([(_, oid), (_, value)]) = elements(attribute).as_deref()
+                && *oid == OID_COMMON_NAME
+            {
+                names.push(String::from_utf8_lossy(value).into_owned());
+            }
+        }
+    }
+
+    let extensions = fields[6..]
+        .iter()
+        .find(|(tag, _)| *tag == TAG_EXTENSIONS)
+        .and_then(|(_, extensions)| read_der(extensions))
+        .and_then(|(_, extensions, _)| elements(extensions))
+        .unwrap_or_default();
+    for (_, extension) in extensions {
+        let Some(extension) = elements(extension) else {
+            continue;
+        };
+        // The critical flag between the identifier and the value is optional.
+        let (Some((_, oid)), Some((_, value))) = (extension.first(), extension.last()) else {
+            continue;
+        };
+        if *oid != OID_SUBJECT_ALT_NAME {
+            continue;
+        }
+        let alt_names = read_der(value)
+            .and_then(|(_, alt_names, _)| elements(alt_names))
+            .unwrap_or_default();
+        for (tag, name) in alt_names {
+            if tag == TAG_DNS_NAME || tag == TAG_EMAIL {
+                names.push(String::from_utf8_lossy(name).into_owned());
+            }
+        }
+    }
+    names
+}
+
+#[cfg(test)]
+mod tests {
+    use base64::{Engine, engine::general_purpose::STANDARD};
+
+    use super::*;
+
+    /// Self-signed certificate for `CN=alice` with the alternative names
+    /// `ftp.example.com` and `alice@example.com`, valid until
+    /// 2036-10-13 11:05:22 UTC.
+    const CERTIFICATE: &[&str] = &[
+        "MIIBxTCCAWqgAwIBAgIUCUNd0OCI3XJToO+vD45nkqR22gAwCgYIKoZIzj0EAwIw",
+        "HzENMAsGA1UECgwERG9jazEOMAwGA1UEAwwFYWxpY2UwHhcNMjYxMDE2MTEwNTIy",
+        "WhcNMzYxMDEzMTEwNTIyWjAfMQ0wCwYDVQQKDAREb2NrMQ4wDAYDVQQDDAVhbGlj",
+        "ZTBZMBMGByqGSM49AgEGCCqGSM49AwEHA0IABL0SRlqZlf0EVuh9NQjX8GtIvC86",
+        "RuOcmksC8YTFQTXS7v9cJ2LqDqhYxe7WJqFSO02RYTBCFf3FWbSbaTtf/rKjgYMw",
+        "gYAwHQYDVR0OBBYEFJh3pHkjoGo4h4vfWl7avSXQHiRJMB8GA1UdIwQYMBaAFJh3",
+        "pHkjoGo4h4vfWl7avSXQHiRJMA8GA1UdEwEB/wQFMAMBAf8wLQYDVR0RBCYwJIIP",
+        "ZnRwLmV4YW1wbGUuY29tgRFhbGljZUBleGFtcGxlLmNvbTAKBggqhkjOPQQDAgNJ",
+        "ADBGAiEA9EK77i5c7eGF+3FHCQtKvgQs0qLcoUBaRDqaeK7p90gCIQDHkAUKrAJu",
+        "Sr2ZuPvBTBZ48JYrRKJjTNNxrd37INbSGQ==",
+    ];
+
+    fn certificate() -> Vec<u8> {
+        STANDARD.decode(CERTIFICATE.concat()).unwrap()
+    }
+
+    #[test]
+    fn reads_names() {
+        assert_eq!(
+            names(&certificate()),
+            ["alice", "ftp.example.com", "alice@example.com"]
+        );
+    }
+
+    #[test]
+    fn reads_expiry() {
+        assert_eq!(not_after(&certificate()), Some(2_107_508_722));
+    }
+
+    #[test]
+    fn gives_up_on_garbage() {
+        let certificate = certificate();
+        assert!(names(&[]).is_empty());
+        assert!(names(&certificate[..certificate.len() / 2]).is_empty());
+        assert!(names(&[0x30, 0x84, 0xff, 0xff, 0xff, 0xff]).is_empty());
+        assert_eq!(not_after(&[0x30, 0x00]), None);
+    }
+}